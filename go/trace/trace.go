@@ -79,6 +79,31 @@ func CopySpan(parentCtx, spanCtx context.Context) context.Context {
 	return parentCtx
 }
 
+// IdentifiedSpan is implemented by the Spans of the plugins that expose the ids
+// of their spans, for instance to link metrics to the traces they come from.
+type IdentifiedSpan interface {
+	Span
+	// TraceID returns the id of the trace of the span.
+	TraceID() string
+	// SpanID returns the id of the span within its trace.
+	SpanID() string
+}
+
+// IDsFromContext returns the trace and span ids of the Span from a Context.
+// The bool return value is false if there's no Span, or if its plugin doesn't
+// expose its ids.
+func IDsFromContext(ctx context.Context) (traceID, spanID string, ok bool) {
+	span, ok := FromContext(ctx)
+	if !ok {
+		return "", "", false
+	}
+	identified, ok := span.(IdentifiedSpan)
+	if !ok {
+		return "", "", false
+	}
+	return identified.TraceID(), identified.SpanID(), true
+}
+
 // SpanFactory is an interface for creating spans or extracting them from Contexts.
 type SpanFactory interface {
 	New(parent Span) Span
@@ -36,3 +36,44 @@ func TestFakeSpan(t *testing.T) {
 	NewContext(ctx, span)
 	CopySpan(ctx, ctx)
 }
+
+// identifiedSpan is a fakeSpan with ids.
+type identifiedSpan struct {
+	fakeSpan
+}
+
+func (identifiedSpan) TraceID() string { return "trace1" }
+func (identifiedSpan) SpanID() string  { return "span1" }
+
+type spanKey struct{}
+
+// contextSpanFactory stores its spans in the Context.
+type contextSpanFactory struct {
+	fakeSpanFactory
+}
+
+func (contextSpanFactory) FromContext(ctx context.Context) (Span, bool) {
+	span, ok := ctx.Value(spanKey{}).(Span)
+	return span, ok
+}
+
+func (contextSpanFactory) NewContext(parent context.Context, span Span) context.Context {
+	return context.WithValue(parent, spanKey{}, span)
+}
+
+func TestIDsFromContext(t *testing.T) {
+	RegisterSpanFactory(contextSpanFactory{})
+	defer RegisterSpanFactory(fakeSpanFactory{})
+
+	ctx := context.Background()
+	if _, _, ok := IDsFromContext(ctx); ok {
+		t.Error("IDsFromContext(no span): true, want false")
+	}
+	if _, _, ok := IDsFromContext(NewContext(ctx, fakeSpan{})); ok {
+		t.Error("IDsFromContext(span without ids): true, want false")
+	}
+	traceID, spanID, ok := IDsFromContext(NewContext(ctx, identifiedSpan{}))
+	if !ok || traceID != "trace1" || spanID != "span1" {
+		t.Errorf("IDsFromContext(): %s, %s, %v, want trace1, span1, true", traceID, spanID, ok)
+	}
+}
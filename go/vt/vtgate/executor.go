@@ -105,6 +105,7 @@ func NewExecutor(ctx context.Context, serv srvtopo.Server, cell, statsName strin
 		}))
 		http.Handle("/debug/query_plans", e)
 		http.Handle("/debug/vschema", e)
+		http.Handle("/debug/vindex_cache_stats", e)
 	})
 	return e
 }
@@ -996,6 +997,9 @@ func (e *Executor) watchSrvVSchema(ctx context.Context, cell string) {
 			// (for show queries).
 			e.vschema = vschema
 			e.srvVschema = v
+			// The vindexes of the new VSchema may not be
+			// backed by the same tables any more.
+			vindexes.NotifyVSchemaReload(vschema)
 		} else {
 			// We had an error, use the empty vschema if
 			// we had nothing before, or if the vschema
@@ -1129,7 +1133,8 @@ func skipQueryPlanCache(safeSession *SafeSession) bool {
 	return safeSession.Options.SkipQueryPlanCache
 }
 
-// ServeHTTP shows the current plans in the query cache.
+// ServeHTTP shows the current plans in the query cache, the VSchema,
+// and the stats of the lookup vindex caches.
 func (e *Executor) ServeHTTP(response http.ResponseWriter, request *http.Request) {
 	if err := acl.CheckAccessHTTP(request, acl.DEBUGGING); err != nil {
 		acl.SendError(response, err)
@@ -1160,6 +1165,16 @@ func (e *Executor) ServeHTTP(response http.ResponseWriter, request *http.Request
 		buf := bytes.NewBuffer(nil)
 		json.HTMLEscape(buf, b)
 		response.Write(buf.Bytes())
+	} else if request.URL.Path == "/debug/vindex_cache_stats" {
+		response.Header().Set("Content-Type", "application/json; charset=utf-8")
+		b, err := json.MarshalIndent(vindexes.LookupCacheStats(), "", " ")
+		if err != nil {
+			response.Write([]byte(err.Error()))
+			return
+		}
+		buf := bytes.NewBuffer(nil)
+		json.HTMLEscape(buf, b)
+		response.Write(buf.Bytes())
 	} else {
 		response.WriteHeader(http.StatusNotFound)
 	}
@@ -330,8 +330,8 @@ func TestSelectBindvars(t *testing.T) {
 		t.Errorf("sbc1.Queries: %+v, want %+v\n", sbc1.Queries, wantQueries)
 	}
 	sbc1.Queries = nil
-	testQueryLog(t, logChan, "VindexLookup", "SELECT", "select user_id from name_user_map where name = :name", 1)
-	testQueryLog(t, logChan, "VindexLookup", "SELECT", "select user_id from name_user_map where name = :name", 1)
+	testQueryLog(t, logChan, "VindexLookup", "SELECT", "select `user_id` from `name_user_map` where `name` = :name", 1)
+	testQueryLog(t, logChan, "VindexLookup", "SELECT", "select `user_id` from `name_user_map` where `name` = :name", 1)
 	testQueryLog(t, logChan, "TestExecute", "SELECT", sql, 1)
 
 	sql = "select id from user where name in (:name1, :name2)"
@@ -354,8 +354,8 @@ func TestSelectBindvars(t *testing.T) {
 		t.Errorf("sbc1.Queries: %+v, want %+v\n", sbc1.Queries, wantQueries)
 	}
 
-	testQueryLog(t, logChan, "VindexLookup", "SELECT", "select user_id from name_user_map where name = :name", 1)
-	testQueryLog(t, logChan, "VindexLookup", "SELECT", "select user_id from name_user_map where name = :name", 1)
+	testQueryLog(t, logChan, "VindexLookup", "SELECT", "select `user_id` from `name_user_map` where `name` = :name", 1)
+	testQueryLog(t, logChan, "VindexLookup", "SELECT", "select `user_id` from `name_user_map` where `name` = :name", 1)
 	testQueryLog(t, logChan, "TestExecute", "SELECT", sql, 1)
 }
 
@@ -246,7 +246,11 @@ func (dg *discoveryGateway) withRetry(ctx context.Context, target *querypb.Targe
 			err = vterrors.New(vtrpcpb.Code_UNAVAILABLE, "no valid tablet")
 			break
 		}
-		shuffleTablets(dg.localCell, tablets)
+		cell := dg.localCell
+		if preferred, ok := PreferredCellFromContext(ctx); ok {
+			cell = preferred
+		}
+		shuffleTablets(cell, tablets)
 
 		// skip tablets we tried before
 		var ts *discovery.TabletStats
@@ -230,6 +230,42 @@ func TestDiscoveryGatewayGetTabletsWithRegion(t *testing.T) {
 	}
 }
 
+func TestDiscoveryGatewayPreferredCell(t *testing.T) {
+	keyspace := "ks"
+	shard := "0"
+	target := &querypb.Target{Keyspace: keyspace, Shard: shard, TabletType: topodatapb.TabletType_REPLICA}
+	hc := discovery.NewFakeHealthCheck()
+	dg := createDiscoveryGateway(hc, nil, nil, "local-west", 2).(*discoveryGateway)
+	defer topo.UpdateCellsToRegionsForTests(map[string]string{})
+	topo.UpdateCellsToRegionsForTests(map[string]string{
+		"local-west": "local",
+		"local-east": "local",
+	})
+
+	hc.Reset()
+	dg.tsc.ResetForTesting()
+	west := hc.AddTestTablet("local-west", "1.1.1.1", 1001, keyspace, shard, topodatapb.TabletType_REPLICA, true, 10, nil)
+	east := hc.AddTestTablet("local-east", "2.2.2.2", 1001, keyspace, shard, topodatapb.TabletType_REPLICA, true, 10, nil)
+	ctx := WithPreferredCell(context.Background(), "local-east")
+	for i := 0; i < 10; i++ {
+		if _, err := dg.Execute(ctx, target, "query", nil, 0, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := east.ExecCount.Get(), int64(10); got != want {
+		t.Errorf("local-east ExecCount: %d, want %d", got, want)
+	}
+	if got := west.ExecCount.Get(); got != 0 {
+		t.Errorf("local-west ExecCount: %d, want 0", got)
+	}
+
+	// A cell without tablets falls back to the others.
+	ctx = WithPreferredCell(context.Background(), "remote")
+	if _, err := dg.Execute(ctx, target, "query", nil, 0, nil); err != nil {
+		t.Error(err)
+	}
+}
+
 func testDiscoveryGatewayGeneric(t *testing.T, streaming bool, f func(dg Gateway, target *querypb.Target) error) {
 	keyspace := "ks"
 	shard := "0"
@@ -69,6 +69,24 @@ type Gateway interface {
 	CacheStatus() TabletCacheStatusList
 }
 
+// preferredCellKey is the type of the context key of the preferred cell.
+type preferredCellKey int
+
+// WithPreferredCell returns a context whose queries prefer the tablets of
+// cell over those of the local cell. The discovery gateway only knows the
+// tablets of the region of the local cell, for the tablet types other than
+// master: if cell has no healthy tablet among them, the others are used.
+// The other gateways ignore it.
+func WithPreferredCell(ctx context.Context, cell string) context.Context {
+	return context.WithValue(ctx, preferredCellKey(0), cell)
+}
+
+// PreferredCellFromContext returns the cell set by WithPreferredCell, if any.
+func PreferredCellFromContext(ctx context.Context) (string, bool) {
+	cell, ok := ctx.Value(preferredCellKey(0)).(string)
+	return cell, ok && cell != ""
+}
+
 // Creator is the factory method which can create the actual gateway object.
 type Creator func(hc discovery.HealthCheck, topoServer *topo.Server, serv srvtopo.Server, cell string, retryCount int) Gateway
 
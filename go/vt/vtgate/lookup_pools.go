@@ -0,0 +1,84 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vtgate
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/flagutil"
+	"github.com/youtube/vitess/go/vt/vterrors"
+
+	vtrpcpb "github.com/youtube/vitess/go/vt/proto/vtrpc"
+)
+
+var lookupConnectionPools flagutil.StringMapValue
+
+func init() {
+	flag.Var(&lookupConnectionPools, "lookup_connection_pools", "comma separated list of name:size pairs, the connection pools that the lookup vindexes with a connection_pool can use. A pool limits the number of concurrent autocommit queries of its vindexes, so that a slow vindex table cannot take all the connections of vttablet.")
+}
+
+// lookupPools are the pools of lookup_connection_pools, by name.
+var lookupPools map[string]*lookupPool
+
+// lookupPool limits the number of concurrent autocommit queries of the
+// lookup vindexes that use it.
+type lookupPool struct {
+	name  string
+	slots chan struct{}
+}
+
+// initLookupPools creates the pools of lookup_connection_pools.
+func initLookupPools() {
+	pools, err := newLookupPools(lookupConnectionPools)
+	if err != nil {
+		log.Fatalf("invalid -lookup_connection_pools: %v", err)
+	}
+	lookupPools = pools
+}
+
+// newLookupPools creates the pools of the name:size pairs of m.
+func newLookupPools(m map[string]string) (map[string]*lookupPool, error) {
+	pools := make(map[string]*lookupPool, len(m))
+	for name, value := range m {
+		size, err := strconv.Atoi(value)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("size of lookup connection pool %s must be a positive number: '%s'", name, value)
+		}
+		pools[name] = &lookupPool{name: name, slots: make(chan struct{}, size)}
+	}
+	return pools, nil
+}
+
+// acquire waits for a slot of the pool, or until ctx is done.
+func (p *lookupPool) acquire(ctx context.Context) error {
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return vterrors.Errorf(vtrpcpb.Code_RESOURCE_EXHAUSTED, "no slot in lookup connection pool %s: %v", p.name, ctx.Err())
+	}
+}
+
+// release gives back the slot of acquire.
+func (p *lookupPool) release() {
+	<-p.slots
+}
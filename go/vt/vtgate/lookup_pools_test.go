@@ -0,0 +1,84 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vtgate
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/sqltypes"
+
+	querypb "github.com/youtube/vitess/go/vt/proto/query"
+	vtgatepb "github.com/youtube/vitess/go/vt/proto/vtgate"
+)
+
+func TestNewLookupPools(t *testing.T) {
+	pools, err := newLookupPools(map[string]string{"lookups": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cap(pools["lookups"].slots), 2; got != want {
+		t.Errorf("pool size: %d, want %d", got, want)
+	}
+
+	_, err = newLookupPools(map[string]string{"lookups": "0"})
+	want := "size of lookup connection pool lookups must be a positive number: '0'"
+	if err == nil || err.Error() != want {
+		t.Errorf("newLookupPools(0): %v, want %s", err, want)
+	}
+}
+
+func TestExecuteAutocommitInPool(t *testing.T) {
+	executor, _, _, sbclookup := createExecutorEnv()
+	defer func() { lookupPools = nil }()
+	var err error
+	if lookupPools, err = newLookupPools(map[string]string{"lookups": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	bv := map[string]*querypb.BindVariable{"id": sqltypes.Int64BindVariable(1)}
+
+	vc := newVCursorImpl(context.Background(), NewSafeSession(&vtgatepb.Session{}), querypb.Target{}, "", executor, nil)
+	if _, err := vc.ExecuteAutocommitInPool("lookups", "VindexLookup", "select user_id from music_user_map where id = :id", bv, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(sbclookup.Queries), 1; got != want {
+		t.Errorf("sbclookup.Queries: %v, want %d queries", sbclookup.Queries, want)
+	}
+
+	_, err = vc.ExecuteAutocommitInPool("other", "VindexLookup", "select user_id from music_user_map where id = :id", bv, false)
+	want := "lookup connection pool other is not in -lookup_connection_pools"
+	if err == nil || err.Error() != want {
+		t.Errorf("ExecuteAutocommitInPool(other): %v, want %s", err, want)
+	}
+
+	// The query waits for a slot of the pool, until the request is done.
+	if err := lookupPools["lookups"].acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	vc = newVCursorImpl(ctx, NewSafeSession(&vtgatepb.Session{}), querypb.Target{}, "", executor, nil)
+	_, err = vc.ExecuteAutocommitInPool("lookups", "VindexLookup", "select user_id from music_user_map where id = :id", bv, false)
+	want = "no slot in lookup connection pool lookups: context canceled"
+	if err == nil || err.Error() != want {
+		t.Errorf("ExecuteAutocommitInPool(full): %v, want %s", err, want)
+	}
+	if got, want := len(sbclookup.Queries), 1; got != want {
+		t.Errorf("sbclookup.Queries: %v, want %d queries", sbclookup.Queries, want)
+	}
+}
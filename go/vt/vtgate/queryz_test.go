@@ -78,7 +78,7 @@ func TestQueryzHandler(t *testing.T) {
 	plan3 := result.(*engine.Plan)
 
 	// vindex insert from above execution
-	result, ok = executor.plans.Get("insert into name_user_map(name, user_id) values(:name0, :user_id0)")
+	result, ok = executor.plans.Get("insert into `name_user_map`(`name`, `user_id`) values(:name0, :user_id0)")
 	if !ok {
 		t.Fatalf("couldn't get plan from cache")
 	}
@@ -143,7 +143,7 @@ func TestQueryzHandler(t *testing.T) {
 	checkQueryzHasPlan(t, planPattern3, plan3, body)
 	planPattern4 := []string{
 		`<tr class="high">`,
-		`<td>insert into name_user_map.*</td>`,
+		"<td>insert into `name_user_map`.*</td>",
 		`<td>2</td>`,
 		`<td>0.200000</td>`,
 		`<td>2</td>`,
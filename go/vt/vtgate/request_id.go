@@ -0,0 +1,97 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vtgate
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/sync2"
+)
+
+var vindexRequestIDs = flag.Bool("vindex_request_ids", false, "if set, the queries that vindexes execute on behalf of a query of a client are tagged with a request id generated for it, to correlate them in the logs of vttablet and MySQL. A request id that a plugin set in the context is used instead.")
+
+var (
+	// requestIDPrefix makes the generated request ids unique across
+	// the vtgates, and their restarts.
+	requestIDPrefix = strconv.FormatInt(time.Now().UnixNano(), 36)
+	requestIDSeq    sync2.AtomicInt64
+)
+
+// requestIDKey is the type of the context key of the request id.
+type requestIDKey int
+
+// NewContextWithRequestID returns a context that carries the request
+// id of a user query. The queries that vindexes execute on behalf of
+// the query, like those of lookup vindexes, are then tagged with it
+// in a trailing comment, to correlate them with the query in the logs.
+func NewContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey(0), requestID)
+}
+
+// withRequestID returns ctx with a new request id if vindex_request_ids
+// is set, unless ctx already has one. It's called by the entry points of
+// VTGate, so that all the queries of a request share its id.
+func withRequestID(ctx context.Context) context.Context {
+	if !*vindexRequestIDs {
+		return ctx
+	}
+	if _, ok := RequestIDFromContext(ctx); ok {
+		return ctx
+	}
+	return NewContextWithRequestID(ctx, fmt.Sprintf("%s-%d", requestIDPrefix, requestIDSeq.Add(1)))
+}
+
+// RequestIDFromContext returns the request id stored in ctx, if any.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	requestID, ok := ctx.Value(requestIDKey(0)).(string)
+	return requestID, ok
+}
+
+// requestIDComment returns the trailing comment that tags a query with
+// the request id of ctx, or "" if ctx has none. The characters that
+// could end the comment are replaced with underscores.
+func requestIDComment(ctx context.Context) string {
+	requestID, ok := RequestIDFromContext(ctx)
+	if !ok || requestID == "" {
+		return ""
+	}
+	requestID = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.', r == ':':
+			return r
+		}
+		return '_'
+	}, requestID)
+	return " /* request_id:" + requestID + " */"
+}
+
+// withRequestIDComment appends the request id comment of ctx to
+// comments, unless they already end with it, which is the case for
+// the comments of the queries that vindexes execute.
+func withRequestIDComment(ctx context.Context, comments string) string {
+	comment := requestIDComment(ctx)
+	if strings.HasSuffix(comments, comment) {
+		return comments
+	}
+	return comments + comment
+}
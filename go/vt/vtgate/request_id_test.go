@@ -0,0 +1,128 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vtgate
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/sqltypes"
+
+	querypb "github.com/youtube/vitess/go/vt/proto/query"
+	vtgatepb "github.com/youtube/vitess/go/vt/proto/vtgate"
+)
+
+func TestRequestIDComment(t *testing.T) {
+	testcases := []struct {
+		requestID string
+		want      string
+	}{{
+		requestID: "",
+		want:      "",
+	}, {
+		requestID: "req-1.a:b_c",
+		want:      " /* request_id:req-1.a:b_c */",
+	}, {
+		requestID: "a */ drop table t /*",
+		want:      " /* request_id:a____drop_table_t___ */",
+	}}
+	for _, tc := range testcases {
+		if got := requestIDComment(NewContextWithRequestID(context.Background(), tc.requestID)); got != tc.want {
+			t.Errorf("requestIDComment(%q): %q, want %q", tc.requestID, got, tc.want)
+		}
+	}
+	if got := requestIDComment(context.Background()); got != "" {
+		t.Errorf("requestIDComment(no request id): %q, want empty", got)
+	}
+
+	ctx := NewContextWithRequestID(context.Background(), "req1")
+	want := " /* trailing */ /* request_id:req1 */"
+	for _, comments := range []string{" /* trailing */", want} {
+		if got := withRequestIDComment(ctx, comments); got != want {
+			t.Errorf("withRequestIDComment(%q): %q, want %q", comments, got, want)
+		}
+	}
+}
+
+func TestInsertRequestID(t *testing.T) {
+	executor, sbc1, _, sbclookup := createExecutorEnv()
+
+	ctx := NewContextWithRequestID(context.Background(), "req1")
+	_, err := executor.Execute(ctx, "TestExecute", NewSafeSession(masterSession), "insert into user(id, v, name) values (1, 2, 'myname') /* trailing */", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	// Only the vindex queries are tagged with the request id.
+	wantQueries := []*querypb.BoundQuery{{
+		Sql: "insert into user(id, v, name) values (:_Id0, 2, :_name0) /* vtgate:: keyspace_id:166b40b44aba4bd6 */ /* trailing */",
+		BindVariables: map[string]*querypb.BindVariable{
+			"_Id0":   sqltypes.Int64BindVariable(1),
+			"_name0": sqltypes.BytesBindVariable([]byte("myname")),
+			"__seq0": sqltypes.Int64BindVariable(1),
+		},
+	}}
+	if !reflect.DeepEqual(sbc1.Queries, wantQueries) {
+		t.Errorf("sbc1.Queries:\n%+v, want\n%+v\n", sbc1.Queries, wantQueries)
+	}
+	wantQueries = []*querypb.BoundQuery{{
+		Sql: "insert into name_user_map(name, user_id) values (:name0, :user_id0) /* trailing */ /* request_id:req1 */",
+		BindVariables: map[string]*querypb.BindVariable{
+			"name0":    sqltypes.BytesBindVariable([]byte("myname")),
+			"user_id0": sqltypes.Uint64BindVariable(1),
+		},
+	}}
+	if !reflect.DeepEqual(sbclookup.Queries, wantQueries) {
+		t.Errorf("sbclookup.Queries: \n%+v, want \n%+v", sbclookup.Queries, wantQueries)
+	}
+}
+
+func TestVTGateRequestID(t *testing.T) {
+	executor, _, _, sbclookup := createExecutorEnv()
+	saved := rpcVTGate.executor
+	defer func() { rpcVTGate.executor = saved }()
+	rpcVTGate.executor = executor
+	defer func() { *vindexRequestIDs = false }()
+	*vindexRequestIDs = true
+
+	// Each request gets a new id.
+	for i := 0; i < 2; i++ {
+		_, _, err := rpcVTGate.Execute(context.Background(), &vtgatepb.Session{TargetString: "@master"}, "insert into user(id, v, name) values (1, 2, 'myname')", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(sbclookup.Queries); got != 2 {
+		t.Fatalf("sbclookup.Queries: %+v, want 2 queries", sbclookup.Queries)
+	}
+	first, second := sbclookup.Queries[0].Sql, sbclookup.Queries[1].Sql
+	if !strings.Contains(first, " /* request_id:"+requestIDPrefix+"-") || first == second {
+		t.Errorf("sbclookup.Queries: %q and %q, want two different request ids", first, second)
+	}
+
+	// An id set in the context is kept.
+	sbclookup.Queries = nil
+	ctx := NewContextWithRequestID(context.Background(), "req1")
+	if _, _, err := rpcVTGate.Execute(ctx, &vtgatepb.Session{TargetString: "@master"}, "insert into user(id, v, name) values (1, 2, 'myname')", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sbclookup.Queries[0].Sql, "insert into name_user_map(name, user_id) values (:name0, :user_id0) /* request_id:req1 */"; got != want {
+		t.Errorf("sbclookup.Queries[0]: %q, want %q", got, want)
+	}
+}
@@ -17,14 +17,17 @@ limitations under the License.
 package vtgate
 
 import (
+	"flag"
 	"sync/atomic"
 
 	"golang.org/x/net/context"
 
 	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/callerid"
 	"github.com/youtube/vitess/go/vt/sqlparser"
 	"github.com/youtube/vitess/go/vt/srvtopo"
 	"github.com/youtube/vitess/go/vt/vterrors"
+	"github.com/youtube/vitess/go/vt/vtgate/gateway"
 	"github.com/youtube/vitess/go/vt/vtgate/vindexes"
 
 	querypb "github.com/youtube/vitess/go/vt/proto/query"
@@ -32,6 +35,21 @@ import (
 	vtrpcpb "github.com/youtube/vitess/go/vt/proto/vtrpc"
 )
 
+var (
+	lookupRetryBudget      = flag.Int("lookup_retry_budget", 0, "if set, the maximum number of retries that the lookup vindexes can make for one request, all vindexes combined. Once it's spent, their failed queries are no longer retried.")
+	lookupRetryBudgetDelay = flag.Duration("lookup_retry_budget_delay", 0, "if set with lookup_retry_budget, the maximum total backoff delay of the retries of the lookup vindexes for one request.")
+)
+
+// withLookupRetryBudget returns ctx with a new vindexes.RetryBudget of
+// lookup_retry_budget retries, which all the lookup vindexes used by
+// the request share, unless the flag is not set or ctx already has one.
+func withLookupRetryBudget(ctx context.Context) context.Context {
+	if *lookupRetryBudget <= 0 || vindexes.RetryBudgetFromContext(ctx) != nil {
+		return ctx
+	}
+	return vindexes.WithRetryBudget(ctx, vindexes.NewRetryBudget(*lookupRetryBudget, *lookupRetryBudgetDelay))
+}
+
 // vcursorImpl implements the VCursor functionality used by dependent
 // packages to call back into VTGate.
 type vcursorImpl struct {
@@ -39,8 +57,12 @@ type vcursorImpl struct {
 	safeSession      *SafeSession
 	target           querypb.Target
 	trailingComments string
-	executor         *Executor
-	logStats         *LogStats
+	// vindexComments are the trailingComments followed by the
+	// request id comment, if any. They're added to the queries
+	// that vindexes execute.
+	vindexComments string
+	executor       *Executor
+	logStats       *LogStats
 	// hasPartialDML is set to true if any DML was successfully
 	// executed. If there was a subsequent failure, the transaction
 	// must be forced to rollback.
@@ -53,10 +75,11 @@ type vcursorImpl struct {
 // on behalf of the original query.
 func newVCursorImpl(ctx context.Context, safeSession *SafeSession, target querypb.Target, trailingComments string, executor *Executor, logStats *LogStats) *vcursorImpl {
 	return &vcursorImpl{
-		ctx:              ctx,
+		ctx:              withLookupRetryBudget(ctx),
 		safeSession:      safeSession,
 		target:           target,
 		trailingComments: trailingComments,
+		vindexComments:   withRequestIDComment(ctx, trailingComments),
 		executor:         executor,
 		logStats:         logStats,
 	}
@@ -102,7 +125,7 @@ func (vc *vcursorImpl) DefaultKeyspace() (*vindexes.Keyspace, error) {
 
 // Execute performs a V3 level execution of the query.
 func (vc *vcursorImpl) Execute(method string, query string, BindVars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
-	qr, err := vc.executor.Execute(vc.ctx, method, vc.safeSession, query+vc.trailingComments, BindVars)
+	qr, err := vc.executor.Execute(vc.ctx, method, vc.safeSession, query+vc.vindexComments, BindVars)
 	if err == nil {
 		vc.hasPartialDML = true
 	}
@@ -111,13 +134,104 @@ func (vc *vcursorImpl) Execute(method string, query string, BindVars map[string]
 
 // ExecuteAutocommit performs a V3 level execution of the query in a separate autocommit session.
 func (vc *vcursorImpl) ExecuteAutocommit(method string, query string, BindVars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
-	qr, err := vc.executor.Execute(vc.ctx, method, NewAutocommitSession(vc.safeSession.Session), query+vc.trailingComments, BindVars)
+	qr, err := vc.executor.Execute(vc.ctx, method, NewAutocommitSession(vc.safeSession.Session), query+vc.vindexComments, BindVars)
 	if err == nil {
 		vc.hasPartialDML = true
 	}
 	return qr, err
 }
 
+// ExecuteAutocommitInPool is like ExecuteAutocommit, but it first waits for a slot of
+// the named pool of lookup_connection_pools, for the lookup vindexes with a
+// connection_pool. It fails if the pool is not configured.
+func (vc *vcursorImpl) ExecuteAutocommitInPool(pool string, method string, query string, BindVars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
+	p, ok := lookupPools[pool]
+	if !ok {
+		return nil, vterrors.Errorf(vtrpcpb.Code_FAILED_PRECONDITION, "lookup connection pool %s is not in -lookup_connection_pools", pool)
+	}
+	if err := p.acquire(vc.ctx); err != nil {
+		return nil, err
+	}
+	defer p.release()
+	return vc.ExecuteAutocommit(method, query, BindVars, isDML)
+}
+
+// ExecuteInCell is like ExecuteAutocommit, but the tablets of cell are preferred over
+// those of the local cell, for the lookup vindexes with a read_cell. The other tablets
+// are used if cell has none. See gateway.WithPreferredCell.
+func (vc *vcursorImpl) ExecuteInCell(cell string, method string, query string, BindVars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
+	return vc.executor.Execute(gateway.WithPreferredCell(vc.ctx, cell), method, NewAutocommitSession(vc.safeSession.Session), query+vc.vindexComments, BindVars)
+}
+
+// InTransaction returns true if the session is in a transaction, which the
+// lookup vindexes with snapshot_reads then read in through Execute.
+func (vc *vcursorImpl) InTransaction() bool {
+	return vc.safeSession.InTransaction()
+}
+
+// Detach returns a copy of the vcursor for the lookup vindexes with async_writes,
+// which execute autocommit queries after the request is done. Its context keeps the
+// caller ids of the request, but is not canceled with it, and its session is a
+// snapshot of the current one.
+func (vc *vcursorImpl) Detach() vindexes.VCursor {
+	return &vcursorImpl{
+		ctx:              vc.detachedContext(),
+		safeSession:      NewAutocommitSession(vc.safeSession.Session),
+		target:           vc.target,
+		trailingComments: vc.trailingComments,
+		vindexComments:   vc.vindexComments,
+		executor:         vc.executor,
+		logStats:         vc.logStats,
+	}
+}
+
+// detachedContext returns a context that keeps the caller ids of the request,
+// but is not canceled with it.
+func (vc *vcursorImpl) detachedContext() context.Context {
+	return callerid.NewContext(context.Background(), callerid.EffectiveCallerIDFromContext(vc.ctx), callerid.ImmediateCallerIDFromContext(vc.ctx))
+}
+
+// Begin starts a transaction in a new session, separate from the session of the
+// request, for the pending Creates of the lookup vindexes. Like Detach, its context
+// is not canceled with the request, since the transaction can be finished later.
+func (vc *vcursorImpl) Begin() (vindexes.VCursorTx, error) {
+	tx := &vcursorTx{
+		ctx:      vc.detachedContext(),
+		session:  NewAutocommitSession(vc.safeSession.Session),
+		comments: vc.vindexComments,
+		executor: vc.executor,
+	}
+	if _, err := tx.executor.Execute(tx.ctx, "VindexBegin", tx.session, "begin", nil); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// vcursorTx is a transaction started by vcursorImpl.Begin.
+type vcursorTx struct {
+	ctx      context.Context
+	session  *SafeSession
+	comments string
+	executor *Executor
+}
+
+// Execute executes the query in the transaction.
+func (tx *vcursorTx) Execute(method string, query string, BindVars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
+	return tx.executor.Execute(tx.ctx, method, tx.session, query+tx.comments, BindVars)
+}
+
+// Commit commits the transaction.
+func (tx *vcursorTx) Commit() error {
+	_, err := tx.executor.Execute(tx.ctx, "VindexCommit", tx.session, "commit", nil)
+	return err
+}
+
+// Rollback rolls the transaction back.
+func (tx *vcursorTx) Rollback() error {
+	_, err := tx.executor.Execute(tx.ctx, "VindexRollback", tx.session, "rollback", nil)
+	return err
+}
+
 // ExecuteMultiShard executes different queries on different shards and returns the combined result.
 func (vc *vcursorImpl) ExecuteMultiShard(keyspace string, shardQueries map[string]*querypb.BoundQuery, isDML, canAutocommit bool) (*sqltypes.Result, error) {
 	atomic.AddUint32(&vc.logStats.ShardQueries, uint32(len(shardQueries)))
@@ -0,0 +1,71 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"math/rand"
+	"time"
+)
+
+// BackoffPolicy decides how long to wait before retrying
+// a failed lookup operation.
+type BackoffPolicy interface {
+	// NextDelay returns the delay before the specified retry attempt.
+	// The first retry is attempt 1.
+	NextDelay(attempt int) time.Duration
+}
+
+// DefaultBackoffPolicy is the BackoffPolicy used by lookup vindexes
+// unless another one is set.
+var DefaultBackoffPolicy BackoffPolicy = &ExponentialBackoff{
+	Initial:    10 * time.Millisecond,
+	Max:        time.Second,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+// ExponentialBackoff is a BackoffPolicy where the delay grows
+// by Multiplier for every attempt, starting at Initial and
+// capped at Max. Jitter is the fraction (between 0 and 1) by
+// which a delay can be randomly shortened, to prevent concurrent
+// retries from hitting the backend in lockstep.
+type ExponentialBackoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+// NextDelay is part of the BackoffPolicy interface.
+// The returned delay is within [d*(1-Jitter), d], where
+// d is min(Initial*Multiplier^(attempt-1), Max).
+func (eb *ExponentialBackoff) NextDelay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	d := float64(eb.Initial)
+	for i := 1; i < attempt && d < float64(eb.Max); i++ {
+		d *= eb.Multiplier
+	}
+	if d > float64(eb.Max) {
+		d = float64(eb.Max)
+	}
+	if eb.Jitter > 0 {
+		d -= d * eb.Jitter * rand.Float64()
+	}
+	return time.Duration(d)
+}
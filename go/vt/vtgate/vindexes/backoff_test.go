@@ -0,0 +1,62 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoffNoJitter(t *testing.T) {
+	eb := &ExponentialBackoff{
+		Initial:    10 * time.Millisecond,
+		Max:        50 * time.Millisecond,
+		Multiplier: 2,
+	}
+	testcases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, 10 * time.Millisecond},
+		{1, 10 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+		{3, 40 * time.Millisecond},
+		{4, 50 * time.Millisecond},
+		{100, 50 * time.Millisecond},
+	}
+	for _, tc := range testcases {
+		if got := eb.NextDelay(tc.attempt); got != tc.want {
+			t.Errorf("NextDelay(%d): %v, want %v", tc.attempt, got, tc.want)
+		}
+	}
+}
+
+func TestExponentialBackoffBounds(t *testing.T) {
+	eb := DefaultBackoffPolicy.(*ExponentialBackoff)
+	for attempt := 1; attempt <= 20; attempt++ {
+		for i := 0; i < 100; i++ {
+			got := eb.NextDelay(attempt)
+			if got > eb.Max {
+				t.Fatalf("NextDelay(%d): %v, want <= %v", attempt, got, eb.Max)
+			}
+			min := time.Duration(float64(eb.Initial) * (1 - eb.Jitter))
+			if got < min {
+				t.Fatalf("NextDelay(%d): %v, want >= %v", attempt, got, min)
+			}
+		}
+	}
+}
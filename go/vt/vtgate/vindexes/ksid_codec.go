@@ -0,0 +1,124 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// KsidCodec translates keyspace ids to and from the form in which
+// they're stored in the 'to' column of a lookup table.
+type KsidCodec interface {
+	// Encode returns the stored form of ksid.
+	Encode(ksid []byte) []byte
+	// Decode returns the keyspace id for a stored value.
+	Decode(stored []byte) ([]byte, error)
+}
+
+var ksidCodecs = make(map[string]KsidCodec)
+
+func init() {
+	RegisterKsidCodec("raw", rawKsidCodec{})
+	RegisterKsidCodec("hex", hexKsidCodec{})
+	RegisterKsidCodec("base64", base64KsidCodec{})
+}
+
+// RegisterKsidCodec registers a KsidCodec under the specified name,
+// which can then be used as the ksid_encoding of lookup vindexes.
+// A duplicate name will generate a panic.
+func RegisterKsidCodec(name string, codec KsidCodec) {
+	if _, ok := ksidCodecs[name]; ok {
+		panic(fmt.Sprintf("ksid codec %s is already registered", name))
+	}
+	ksidCodecs[name] = codec
+}
+
+// ksidCodecFromMap returns the KsidCodec named by the ksid_encoding
+// param. It defaults to raw.
+func ksidCodecFromMap(m map[string]string) (KsidCodec, error) {
+	name, ok := m["ksid_encoding"]
+	if !ok {
+		return rawKsidCodec{}, nil
+	}
+	codec, ok := ksidCodecs[name]
+	if !ok {
+		return nil, fmt.Errorf("ksid_encoding %q is not registered", name)
+	}
+	return codec, nil
+}
+
+// rawKsidCodec stores keyspace ids as is.
+type rawKsidCodec struct{}
+
+func (rawKsidCodec) Encode(ksid []byte) []byte {
+	return ksid
+}
+
+func (rawKsidCodec) Decode(stored []byte) ([]byte, error) {
+	return stored, nil
+}
+
+// hexKsidCodec stores keyspace ids as lower case hex strings.
+type hexKsidCodec struct{}
+
+func (hexKsidCodec) Encode(ksid []byte) []byte {
+	stored := make([]byte, hex.EncodedLen(len(ksid)))
+	hex.Encode(stored, ksid)
+	return stored
+}
+
+func (hexKsidCodec) Decode(stored []byte) ([]byte, error) {
+	ksid := make([]byte, hex.DecodedLen(len(stored)))
+	if _, err := hex.Decode(ksid, stored); err != nil {
+		return nil, err
+	}
+	return ksid, nil
+}
+
+// base64KsidCodec stores keyspace ids as standard base64 strings.
+type base64KsidCodec struct{}
+
+func (base64KsidCodec) Encode(ksid []byte) []byte {
+	stored := make([]byte, base64.StdEncoding.EncodedLen(len(ksid)))
+	base64.StdEncoding.Encode(stored, ksid)
+	return stored
+}
+
+func (base64KsidCodec) Decode(stored []byte) ([]byte, error) {
+	ksid := make([]byte, base64.StdEncoding.DecodedLen(len(stored)))
+	n, err := base64.StdEncoding.Decode(ksid, stored)
+	if err != nil {
+		return nil, err
+	}
+	return ksid[:n], nil
+}
+
+// md5KsidCodec stores the md5 hash of keyspace ids, for the lookup
+// vindexes with to_hash. It's not registered as a ksid_encoding since
+// a hash cannot be decoded back to its keyspace id.
+type md5KsidCodec struct{}
+
+func (md5KsidCodec) Encode(ksid []byte) []byte {
+	return binHash(ksid)
+}
+
+func (md5KsidCodec) Decode(stored []byte) ([]byte, error) {
+	return nil, errors.New("the keyspace id cannot be decoded from its hash")
+}
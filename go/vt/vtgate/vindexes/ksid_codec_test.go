@@ -0,0 +1,222 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/youtube/vitess/go/sqltypes"
+
+	querypb "github.com/youtube/vitess/go/vt/proto/query"
+	topodatapb "github.com/youtube/vitess/go/vt/proto/topodata"
+)
+
+func TestKsidCodecs(t *testing.T) {
+	ksid := []byte("\x16k@\xb4J\xbaK\xd6")
+	testcases := []struct {
+		name   string
+		stored string
+	}{{
+		name:   "raw",
+		stored: "\x16k@\xb4J\xbaK\xd6",
+	}, {
+		name:   "hex",
+		stored: "166b40b44aba4bd6",
+	}, {
+		name:   "base64",
+		stored: "FmtAtEq6S9Y=",
+	}}
+	for _, tcase := range testcases {
+		codec := ksidCodecs[tcase.name]
+		if got := string(codec.Encode(ksid)); got != tcase.stored {
+			t.Errorf("%s.Encode: %q, want %q", tcase.name, got, tcase.stored)
+		}
+		got, err := codec.Decode([]byte(tcase.stored))
+		if err != nil {
+			t.Errorf("%s.Decode: %v", tcase.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, ksid) {
+			t.Errorf("%s.Decode: %q, want %q", tcase.name, got, ksid)
+		}
+	}
+}
+
+func TestLookupNonUniqueKsidEncoding(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":         "t",
+		"from":          "fromc",
+		"to":            "toc",
+		"ksid_encoding": "hex",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{}
+
+	err = lookupNonUnique.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("\x16k")}, false /* ignoreMode */)
+	if err != nil {
+		t.Error(err)
+	}
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: "insert into `t`(`fromc`, `toc`) values(:fromc0, :toc0)",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc0": sqltypes.Int64BindVariable(1),
+			"toc0":   sqltypes.BytesBindVariable([]byte("166b")),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("lookup.Create queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	vc.result = sqltypes.MakeTestResult(sqltypes.MakeTestFields("toc", "varbinary"), "166b")
+	got, err := lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1)})
+	if err != nil {
+		t.Error(err)
+	}
+	want := []Ksids{{IDs: [][]byte{[]byte("\x16k")}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Map(): %#v, want %+v", got, want)
+	}
+
+	vc.result = sqltypes.MakeTestResult(sqltypes.MakeTestFields("toc", "varbinary"), "zz")
+	_, err = lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1)})
+	wantErr := "lookup.Map: cannot decode keyspace id VARBINARY(\"zz\"): encoding/hex: invalid byte: U+007A 'z'"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("Map(bad hex): %v, want %s", err, wantErr)
+	}
+
+	_, err = CreateVindex("lookup_unique", "lookup_unique", map[string]string{
+		"table":         "t",
+		"from":          "fromc",
+		"to":            "toc",
+		"ksid_encoding": "rot13",
+	})
+	wantErr = `ksid_encoding "rot13" is not registered`
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("Create(bad encoding): %v, want %s", err, wantErr)
+	}
+
+	_, err = CreateVindex("lookup_hash", "lookup_hash", map[string]string{
+		"table":         "t",
+		"from":          "fromc",
+		"to":            "toc",
+		"ksid_encoding": "hex",
+	})
+	wantErr = "unknown params for lookup vindex on table t: ksid_encoding"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("Create(lookup_hash encoding): %v, want %s", err, wantErr)
+	}
+}
+
+func TestLookupNonUniqueToHash(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":      "t",
+		"from":       "fromc",
+		"to":         "toc",
+		"to_hash":    "true",
+		"write_only": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := lookupNonUnique.Cost(), 100; got != want {
+		t.Errorf("Cost(): %d, want %d", got, want)
+	}
+	ksid := []byte("\x16k@\xb4J\xbaK\xd6")
+	hash := binHash(ksid)
+	vc := &vcursor{numRows: 1}
+
+	err = lookupNonUnique.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{ksid}, false /* ignoreMode */)
+	if err != nil {
+		t.Error(err)
+	}
+	// Unlike the one of write_only alone, Verify checks the table.
+	_, err = lookupNonUnique.Verify(vc, []sqltypes.Value{sqltypes.NewInt64(1)}, [][]byte{ksid})
+	if err != nil {
+		t.Error(err)
+	}
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: "insert into `t`(`fromc`, `toc`) values(:fromc0, :toc0)",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc0": sqltypes.Int64BindVariable(1),
+			"toc0":   sqltypes.BytesBindVariable(hash),
+		},
+	}, {
+		Sql: "select `fromc` from `t` where `fromc` = :fromc and `toc` = :toc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc": sqltypes.Int64BindVariable(1),
+			"toc":   sqltypes.BytesBindVariable(hash),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("lookup queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	// Map cannot recover the keyspace ids: it scatters.
+	vc.queries = nil
+	got, err := lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1)})
+	if err != nil {
+		t.Error(err)
+	}
+	want := []Ksids{{Range: &topodatapb.KeyRange{}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Map(): %+v, want %+v", got, want)
+	}
+	if len(vc.queries) != 0 {
+		t.Errorf("Map() executed %v, want no queries", vc.queries)
+	}
+
+	testcases := []struct {
+		vindexType string
+		params     map[string]string
+		want       string
+	}{{
+		vindexType: "lookup",
+		want:       "to_hash requires write_only, since Map cannot recover the keyspace ids from their hashes",
+	}, {
+		vindexType: "lookup",
+		params:     map[string]string{"write_only": "true", "write_only_dry_run": "true"},
+		want:       "to_hash cannot be used with write_only_dry_run, which doesn't write the table that Verify checks",
+	}, {
+		vindexType: "lookup",
+		params:     map[string]string{"write_only": "true", "ksid_encoding": "hex"},
+		want:       "to_hash cannot be used with ksid_encoding for vindex table t",
+	}, {
+		vindexType: "lookup_unique",
+		want:       "to_hash cannot be true for a unique lookup vindex, whose Map needs the keyspace ids",
+	}, {
+		vindexType: "lookup_hash",
+		want:       "unknown params for lookup vindex on table t: to_hash",
+	}}
+	for _, tcase := range testcases {
+		params := map[string]string{
+			"table":   "t",
+			"from":    "fromc",
+			"to":      "toc",
+			"to_hash": "true",
+		}
+		for k, v := range tcase.params {
+			params[k] = v
+		}
+		_, err := CreateVindex(tcase.vindexType, "v", params)
+		if err == nil || err.Error() != tcase.want {
+			t.Errorf("CreateVindex(%s, %v): %v, want %s", tcase.vindexType, tcase.params, err, tcase.want)
+		}
+	}
+}
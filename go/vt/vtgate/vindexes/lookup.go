@@ -17,11 +17,15 @@ limitations under the License.
 package vindexes
 
 import (
-	"encoding/json"
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"strings"
+	"time"
 
 	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/logutil"
 	"github.com/youtube/vitess/go/vt/proto/topodata"
 )
 
@@ -37,12 +41,31 @@ func init() {
 	Register("lookup_unique", NewLookupUnique)
 }
 
+// lookupScatterOnError counts, by vindex, the Map calls of the
+// vindexes with scatter_on_error whose error was suppressed.
+var lookupScatterOnError = newSinkCounters("VindexLookupScatterOnError")
+
 // LookupNonUnique defines a vindex that uses a lookup table and create a mapping between from ids and KeyspaceId.
 // It's NonUnique and a Lookup.
 type LookupNonUnique struct {
-	name      string
-	writeOnly bool
-	lkp       lookupInternal
+	name          string
+	writeOnly     bool
+	writeOnlyCost int
+	distinct      bool
+	// coalesceRanges makes Map return the keyspace ids of an id as a
+	// keyrange when they're contiguous, so it must not be used by a
+	// caller that needs the exact keyspace ids.
+	coalesceRanges bool
+	// idRanges are the ranges of ids, compared as strings, for
+	// which Map consults the table. See idRangesFromMap.
+	idRanges []idRange
+	codec    KsidCodec
+	lkp      lookupInternal
+	// scatterOnError makes Map return the full keyrange instead of
+	// its errors, which it logs with scatterLog. It also hides the
+	// errors that are bugs, like a misconfigured table.
+	scatterOnError bool
+	scatterLog     *logutil.ThrottledLogger
 }
 
 // String returns the name of the vindex.
@@ -50,13 +73,37 @@ func (ln *LookupNonUnique) String() string {
 	return ln.name
 }
 
-// Cost returns the cost of this vindex as 20.
+// Cost returns the cost of this vindex as 20, or as the
+// write_only_cost if the vindex is write_only.
+// With adaptive_cost, it follows the latency of Map instead of 20.
 func (ln *LookupNonUnique) Cost() int {
-	return 20
+	if ln.writeOnly {
+		return ln.writeOnlyCost
+	}
+	return ln.lkp.cost(20)
 }
 
 // Map returns the corresponding KeyspaceId values for the given ids.
+// If the vindex is write_only, it returns the full keyrange,
+// and it does so for the ids outside lookup_id_ranges, and for an
+// empty id with prefix_match, which is a prefix of every id. With
+// scatter_on_error, it returns the full keyrange for all the ids
+// instead of an error.
 func (ln *LookupNonUnique) Map(vcursor VCursor, ids []sqltypes.Value) ([]Ksids, error) {
+	out, err := ln.mapIDs(vcursor, ids)
+	if err == nil || !ln.scatterOnError {
+		return out, err
+	}
+	lookupScatterOnError.Add(ln.name, 1)
+	ln.scatterLog.Warningf("vindex %s returns the full keyrange for %d ids instead of the error of Map: %v", ln.name, len(ids), err)
+	out = make([]Ksids, 0, len(ids))
+	for range ids {
+		out = append(out, Ksids{Range: &topodata.KeyRange{}})
+	}
+	return out, nil
+}
+
+func (ln *LookupNonUnique) mapIDs(vcursor VCursor, ids []sqltypes.Value) ([]Ksids, error) {
 	out := make([]Ksids, 0, len(ids))
 	if ln.writeOnly {
 		for range ids {
@@ -65,54 +112,400 @@ func (ln *LookupNonUnique) Map(vcursor VCursor, ids []sqltypes.Value) ([]Ksids,
 		return out, nil
 	}
 
-	results, err := ln.lkp.Lookup(vcursor, ids)
-	if err != nil {
-		return nil, err
+	lookupIDs := ln.lookupIDs(ids)
+	var results []*sqltypes.Result
+	if len(lookupIDs) != 0 {
+		var err error
+		if results, err = ln.lkp.Lookup(vcursor, lookupIDs); err != nil {
+			return nil, err
+		}
 	}
-	for _, result := range results {
+	for _, id := range ids {
+		if !ln.mapsWithLookup(id) {
+			out = append(out, Ksids{Range: &topodata.KeyRange{}})
+			continue
+		}
+		result := results[0]
+		results = results[1:]
 		if len(result.Rows) == 0 {
 			out = append(out, Ksids{})
 			continue
 		}
 		ksids := make([][]byte, 0, len(result.Rows))
+		var seen map[string]bool
+		if ln.distinct {
+			seen = make(map[string]bool, len(result.Rows))
+		}
 		for _, row := range result.Rows {
-			ksids = append(ksids, row[0].ToBytes())
+			ksid, err := decodeKsid(ln.codec, row[0])
+			if err != nil {
+				return nil, err
+			}
+			// A NULL keyspace id is not equal to another one.
+			if seen != nil && !row[0].IsNull() {
+				if seen[string(ksid)] {
+					continue
+				}
+				seen[string(ksid)] = true
+			}
+			ksids = append(ksids, ksid)
 		}
 		out = append(out, Ksids{IDs: ksids})
 	}
+	recordLookupFanout(ln.name, out)
+	if ln.coalesceRanges {
+		for i := range out {
+			if r := coalesceKsids(out[i].IDs); r != nil {
+				out[i] = Ksids{Range: r}
+			}
+		}
+	}
 	return out, nil
 }
 
-// Verify returns true if ids maps to ksids.
+// ReverseMap returns the from values that map to each of the given ksids.
+// The result has one entry per ksid, in the same order. A ksid that has
+// no mapping yields an empty slice. The lookup is done on the 'to' column,
+// which must be indexed in the backing table for this to be efficient.
+func (ln *LookupNonUnique) ReverseMap(vcursor VCursor, ksids [][]byte) ([][]sqltypes.Value, error) {
+	values := pooledKsidsToValues(ln.codec, ksids)
+	defer putValues(values)
+	results, err := ln.lkp.ReverseLookup(vcursor, *values)
+	if err != nil {
+		return nil, err
+	}
+	out := make([][]sqltypes.Value, 0, len(results))
+	for _, result := range results {
+		ids := make([]sqltypes.Value, 0, len(result.Rows))
+		for _, row := range result.Rows {
+			ids = append(ids, row[0])
+		}
+		out = append(out, ids)
+	}
+	return out, nil
+}
+
+// Verify returns true if ids maps to ksids. Like Map, it only consults
+// the table for the ids within lookup_id_ranges, and returns true for
+// the others.
 func (ln *LookupNonUnique) Verify(vcursor VCursor, ids []sqltypes.Value, ksids [][]byte) ([]bool, error) {
-	if ln.writeOnly {
+	return ln.VerifyWithOptions(vcursor, ids, ksids, VerifyOptions{})
+}
+
+// VerifyStream is like Verify, but it calls cb with the result of each
+// id instead of returning them. See StreamVerifier.
+func (ln *LookupNonUnique) VerifyStream(vcursor VCursor, ids []sqltypes.Value, ksids [][]byte, cb func(i int, ok bool) error) error {
+	return verifyStream(ln.Verify, vcursor, ids, ksids, cb)
+}
+
+// VerifyAny is like Verify, but it accepts a set of keyspace ids for
+// each id. See AnyVerifier.
+func (ln *LookupNonUnique) VerifyAny(vcursor VCursor, ids []sqltypes.Value, ksids [][][]byte) ([]bool, error) {
+	return verifyAny(ln.Verify, vcursor, ids, ksids)
+}
+
+// VerifyWithOptions is like Verify, but with the options of one call.
+// With ForceLookup, it consults the table for all the ids, even if the
+// vindex is write_only. A write_only vindex with to_hash always
+// consults it, since its table is complete: it's only write_only
+// because Map cannot recover the keyspace ids from their hashes.
+func (ln *LookupNonUnique) VerifyWithOptions(vcursor VCursor, ids []sqltypes.Value, ksids [][]byte, options VerifyOptions) ([]bool, error) {
+	if options.ForceLookup {
+		return ln.verify(vcursor, ids, ksids)
+	}
+	if ln.writeOnly && !ln.lkp.ToHash {
 		out := make([]bool, len(ids))
 		for i := range ids {
 			out[i] = true
 		}
 		return out, nil
 	}
-	return ln.lkp.Verify(vcursor, ids, ksidsToValues(ksids))
+	if ln.idRanges == nil {
+		return ln.verify(vcursor, ids, ksids)
+	}
+	var lookupIDs []sqltypes.Value
+	var lookupKsids [][]byte
+	for i, id := range ids {
+		if ln.usesLookup(id) {
+			lookupIDs = append(lookupIDs, id)
+			lookupKsids = append(lookupKsids, ksids[i])
+		}
+	}
+	var verified []bool
+	if len(lookupIDs) != 0 {
+		var err error
+		if verified, err = ln.verify(vcursor, lookupIDs, lookupKsids); err != nil {
+			return nil, err
+		}
+	}
+	out := make([]bool, len(ids))
+	for i, id := range ids {
+		if !ln.usesLookup(id) {
+			out[i] = true
+			continue
+		}
+		out[i] = verified[0]
+		verified = verified[1:]
+	}
+	return out, nil
+}
+
+// verify checks ids against ksids in the table.
+func (ln *LookupNonUnique) verify(vcursor VCursor, ids []sqltypes.Value, ksids [][]byte) ([]bool, error) {
+	values := pooledKsidsToValues(ln.codec, ksids)
+	defer putValues(values)
+	return ln.lkp.Verify(vcursor, ids, *values)
+}
+
+// usesLookup returns true if Map consults the table for id,
+// that is if the vindex has no lookup_id_ranges or id is in one.
+func (ln *LookupNonUnique) usesLookup(id sqltypes.Value) bool {
+	if ln.idRanges == nil {
+		return true
+	}
+	s := id.ToString()
+	for _, r := range ln.idRanges {
+		if s >= r.start && (r.end == "" || s < r.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// mapsWithLookup returns true if Map consults the table for id. Unlike
+// Verify, Map doesn't look up an empty id with prefix_match, whose range
+// would be the entire table.
+func (ln *LookupNonUnique) mapsWithLookup(id sqltypes.Value) bool {
+	if ln.lkp.PrefixMatch && !id.IsNull() && len(id.ToBytes()) == 0 {
+		return false
+	}
+	return ln.usesLookup(id)
+}
+
+// Describe returns the RoutePlan of ids, with the option that made
+// Map return the full keyrange for an id, if any. An error that
+// scatter_on_error suppresses is in the plan, but not counted in
+// VindexLookupScatterOnError. See Describer.
+func (ln *LookupNonUnique) Describe(vcursor VCursor, ids []sqltypes.Value) (RoutePlan, error) {
+	plan := RoutePlan{Vindex: ln.name, Cost: ln.Cost()}
+	out, err := ln.mapIDs(vcursor, ids)
+	if err != nil {
+		if !ln.scatterOnError {
+			return RoutePlan{}, err
+		}
+		plan.Error = err.Error()
+		for _, id := range ids {
+			plan.addRoute(id, Ksids{Range: &topodata.KeyRange{}}, func(sqltypes.Value) string { return "scatter_on_error" })
+		}
+		return plan, nil
+	}
+	for i, id := range ids {
+		plan.addRoute(id, out[i], ln.rangeReason)
+	}
+	return plan, nil
+}
+
+// rangeReason returns the option that makes Map return the full
+// keyrange for id without consulting the table, if any.
+func (ln *LookupNonUnique) rangeReason(id sqltypes.Value) string {
+	switch {
+	case ln.writeOnly:
+		return "write_only"
+	case !ln.usesLookup(id):
+		return "lookup_id_ranges"
+	case !ln.mapsWithLookup(id):
+		return "prefix_match"
+	}
+	return ""
+}
+
+// lookupIDs returns the ids for which Map consults the table.
+func (ln *LookupNonUnique) lookupIDs(ids []sqltypes.Value) []sqltypes.Value {
+	if ln.idRanges == nil && !ln.lkp.PrefixMatch {
+		return ids
+	}
+	lookupIDs := make([]sqltypes.Value, 0, len(ids))
+	for _, id := range ids {
+		if ln.mapsWithLookup(id) {
+			lookupIDs = append(lookupIDs, id)
+		}
+	}
+	return lookupIDs
 }
 
 // Create reserves the id by inserting it into the vindex table.
 func (ln *LookupNonUnique) Create(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksids [][]byte, ignoreMode bool) error {
-	return ln.lkp.Create(vcursor, rowsColValues, ksidsToValues(ksids), ignoreMode)
+	return ln.lkp.Create(vcursor, rowsColValues, ksidsToValues(ln.codec, ksids), ignoreMode)
+}
+
+// CreateWithSourcePK is like Create, but also records the primary key of
+// the source row of each entry in the source_pk_column.
+func (ln *LookupNonUnique) CreateWithSourcePK(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksids [][]byte, sourcePKs []sqltypes.Value, ignoreMode bool) error {
+	return ln.lkp.CreateWithSourcePK(vcursor, rowsColValues, ksidsToValues(ln.codec, ksids), sourcePKs, ignoreMode)
+}
+
+// BatchCreate is like CreateWithSourcePK, but it inserts the entries in
+// batches, possibly in parallel, as specified by options. sourcePKs can be nil.
+func (ln *LookupNonUnique) BatchCreate(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksids [][]byte, sourcePKs []sqltypes.Value, options BatchCreateOptions) error {
+	return ln.lkp.BatchCreate(vcursor, rowsColValues, ksidsToValues(ln.codec, ksids), sourcePKs, options)
+}
+
+// CreateWithStatus is like Create, but it returns whether each row was
+// inserted, updated or ignored. It issues one insert per row. See
+// lookupInternal.CreateWithStatus for how the statuses are derived.
+func (ln *LookupNonUnique) CreateWithStatus(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksids [][]byte, ignoreMode bool) ([]CreateStatus, error) {
+	return ln.lkp.CreateWithStatus(vcursor, rowsColValues, ksidsToValues(ln.codec, ksids), ignoreMode)
+}
+
+// CreatePending is like Create, but it inserts the entries in a
+// transaction of their own, and returns the handle that commits it.
+// See PendingCreate.
+func (ln *LookupNonUnique) CreatePending(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksids [][]byte, ignoreMode bool) (*PendingCreate, error) {
+	return ln.lkp.CreatePending(vcursor, rowsColValues, ksidsToValues(ln.codec, ksids), ignoreMode)
+}
+
+// Move moves the entries from oldKsid to newKsid in one transaction.
+// See lookupInternal.Move.
+func (ln *LookupNonUnique) Move(vcursor VCursor, rowsColValues [][]sqltypes.Value, oldKsid, newKsid []byte) error {
+	return ln.lkp.Move(vcursor, rowsColValues, ksidToValue(ln.codec, oldKsid), ksidToValue(ln.codec, newKsid))
 }
 
 // Delete deletes the entry from the vindex table.
 func (ln *LookupNonUnique) Delete(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksid []byte) error {
-	return ln.lkp.Delete(vcursor, rowsColValues, sqltypes.MakeTrusted(sqltypes.VarBinary, ksid))
+	return ln.lkp.Delete(vcursor, rowsColValues, ksidToValue(ln.codec, ksid))
+}
+
+// DeleteWithSourcePK is like Delete, but if delete_by_source_pk is set,
+// it deletes the entries by the primary keys of their source rows.
+func (ln *LookupNonUnique) DeleteWithSourcePK(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksid []byte, sourcePKs []sqltypes.Value) error {
+	return ln.lkp.DeleteWithSourcePK(vcursor, rowsColValues, ksidToValue(ln.codec, ksid), sourcePKs)
 }
 
 // Update updates the entry in the vindex table.
 func (ln *LookupNonUnique) Update(vcursor VCursor, oldValues []sqltypes.Value, ksid []byte, newValues []sqltypes.Value) error {
-	return ln.lkp.Update(vcursor, oldValues, sqltypes.MakeTrusted(sqltypes.VarBinary, ksid), newValues)
+	return ln.lkp.Update(vcursor, oldValues, ksidToValue(ln.codec, ksid), newValues)
+}
+
+// CreateWithCount is like Create, but it returns the number of rows
+// affected. See lookupInternal.CreateWithCount.
+func (ln *LookupNonUnique) CreateWithCount(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksids [][]byte, ignoreMode bool) (uint64, error) {
+	return ln.lkp.CreateWithCount(vcursor, rowsColValues, ksidsToValues(ln.codec, ksids), ignoreMode)
+}
+
+// UpdateWithCount is like Update, but it returns the number of rows
+// affected.
+func (ln *LookupNonUnique) UpdateWithCount(vcursor VCursor, oldValues []sqltypes.Value, ksid []byte, newValues []sqltypes.Value) (uint64, error) {
+	return ln.lkp.UpdateWithCount(vcursor, oldValues, ksidToValue(ln.codec, ksid), newValues)
+}
+
+// DeleteWithCount is like Delete, but it returns the number of rows
+// deleted.
+func (ln *LookupNonUnique) DeleteWithCount(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksid []byte) (uint64, error) {
+	return ln.lkp.DeleteWithCount(vcursor, rowsColValues, ksidToValue(ln.codec, ksid))
+}
+
+// Reset clears the runtime state of the vindex without rebuilding it:
+// the cached lookup results and, if resetStats is true, its stats,
+// including the VindexLookupMapFanout histogram. This is useful after
+// a known change of the lookup table, or in tests.
+func (ln *LookupNonUnique) Reset(resetStats bool) {
+	ln.lkp.Reset(resetStats)
+	if resetStats {
+		resetLookupFanout(ln.name)
+	}
+}
+
+// SnapshotCache writes the cached lookup results to w, for RestoreCache
+// to load them into the same vindex of a new vtgate after a graceful
+// restart. It fails if cache_size is not set.
+func (ln *LookupNonUnique) SnapshotCache(w io.Writer) error {
+	return ln.lkp.SnapshotCache(w)
+}
+
+// RestoreCache loads a snapshot written by SnapshotCache into the cache,
+// and returns the number of entries added. An incompatible snapshot is
+// discarded with an error, and can be ignored: the cache is then only
+// warmed by Map, as usual.
+func (ln *LookupNonUnique) RestoreCache(r io.Reader) (int, error) {
+	return ln.lkp.RestoreCache(r)
+}
+
+// Flush waits until the mutations queued by async_writes are executed.
+func (ln *LookupNonUnique) Flush() {
+	ln.lkp.Flush()
+}
+
+// SetBackoffPolicy sets the BackoffPolicy used between retries.
+// If not set, DefaultBackoffPolicy is used.
+func (ln *LookupNonUnique) SetBackoffPolicy(backoff BackoffPolicy) {
+	ln.lkp.SetBackoffPolicy(backoff)
+}
+
+// SetErrorMapper sets the ErrorMapper of the errors returned by Map,
+// Verify, Create, Update and Delete. If not set, DefaultErrorMapper
+// is used.
+func (ln *LookupNonUnique) SetErrorMapper(mapper ErrorMapper) {
+	ln.lkp.SetErrorMapper(mapper)
+}
+
+// SetCacheInvalidator sets the CacheInvalidator that publishes the
+// cache invalidations of Create, Update and Delete to the other
+// vtgates. If not set, DefaultCacheInvalidator is used.
+func (ln *LookupNonUnique) SetCacheInvalidator(invalidator CacheInvalidator) {
+	ln.lkp.SetCacheInvalidator(invalidator)
+}
+
+// EstimateRows returns an estimate of the number of rows of the
+// vindex table. See lookupInternal.EstimateRows for its accuracy.
+func (ln *LookupNonUnique) EstimateRows(vcursor VCursor) (int64, error) {
+	return ln.lkp.EstimateRows(vcursor)
+}
+
+// Checksum returns a checksum of the rows of the vindex table.
+// See lookupInternal.Checksum for how it's computed.
+func (ln *LookupNonUnique) Checksum(vcursor VCursor) ([]byte, error) {
+	return ln.lkp.Checksum(vcursor)
+}
+
+// SelfTest reads the vindex table and, if self_test_id is set,
+// creates, verifies and deletes an entry in it.
+func (ln *LookupNonUnique) SelfTest(vcursor VCursor) error {
+	return selfTest(vcursor, ln, &ln.lkp)
+}
+
+// OnVSchemaReload invalidates the cache of the vindex if its config
+// changed. See VSchemaReloadHook.
+func (ln *LookupNonUnique) OnVSchemaReload(vcursor VCursor) error {
+	return ln.lkp.OnVSchemaReload(vcursor)
+}
+
+// SelfTestReport runs all the checks of SelfTest, and ValidateIndex,
+// without stopping at the first failure. See SelfTestReporter.
+func (ln *LookupNonUnique) SelfTestReport(vcursor VCursor) *SelfTestReport {
+	return selfTestReport(vcursor, ln, &ln.lkp, false /* unique */)
+}
+
+// ValidateIndex logs a warning if the vindex table has no index on
+// the first from column. It fails if an index of index_hint is missing.
+func (ln *LookupNonUnique) ValidateIndex(vcursor VCursor) error {
+	return ln.lkp.validateIndex(vcursor, false /* unique */)
+}
+
+// ValidateCollation fails with a *CollationError if a from column of
+// the vindex table has a non-binary collation.
+func (ln *LookupNonUnique) ValidateCollation(vcursor VCursor) error {
+	return ln.lkp.validateCollation(vcursor)
+}
+
+// ValidateCreate checks the rows of a Create without executing it.
+// See lookupInternal.validateCreate.
+func (ln *LookupNonUnique) ValidateCreate(rowsColValues [][]sqltypes.Value, ksids [][]byte) error {
+	return ln.lkp.validateCreate(rowsColValues, ksids, false /* unique */, nil)
 }
 
 // MarshalJSON returns a JSON representation of LookupHash.
 func (ln *LookupNonUnique) MarshalJSON() ([]byte, error) {
-	return json.Marshal(ln.lkp)
+	return ln.lkp.MarshalJSON()
 }
 
 // NewLookup creates a LookupNonUnique vindex.
@@ -121,9 +514,66 @@ func (ln *LookupNonUnique) MarshalJSON() ([]byte, error) {
 //   from: list of columns in the table that have the 'from' values of the lookup vindex.
 //   to: The 'to' column name of the table.
 //
+// A NULL from value is not equal to any value: Map returns no keyspace
+// id for it, Verify returns false, and it's never cached.
+//
 // The following fields are optional:
 //   autocommit: setting this to "true" will cause inserts to upsert and deletes to be ignored.
 //   write_only: in this mode, Map functions return the full keyrange causing a full scatter.
+//   write_only_cost: the cost of the vindex in write_only mode. It defaults to 100, which
+//     makes the planner prefer any other vindex of a query. It was 20 before, like the
+//     cost of a lookup vindex that isn't write_only.
+//   write_only_dry_run: log and count the inserts of a write_only vindex instead of executing them.
+//   read_only: make Create, Update and Delete fail, while Map and Verify keep working.
+//   require_qualified_table: fail if table is not qualified by its keyspace.
+//   upsert_only_changed: make the upsert of autocommit leave a row as is if its keyspace id doesn't change.
+//   ksid_encoding: "raw" (the default), "hex", "base64", or a codec registered with RegisterKsidCodec.
+//   to_hash: store the md5 hash of the keyspace ids. It requires write_only, since Map cannot
+//     recover the keyspace ids from their hashes, but Verify still checks the hashes in the
+//     table. It cannot be used with write_only_dry_run, which doesn't write the table.
+//   source_pk_column: column that records the primary key of the source row (see CreateWithSourcePK).
+//   delete_by_source_pk: make DeleteWithSourcePK delete rows by source_pk_column.
+//   delete_missing: "ignore" (the default) or "error" to fail Delete for a row without a mapping.
+//   created_at_column, updated_at_column: columns that Create sets to NOW().
+//   deadlock_retries: number of times an autocommit insert is retried on deadlock.
+//   commit_batch_size: the maximum number of rows of an autocommit insert.
+//   retry_on_missing_table: number of times Map and Verify are retried if the table doesn't exist.
+//   adaptive_cost, adaptive_cost_min, adaptive_cost_max, adaptive_cost_unit, adaptive_cost_smoothing:
+//     make Cost follow the latency of Map. See adaptiveCost.
+//   log_queries, log_queries_redact: log the queries of the vindex at -v=2, with or without the from values.
+//   error_context: wrap the errors in an *OperationError that tells the operation and its inputs.
+//   allow_unknown_params: setting this to "true" makes unrecognized params be ignored instead of failing.
+//   from_list: "csv" or "json" if the (single) from column holds a list of values.
+//   full_scan_threshold: the number of ids above which Map reads the entire table once.
+//   cache_size, cache_ttl: cache the results of Map for up to cache_size from values.
+//   ttl_column, ttl_column_type: a column that holds the cache TTL of each row.
+//   json_hex: setting this to "true" makes SnapshotCache write the cached values in hex instead of base64.
+//   consolidate_lookups: make the concurrent lookups of an id share one query.
+//   dedupe_ids: look up the ids that are repeated in one Map once.
+//   shard_key_column, shard_key_prefix: a column, derived from the from value, that the table is sharded by.
+//   collation_check: "warn" or "error" if SelfTest finds a from column with a non-binary collation.
+//   self_test_id: a from value that SelfTest creates, verifies and deletes.
+//   warn_on_empty_map: log a warning when none of the ids of Map has a mapping.
+//   verify_before_create: make Create fail with a *ConflictError if an id maps to another keyspace id.
+//   estimate_rows_ttl, estimate_rows_count: how EstimateRows estimates the size of the table.
+//   distinct: make Map return each keyspace id only once per id.
+//   coalesce_ranges: make Map return consecutive keyspace ids of an id as a keyrange.
+//   scatter_on_error: make Map return the full keyrange instead of its errors.
+//   lookup_id_ranges: the ranges of ids, like "100-200,500-", for which Map consults the table.
+//   prefix_match: make Map return the keyspace ids of the from values that start with the id.
+//   query_builder: a LookupQueryBuilder registered with RegisterLookupQueryBuilder.
+//   async_writes, async_queue_size: queue the inserts for a background worker. Requires autocommit. See AsyncWrites.
+//   max_inflight_mutations: the maximum number of mutations that the vindex executes at once.
+//   pending_create_timeout: the time after which an unfinished PendingCreate is rolled back.
+//   connection_pool: the connection pool of the queries of an autocommit vindex. vtgate has the
+//     pools of its -lookup_connection_pools flag.
+//   read_cell: the cell whose tablets serve the queries of Map and Verify. vtgate prefers them
+//     among the tablets of the region of its cell, and falls back to the others.
+//   snapshot_reads: execute the queries of Map and Verify in the transaction of the session.
+//   index_hint: a "use index" or "force index" hint for the queries of Map and Verify.
+//
+// The fields of lookupInternal, and the functions that implement the
+// options, document their details and interactions.
 func NewLookup(name string, m map[string]string) (Vindex, error) {
 	lookup := &LookupNonUnique{name: name}
 
@@ -135,30 +585,144 @@ func NewLookup(name string, m map[string]string) (Vindex, error) {
 	if err != nil {
 		return nil, err
 	}
+	lookup.writeOnlyCost, err = writeOnlyCostFromMap(m)
+	if err != nil {
+		return nil, err
+	}
+	lookup.distinct, err = boolFromMap(m, "distinct")
+	if err != nil {
+		return nil, err
+	}
+	lookup.coalesceRanges, err = boolFromMap(m, "coalesce_ranges")
+	if err != nil {
+		return nil, err
+	}
+	lookup.idRanges, err = idRangesFromMap(m)
+	if err != nil {
+		return nil, err
+	}
+	lookup.scatterOnError, err = boolFromMap(m, "scatter_on_error")
+	if err != nil {
+		return nil, err
+	}
+	if lookup.scatterOnError {
+		lookup.scatterLog = logutil.NewThrottledLogger("VindexLookupScatterOnError "+name, time.Minute)
+	}
+	lookup.codec, err = ksidCodecFromMap(m)
+	if err != nil {
+		return nil, err
+	}
 
 	// if autocommit is on for non-unique lookup, upsert should also be on.
-	if err := lookup.lkp.Init(m, autocommit, autocommit /* upsert */); err != nil {
+	if err := lookup.lkp.Init(name, m, lookupNonUniqueParams, autocommit, autocommit /* upsert */); err != nil {
 		return nil, err
 	}
+	if lookup.lkp.ToHash {
+		if !lookup.writeOnly {
+			return nil, errors.New("to_hash requires write_only, since Map cannot recover the keyspace ids from their hashes")
+		}
+		if lookup.lkp.WriteOnlyDryRun {
+			return nil, errors.New("to_hash cannot be used with write_only_dry_run, which doesn't write the table that Verify checks")
+		}
+		lookup.codec = md5KsidCodec{}
+	}
 	return lookup, nil
 }
 
-func ksidsToValues(ksids [][]byte) []sqltypes.Value {
+func ksidsToValues(codec KsidCodec, ksids [][]byte) []sqltypes.Value {
 	values := make([]sqltypes.Value, 0, len(ksids))
 	for _, ksid := range ksids {
-		values = append(values, sqltypes.MakeTrusted(sqltypes.VarBinary, ksid))
+		values = append(values, ksidToValue(codec, ksid))
 	}
 	return values
 }
 
+func ksidToValue(codec KsidCodec, ksid []byte) sqltypes.Value {
+	return sqltypes.MakeTrusted(sqltypes.VarBinary, codec.Encode(ksid))
+}
+
+func decodeKsid(codec KsidCodec, v sqltypes.Value) ([]byte, error) {
+	ksid, err := codec.Decode(v.ToBytes())
+	if err != nil {
+		return nil, fmt.Errorf("lookup.Map: cannot decode keyspace id %v: %v", v, err)
+	}
+	return ksid, nil
+}
+
+// idRange is a range of ids, compared as strings, like keyranges
+// compare keyspace ids: start is included and end is excluded.
+// An empty start or end is unbounded.
+type idRange struct {
+	start, end string
+}
+
+// idRangesFromMap parses the lookup_id_ranges param, a comma
+// separated list of "start-end" ranges. It returns nil if it's
+// not set.
+func idRangesFromMap(m map[string]string) ([]idRange, error) {
+	val, ok := m["lookup_id_ranges"]
+	if !ok {
+		return nil, nil
+	}
+	var ranges []idRange
+	for _, part := range strings.Split(val, ",") {
+		bounds := strings.Split(strings.TrimSpace(part), "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("lookup_id_ranges: range %q must be of the form start-end", part)
+		}
+		r := idRange{start: bounds[0], end: bounds[1]}
+		if r.end != "" && r.start >= r.end {
+			return nil, fmt.Errorf("lookup_id_ranges: range %q is empty", part)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
 //====================================================================
 
 // LookupUnique defines a vindex that uses a lookup table.
 // The table is expected to define the id column as unique. It's
 // Unique and a Lookup.
 type LookupUnique struct {
-	name string
-	lkp  lookupInternal
+	name          string
+	failOnMissing bool
+	strictVerify  bool
+	allowMulti    bool
+	codec         KsidCodec
+	lkp           lookupInternal
+}
+
+// NotFoundError is returned by LookupUnique.Map for an id
+// that has no mapping, if on_missing is set to "error", and by
+// Delete for a row that has no mapping to the deleted keyspace id,
+// if delete_missing is set to "error".
+type NotFoundError struct {
+	Vindex string
+	ID     sqltypes.Value
+	// Row is set instead of ID by Delete, to the from values
+	// of the row.
+	Row []sqltypes.Value
+}
+
+func (e *NotFoundError) Error() string {
+	if e.Row != nil {
+		return fmt.Sprintf("lookup.Delete: no mapping found in vindex %s for row %v", e.Vindex, e.Row)
+	}
+	return fmt.Sprintf("lookup.Map: no mapping found in vindex %s for id %v", e.Vindex, e.ID)
+}
+
+// DuplicateMappingError is returned by LookupUnique.Verify for an id
+// that has more than one row in the vindex table, if
+// strict_unique_verify is set.
+type DuplicateMappingError struct {
+	Vindex string
+	ID     sqltypes.Value
+	Rows   int
+}
+
+func (e *DuplicateMappingError) Error() string {
+	return fmt.Sprintf("lookup.Verify: %d mappings found in vindex %s for id %v, want 1", e.Rows, e.Vindex, e.ID)
 }
 
 // NewLookupUnique creates a LookupUnique vindex.
@@ -169,6 +733,31 @@ type LookupUnique struct {
 //
 // The following fields are optional:
 //   autocommit: setting this to "true" will cause deletes to be ignored.
+//   source_pk_column: column that records the primary key of the source row (see CreateWithSourcePK).
+//   delete_by_source_pk: setting this to "true" makes DeleteWithSourcePK delete rows by source_pk_column
+//     instead of by their from values, for tables where the from columns are not indexed.
+//   deadlock_retries: number of times an autocommit insert is retried on deadlock.
+//   allow_unknown_params: setting this to "true" makes unrecognized params be ignored instead of failing.
+//     The custom options registered with RegisterLookupOption are recognized.
+//   on_missing: what Map does for an id that has no mapping. "null" (the default) returns
+//     a nil keyspace id for it. "error" fails the Map with a *NotFoundError instead.
+//     Since a unique lookup vindex cannot be write_only, Map always consults the table.
+//   strict_unique_verify: setting this to "true" makes Verify fail with a *DuplicateMappingError
+//     if an id has more than one row in the table, instead of only checking that the given
+//     keyspace id is one of them. It reads all the rows of the id from the table, bypassing
+//     the cache. It cannot be used with from_list.
+//   allow_multi: setting this to "true" makes Map return the first keyspace id of an id that
+//     has more than one, instead of failing. MapMulti can be used to get all of them. This is
+//     meant for migrations during which an id can briefly have two keyspace ids.
+//   cache_size, cache_ttl, ksid_encoding, shard_key_column, shard_key_prefix, self_test_id,
+//     warn_on_empty_map, verify_before_create, retry_on_missing_table, estimate_rows_ttl,
+//     estimate_rows_count, commit_batch_size, query_builder, ttl_column,
+//     ttl_column_type, async_writes, async_queue_size, log_queries, log_queries_redact,
+//     adaptive_cost, adaptive_cost_min, adaptive_cost_max, adaptive_cost_unit,
+//     adaptive_cost_smoothing, connection_pool, read_only, pending_create_timeout,
+//     consolidate_lookups, max_inflight_mutations, collation_check, require_qualified_table,
+//     read_cell, dedupe_ids, created_at_column, updated_at_column, error_context,
+//     snapshot_reads, delete_missing, index_hint, json_hex: see NewLookup.
 func NewLookupUnique(name string, m map[string]string) (Vindex, error) {
 	lu := &LookupUnique{name: name}
 
@@ -176,6 +765,28 @@ func NewLookupUnique(name string, m map[string]string) (Vindex, error) {
 	if err != nil {
 		return nil, err
 	}
+	switch m["on_missing"] {
+	case "", "null":
+	case "error":
+		lu.failOnMissing = true
+	default:
+		return nil, fmt.Errorf("on_missing value must be 'null' or 'error': '%s'", m["on_missing"])
+	}
+	lu.strictVerify, err = boolFromMap(m, "strict_unique_verify")
+	if err != nil {
+		return nil, err
+	}
+	if lu.strictVerify && m["from_list"] != "" {
+		return nil, errors.New("strict_unique_verify cannot be used with from_list")
+	}
+	lu.allowMulti, err = boolFromMap(m, "allow_multi")
+	if err != nil {
+		return nil, err
+	}
+	lu.codec, err = ksidCodecFromMap(m)
+	if err != nil {
+		return nil, err
+	}
 	scatter, err := boolFromMap(m, "write_only")
 	if err != nil {
 		return nil, err
@@ -183,9 +794,26 @@ func NewLookupUnique(name string, m map[string]string) (Vindex, error) {
 	if scatter {
 		return nil, errors.New("write_only cannot be true for a unique lookup vindex")
 	}
+	toHash, err := boolFromMap(m, "to_hash")
+	if err != nil {
+		return nil, err
+	}
+	if toHash {
+		return nil, errors.New("to_hash cannot be true for a unique lookup vindex, whose Map needs the keyspace ids")
+	}
+	if _, ok := m["lookup_id_ranges"]; ok {
+		return nil, errors.New("lookup_id_ranges cannot be used with a unique lookup vindex, whose Map cannot scatter")
+	}
+	if _, ok := m["prefix_match"]; ok {
+		return nil, errors.New("prefix_match cannot be used with a unique lookup vindex, whose Map returns one keyspace id per id")
+	}
+	if _, ok := m["scatter_on_error"]; ok {
+		return nil, errors.New("scatter_on_error cannot be used with a unique lookup vindex, whose Map cannot scatter")
+	}
 
 	// Don't allow upserts for unique vindexes.
-	if err := lu.lkp.Init(m, autocommit, false /* upsert */); err != nil {
+	lu.lkp.unique = true
+	if err := lu.lkp.Init(name, m, lookupUniqueParams, autocommit, false /* upsert */); err != nil {
 		return nil, err
 	}
 	return lu, nil
@@ -196,9 +824,10 @@ func (lu *LookupUnique) String() string {
 	return lu.name
 }
 
-// Cost returns the cost of this vindex as 10.
+// Cost returns the cost of this vindex as 10. With adaptive_cost,
+// it follows the latency of Map instead.
 func (lu *LookupUnique) Cost() int {
-	return 10
+	return lu.lkp.cost(10)
 }
 
 // Map returns the corresponding KeyspaceId values for the given ids.
@@ -211,37 +840,305 @@ func (lu *LookupUnique) Map(vcursor VCursor, ids []sqltypes.Value) ([][]byte, er
 	for i, result := range results {
 		switch len(result.Rows) {
 		case 0:
+			if lu.failOnMissing {
+				return nil, &NotFoundError{Vindex: lu.name, ID: ids[i]}
+			}
 			out = append(out, nil)
 		case 1:
-			out = append(out, result.Rows[0][0].ToBytes())
+			ksid, err := decodeKsid(lu.codec, result.Rows[0][0])
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, ksid)
 		default:
-			return nil, fmt.Errorf("Lookup.Map: unexpected multiple results from vindex %s: %v", lu.lkp.Table, ids[i])
+			if !lu.allowMulti {
+				return nil, fmt.Errorf("Lookup.Map: unexpected multiple results from vindex %s: %v", lu.lkp.Table, ids[i])
+			}
+			ksid, err := decodeKsid(lu.codec, result.Rows[0][0])
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, ksid)
 		}
 	}
 	return out, nil
 }
 
+// MapMulti is like Map, but it returns all the keyspace ids of each id,
+// even if there is more than one.
+func (lu *LookupUnique) MapMulti(vcursor VCursor, ids []sqltypes.Value) ([]Ksids, error) {
+	results, err := lu.lkp.Lookup(vcursor, ids)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Ksids, 0, len(ids))
+	for i, result := range results {
+		if len(result.Rows) == 0 {
+			if lu.failOnMissing {
+				return nil, &NotFoundError{Vindex: lu.name, ID: ids[i]}
+			}
+			out = append(out, Ksids{})
+			continue
+		}
+		ksids := make([][]byte, 0, len(result.Rows))
+		for _, row := range result.Rows {
+			ksid, err := decodeKsid(lu.codec, row[0])
+			if err != nil {
+				return nil, err
+			}
+			ksids = append(ksids, ksid)
+		}
+		out = append(out, Ksids{IDs: ksids})
+	}
+	return out, nil
+}
+
 // Verify returns true if ids maps to ksids.
+// If strict_unique_verify is set, the id must also have no other mapping.
 func (lu *LookupUnique) Verify(vcursor VCursor, ids []sqltypes.Value, ksids [][]byte) ([]bool, error) {
-	return lu.lkp.Verify(vcursor, ids, ksidsToValues(ksids))
+	return lu.VerifyWithOptions(vcursor, ids, ksids, VerifyOptions{})
+}
+
+// VerifyStream is like Verify, but it calls cb with the result of each
+// id instead of returning them. See StreamVerifier.
+func (lu *LookupUnique) VerifyStream(vcursor VCursor, ids []sqltypes.Value, ksids [][]byte, cb func(i int, ok bool) error) error {
+	return verifyStream(lu.Verify, vcursor, ids, ksids, cb)
+}
+
+// Describe returns the RoutePlan of ids. With on_missing set to
+// "error", it fails for an id that has no mapping, like Map. See
+// Describer.
+func (lu *LookupUnique) Describe(vcursor VCursor, ids []sqltypes.Value) (RoutePlan, error) {
+	return describeMap(vcursor, lu, ids, nil)
+}
+
+// VerifyAny is like Verify, but it accepts a set of keyspace ids for
+// each id. See AnyVerifier. If strict_unique_verify is set, the id must
+// still have a single mapping, which must be to one of the set: an id
+// with several mappings fails with a *DuplicateMappingError, even if
+// they are all in the set. The strict verification reads the mapping of
+// each id once, from the table, and compares it to the whole set.
+func (lu *LookupUnique) VerifyAny(vcursor VCursor, ids []sqltypes.Value, ksids [][][]byte) ([]bool, error) {
+	if !lu.strictVerify {
+		return verifyAny(lu.Verify, vcursor, ids, ksids)
+	}
+	if len(ksids) != len(ids) {
+		return nil, fmt.Errorf("lookup.Verify: got %d keyspace id sets for %d ids", len(ksids), len(ids))
+	}
+	results, err := lu.lkp.VerifyMappings(vcursor, ids)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]bool, len(ids))
+	for i, result := range results {
+		switch len(result.Rows) {
+		case 0:
+		case 1:
+			for _, ksid := range ksids[i] {
+				if bytes.Equal(result.Rows[0][0].ToBytes(), lu.codec.Encode(ksid)) {
+					out[i] = true
+					break
+				}
+			}
+		default:
+			return nil, &DuplicateMappingError{Vindex: lu.name, ID: ids[i], Rows: len(result.Rows)}
+		}
+	}
+	return out, nil
+}
+
+// VerifyWithOptions is like Verify, but with the options of one call.
+// A unique lookup vindex cannot be write_only, so it always consults
+// the table: it exists so that callers can treat both lookup vindexes
+// the same.
+func (lu *LookupUnique) VerifyWithOptions(vcursor VCursor, ids []sqltypes.Value, ksids [][]byte, options VerifyOptions) ([]bool, error) {
+	if !lu.strictVerify {
+		values := pooledKsidsToValues(lu.codec, ksids)
+		defer putValues(values)
+		return lu.lkp.Verify(vcursor, ids, *values)
+	}
+	results, err := lu.lkp.VerifyMappings(vcursor, ids)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]bool, len(ids))
+	for i, result := range results {
+		switch len(result.Rows) {
+		case 0:
+		case 1:
+			out[i] = bytes.Equal(result.Rows[0][0].ToBytes(), lu.codec.Encode(ksids[i]))
+		default:
+			return nil, &DuplicateMappingError{Vindex: lu.name, ID: ids[i], Rows: len(result.Rows)}
+		}
+	}
+	return out, nil
 }
 
 // Create reserves the id by inserting it into the vindex table.
 func (lu *LookupUnique) Create(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksids [][]byte, ignoreMode bool) error {
-	return lu.lkp.Create(vcursor, rowsColValues, ksidsToValues(ksids), ignoreMode)
+	return lu.lkp.Create(vcursor, rowsColValues, ksidsToValues(lu.codec, ksids), ignoreMode)
+}
+
+// CreateWithSourcePK is like Create, but also records the primary key of
+// the source row of each entry in the source_pk_column.
+func (lu *LookupUnique) CreateWithSourcePK(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksids [][]byte, sourcePKs []sqltypes.Value, ignoreMode bool) error {
+	return lu.lkp.CreateWithSourcePK(vcursor, rowsColValues, ksidsToValues(lu.codec, ksids), sourcePKs, ignoreMode)
+}
+
+// BatchCreate is like CreateWithSourcePK, but it inserts the entries in
+// batches, possibly in parallel, as specified by options. sourcePKs can be nil.
+func (lu *LookupUnique) BatchCreate(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksids [][]byte, sourcePKs []sqltypes.Value, options BatchCreateOptions) error {
+	return lu.lkp.BatchCreate(vcursor, rowsColValues, ksidsToValues(lu.codec, ksids), sourcePKs, options)
+}
+
+// CreateWithStatus is like Create, but it returns whether each row was
+// inserted or ignored. A unique vindex doesn't upsert, so no row is
+// updated. See LookupNonUnique.CreateWithStatus.
+func (lu *LookupUnique) CreateWithStatus(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksids [][]byte, ignoreMode bool) ([]CreateStatus, error) {
+	return lu.lkp.CreateWithStatus(vcursor, rowsColValues, ksidsToValues(lu.codec, ksids), ignoreMode)
+}
+
+// CreatePending is like Create, but it inserts the entries in a
+// transaction of their own, and returns the handle that commits it.
+// See PendingCreate.
+func (lu *LookupUnique) CreatePending(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksids [][]byte, ignoreMode bool) (*PendingCreate, error) {
+	return lu.lkp.CreatePending(vcursor, rowsColValues, ksidsToValues(lu.codec, ksids), ignoreMode)
+}
+
+// Move moves the entries from oldKsid to newKsid in one transaction.
+// See lookupInternal.Move.
+func (lu *LookupUnique) Move(vcursor VCursor, rowsColValues [][]sqltypes.Value, oldKsid, newKsid []byte) error {
+	return lu.lkp.Move(vcursor, rowsColValues, ksidToValue(lu.codec, oldKsid), ksidToValue(lu.codec, newKsid))
 }
 
 // Update updates the entry in the vindex table.
 func (lu *LookupUnique) Update(vcursor VCursor, oldValues []sqltypes.Value, ksid []byte, newValues []sqltypes.Value) error {
-	return lu.lkp.Update(vcursor, oldValues, sqltypes.MakeTrusted(sqltypes.VarBinary, ksid), newValues)
+	return lu.lkp.Update(vcursor, oldValues, ksidToValue(lu.codec, ksid), newValues)
 }
 
 // Delete deletes the entry from the vindex table.
 func (lu *LookupUnique) Delete(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksid []byte) error {
-	return lu.lkp.Delete(vcursor, rowsColValues, sqltypes.MakeTrusted(sqltypes.VarBinary, ksid))
+	return lu.lkp.Delete(vcursor, rowsColValues, ksidToValue(lu.codec, ksid))
+}
+
+// DeleteWithSourcePK is like Delete, but if delete_by_source_pk is set,
+// it deletes the entry by the primary key of its source row.
+func (lu *LookupUnique) DeleteWithSourcePK(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksid []byte, sourcePKs []sqltypes.Value) error {
+	return lu.lkp.DeleteWithSourcePK(vcursor, rowsColValues, ksidToValue(lu.codec, ksid), sourcePKs)
+}
+
+// CreateWithCount is like Create, but it returns the number of rows
+// affected. See lookupInternal.CreateWithCount.
+func (lu *LookupUnique) CreateWithCount(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksids [][]byte, ignoreMode bool) (uint64, error) {
+	return lu.lkp.CreateWithCount(vcursor, rowsColValues, ksidsToValues(lu.codec, ksids), ignoreMode)
+}
+
+// UpdateWithCount is like Update, but it returns the number of rows
+// affected.
+func (lu *LookupUnique) UpdateWithCount(vcursor VCursor, oldValues []sqltypes.Value, ksid []byte, newValues []sqltypes.Value) (uint64, error) {
+	return lu.lkp.UpdateWithCount(vcursor, oldValues, ksidToValue(lu.codec, ksid), newValues)
+}
+
+// DeleteWithCount is like Delete, but it returns the number of rows
+// deleted.
+func (lu *LookupUnique) DeleteWithCount(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksid []byte) (uint64, error) {
+	return lu.lkp.DeleteWithCount(vcursor, rowsColValues, ksidToValue(lu.codec, ksid))
+}
+
+// Reset clears the runtime state of the vindex without rebuilding it:
+// the cached lookup results and, if resetStats is true, its stats.
+// See LookupNonUnique.Reset.
+func (lu *LookupUnique) Reset(resetStats bool) {
+	lu.lkp.Reset(resetStats)
+}
+
+// SnapshotCache writes the cached lookup results to w.
+// See LookupNonUnique.SnapshotCache.
+func (lu *LookupUnique) SnapshotCache(w io.Writer) error {
+	return lu.lkp.SnapshotCache(w)
+}
+
+// RestoreCache loads a snapshot written by SnapshotCache into the cache.
+// See LookupNonUnique.RestoreCache.
+func (lu *LookupUnique) RestoreCache(r io.Reader) (int, error) {
+	return lu.lkp.RestoreCache(r)
+}
+
+// Flush waits until the mutations queued by async_writes are executed.
+func (lu *LookupUnique) Flush() {
+	lu.lkp.Flush()
+}
+
+// SetBackoffPolicy sets the BackoffPolicy used between retries.
+// If not set, DefaultBackoffPolicy is used.
+func (lu *LookupUnique) SetBackoffPolicy(backoff BackoffPolicy) {
+	lu.lkp.SetBackoffPolicy(backoff)
+}
+
+// SetErrorMapper sets the ErrorMapper of the errors returned by Map,
+// Verify, Create, Update and Delete. If not set, DefaultErrorMapper
+// is used.
+func (lu *LookupUnique) SetErrorMapper(mapper ErrorMapper) {
+	lu.lkp.SetErrorMapper(mapper)
+}
+
+// SetCacheInvalidator sets the CacheInvalidator that publishes the
+// cache invalidations of Create, Update and Delete to the other
+// vtgates. If not set, DefaultCacheInvalidator is used.
+func (lu *LookupUnique) SetCacheInvalidator(invalidator CacheInvalidator) {
+	lu.lkp.SetCacheInvalidator(invalidator)
+}
+
+// EstimateRows returns an estimate of the number of rows of the
+// vindex table. See lookupInternal.EstimateRows for its accuracy.
+func (lu *LookupUnique) EstimateRows(vcursor VCursor) (int64, error) {
+	return lu.lkp.EstimateRows(vcursor)
+}
+
+// Checksum returns a checksum of the rows of the vindex table.
+// See lookupInternal.Checksum for how it's computed.
+func (lu *LookupUnique) Checksum(vcursor VCursor) ([]byte, error) {
+	return lu.lkp.Checksum(vcursor)
+}
+
+// SelfTest reads the vindex table and, if self_test_id is set,
+// creates, verifies and deletes an entry in it.
+func (lu *LookupUnique) SelfTest(vcursor VCursor) error {
+	return selfTest(vcursor, lu, &lu.lkp)
+}
+
+// OnVSchemaReload invalidates the cache of the vindex if its config
+// changed. See VSchemaReloadHook.
+func (lu *LookupUnique) OnVSchemaReload(vcursor VCursor) error {
+	return lu.lkp.OnVSchemaReload(vcursor)
+}
+
+// SelfTestReport runs all the checks of SelfTest, and ValidateIndex,
+// without stopping at the first failure. See SelfTestReporter.
+func (lu *LookupUnique) SelfTestReport(vcursor VCursor) *SelfTestReport {
+	return selfTestReport(vcursor, lu, &lu.lkp, true /* unique */)
+}
+
+// ValidateIndex fails with a *MissingIndexError if the vindex table
+// has no unique index on the from columns, and if an index of
+// index_hint is missing.
+func (lu *LookupUnique) ValidateIndex(vcursor VCursor) error {
+	return lu.lkp.validateIndex(vcursor, true /* unique */)
+}
+
+// ValidateCollation fails with a *CollationError if a from column of
+// the vindex table has a non-binary collation.
+func (lu *LookupUnique) ValidateCollation(vcursor VCursor) error {
+	return lu.lkp.validateCollation(vcursor)
+}
+
+// ValidateCreate checks the rows of a Create without executing it.
+// See lookupInternal.validateCreate.
+func (lu *LookupUnique) ValidateCreate(rowsColValues [][]sqltypes.Value, ksids [][]byte) error {
+	return lu.lkp.validateCreate(rowsColValues, ksids, true /* unique */, nil)
 }
 
 // MarshalJSON returns a JSON representation of LookupUnique.
 func (lu *LookupUnique) MarshalJSON() ([]byte, error) {
-	return json.Marshal(lu.lkp)
+	return lu.lkp.MarshalJSON()
 }
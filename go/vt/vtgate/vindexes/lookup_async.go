@@ -0,0 +1,368 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+// This file contains the write-ahead queue of the lookup vindexes with
+// async_writes, whose Create and Update return once their inserts are
+// queued, and a background worker executes them later. async_writes
+// requires autocommit, whose Delete is a no-op, so there are no queued
+// deletes. The lookup table is then only eventually consistent with
+// the user table: a Map or Verify that follows a Create can miss it.
+
+// defaultAsyncQueueSize is the capacity of the queue of a vindex,
+// unless async_queue_size is set.
+const defaultAsyncQueueSize = 1000
+
+// asyncBatchSize is the maximum number of queued mutations that the
+// worker takes at once. Its consecutive Creates are merged into one
+// insert.
+const asyncBatchSize = 100
+
+var (
+	lookupAsyncQueuesMu sync.Mutex
+	// lookupAsyncQueues contains the queues whose worker is running,
+	// by vindex. It isn't keyed by name, since two keyspaces can have
+	// a vindex of the same name.
+	lookupAsyncQueues = make(map[*lookupInternal]*asyncQueue)
+	// lookupAsyncDrained is set by DrainAsyncWrites, after which the
+	// queues that were not started reject their first mutation.
+	lookupAsyncDrained bool
+	// lookupAsyncVSchemaQueues contains the queues of the vindexes of
+	// the last VSchema passed to NotifyVSchemaReload.
+	lookupAsyncVSchemaQueues = make(map[*asyncQueue]bool)
+
+	// lookupAsyncErrors counts, by vindex, the queued mutations that
+	// failed. They're lost.
+	lookupAsyncErrors = newSinkCounters("VindexLookupAsyncErrors")
+)
+
+func init() {
+	registerLookupGauge("VindexLookupAsyncQueueLength", func() map[string]int64 {
+		lookupAsyncQueuesMu.Lock()
+		defer lookupAsyncQueuesMu.Unlock()
+		counts := make(map[string]int64, len(lookupAsyncQueues))
+		for lkp, q := range lookupAsyncQueues {
+			counts[lkp.name] += int64(len(q.ops))
+		}
+		return counts
+	})
+}
+
+// A DetachableVCursor is a VCursor that can outlive the request it was
+// created for. The lookup vindexes with async_writes detach the VCursor
+// of a mutation, if it implements this interface, before queuing it.
+// Otherwise, the VCursor must remain usable after the mutation returns.
+type DetachableVCursor interface {
+	VCursor
+	// Detach returns a VCursor whose ExecuteAutocommit is not
+	// canceled when the request is done.
+	Detach() VCursor
+}
+
+// DrainAsyncWrites stops accepting new mutations on the lookup vindexes
+// with async_writes, and waits until the worker of each one has
+// executed all the queued ones. It must be called on shutdown, so that
+// no mutation is lost.
+func DrainAsyncWrites() {
+	lookupAsyncQueuesMu.Lock()
+	lookupAsyncDrained = true
+	queues := make([]*asyncQueue, 0, len(lookupAsyncQueues))
+	for _, q := range lookupAsyncQueues {
+		queues = append(queues, q)
+	}
+	lookupAsyncQueuesMu.Unlock()
+	for _, q := range queues {
+		q.Close()
+	}
+}
+
+// asyncOp is a queued Create, or a flush marker if done is set.
+type asyncOp struct {
+	vcursor       VCursor
+	rowsColValues [][]sqltypes.Value
+	toValues      []sqltypes.Value
+	sourcePKs     []sqltypes.Value
+	ignoreMode    bool
+	done          chan struct{}
+}
+
+// asyncQueue is the write-ahead queue of a lookup vindex. Its worker
+// executes the queued mutations in order. It's started by the first
+// mutation, so that the vindexes that are created but never written,
+// like the ones of a VSchema that is only validated, don't have one.
+// When the queue is full, the mutations wait until there's room, or
+// their request is done.
+type asyncQueue struct {
+	lkp *lookupInternal
+	ops chan *asyncOp
+
+	// mu protects started and closed.
+	mu      sync.Mutex
+	started bool
+	closed  bool
+	// senders are the enqueues that wait for room in ops. Close
+	// waits for them before it closes ops.
+	senders sync.WaitGroup
+	// closing is closed by Close, to fail the waiting enqueues.
+	closing chan struct{}
+	stopped chan struct{}
+}
+
+// newAsyncQueue creates the queue of lkp. Its worker is started by
+// the first enqueue.
+func newAsyncQueue(lkp *lookupInternal, size int) *asyncQueue {
+	return &asyncQueue{
+		lkp:     lkp,
+		ops:     make(chan *asyncOp, size),
+		closing: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// retireAsyncQueues closes, in the background, the queues of the
+// vindexes of the previous VSchema passed to NotifyVSchemaReload that
+// vschema doesn't have. A reload creates new vindexes, so these are
+// the queues of the vindexes it replaced or removed.
+func retireAsyncQueues(vschema *VSchema) {
+	current := make(map[*asyncQueue]bool)
+	for _, ks := range vschema.Keyspaces {
+		for _, vindex := range ks.Vindexes {
+			if lkp, err := lookupInternalOf(vindex); err == nil && lkp.async != nil {
+				current[lkp.async] = true
+			}
+		}
+	}
+	lookupAsyncQueuesMu.Lock()
+	previous := lookupAsyncVSchemaQueues
+	lookupAsyncVSchemaQueues = current
+	lookupAsyncQueuesMu.Unlock()
+	for q := range previous {
+		if !current[q] {
+			go q.Close()
+		}
+	}
+}
+
+// enqueueAsync queues op for the worker of lkp, with the VCursor of the
+// request, which is detached from it if it's a DetachableVCursor. If
+// the queue is full, it waits until the request is done.
+func (lkp *lookupInternal) enqueueAsync(vcursor VCursor, op *asyncOp) error {
+	// A nil done never fires.
+	var ctx context.Context
+	var done <-chan struct{}
+	if cvc, ok := vcursor.(ContextVCursor); ok {
+		ctx = cvc.Context()
+		done = ctx.Done()
+	}
+	if detachable, ok := vcursor.(DetachableVCursor); ok {
+		vcursor = detachable.Detach()
+	}
+	op.vcursor = vcursor
+	if err := lkp.async.enqueue(op, done); err != nil {
+		if err == errAsyncQueueFull {
+			return fmt.Errorf("lookup.Create: gave up waiting for room in the async writes queue of vindex %s: %v", lkp.name, ctx.Err())
+		}
+		return fmt.Errorf("lookup.Create: %v", err)
+	}
+	return nil
+}
+
+// errAsyncQueueFull is returned by enqueue if done fires while the
+// queue is full.
+var errAsyncQueueFull = errors.New("async writes queue is full")
+
+// enqueue queues op, starting the worker if it's the first one. It
+// fails if the queue is closed, or if done fires while the queue
+// is full.
+func (q *asyncQueue) enqueue(op *asyncOp, done <-chan struct{}) error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return fmt.Errorf("async writes of vindex %s are closed", q.lkp.name)
+	}
+	if !q.started {
+		if err := q.start(); err != nil {
+			q.mu.Unlock()
+			return err
+		}
+	}
+	q.senders.Add(1)
+	q.mu.Unlock()
+	defer q.senders.Done()
+
+	select {
+	case q.ops <- op:
+		return nil
+	case <-q.closing:
+		return fmt.Errorf("async writes of vindex %s are closed", q.lkp.name)
+	case <-done:
+		return errAsyncQueueFull
+	}
+}
+
+// start registers the queue and starts its worker, unless
+// DrainAsyncWrites was called. q.mu must be held.
+func (q *asyncQueue) start() error {
+	lookupAsyncQueuesMu.Lock()
+	defer lookupAsyncQueuesMu.Unlock()
+	if lookupAsyncDrained {
+		return fmt.Errorf("async writes of vindex %s are closed", q.lkp.name)
+	}
+	lookupAsyncQueues[q.lkp] = q
+	q.started = true
+	go q.run()
+	return nil
+}
+
+// Flush waits until the worker has executed the mutations that were
+// queued before it was called. It returns right away if the queue
+// is closed, since Close already waits for them, or was never used.
+func (q *asyncQueue) Flush() {
+	q.mu.Lock()
+	started := q.started
+	q.mu.Unlock()
+	if !started {
+		return
+	}
+	done := make(chan struct{})
+	if err := q.enqueue(&asyncOp{done: done}, nil); err != nil {
+		<-q.stopped
+		return
+	}
+	<-done
+}
+
+// Close stops accepting new mutations, and waits until the worker has
+// executed the queued ones. The mutations that are waiting for room in
+// the queue fail.
+func (q *asyncQueue) Close() {
+	q.mu.Lock()
+	first := !q.closed
+	q.closed = true
+	started := q.started
+	q.mu.Unlock()
+	if first {
+		close(q.closing)
+		// Once the waiting enqueues are gone, no one sends to ops.
+		q.senders.Wait()
+		close(q.ops)
+		if !started {
+			close(q.stopped)
+		}
+	}
+	<-q.stopped
+
+	lookupAsyncQueuesMu.Lock()
+	delete(lookupAsyncQueues, q.lkp)
+	lookupAsyncQueuesMu.Unlock()
+}
+
+// apply executes the queued Create op, in one of the mutation slots of
+// the vindex. A failed op is logged and counted in
+// VindexLookupAsyncErrors, since its caller is gone.
+func (q *asyncQueue) apply(op *asyncOp) {
+	release, err := q.lkp.acquireMutation(op.vcursor, "Create")
+	if err == nil {
+		_, err = q.lkp.create(op.vcursor, op.rowsColValues, op.toValues, op.sourcePKs, op.ignoreMode)
+		release()
+	}
+	if err != nil {
+		lookupAsyncErrors.Add(q.lkp.name, 1)
+		log.Errorf("async Create of %d rows in vindex %s failed, the rows are lost: %v", len(op.rowsColValues), q.lkp.name, err)
+	}
+}
+
+// run executes the queued ops until the queue is closed. It takes the
+// ops that are already queued along with the first one, up to
+// asyncBatchSize, so that it can merge them into fewer inserts.
+func (q *asyncQueue) run() {
+	defer close(q.stopped)
+	for op := range q.ops {
+		batch := []*asyncOp{op}
+	fill:
+		for len(batch) < asyncBatchSize {
+			select {
+			case op, ok := <-q.ops:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, op)
+			default:
+				break fill
+			}
+		}
+		q.execute(batch)
+	}
+}
+
+// execute executes the ops of batch in order. Consecutive Creates with
+// the same VCursor and options are merged into one.
+func (q *asyncQueue) execute(batch []*asyncOp) {
+	var merged *asyncOp
+	flush := func() {
+		if merged == nil {
+			return
+		}
+		q.apply(merged)
+		merged = nil
+	}
+	for _, op := range batch {
+		if op.done != nil {
+			flush()
+			close(op.done)
+			continue
+		}
+		if merged != nil && sameVCursor(merged.vcursor, op.vcursor) && merged.ignoreMode == op.ignoreMode && (merged.sourcePKs == nil) == (op.sourcePKs == nil) {
+			merged.rowsColValues = append(merged.rowsColValues, op.rowsColValues...)
+			merged.toValues = append(merged.toValues, op.toValues...)
+			if op.sourcePKs != nil {
+				merged.sourcePKs = append(merged.sourcePKs, op.sourcePKs...)
+			}
+			continue
+		}
+		flush()
+		// The op is copied, since merging appends to its slices.
+		merged = &asyncOp{
+			vcursor:       op.vcursor,
+			rowsColValues: append([][]sqltypes.Value(nil), op.rowsColValues...),
+			toValues:      append([]sqltypes.Value(nil), op.toValues...),
+			ignoreMode:    op.ignoreMode,
+		}
+		if op.sourcePKs != nil {
+			merged.sourcePKs = append([]sqltypes.Value{}, op.sourcePKs...)
+		}
+	}
+	flush()
+}
+
+// sameVCursor returns true if a and b are the same VCursor. Unlike ==,
+// it doesn't panic if they have the same type and it's not comparable.
+func sameVCursor(a, b VCursor) bool {
+	return reflect.TypeOf(a) == reflect.TypeOf(b) && reflect.TypeOf(a).Comparable() && a == b
+}
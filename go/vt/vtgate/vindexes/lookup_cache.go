@@ -0,0 +1,268 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/sync2"
+)
+
+// Reasons for which an entry gets evicted from a lookupCache.
+// They're used as the "Reason" label of VindexLookupCacheEvictions.
+const (
+	evictTTL        = "TTL"
+	evictSize       = "Size"
+	evictGeneration = "Generation"
+)
+
+// Per-entry and per-value overheads used for estimating the
+// memory used by a lookupCache.
+const (
+	cacheEntryOverhead = 64
+	cacheValueOverhead = 16
+)
+
+var (
+	lookupCachesMu sync.Mutex
+	// lookupCaches contains the live caches by vindex name.
+	lookupCaches = make(map[string]*lookupCache)
+
+	// lookupCacheEvictions counts the evicted entries by vindex and reason.
+	lookupCacheEvictions = newSinkMultiCounters("VindexLookupCacheEvictions", []string{"Vindex", "Reason"})
+
+	// lookupCacheGeneration is the current generation of the lookup
+	// caches. Entries cached in an older generation are stale.
+	lookupCacheGeneration sync2.AtomicInt64
+)
+
+// BumpLookupCacheGeneration invalidates the entries of all the lookup
+// vindex caches. It must be called when the VSchema is reloaded, since
+// the table or columns of a vindex may have changed. Stale entries are
+// not removed right away, but dropped when they're next read or evicted.
+func BumpLookupCacheGeneration() {
+	lookupCacheGeneration.Add(1)
+}
+
+func init() {
+	registerLookupGauge("VindexLookupCacheEntries", func() map[string]int64 {
+		return lookupCacheCounts((*lookupCache).Len)
+	})
+	registerLookupGauge("VindexLookupCacheBytes", func() map[string]int64 {
+		return lookupCacheCounts((*lookupCache).Bytes)
+	})
+}
+
+func lookupCacheCounts(f func(*lookupCache) int64) map[string]int64 {
+	lookupCachesMu.Lock()
+	defer lookupCachesMu.Unlock()
+	counts := make(map[string]int64, len(lookupCaches))
+	for name, c := range lookupCaches {
+		counts[name] = f(c)
+	}
+	return counts
+}
+
+// lookupCache is an LRU cache of lookup results keyed by the from
+// value. Entries are evicted when they're older than ttl, or when
+// the cache grows beyond capacity. Since other vtgates can modify
+// the lookup table, cached results can be stale for up to ttl.
+type lookupCache struct {
+	name     string
+	capacity int
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu sync.Mutex
+	// order has the most recently used entries at the front.
+	order   *list.List
+	entries map[string]*list.Element
+	bytes   int64
+	// hits, misses and evictions are the counts reported by
+	// LookupCacheStats.
+	hits      int64
+	misses    int64
+	evictions int64
+	// generation is bumped by bumpGeneration to invalidate the entries
+	// of this cache only. See currentGeneration.
+	generation sync2.AtomicInt64
+}
+
+type cacheEntry struct {
+	key    string
+	result *sqltypes.Result
+	// expires is the zero time if the entry doesn't expire.
+	expires    time.Time
+	size       int64
+	generation int64
+}
+
+// newLookupCache creates a lookupCache for the named vindex and
+// registers it for the cache stats, replacing any previous cache
+// of the same name. A zero ttl means that entries don't expire.
+func newLookupCache(name string, capacity int, ttl time.Duration) *lookupCache {
+	c := &lookupCache{
+		name:     name,
+		capacity: capacity,
+		ttl:      ttl,
+		now:      time.Now,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+	lookupCachesMu.Lock()
+	lookupCaches[name] = c
+	lookupCachesMu.Unlock()
+	return c
+}
+
+// Get returns the cached result for key, if there is one.
+// The returned result must not be modified.
+func (c *lookupCache) Get(key string) (*sqltypes.Result, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if entry.generation != c.currentGeneration() {
+		c.remove(elem, evictGeneration)
+		c.misses++
+		return nil, false
+	}
+	if !entry.expires.IsZero() && !c.now().Before(entry.expires) {
+		c.remove(elem, evictTTL)
+		c.misses++
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	c.hits++
+	return entry.result, true
+}
+
+// Set caches result for key, evicting the least recently
+// used entries if the cache is full.
+func (c *lookupCache) Set(key string, result *sqltypes.Result) {
+	c.SetWithTTL(key, result, c.ttl)
+}
+
+// SetWithTTL is like Set, but the entry expires after ttl instead of
+// the ttl of the cache. A zero ttl means that it doesn't expire.
+func (c *lookupCache) SetWithTTL(key string, result *sqltypes.Result, ttl time.Duration) {
+	c.setAt(key, result, ttl, c.currentGeneration())
+}
+
+// setAt is like SetWithTTL, but result was read in generation, as
+// returned by currentGeneration before the read. It's dropped if the
+// generation changed since, so that a read that raced with a bump
+// doesn't cache a stale result.
+func (c *lookupCache) setAt(key string, result *sqltypes.Result, ttl time.Duration, generation int64) {
+	entry := &cacheEntry{
+		key:        key,
+		result:     result,
+		size:       resultSize(key, result),
+		generation: generation,
+	}
+	if ttl != 0 {
+		entry.expires = c.now().Add(ttl)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.currentGeneration() {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem, "")
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	c.bytes += entry.size
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back(), evictSize)
+	}
+}
+
+// Delete removes the entry for key. It's not counted as an eviction.
+func (c *lookupCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem, "")
+	}
+}
+
+// currentGeneration returns the generation of the entries that are
+// not stale. It changes when either BumpLookupCacheGeneration or
+// bumpGeneration is called: both counters only grow, so their sum
+// never returns to a previous value.
+func (c *lookupCache) currentGeneration() int64 {
+	return lookupCacheGeneration.Get() + c.generation.Get()
+}
+
+// bumpGeneration invalidates the entries of the cache, like
+// BumpLookupCacheGeneration does for all the caches.
+func (c *lookupCache) bumpGeneration() {
+	c.generation.Add(1)
+}
+
+// Clear removes all the entries. It's not counted as evictions.
+func (c *lookupCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+	c.bytes = 0
+}
+
+// Len returns the number of cached entries.
+func (c *lookupCache) Len() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int64(c.order.Len())
+}
+
+// Bytes returns an estimate of the memory used by the cached entries.
+func (c *lookupCache) Bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+// remove must be called with mu held. If reason is set,
+// the removal is counted as an eviction.
+func (c *lookupCache) remove(elem *list.Element, reason string) {
+	entry := c.order.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+	if reason != "" {
+		c.evictions++
+		lookupCacheEvictions.Add([]string{c.name, reason}, 1)
+	}
+}
+
+func resultSize(key string, result *sqltypes.Result) int64 {
+	size := int64(cacheEntryOverhead + len(key))
+	for _, row := range result.Rows {
+		for _, v := range row {
+			size += int64(cacheValueOverhead + v.Len())
+		}
+	}
+	return size
+}
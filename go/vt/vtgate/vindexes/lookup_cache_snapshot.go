@@ -0,0 +1,239 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/youtube/vitess/go/sqltypes"
+
+	querypb "github.com/youtube/vitess/go/vt/proto/query"
+)
+
+// This file contains the snapshots of the lookup caches, which let a
+// vtgate that restarts gracefully hand its warm caches over to the new
+// process. A snapshot is a stream of JSON objects: a header, followed
+// by the entries from the most to the least recently used.
+
+// lookupCacheSnapshotVersion is the version of the snapshot format.
+// It must be incremented when the format changes.
+const lookupCacheSnapshotVersion = 1
+
+// cacheSnapshotHeader describes the vindex whose cache was saved.
+// A snapshot is only restored into a vindex with the same header,
+// since the cached rows depend on its table and columns, and are
+// decoded with its ksid_encoding.
+type cacheSnapshotHeader struct {
+	Version      int      `json:"version"`
+	Table        string   `json:"table"`
+	FromColumns  []string `json:"from_columns"`
+	To           string   `json:"to"`
+	KsidEncoding string   `json:"ksid_encoding,omitempty"`
+	ToHash       bool     `json:"to_hash,omitempty"`
+}
+
+type cacheSnapshotEntry struct {
+	Key string `json:"key"`
+	// Expires is the zero time if the entry doesn't expire.
+	Expires time.Time              `json:"expires"`
+	Fields  []cacheSnapshotField   `json:"fields,omitempty"`
+	Rows    [][]cacheSnapshotValue `json:"rows"`
+}
+
+type cacheSnapshotField struct {
+	Name string       `json:"name"`
+	Type querypb.Type `json:"type"`
+}
+
+// cacheSnapshotValue is a value of a cached row. Its bytes are in
+// Value, or in Hex if the vindex has json_hex.
+type cacheSnapshotValue struct {
+	Type  querypb.Type `json:"type"`
+	Value []byte       `json:"value,omitempty"`
+	Hex   string       `json:"hex,omitempty"`
+}
+
+func (lkp *lookupInternal) snapshotHeader() *cacheSnapshotHeader {
+	return &cacheSnapshotHeader{
+		Version:      lookupCacheSnapshotVersion,
+		Table:        lkp.Table,
+		FromColumns:  lkp.FromColumns,
+		To:           lkp.To,
+		KsidEncoding: lkp.KsidEncoding,
+		ToHash:       lkp.ToHash,
+	}
+}
+
+// SnapshotCache writes the cached lookup results to w, so that
+// RestoreCache can load them into the cache of the same vindex in
+// another process. It fails if the vindex has no cache_size. With
+// JSONHex, the values are written as hex strings. RestoreCache reads
+// both, so json_hex can be changed across a restart.
+func (lkp *lookupInternal) SnapshotCache(w io.Writer) error {
+	if lkp.cache == nil {
+		return fmt.Errorf("lookup.SnapshotCache: vindex %s has no cache", lkp.name)
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(lkp.snapshotHeader()); err != nil {
+		return fmt.Errorf("lookup.SnapshotCache: %v", err)
+	}
+	for _, entry := range lkp.cache.snapshot() {
+		if lkp.JSONHex {
+			for _, values := range entry.Rows {
+				for i := range values {
+					values[i].Hex = hex.EncodeToString(values[i].Value)
+					values[i].Value = nil
+				}
+			}
+		}
+		if err := enc.Encode(entry); err != nil {
+			return fmt.Errorf("lookup.SnapshotCache: %v", err)
+		}
+	}
+	return nil
+}
+
+// RestoreCache loads a snapshot written by SnapshotCache into the
+// cache, and returns the number of entries it added. The snapshot is
+// discarded if it has another format version, or was taken for a
+// vindex with another table, columns or encoding. Expired entries are
+// skipped, and the entries that are already cached are kept, since
+// they're more recent. Like the other entries of the cache, restored
+// entries can be stale for up to cache_ttl.
+func (lkp *lookupInternal) RestoreCache(r io.Reader) (int, error) {
+	if lkp.cache == nil {
+		return 0, fmt.Errorf("lookup.RestoreCache: vindex %s has no cache", lkp.name)
+	}
+	dec := json.NewDecoder(r)
+	header := &cacheSnapshotHeader{}
+	if err := dec.Decode(header); err != nil {
+		return 0, fmt.Errorf("lookup.RestoreCache: cannot read header: %v", err)
+	}
+	if header.Version != lookupCacheSnapshotVersion {
+		return 0, fmt.Errorf("lookup.RestoreCache: snapshot has version %d, want %d", header.Version, lookupCacheSnapshotVersion)
+	}
+	if want := lkp.snapshotHeader(); !reflect.DeepEqual(header, want) {
+		return 0, fmt.Errorf("lookup.RestoreCache: snapshot is for %+v, incompatible with vindex %s: %+v", *header, lkp.name, *want)
+	}
+	var entries []*cacheSnapshotEntry
+	for {
+		entry := &cacheSnapshotEntry{}
+		err := dec.Decode(entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("lookup.RestoreCache: cannot read entry %d: %v", len(entries), err)
+		}
+		for _, values := range entry.Rows {
+			for i := range values {
+				if values[i].Hex == "" {
+					continue
+				}
+				if values[i].Value, err = hex.DecodeString(values[i].Hex); err != nil {
+					return 0, fmt.Errorf("lookup.RestoreCache: cannot read entry %d: %v", len(entries), err)
+				}
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return lkp.cache.restore(entries), nil
+}
+
+// snapshot returns the current entries, from the most to the least
+// recently used. Stale entries are skipped.
+func (c *lookupCache) snapshot() []*cacheSnapshotEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	generation := c.currentGeneration()
+	entries := make([]*cacheSnapshotEntry, 0, c.order.Len())
+	for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*cacheEntry)
+		if entry.generation != generation || (!entry.expires.IsZero() && !now.Before(entry.expires)) {
+			continue
+		}
+		se := &cacheSnapshotEntry{Key: entry.key, Expires: entry.expires}
+		for _, field := range entry.result.Fields {
+			se.Fields = append(se.Fields, cacheSnapshotField{Name: field.Name, Type: field.Type})
+		}
+		se.Rows = make([][]cacheSnapshotValue, 0, len(entry.result.Rows))
+		for _, row := range entry.result.Rows {
+			values := make([]cacheSnapshotValue, 0, len(row))
+			for _, v := range row {
+				values = append(values, cacheSnapshotValue{Type: v.Type(), Value: v.Raw()})
+			}
+			se.Rows = append(se.Rows, values)
+		}
+		entries = append(entries, se)
+	}
+	return entries
+}
+
+// restore adds the entries, which are ordered from the most to the
+// least recently used, behind the current ones, up to the capacity.
+// An entry keeps its expiration time. An entry that didn't expire gets
+// the ttl of the cache. It returns the number of entries added.
+func (c *lookupCache) restore(entries []*cacheSnapshotEntry) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	generation := c.currentGeneration()
+	added := 0
+	for _, se := range entries {
+		if c.order.Len() >= c.capacity {
+			break
+		}
+		if _, ok := c.entries[se.Key]; ok {
+			continue
+		}
+		expires := se.Expires
+		if expires.IsZero() && c.ttl != 0 {
+			expires = now.Add(c.ttl)
+		}
+		if !expires.IsZero() && !now.Before(expires) {
+			continue
+		}
+		result := &sqltypes.Result{RowsAffected: uint64(len(se.Rows))}
+		for _, field := range se.Fields {
+			result.Fields = append(result.Fields, &querypb.Field{Name: field.Name, Type: field.Type})
+		}
+		for _, values := range se.Rows {
+			row := make([]sqltypes.Value, 0, len(values))
+			for _, v := range values {
+				row = append(row, sqltypes.MakeTrusted(v.Type, v.Value))
+			}
+			result.Rows = append(result.Rows, row)
+		}
+		entry := &cacheEntry{
+			key:        se.Key,
+			result:     result,
+			expires:    expires,
+			size:       resultSize(se.Key, result),
+			generation: generation,
+		}
+		c.entries[se.Key] = c.order.PushBack(entry)
+		c.bytes += entry.size
+		added++
+	}
+	return added
+}
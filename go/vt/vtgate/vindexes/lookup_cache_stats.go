@@ -0,0 +1,74 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import "sort"
+
+// CacheStats are the runtime stats of the cache of a lookup vindex.
+// The counts start when the cache is created, which a VSchema reload
+// does again, and are not reset by the Reset of the vindex.
+type CacheStats struct {
+	Vindex   string
+	Capacity int
+	Entries  int64
+	Bytes    int64
+	Hits     int64
+	Misses   int64
+	// Evictions counts the entries dropped because they expired, went
+	// stale, or didn't fit. Deletes by Create, Update and Delete are
+	// not evictions.
+	Evictions int64
+	// HitRatio is Hits / (Hits + Misses), or 0 if there was no lookup.
+	HitRatio float64
+}
+
+// LookupCacheStats returns the stats of the caches of the lookup
+// vindexes, sorted by vindex. It only takes the lock of each cache
+// long enough to copy its counts, so it's cheap enough to serve live.
+func LookupCacheStats() []*CacheStats {
+	lookupCachesMu.Lock()
+	caches := make([]*lookupCache, 0, len(lookupCaches))
+	for _, c := range lookupCaches {
+		caches = append(caches, c)
+	}
+	lookupCachesMu.Unlock()
+
+	stats := make([]*CacheStats, 0, len(caches))
+	for _, c := range caches {
+		stats = append(stats, c.stats())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Vindex < stats[j].Vindex })
+	return stats
+}
+
+func (c *lookupCache) stats() *CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := &CacheStats{
+		Vindex:    c.name,
+		Capacity:  c.capacity,
+		Entries:   int64(c.order.Len()),
+		Bytes:     c.bytes,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+	if lookups := c.hits + c.misses; lookups != 0 {
+		s.HitRatio = float64(c.hits) / float64(lookups)
+	}
+	return s
+}
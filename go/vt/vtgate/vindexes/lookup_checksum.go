@@ -0,0 +1,83 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+// checksumBatchSize is the number of rows that Checksum reads at a
+// time.
+const checksumBatchSize = 1000
+
+// nullLength is the length that Checksum writes for a NULL value.
+const nullLength = ^uint64(0)
+
+// Checksum returns a checksum of all the rows of the table, to check
+// that two copies of it, like in two environments, are in sync without
+// diffing them. Two tables with the same rows have the same checksum,
+// whatever their physical order.
+//
+// The rows are read in batches, ordered by the first from column and
+// the to column, like by DiffLookups, so the order only depends on the
+// values and the collation of the columns. The checksum is the SHA-256
+// of the rows in that order, where each row is written as its from
+// value followed by its to value, and each value as its length, as an
+// 8 byte big endian integer, followed by its bytes. A NULL is written
+// as the length 2^64-1 and no bytes. The other from columns, and the
+// types of the values, are not part of the checksum.
+//
+// The to value is the keyspace id as stored in the table, so the tables
+// of two vindexes that have a different ksid_codec, or of which only one
+// has to_hash, have different checksums. Rows that change during the
+// scan may or may not be part of the checksum, so it should only be
+// compared for tables that are not being written.
+func (lkp *lookupInternal) Checksum(vcursor VCursor) ([]byte, error) {
+	h := sha256.New()
+	scanner := newLookupScanner(vcursor, lkp, checksumBatchSize)
+	for {
+		row, err := scanner.peek()
+		if err != nil {
+			return nil, fmt.Errorf("lookup.Checksum: %v", err)
+		}
+		if row == nil {
+			return h.Sum(nil), nil
+		}
+		checksumValue(h, row[0])
+		checksumValue(h, row[1])
+		scanner.next()
+	}
+}
+
+// checksumValue writes v to h for Checksum.
+func checksumValue(h io.Writer, v sqltypes.Value) {
+	var length [8]byte
+	if v.IsNull() {
+		binary.BigEndian.PutUint64(length[:], nullLength)
+		h.Write(length[:])
+		return
+	}
+	raw := v.Raw()
+	binary.BigEndian.PutUint64(length[:], uint64(len(raw)))
+	h.Write(length[:])
+	h.Write(raw)
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/youtube/vitess/go/vt/proto/topodata"
+)
+
+// coalesceKsids returns the keyrange that contains exactly ksids among
+// the keyspace ids of their length, if there are at least two of them,
+// they all have the same length, and, once sorted and without
+// duplicates, each one is the next of the previous one as a big-endian
+// number. It returns nil otherwise. A Ksids can only hold one keyrange,
+// so keyspace ids that form several runs are not coalesced.
+func coalesceKsids(ksids [][]byte) *topodata.KeyRange {
+	if len(ksids) < 2 {
+		return nil
+	}
+	sorted := make([][]byte, 0, len(ksids))
+	for _, ksid := range ksids {
+		if len(ksid) == 0 || len(ksid) != len(ksids[0]) {
+			return nil
+		}
+		sorted = append(sorted, ksid)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+	last := sorted[0]
+	for _, ksid := range sorted[1:] {
+		if bytes.Equal(ksid, last) {
+			continue
+		}
+		if next := nextKsid(last); next == nil || !bytes.Equal(ksid, next) {
+			return nil
+		}
+		last = ksid
+	}
+	// The End of the last keyrange is empty, which means unbounded.
+	return &topodata.KeyRange{Start: sorted[0], End: nextKsid(last)}
+}
+
+// nextKsid returns the keyspace id that follows ksid among the ones of
+// its length, or nil if ksid is the last one, all 0xff.
+func nextKsid(ksid []byte) []byte {
+	next := make([]byte, len(ksid))
+	copy(next, ksid)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
+	}
+	return nil
+}
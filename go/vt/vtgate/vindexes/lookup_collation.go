@@ -0,0 +1,125 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/golang/glog"
+
+	"github.com/youtube/vitess/go/sqltypes"
+
+	querypb "github.com/youtube/vitess/go/vt/proto/query"
+)
+
+var (
+	_ CollationValidator = (*LookupNonUnique)(nil)
+	_ CollationValidator = (*LookupUnique)(nil)
+	_ CollationValidator = (*LookupHash)(nil)
+	_ CollationValidator = (*LookupHashUnique)(nil)
+)
+
+// CollationValidator is implemented by the vindexes that can check
+// that the collation of the from columns of their backing table
+// matches values the way the vindex does.
+type CollationValidator interface {
+	ValidateCollation(vcursor VCursor) error
+}
+
+const fromCollationsQuery = "select column_name, collation_name from information_schema.columns where table_schema = database() and table_name = :table_name"
+
+// CollationError is returned by ValidateCollation if from columns of
+// the vindex table have a collation that compares values differently
+// than the vindex. The vindex matches values byte for byte in its cache,
+// its full scans and its from lists, while MySQL matches them with the
+// collation of the column. With a case-insensitive collation, a Map of
+// 'a' then returns the keyspace ids of 'A', unless it hits the cache.
+type CollationError struct {
+	Vindex string
+	Table  string
+	// Columns are the from columns that have a non-binary collation,
+	// and Collations their collations.
+	Columns    []string
+	Collations []string
+}
+
+func (e *CollationError) Error() string {
+	columns := make([]string, len(e.Columns))
+	for i, column := range e.Columns {
+		columns[i] = column + " " + e.Collations[i]
+	}
+	return fmt.Sprintf("lookup.ValidateCollation: table %s of vindex %s has from columns with a non-binary collation, which matches values that the vindex tells apart: %s; want binary or a _bin collation", e.Table, e.Vindex, strings.Join(columns, ", "))
+}
+
+// validateCollation reads the collations of the from columns from
+// information_schema, with the same limitations as EstimateRows. It
+// fails with a *CollationError if one of them is not binary. Columns
+// that are not strings, and have no collation, match byte for byte.
+func (lkp *lookupInternal) validateCollation(vcursor VCursor) error {
+	bindVars := map[string]*querypb.BindVariable{
+		"table_name": sqltypes.StringBindVariable(unqualifiedTable(lkp.Table)),
+	}
+	result, err := lkp.executeRead(vcursor, "VindexValidateCollation", fromCollationsQuery, bindVars, false /* isDML */)
+	if err != nil {
+		return fmt.Errorf("lookup.ValidateCollation: %v", err)
+	}
+	if err := lkp.checkRows(result, 2); err != nil {
+		return fmt.Errorf("lookup.ValidateCollation: %v", err)
+	}
+	collations := make(map[string]sqltypes.Value, len(result.Rows))
+	for _, row := range result.Rows {
+		collations[strings.ToLower(row[0].ToString())] = row[1]
+	}
+	e := &CollationError{Vindex: lkp.name, Table: lkp.Table}
+	for _, from := range lkp.FromColumns {
+		collation, ok := collations[strings.ToLower(from)]
+		if !ok {
+			return fmt.Errorf("lookup.ValidateCollation: table %s not found or has no column %s", lkp.Table, from)
+		}
+		if collation.IsNull() || isBinaryCollation(collation.ToString()) {
+			continue
+		}
+		e.Columns = append(e.Columns, from)
+		e.Collations = append(e.Collations, collation.ToString())
+	}
+	if len(e.Columns) != 0 {
+		return e
+	}
+	return nil
+}
+
+// checkCollation runs validateCollation for SelfTest if CollationCheck
+// is set. With "warn", it only logs the error.
+func (lkp *lookupInternal) checkCollation(vcursor VCursor) error {
+	if lkp.CollationCheck == "" {
+		return nil
+	}
+	err := lkp.validateCollation(vcursor)
+	if err != nil && lkp.CollationCheck == "warn" {
+		log.Warningf("%v", err)
+		return nil
+	}
+	return err
+}
+
+// isBinaryCollation returns true if collation compares strings byte
+// for byte, or as their code points.
+func isBinaryCollation(collation string) bool {
+	collation = strings.ToLower(collation)
+	return collation == "binary" || strings.HasSuffix(collation, "_bin")
+}
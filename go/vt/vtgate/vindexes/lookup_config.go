@@ -0,0 +1,59 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import "fmt"
+
+// LookupConfigProvider supplies the params of lookup vindexes,
+// like table, from, to and the options, for the deployments
+// that keep them in an external config service.
+type LookupConfigProvider interface {
+	// LookupConfig returns the params of the named vindex.
+	// The returned map must not be modified afterwards.
+	LookupConfig(name string) (map[string]string, error)
+}
+
+// MapLookupConfigProvider is a LookupConfigProvider that returns
+// the params stored for each vindex name. It's equivalent to passing
+// the params to CreateVindex directly.
+type MapLookupConfigProvider map[string]map[string]string
+
+// LookupConfig is part of the LookupConfigProvider interface.
+func (p MapLookupConfigProvider) LookupConfig(name string) (map[string]string, error) {
+	params, ok := p[name]
+	if !ok {
+		return nil, fmt.Errorf("no params for vindex %s", name)
+	}
+	return params, nil
+}
+
+// CreateLookupFromProvider creates a lookup vindex of the specified
+// type, which must be one of the lookup types, with the params that
+// provider returns for name. The provider is only consulted here, so
+// the vindex then behaves exactly as if it was created from a map.
+func CreateLookupFromProvider(vindexType, name string, provider LookupConfigProvider) (Vindex, error) {
+	switch vindexType {
+	case "lookup", "lookup_unique", "lookup_hash", "lookup_hash_unique":
+	default:
+		return nil, fmt.Errorf("vindexType %q is not a lookup vindex", vindexType)
+	}
+	params, err := provider.LookupConfig(name)
+	if err != nil {
+		return nil, fmt.Errorf("lookup config for vindex %s: %v", name, err)
+	}
+	return CreateVindex(vindexType, name, params)
+}
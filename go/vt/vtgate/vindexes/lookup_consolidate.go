@@ -0,0 +1,48 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+// lookupConsolidations counts, by vindex, the lookups that waited for
+// the query of a concurrent lookup of the same id instead of executing
+// their own.
+var lookupConsolidations = newSinkCounters("VindexLookupConsolidations")
+
+// consolidatedFetchOne is like fetchOne, but if a lookup of the same
+// key is already executing, it waits for it and returns its result or
+// error instead of querying the table, like the query consolidator of
+// vttablet. The first lookup caches its result before it releases the
+// others, and the lookups that arrive once it's done execute a new
+// query or hit the cache, rather than waiting.
+func (lkp *lookupInternal) consolidatedFetchOne(vcursor VCursor, key string, id sqltypes.Value) (*sqltypes.Result, error) {
+	r, created := lkp.consolidator.Create(key)
+	if !created {
+		lookupConsolidations.Add(lkp.name, 1)
+		r.Wait()
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		return r.Result.(*sqltypes.Result), nil
+	}
+	defer r.Broadcast()
+	result, err := lkp.fetchOne(vcursor, key, id)
+	r.Result, r.Err = result, err
+	return result, err
+}
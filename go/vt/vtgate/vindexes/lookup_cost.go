@@ -0,0 +1,126 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultAdaptiveCostUnit is the latency of one unit of adaptive
+	// cost, unless adaptive_cost_unit is set.
+	defaultAdaptiveCostUnit = time.Millisecond
+	// defaultAdaptiveCostSmoothing is the weight of a new latency
+	// sample, unless adaptive_cost_smoothing is set.
+	defaultAdaptiveCostSmoothing = 0.2
+)
+
+// adaptiveCost derives the cost of a vindex from an exponentially
+// weighted moving average (EWMA) of the latency of its lookups.
+type adaptiveCost struct {
+	// min is 0 for the static cost of the vindex.
+	min, max  int
+	unit      time.Duration
+	smoothing float64
+
+	mu      sync.Mutex
+	sampled bool
+	// latency is the EWMA, in nanoseconds.
+	latency float64
+}
+
+// adaptiveCostFromMap returns the adaptiveCost configured by the
+// adaptive_cost params of m, or nil if adaptive_cost is not set.
+func adaptiveCostFromMap(m map[string]string) (*adaptiveCost, error) {
+	enabled, err := boolFromMap(m, "adaptive_cost")
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		for _, param := range []string{"adaptive_cost_min", "adaptive_cost_max", "adaptive_cost_unit", "adaptive_cost_smoothing"} {
+			if _, ok := m[param]; ok {
+				return nil, fmt.Errorf("%s requires adaptive_cost", param)
+			}
+		}
+		return nil, nil
+	}
+	ac := &adaptiveCost{
+		max:       defaultWriteOnlyCost,
+		unit:      defaultAdaptiveCostUnit,
+		smoothing: defaultAdaptiveCostSmoothing,
+	}
+	if ac.min, err = intFromMap(m, "adaptive_cost_min"); err != nil {
+		return nil, err
+	}
+	if _, ok := m["adaptive_cost_max"]; ok {
+		if ac.max, err = intFromMap(m, "adaptive_cost_max"); err != nil {
+			return nil, err
+		}
+	}
+	if ac.min < 0 || ac.max < ac.min {
+		return nil, fmt.Errorf("adaptive_cost_min and adaptive_cost_max must satisfy 0 <= min <= max: %d, %d", ac.min, ac.max)
+	}
+	if unit := m["adaptive_cost_unit"]; unit != "" {
+		if ac.unit, err = time.ParseDuration(unit); err != nil || ac.unit <= 0 {
+			return nil, fmt.Errorf("adaptive_cost_unit value must be a positive duration: '%s'", unit)
+		}
+	}
+	if smoothing := m["adaptive_cost_smoothing"]; smoothing != "" {
+		if ac.smoothing, err = strconv.ParseFloat(smoothing, 64); err != nil || ac.smoothing <= 0 || ac.smoothing > 1 {
+			return nil, fmt.Errorf("adaptive_cost_smoothing value must be a number in (0, 1]: '%s'", smoothing)
+		}
+	}
+	return ac, nil
+}
+
+// record adds a latency sample to the EWMA.
+func (ac *adaptiveCost) record(latency time.Duration) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if !ac.sampled {
+		ac.sampled = true
+		ac.latency = float64(latency)
+		return
+	}
+	ac.latency = ac.smoothing*float64(latency) + (1-ac.smoothing)*ac.latency
+}
+
+// cost returns the EWMA in units, clamped to [min, max], or static
+// before the first sample. A zero min is the static cost.
+func (ac *adaptiveCost) cost(static int) int {
+	ac.mu.Lock()
+	sampled, latency := ac.sampled, ac.latency
+	ac.mu.Unlock()
+	if !sampled {
+		return static
+	}
+	min := ac.min
+	if min == 0 {
+		min = static
+	}
+	cost := int(latency / float64(ac.unit))
+	if cost < min {
+		cost = min
+	}
+	if cost > ac.max {
+		cost = ac.max
+	}
+	return cost
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"fmt"
+
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+var (
+	_ MutationCounter = (*LookupNonUnique)(nil)
+	_ MutationCounter = (*LookupUnique)(nil)
+	_ MutationCounter = (*LookupHash)(nil)
+	_ MutationCounter = (*LookupHashUnique)(nil)
+)
+
+// MutationCounter is implemented by the vindexes whose Create, Update
+// and Delete can return the number of rows they affected in the table,
+// for tools that reconcile the expected and actual changes of a
+// backfill.
+type MutationCounter interface {
+	CreateWithCount(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksids [][]byte, ignoreMode bool) (uint64, error)
+	UpdateWithCount(vcursor VCursor, oldValues []sqltypes.Value, ksid []byte, newValues []sqltypes.Value) (uint64, error)
+	DeleteWithCount(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksid []byte) (uint64, error)
+}
+
+// CreateWithCount is like Create, but it returns the sum of the rows
+// affected reported by MySQL for its inserts, as is. An upsert counts
+// 2 for a row it updated, and 0 for a row it left as is, unless the
+// connections of vttablet have CLIENT_FOUND_ROWS. An insert ignore
+// counts 0 for a row that already exists, and so does a row skipped by
+// verify_before_create. It cannot be used with async_writes, whose
+// inserts happen after Create returns.
+func (lkp *lookupInternal) CreateWithCount(vcursor VCursor, rowsColValues [][]sqltypes.Value, toValues []sqltypes.Value, ignoreMode bool) (uint64, error) {
+	if lkp.async != nil {
+		return 0, lkp.mapError("Create", rowsColValues, fmt.Errorf("lookup.Create: CreateWithCount does not support async_writes for vindex table %s", lkp.Table))
+	}
+	affected, err := lkp.createWithSourcePK(vcursor, rowsColValues, toValues, nil, ignoreMode)
+	return affected, lkp.mapError("Create", rowsColValues, err)
+}
+
+// UpdateWithCount is like Update, but it returns the sum of the rows
+// affected by its Delete and its Create. See DeleteWithCount and
+// CreateWithCount.
+func (lkp *lookupInternal) UpdateWithCount(vcursor VCursor, oldValues []sqltypes.Value, ksid sqltypes.Value, newValues []sqltypes.Value) (uint64, error) {
+	if lkp.async != nil {
+		return 0, lkp.mapError("Update", oldValues, fmt.Errorf("lookup.Update: UpdateWithCount does not support async_writes for vindex table %s", lkp.Table))
+	}
+	affected, err := lkp.update(vcursor, oldValues, ksid, newValues)
+	return affected, lkp.mapError("Update", oldValues, err)
+}
+
+// DeleteWithCount is like Delete, but it returns the number of rows
+// it deleted. In autocommit mode, where Delete is a no-op, it's 0.
+// It cannot be used with async_writes.
+func (lkp *lookupInternal) DeleteWithCount(vcursor VCursor, rowsColValues [][]sqltypes.Value, value sqltypes.Value) (uint64, error) {
+	if lkp.async != nil {
+		return 0, lkp.mapError("Delete", rowsColValues, fmt.Errorf("lookup.Delete: DeleteWithCount does not support async_writes for vindex table %s", lkp.Table))
+	}
+	affected, err := lkp.delete(vcursor, rowsColValues, value, false /* anyValue */, lkp.failDeleteMissing())
+	return affected, lkp.mapError("Delete", rowsColValues, err)
+}
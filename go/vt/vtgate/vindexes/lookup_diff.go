@@ -0,0 +1,195 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"fmt"
+
+	"github.com/youtube/vitess/go/sqltypes"
+
+	querypb "github.com/youtube/vitess/go/vt/proto/query"
+)
+
+// LookupDiff is a row that's present in only one of the
+// two lookup tables compared by DiffLookups.
+type LookupDiff struct {
+	// InFirst is true if the row is only in the table of the
+	// first vindex, and false if it's only in the second one.
+	InFirst bool
+	From    sqltypes.Value
+	To      sqltypes.Value
+}
+
+// DiffLookups compares the tables of two lookup vindexes, and calls fn
+// for every (from, to) row that is present in only one of them. If fn
+// returns an error, the comparison stops and the error is returned.
+//
+// The tables are read in batches of batchSize rows, sorted by from and
+// to, and merged. So, neither of them is fully loaded in memory.
+// Since the rows are compared in memory, the from and to values must be
+// numeric or binary, for which MySQL uses the same ordering. Only the
+// first column of a multi-column from is compared.
+func DiffLookups(vcursor VCursor, first, second Vindex, batchSize int, fn func(*LookupDiff) error) error {
+	if batchSize <= 0 {
+		return fmt.Errorf("lookup.Diff: batch size must be positive: %d", batchSize)
+	}
+	firstLkp, err := lookupInternalOf(first)
+	if err != nil {
+		return err
+	}
+	secondLkp, err := lookupInternalOf(second)
+	if err != nil {
+		return err
+	}
+	firstScanner := newLookupScanner(vcursor, firstLkp, batchSize)
+	secondScanner := newLookupScanner(vcursor, secondLkp, batchSize)
+	for {
+		firstRow, err := firstScanner.peek()
+		if err != nil {
+			return fmt.Errorf("lookup.Diff: %v", err)
+		}
+		secondRow, err := secondScanner.peek()
+		if err != nil {
+			return fmt.Errorf("lookup.Diff: %v", err)
+		}
+		cmp := 0
+		switch {
+		case firstRow == nil && secondRow == nil:
+			return nil
+		case secondRow == nil:
+			cmp = -1
+		case firstRow == nil:
+			cmp = 1
+		default:
+			if cmp, err = compareLookupRows(firstRow, secondRow); err != nil {
+				return fmt.Errorf("lookup.Diff: %v", err)
+			}
+		}
+		switch {
+		case cmp < 0:
+			err = fn(&LookupDiff{InFirst: true, From: firstRow[0], To: firstRow[1]})
+			firstScanner.next()
+		case cmp > 0:
+			err = fn(&LookupDiff{InFirst: false, From: secondRow[0], To: secondRow[1]})
+			secondScanner.next()
+		default:
+			firstScanner.next()
+			secondScanner.next()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func lookupInternalOf(v Vindex) (*lookupInternal, error) {
+	switch v := v.(type) {
+	case *LookupNonUnique:
+		return &v.lkp, nil
+	case *LookupUnique:
+		return &v.lkp, nil
+	case *LookupHash:
+		return &v.lkp, nil
+	case *LookupHashUnique:
+		return &v.lkp, nil
+	}
+	return nil, fmt.Errorf("lookup.Diff: %s is not a lookup vindex", v)
+}
+
+func compareLookupRows(row1, row2 []sqltypes.Value) (int, error) {
+	for i := range row1 {
+		cmp, err := sqltypes.NullsafeCompare(row1[i], row2[i])
+		if err != nil || cmp != 0 {
+			return cmp, err
+		}
+	}
+	return 0, nil
+}
+
+// lookupScanner reads the (from, to) rows of a lookup table in order,
+// one batch at a time. Each batch resumes after the last row read.
+type lookupScanner struct {
+	vcursor   VCursor
+	lkp       *lookupInternal
+	batchSize int
+	first     string
+	more      string
+
+	rows [][]sqltypes.Value
+	last []sqltypes.Value
+	done bool
+}
+
+func newLookupScanner(vcursor VCursor, lkp *lookupInternal, batchSize int) *lookupScanner {
+	from, to := quoteIdent(lkp.FromColumns[0]), quoteIdent(lkp.To)
+	return &lookupScanner{
+		vcursor:   vcursor,
+		lkp:       lkp,
+		batchSize: batchSize,
+		first:     fmt.Sprintf("select %s, %s from %s order by %s, %s limit %d", from, to, quoteIdent(lkp.Table), from, to, batchSize),
+		more: fmt.Sprintf("select %s, %s from %s where %s > :%s or (%s = :%s and %s > :%s) order by %s, %s limit %d",
+			from, to, quoteIdent(lkp.Table), from, lkp.FromColumns[0], from, lkp.FromColumns[0], to, lkp.To, from, to, batchSize),
+	}
+}
+
+// peek returns the current row, or nil if all the rows were read.
+func (s *lookupScanner) peek() ([]sqltypes.Value, error) {
+	if len(s.rows) == 0 && !s.done {
+		if err := s.fetch(); err != nil {
+			return nil, err
+		}
+	}
+	if len(s.rows) == 0 {
+		return nil, nil
+	}
+	return s.rows[0], nil
+}
+
+// next moves past the current row.
+func (s *lookupScanner) next() {
+	s.last = s.rows[0]
+	s.rows = s.rows[1:]
+}
+
+func (s *lookupScanner) fetch() error {
+	query := s.first
+	var bindVars map[string]*querypb.BindVariable
+	if s.last != nil {
+		query = s.more
+		bindVars = map[string]*querypb.BindVariable{
+			s.lkp.FromColumns[0]: sqltypes.ValueBindVariable(s.last[0]),
+			s.lkp.To:             sqltypes.ValueBindVariable(s.last[1]),
+		}
+	}
+	s.lkp.logQuery("VindexDiff", query, bindVars)
+	var err error
+	var result *sqltypes.Result
+	if s.lkp.Autocommit {
+		result, err = s.lkp.executeAutocommit(s.vcursor, "VindexDiff", query, bindVars, false /* isDML */)
+	} else {
+		result, err = s.vcursor.Execute("VindexDiff", query, bindVars, false /* isDML */)
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.lkp.checkRows(result, 2); err != nil {
+		return err
+	}
+	s.rows = result.Rows
+	s.done = len(result.Rows) < s.batchSize
+	return nil
+}
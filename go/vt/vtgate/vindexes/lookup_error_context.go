@@ -0,0 +1,123 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+// Limits of the summary of the inputs of an OperationError, so that a
+// Create of thousands of rows doesn't make a huge error.
+const (
+	errorContextMaxValues = 3
+	errorContextMaxBytes  = 32
+)
+
+// OperationError is returned by the operations of a lookup vindex with
+// error_context instead of their error, Err, to tell which vindex and
+// operation failed, and for which inputs. It's returned before the
+// ErrorMapper is applied, and it unwraps to Err, so errors.As can still
+// find a typed error like a *NotFoundError.
+type OperationError struct {
+	Vindex string
+	Table  string
+	// Method is the operation, as passed to the ErrorMapper: "Map",
+	// "Verify", "Create", "Update" or "Delete".
+	Method string
+	// Inputs is a summary of the ids of Map and Verify, the rows of
+	// Create and Delete, or the old values of Update. It has the first
+	// few of them, and their count.
+	Inputs string
+	Err    error
+}
+
+func (e *OperationError) Error() string {
+	return fmt.Sprintf("vindex %s (table %s): %s of %s: %v", e.Vindex, e.Table, e.Method, e.Inputs, e.Err)
+}
+
+// Unwrap returns the error of the operation.
+func (e *OperationError) Unwrap() error {
+	return e.Err
+}
+
+// operationError wraps the error err of method in an *OperationError.
+func (lkp *lookupInternal) operationError(method string, inputs interface{}, err error) error {
+	return &OperationError{
+		Vindex: lkp.name,
+		Table:  lkp.Table,
+		Method: method,
+		Inputs: summarizeInputs(inputs),
+		Err:    err,
+	}
+}
+
+// summarizeInputs returns the summary of inputs for an OperationError.
+// inputs is a []sqltypes.Value, one per id or from column, or a
+// [][]sqltypes.Value, one per row.
+func summarizeInputs(inputs interface{}) string {
+	buf := new(bytes.Buffer)
+	switch inputs := inputs.(type) {
+	case []sqltypes.Value:
+		fmt.Fprintf(buf, "%d values ", len(inputs))
+		summarizeList(buf, len(inputs), func(i int) {
+			summarizeValue(buf, inputs[i])
+		})
+	case [][]sqltypes.Value:
+		fmt.Fprintf(buf, "%d rows ", len(inputs))
+		summarizeList(buf, len(inputs), func(i int) {
+			summarizeList(buf, len(inputs[i]), func(j int) {
+				summarizeValue(buf, inputs[i][j])
+			})
+		})
+	default:
+		fmt.Fprintf(buf, "%T", inputs)
+	}
+	return buf.String()
+}
+
+// summarizeList writes the first errorContextMaxValues of the n
+// elements of a list, with write, between brackets.
+func summarizeList(buf *bytes.Buffer, n int, write func(i int)) {
+	buf.WriteByte('[')
+	for i := 0; i < n && i < errorContextMaxValues; i++ {
+		if i != 0 {
+			buf.WriteString(", ")
+		}
+		write(i)
+	}
+	if n > errorContextMaxValues {
+		fmt.Fprintf(buf, ", ... %d more", n-errorContextMaxValues)
+	}
+	buf.WriteByte(']')
+}
+
+// summarizeValue writes v, truncated to errorContextMaxBytes.
+func summarizeValue(buf *bytes.Buffer, v sqltypes.Value) {
+	if v.IsNull() {
+		buf.WriteString("NULL")
+		return
+	}
+	raw := v.ToBytes()
+	if len(raw) <= errorContextMaxBytes {
+		fmt.Fprintf(buf, "%v(%q)", v.Type(), raw)
+		return
+	}
+	fmt.Fprintf(buf, "%v(%q...)", v.Type(), raw[:errorContextMaxBytes])
+}
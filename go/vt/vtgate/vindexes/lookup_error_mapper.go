@@ -0,0 +1,44 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+// ErrorMapper translates the errors of the lookup vindexes before they
+// are returned, for example into a vterrors error with the code that a
+// deployment wants users to see when the lookup table is unavailable.
+type ErrorMapper interface {
+	// MapError returns the error to return instead of err, which is
+	// never nil. method is the operation that failed: "Map", "Verify",
+	// "Create", "Update" or "Delete". The errors of the variants of an
+	// operation, like CreateWithStatus or DeleteWithSourcePK, are mapped
+	// as the operation. If the vindex has error_context, err is an
+	// *OperationError.
+	MapError(vindex, method string, err error) error
+}
+
+// ErrorMapperFunc adapts a function to an ErrorMapper.
+type ErrorMapperFunc func(vindex, method string, err error) error
+
+// MapError is part of the ErrorMapper interface.
+func (f ErrorMapperFunc) MapError(vindex, method string, err error) error {
+	return f(vindex, method, err)
+}
+
+// DefaultErrorMapper is the ErrorMapper used by lookup vindexes unless
+// another one is set. It returns the errors as is.
+var DefaultErrorMapper ErrorMapper = ErrorMapperFunc(func(vindex, method string, err error) error {
+	return err
+})
@@ -0,0 +1,103 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/youtube/vitess/go/sqltypes"
+
+	querypb "github.com/youtube/vitess/go/vt/proto/query"
+)
+
+// defaultEstimateRowsTTL is how long EstimateRows caches its
+// estimate, unless estimate_rows_ttl is set.
+const defaultEstimateRowsTTL = 10 * time.Minute
+
+const estimateRowsQuery = "select table_rows from information_schema.tables where table_schema = database() and table_name = :table_name"
+
+// rowEstimate is the cached result of EstimateRows.
+type rowEstimate struct {
+	mu      sync.Mutex
+	rows    int64
+	expires time.Time
+}
+
+// EstimateRows returns an estimate of the number of rows of the table,
+// for planner hints. The estimate is cached for EstimateRowsTTL.
+//
+// By default, it reads table_rows from information_schema, which is
+// cheap, but only as accurate as the InnoDB statistics: it can be off by
+// half. Also, since vtgate sends information_schema queries to a single
+// tablet of the default keyspace, it's only meaningful if the table is in
+// that keyspace, and it's the count of a single shard. If EstimateRowsCount
+// is set, the rows are counted instead, which is exact but scans the table.
+func (lkp *lookupInternal) EstimateRows(vcursor VCursor) (int64, error) {
+	lkp.estimate.mu.Lock()
+	defer lkp.estimate.mu.Unlock()
+	now := time.Now()
+	if now.Before(lkp.estimate.expires) {
+		return lkp.estimate.rows, nil
+	}
+
+	var result *sqltypes.Result
+	var err error
+	if lkp.EstimateRowsCount {
+		result, err = lkp.executeRead(vcursor, "VindexEstimateRows", fmt.Sprintf("select count(*) from %s", quoteIdent(lkp.Table)), nil, false /* isDML */)
+	} else {
+		bindVars := map[string]*querypb.BindVariable{
+			"table_name": sqltypes.StringBindVariable(unqualifiedTable(lkp.Table)),
+		}
+		result, err = lkp.executeRead(vcursor, "VindexEstimateRows", estimateRowsQuery, bindVars, false /* isDML */)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("lookup.EstimateRows: %v", err)
+	}
+	if len(result.Rows) == 0 {
+		return 0, fmt.Errorf("lookup.EstimateRows: table %s not found", lkp.Table)
+	}
+	if err := lkp.checkRows(result, 1); err != nil {
+		return 0, fmt.Errorf("lookup.EstimateRows: %v", err)
+	}
+	var rows int64
+	// table_rows is NULL for views.
+	if v := result.Rows[0][0]; !v.IsNull() {
+		if rows, err = sqltypes.ToInt64(v); err != nil {
+			return 0, fmt.Errorf("lookup.EstimateRows: %v", err)
+		}
+	}
+
+	ttl := lkp.EstimateRowsTTL
+	if ttl == 0 {
+		ttl = defaultEstimateRowsTTL
+	}
+	lkp.estimate.rows = rows
+	lkp.estimate.expires = now.Add(ttl)
+	return rows, nil
+}
+
+// unqualifiedTable returns the name of table without its
+// keyspace qualifier and quotes.
+func unqualifiedTable(table string) string {
+	if i := strings.LastIndex(table, "."); i != -1 {
+		table = table[i+1:]
+	}
+	return strings.Trim(table, "`")
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/youtube/vitess/go/sqltypes"
+
+	querypb "github.com/youtube/vitess/go/vt/proto/query"
+)
+
+// exportTokenVersion is the version of the tokens of Export. It must
+// be incremented if their content changes in a way that the previous
+// versions cannot be decoded.
+const exportTokenVersion = 1
+
+// ExportPage is a page of the rows of the table of a lookup vindex,
+// as returned by Export.
+type ExportPage struct {
+	// Rows are the (from, to) rows of the page, in the order of their
+	// from and to values.
+	Rows [][]sqltypes.Value
+	// Token resumes the export after the rows of the page. It's empty
+	// if there are no more rows.
+	Token string
+}
+
+// exportToken is the content of a token of Export.
+type exportToken struct {
+	Version int            `json:"v"`
+	Table   string         `json:"t"`
+	From    *querypb.Value `json:"f"`
+	To      *querypb.Value `json:"to"`
+}
+
+// Export reads a page of up to batchSize rows of the table of the lookup
+// vindex v, for a resumable export or backup of the table. An empty token
+// starts at the first row. The token of the returned page resumes after
+// its last row, so an interrupted export can continue from the last page
+// it stored instead of restarting. The rows are ordered by their (first)
+// from value and to value, and each page is read with them as a lower
+// bound, which the primary key or an index of the table should cover.
+//
+// A token is opaque: it encodes the from and to values of the last row of
+// a page, and the table it was read from, but its format can change. It
+// doesn't depend on the vtgate or the session, so it can be stored and
+// used by another process, and the tokens of a version stay valid in the
+// later ones unless their version is changed, in which case Export fails
+// instead of resuming at the wrong row. It fails for a token of another
+// table. The export is not a snapshot: the rows created or deleted after
+// the token while it's running are included or not depending on where
+// they fall.
+func Export(vcursor VCursor, v Vindex, token string, batchSize int) (*ExportPage, error) {
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("lookup.Export: batch size must be positive: %d", batchSize)
+	}
+	lkp, err := lookupInternalOf(v)
+	if err != nil {
+		return nil, fmt.Errorf("lookup.Export: %s is not a lookup vindex", v)
+	}
+	scanner := newLookupScanner(vcursor, lkp, batchSize)
+	if token != "" {
+		if scanner.last, err = decodeExportToken(lkp, token); err != nil {
+			return nil, fmt.Errorf("lookup.Export: %v", err)
+		}
+	}
+	if err := scanner.fetch(); err != nil {
+		return nil, fmt.Errorf("lookup.Export: %v", err)
+	}
+	page := &ExportPage{Rows: scanner.rows}
+	if !scanner.done {
+		if page.Token, err = encodeExportToken(lkp, scanner.rows[len(scanner.rows)-1]); err != nil {
+			return nil, fmt.Errorf("lookup.Export: %v", err)
+		}
+	}
+	return page, nil
+}
+
+// encodeExportToken returns the token that resumes an export after row.
+func encodeExportToken(lkp *lookupInternal, row []sqltypes.Value) (string, error) {
+	data, err := json.Marshal(&exportToken{
+		Version: exportTokenVersion,
+		Table:   lkp.Table,
+		From:    sqltypes.ValueToProto(row[0]),
+		To:      sqltypes.ValueToProto(row[1]),
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeExportToken returns the row after which token resumes.
+func decodeExportToken(lkp *lookupInternal, token string) ([]sqltypes.Value, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+	var t exportToken
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+	switch {
+	case t.Version != exportTokenVersion:
+		return nil, fmt.Errorf("token version %d is not supported, want %d", t.Version, exportTokenVersion)
+	case t.Table != lkp.Table:
+		return nil, fmt.Errorf("token is for table %s, not %s", t.Table, lkp.Table)
+	case t.From == nil || t.To == nil:
+		return nil, fmt.Errorf("invalid token: missing values")
+	}
+	return []sqltypes.Value{sqltypes.ProtoToValue(t.From), sqltypes.ProtoToValue(t.To)}, nil
+}
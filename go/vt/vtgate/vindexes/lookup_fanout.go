@@ -0,0 +1,54 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"github.com/youtube/vitess/go/stats"
+)
+
+// lookupFanoutCutoffs are the buckets of the number of
+// distinct keyspace ids returned by a Map call.
+var lookupFanoutCutoffs = []int64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+
+// lookupFanouts contains the fan-out histograms by vindex name.
+// VindexLookupMapFanout has, for each LookupNonUnique vindex, the
+// histogram of the number of distinct keyspace ids returned by its
+// Map calls. Wide fan-outs mean expensive scatters.
+var lookupFanouts = newVindexHistograms("VindexLookupMapFanout", lookupFanoutCutoffs)
+
+// recordLookupFanout adds the number of distinct keyspace ids
+// in the output of a Map call of the vindex to its histogram.
+func recordLookupFanout(name string, out []Ksids) {
+	distinct := make(map[string]bool)
+	for _, ksids := range out {
+		for _, ksid := range ksids.IDs {
+			distinct[string(ksid)] = true
+		}
+	}
+	metrics().Observe("VindexLookupMapFanout", name, int64(len(distinct)))
+}
+
+// resetLookupFanout drops the histogram of the vindex. A new one
+// is created on its next Map call.
+func resetLookupFanout(name string) {
+	metrics().ResetHistogram("VindexLookupMapFanout", name)
+}
+
+// lookupFanout returns the histogram of the vindex in the stats.
+func lookupFanout(name string) *stats.Histogram {
+	return lookupFanouts.get(name)
+}
@@ -17,7 +17,6 @@ limitations under the License.
 package vindexes
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 
@@ -44,9 +43,10 @@ func init() {
 // NonUnique and a Lookup.
 // Warning: This Vindex is being depcreated in favor of Lookup
 type LookupHash struct {
-	name      string
-	writeOnly bool
-	lkp       lookupInternal
+	name          string
+	writeOnly     bool
+	writeOnlyCost int
+	lkp           lookupInternal
 }
 
 // NewLookupHash creates a LookupHash vindex.
@@ -58,6 +58,19 @@ type LookupHash struct {
 // The following fields are optional:
 //   autocommit: setting this to "true" will cause inserts to upsert and deletes to be ignored.
 //   write_only: in this mode, Map functions return the full keyrange causing a full scatter.
+//   write_only_cost: the cost of the vindex in write_only mode. It defaults to 100. See NewLookup.
+//   write_only_dry_run: see NewLookup.
+//   require_qualified_table: see NewLookup.
+//   read_cell: see NewLookup.
+//   dedupe_ids: see NewLookup.
+//   created_at_column: see NewLookup.
+//   updated_at_column: see NewLookup.
+//   error_context: see NewLookup.
+//   snapshot_reads: see NewLookup.
+//   delete_missing: see NewLookup.
+//   index_hint: see NewLookup.
+//   allow_unknown_params: setting this to "true" makes unrecognized params be ignored instead of failing.
+//     The custom options registered with RegisterLookupOption are recognized.
 func NewLookupHash(name string, m map[string]string) (Vindex, error) {
 	lh := &LookupHash{name: name}
 
@@ -69,9 +82,13 @@ func NewLookupHash(name string, m map[string]string) (Vindex, error) {
 	if err != nil {
 		return nil, err
 	}
+	lh.writeOnlyCost, err = writeOnlyCostFromMap(m)
+	if err != nil {
+		return nil, err
+	}
 
 	// if autocommit is on for non-unique lookup, upsert should also be on.
-	if err := lh.lkp.Init(m, autocommit, autocommit /* upsert */); err != nil {
+	if err := lh.lkp.Init(name, m, lookupHashParams, autocommit, autocommit /* upsert */); err != nil {
 		return nil, err
 	}
 	return lh, nil
@@ -82,9 +99,14 @@ func (lh *LookupHash) String() string {
 	return lh.name
 }
 
-// Cost returns the cost of this vindex as 20.
+// Cost returns the cost of this vindex as 20, or as the
+// write_only_cost if the vindex is write_only.
+// With adaptive_cost, it follows the latency of Map instead of 20.
 func (lh *LookupHash) Cost() int {
-	return 20
+	if lh.writeOnly {
+		return lh.writeOnlyCost
+	}
+	return lh.lkp.cost(20)
 }
 
 // Map returns the corresponding KeyspaceId values for the given ids.
@@ -123,7 +145,36 @@ func (lh *LookupHash) Map(vcursor VCursor, ids []sqltypes.Value) ([]Ksids, error
 
 // Verify returns true if ids maps to ksids.
 func (lh *LookupHash) Verify(vcursor VCursor, ids []sqltypes.Value, ksids [][]byte) ([]bool, error) {
-	if lh.writeOnly {
+	return lh.VerifyWithOptions(vcursor, ids, ksids, VerifyOptions{})
+}
+
+// VerifyStream is like Verify, but it calls cb with the result of each
+// id instead of returning them. See StreamVerifier.
+func (lh *LookupHash) VerifyStream(vcursor VCursor, ids []sqltypes.Value, ksids [][]byte, cb func(i int, ok bool) error) error {
+	return verifyStream(lh.Verify, vcursor, ids, ksids, cb)
+}
+
+// VerifyAny is like Verify, but it accepts a set of keyspace ids for
+// each id. See AnyVerifier.
+func (lh *LookupHash) VerifyAny(vcursor VCursor, ids []sqltypes.Value, ksids [][][]byte) ([]bool, error) {
+	return verifyAny(lh.Verify, vcursor, ids, ksids)
+}
+
+// Describe returns the RoutePlan of ids, which are routed to the full
+// keyrange if the vindex is write_only. See Describer.
+func (lh *LookupHash) Describe(vcursor VCursor, ids []sqltypes.Value) (RoutePlan, error) {
+	return describeMap(vcursor, lh, ids, func(sqltypes.Value) string {
+		if lh.writeOnly {
+			return "write_only"
+		}
+		return ""
+	})
+}
+
+// VerifyWithOptions is like Verify, but with the options of one call.
+// With ForceLookup, it consults the table even if the vindex is write_only.
+func (lh *LookupHash) VerifyWithOptions(vcursor VCursor, ids []sqltypes.Value, ksids [][]byte, options VerifyOptions) ([]bool, error) {
+	if lh.writeOnly && !options.ForceLookup {
 		out := make([]bool, len(ids))
 		for i := range ids {
 			out[i] = true
@@ -139,34 +190,120 @@ func (lh *LookupHash) Verify(vcursor VCursor, ids []sqltypes.Value, ksids [][]by
 
 // Create reserves the id by inserting it into the vindex table.
 func (lh *LookupHash) Create(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksids [][]byte, ignoreMode bool) error {
+	_, err := lh.CreateWithCount(vcursor, rowsColValues, ksids, ignoreMode)
+	return err
+}
+
+// CreateWithCount is like Create, but it returns the number of rows
+// affected. See lookupInternal.CreateWithCount.
+func (lh *LookupHash) CreateWithCount(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksids [][]byte, ignoreMode bool) (uint64, error) {
 	values, err := unhashList(ksids)
 	if err != nil {
-		return fmt.Errorf("lookup.Create.vunhash: %v", err)
+		return 0, fmt.Errorf("lookup.Create.vunhash: %v", err)
 	}
-	return lh.lkp.Create(vcursor, rowsColValues, values, ignoreMode)
+	return lh.lkp.CreateWithCount(vcursor, rowsColValues, values, ignoreMode)
 }
 
 // Update updates the entry in the vindex table.
 func (lh *LookupHash) Update(vcursor VCursor, oldValues []sqltypes.Value, ksid []byte, newValues []sqltypes.Value) error {
+	_, err := lh.UpdateWithCount(vcursor, oldValues, ksid, newValues)
+	return err
+}
+
+// UpdateWithCount is like Update, but it returns the number of rows
+// affected.
+func (lh *LookupHash) UpdateWithCount(vcursor VCursor, oldValues []sqltypes.Value, ksid []byte, newValues []sqltypes.Value) (uint64, error) {
+	if len(ksid) == 0 {
+		return lh.lkp.UpdateWithCount(vcursor, oldValues, sqltypes.NULL, newValues)
+	}
 	v, err := vunhash(ksid)
 	if err != nil {
-		return fmt.Errorf("lookup.Update.vunhash: %v", err)
+		return 0, fmt.Errorf("lookup.Update.vunhash: %v", err)
 	}
-	return lh.lkp.Update(vcursor, oldValues, sqltypes.NewUint64(v), newValues)
+	return lh.lkp.UpdateWithCount(vcursor, oldValues, sqltypes.NewUint64(v), newValues)
 }
 
 // Delete deletes the entry from the vindex table.
 func (lh *LookupHash) Delete(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksid []byte) error {
+	_, err := lh.DeleteWithCount(vcursor, rowsColValues, ksid)
+	return err
+}
+
+// DeleteWithCount is like Delete, but it returns the number of rows
+// deleted.
+func (lh *LookupHash) DeleteWithCount(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksid []byte) (uint64, error) {
 	v, err := vunhash(ksid)
 	if err != nil {
-		return fmt.Errorf("lookup.Delete.vunhash: %v", err)
+		return 0, fmt.Errorf("lookup.Delete.vunhash: %v", err)
 	}
-	return lh.lkp.Delete(vcursor, rowsColValues, sqltypes.NewUint64(v))
+	return lh.lkp.DeleteWithCount(vcursor, rowsColValues, sqltypes.NewUint64(v))
+}
+
+// EstimateRows returns an estimate of the number of rows of the
+// vindex table. See lookupInternal.EstimateRows for its accuracy.
+func (lh *LookupHash) EstimateRows(vcursor VCursor) (int64, error) {
+	return lh.lkp.EstimateRows(vcursor)
+}
+
+// Checksum returns a checksum of the rows of the vindex table.
+// See lookupInternal.Checksum for how it's computed.
+func (lh *LookupHash) Checksum(vcursor VCursor) ([]byte, error) {
+	return lh.lkp.Checksum(vcursor)
+}
+
+// SelfTest reads the vindex table and, if self_test_id is set,
+// creates, verifies and deletes an entry in it.
+func (lh *LookupHash) SelfTest(vcursor VCursor) error {
+	return selfTest(vcursor, lh, &lh.lkp)
+}
+
+// OnVSchemaReload invalidates the cache of the vindex if its config
+// changed. See VSchemaReloadHook.
+func (lh *LookupHash) OnVSchemaReload(vcursor VCursor) error {
+	return lh.lkp.OnVSchemaReload(vcursor)
+}
+
+// SelfTestReport runs all the checks of SelfTest, and ValidateIndex,
+// without stopping at the first failure. See SelfTestReporter.
+func (lh *LookupHash) SelfTestReport(vcursor VCursor) *SelfTestReport {
+	return selfTestReport(vcursor, lh, &lh.lkp, false /* unique */)
+}
+
+// ValidateIndex logs a warning if the vindex table has no index on
+// the first from column. It fails if an index of index_hint is missing.
+func (lh *LookupHash) ValidateIndex(vcursor VCursor) error {
+	return lh.lkp.validateIndex(vcursor, false /* unique */)
+}
+
+// ValidateCollation fails with a *CollationError if a from column of
+// the vindex table has a non-binary collation.
+func (lh *LookupHash) ValidateCollation(vcursor VCursor) error {
+	return lh.lkp.validateCollation(vcursor)
+}
+
+// ValidateCreate checks the rows of a Create without executing it.
+// See lookupInternal.validateCreate.
+func (lh *LookupHash) ValidateCreate(rowsColValues [][]sqltypes.Value, ksids [][]byte) error {
+	return lh.lkp.validateCreate(rowsColValues, ksids, false /* unique */, checkHashKsid)
+}
+
+// SetErrorMapper sets the ErrorMapper of the errors returned by Map,
+// Verify, Create, Update and Delete. If not set, DefaultErrorMapper
+// is used.
+func (lh *LookupHash) SetErrorMapper(mapper ErrorMapper) {
+	lh.lkp.SetErrorMapper(mapper)
+}
+
+// SetCacheInvalidator sets the CacheInvalidator that publishes the
+// cache invalidations of Create, Update and Delete to the other
+// vtgates. If not set, DefaultCacheInvalidator is used.
+func (lh *LookupHash) SetCacheInvalidator(invalidator CacheInvalidator) {
+	lh.lkp.SetCacheInvalidator(invalidator)
 }
 
 // MarshalJSON returns a JSON representation of LookupHash.
 func (lh *LookupHash) MarshalJSON() ([]byte, error) {
-	return json.Marshal(lh.lkp)
+	return lh.lkp.MarshalJSON()
 }
 
 // unhashList unhashes a list of keyspace ids into []sqltypes.Value.
@@ -182,6 +319,12 @@ func unhashList(ksids [][]byte) ([]sqltypes.Value, error) {
 	return values, nil
 }
 
+// checkHashKsid fails if ksid cannot be unhashed.
+func checkHashKsid(ksid []byte) error {
+	_, err := vunhash(ksid)
+	return err
+}
+
 //====================================================================
 
 // LookupHashUnique defines a vindex that uses a lookup table.
@@ -201,6 +344,17 @@ type LookupHashUnique struct {
 //
 // The following fields are optional:
 //   autocommit: setting this to "true" will cause deletes to be ignored.
+//   require_qualified_table: see NewLookup.
+//   read_cell: see NewLookup.
+//   dedupe_ids: see NewLookup.
+//   created_at_column: see NewLookup.
+//   updated_at_column: see NewLookup.
+//   error_context: see NewLookup.
+//   snapshot_reads: see NewLookup.
+//   delete_missing: see NewLookup.
+//   index_hint: see NewLookup.
+//   allow_unknown_params: setting this to "true" makes unrecognized params be ignored instead of failing.
+//     The custom options registered with RegisterLookupOption are recognized.
 func NewLookupHashUnique(name string, m map[string]string) (Vindex, error) {
 	lhu := &LookupHashUnique{name: name}
 
@@ -217,7 +371,8 @@ func NewLookupHashUnique(name string, m map[string]string) (Vindex, error) {
 	}
 
 	// Don't allow upserts for unique vindexes.
-	if err := lhu.lkp.Init(m, autocommit, false /* upsert */); err != nil {
+	lhu.lkp.unique = true
+	if err := lhu.lkp.Init(name, m, lookupHashUniqueParams, autocommit, false /* upsert */); err != nil {
 		return nil, err
 	}
 	return lhu, nil
@@ -228,9 +383,10 @@ func (lhu *LookupHashUnique) String() string {
 	return lhu.name
 }
 
-// Cost returns the cost of this vindex as 10.
+// Cost returns the cost of this vindex as 10. With adaptive_cost,
+// it follows the latency of Map instead.
 func (lhu *LookupHashUnique) Cost() int {
-	return 10
+	return lhu.lkp.cost(10)
 }
 
 // Map returns the corresponding KeyspaceId values for the given ids.
@@ -267,34 +423,138 @@ func (lhu *LookupHashUnique) Verify(vcursor VCursor, ids []sqltypes.Value, ksids
 	return lhu.lkp.Verify(vcursor, ids, values)
 }
 
+// VerifyStream is like Verify, but it calls cb with the result of each
+// id instead of returning them. See StreamVerifier.
+func (lhu *LookupHashUnique) VerifyStream(vcursor VCursor, ids []sqltypes.Value, ksids [][]byte, cb func(i int, ok bool) error) error {
+	return verifyStream(lhu.Verify, vcursor, ids, ksids, cb)
+}
+
+// VerifyAny is like Verify, but it accepts a set of keyspace ids for
+// each id. See AnyVerifier.
+func (lhu *LookupHashUnique) VerifyAny(vcursor VCursor, ids []sqltypes.Value, ksids [][][]byte) ([]bool, error) {
+	return verifyAny(lhu.Verify, vcursor, ids, ksids)
+}
+
+// Describe returns the RoutePlan of ids. See Describer.
+func (lhu *LookupHashUnique) Describe(vcursor VCursor, ids []sqltypes.Value) (RoutePlan, error) {
+	return describeMap(vcursor, lhu, ids, nil)
+}
+
 // Create reserves the id by inserting it into the vindex table.
 func (lhu *LookupHashUnique) Create(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksids [][]byte, ignoreMode bool) error {
+	_, err := lhu.CreateWithCount(vcursor, rowsColValues, ksids, ignoreMode)
+	return err
+}
+
+// CreateWithCount is like Create, but it returns the number of rows
+// affected. See lookupInternal.CreateWithCount.
+func (lhu *LookupHashUnique) CreateWithCount(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksids [][]byte, ignoreMode bool) (uint64, error) {
 	values, err := unhashList(ksids)
 	if err != nil {
-		return fmt.Errorf("lookup.Create.vunhash: %v", err)
+		return 0, fmt.Errorf("lookup.Create.vunhash: %v", err)
 	}
-	return lhu.lkp.Create(vcursor, rowsColValues, values, ignoreMode)
+	return lhu.lkp.CreateWithCount(vcursor, rowsColValues, values, ignoreMode)
 }
 
 // Delete deletes the entry from the vindex table.
 func (lhu *LookupHashUnique) Delete(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksid []byte) error {
+	_, err := lhu.DeleteWithCount(vcursor, rowsColValues, ksid)
+	return err
+}
+
+// DeleteWithCount is like Delete, but it returns the number of rows
+// deleted.
+func (lhu *LookupHashUnique) DeleteWithCount(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksid []byte) (uint64, error) {
 	v, err := vunhash(ksid)
 	if err != nil {
-		return fmt.Errorf("lookup.Delete.vunhash: %v", err)
+		return 0, fmt.Errorf("lookup.Delete.vunhash: %v", err)
 	}
-	return lhu.lkp.Delete(vcursor, rowsColValues, sqltypes.NewUint64(v))
+	return lhu.lkp.DeleteWithCount(vcursor, rowsColValues, sqltypes.NewUint64(v))
 }
 
 // Update updates the entry in the vindex table.
 func (lhu *LookupHashUnique) Update(vcursor VCursor, oldValues []sqltypes.Value, ksid []byte, newValues []sqltypes.Value) error {
+	_, err := lhu.UpdateWithCount(vcursor, oldValues, ksid, newValues)
+	return err
+}
+
+// UpdateWithCount is like Update, but it returns the number of rows
+// affected.
+func (lhu *LookupHashUnique) UpdateWithCount(vcursor VCursor, oldValues []sqltypes.Value, ksid []byte, newValues []sqltypes.Value) (uint64, error) {
+	if len(ksid) == 0 {
+		return lhu.lkp.UpdateWithCount(vcursor, oldValues, sqltypes.NULL, newValues)
+	}
 	v, err := vunhash(ksid)
 	if err != nil {
-		return fmt.Errorf("lookup.Update.vunhash: %v", err)
+		return 0, fmt.Errorf("lookup.Update.vunhash: %v", err)
 	}
-	return lhu.lkp.Update(vcursor, oldValues, sqltypes.NewUint64(v), newValues)
+	return lhu.lkp.UpdateWithCount(vcursor, oldValues, sqltypes.NewUint64(v), newValues)
+}
+
+// EstimateRows returns an estimate of the number of rows of the
+// vindex table. See lookupInternal.EstimateRows for its accuracy.
+func (lhu *LookupHashUnique) EstimateRows(vcursor VCursor) (int64, error) {
+	return lhu.lkp.EstimateRows(vcursor)
+}
+
+// Checksum returns a checksum of the rows of the vindex table.
+// See lookupInternal.Checksum for how it's computed.
+func (lhu *LookupHashUnique) Checksum(vcursor VCursor) ([]byte, error) {
+	return lhu.lkp.Checksum(vcursor)
+}
+
+// SelfTest reads the vindex table and, if self_test_id is set,
+// creates, verifies and deletes an entry in it.
+func (lhu *LookupHashUnique) SelfTest(vcursor VCursor) error {
+	return selfTest(vcursor, lhu, &lhu.lkp)
+}
+
+// OnVSchemaReload invalidates the cache of the vindex if its config
+// changed. See VSchemaReloadHook.
+func (lhu *LookupHashUnique) OnVSchemaReload(vcursor VCursor) error {
+	return lhu.lkp.OnVSchemaReload(vcursor)
+}
+
+// SelfTestReport runs all the checks of SelfTest, and ValidateIndex,
+// without stopping at the first failure. See SelfTestReporter.
+func (lhu *LookupHashUnique) SelfTestReport(vcursor VCursor) *SelfTestReport {
+	return selfTestReport(vcursor, lhu, &lhu.lkp, true /* unique */)
+}
+
+// ValidateIndex fails with a *MissingIndexError if the vindex table
+// has no unique index on the from columns, and if an index of
+// index_hint is missing.
+func (lhu *LookupHashUnique) ValidateIndex(vcursor VCursor) error {
+	return lhu.lkp.validateIndex(vcursor, true /* unique */)
+}
+
+// ValidateCollation fails with a *CollationError if a from column of
+// the vindex table has a non-binary collation.
+func (lhu *LookupHashUnique) ValidateCollation(vcursor VCursor) error {
+	return lhu.lkp.validateCollation(vcursor)
+}
+
+// ValidateCreate checks the rows of a Create without executing it.
+// See lookupInternal.validateCreate.
+func (lhu *LookupHashUnique) ValidateCreate(rowsColValues [][]sqltypes.Value, ksids [][]byte) error {
+	return lhu.lkp.validateCreate(rowsColValues, ksids, true /* unique */, checkHashKsid)
+}
+
+// SetErrorMapper sets the ErrorMapper of the errors returned by Map,
+// Verify, Create, Update and Delete. If not set, DefaultErrorMapper
+// is used.
+func (lhu *LookupHashUnique) SetErrorMapper(mapper ErrorMapper) {
+	lhu.lkp.SetErrorMapper(mapper)
+}
+
+// SetCacheInvalidator sets the CacheInvalidator that publishes the
+// cache invalidations of Create, Update and Delete to the other
+// vtgates. If not set, DefaultCacheInvalidator is used.
+func (lhu *LookupHashUnique) SetCacheInvalidator(invalidator CacheInvalidator) {
+	lhu.lkp.SetCacheInvalidator(invalidator)
 }
 
 // MarshalJSON returns a JSON representation of LookupHashUnique.
 func (lhu *LookupHashUnique) MarshalJSON() ([]byte, error) {
-	return json.Marshal(lhu.lkp)
+	return lhu.lkp.MarshalJSON()
 }
@@ -22,6 +22,7 @@ import (
 	"testing"
 
 	"github.com/youtube/vitess/go/sqltypes"
+
 	topodatapb "github.com/youtube/vitess/go/vt/proto/topodata"
 )
 
@@ -58,6 +59,11 @@ func TestLookupHashCost(t *testing.T) {
 	if lookuphashunique.Cost() != 10 {
 		t.Errorf("Cost(): %d, want 10", lookuphashunique.Cost())
 	}
+
+	lookuphash = createLookup(t, "lookup_hash", true)
+	if lookuphash.Cost() != 100 {
+		t.Errorf("Cost(write_only): %d, want 100", lookuphash.Cost())
+	}
 }
 
 func TestLookupHashString(t *testing.T) {
@@ -196,6 +202,16 @@ func TestLookupHashVerify(t *testing.T) {
 	if !reflect.DeepEqual(got, wantBools) {
 		t.Errorf("lookuphash.Verify(scatter): %v, want %v", got, wantBools)
 	}
+
+	// ForceLookup consults the table even in writeOnly mode.
+	ksid := []byte("\x16k@\xb4J\xbaK\xd6")
+	_, err = lookuphash.(*LookupHash).VerifyWithOptions(vc, []sqltypes.Value{sqltypes.NewInt64(1)}, [][]byte{ksid}, VerifyOptions{ForceLookup: true})
+	if err != nil {
+		t.Error(err)
+	}
+	if got, want := len(vc.queries), 1; got != want {
+		t.Errorf("lookuphash.Verify(ForceLookup) queries: %v, want %d", vc.queries, want)
+	}
 }
 
 func TestLookupHashCreate(t *testing.T) {
@@ -247,4 +263,34 @@ func TestLookupHashUpdate(t *testing.T) {
 	if got, want := len(vc.queries), 2; got != want {
 		t.Errorf("vc.queries length: %v, want %v", got, want)
 	}
+
+	// An empty ksid fails, instead of failing to unhash.
+	vc.queries = nil
+	err = lookuphash.(Lookup).Update(vc, []sqltypes.Value{sqltypes.NewInt64(1)}, nil, nil)
+	want := "lookup.Update: empty keyspace id for [INT64(1)], which would delete all its keyspace ids in non-unique vindex lookup_hash"
+	if err == nil || err.Error() != want {
+		t.Errorf("lookup.Update(empty ksid): %v, want %s", err, want)
+	}
+	if vc.queries != nil {
+		t.Errorf("lookup.Update(empty ksid) queries: %v, want nil", vc.queries)
+	}
+}
+
+func TestLookupHashMutationCounts(t *testing.T) {
+	lookuphash, err := CreateVindex("lookup_hash", "lookup_hash", map[string]string{
+		"table": "t",
+		"from":  "fromc",
+		"to":    "toc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{deletesAffected: []uint64{1}}
+	count, err := lookuphash.(MutationCounter).DeleteWithCount(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, []byte("\x16k@\xb4J\xbaK\xd6"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("DeleteWithCount: %d, want 1", count)
+	}
 }
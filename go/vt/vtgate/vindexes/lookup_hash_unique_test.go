@@ -196,4 +196,13 @@ func TestLookupHashUniqueUpdate(t *testing.T) {
 	if got, want := len(vc.queries), 2; got != want {
 		t.Errorf("vc.queries length: %v, want %v", got, want)
 	}
+	// An empty ksid deletes the old mapping, instead of failing to unhash.
+	vc.queries = nil
+	err = lhu.(Lookup).Update(vc, []sqltypes.Value{sqltypes.NewInt64(1)}, nil, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if got, want := len(vc.queries), 1; got != want {
+		t.Errorf("vc.queries length: %v, want %v", got, want)
+	}
 }
@@ -0,0 +1,161 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/golang/glog"
+
+	"github.com/youtube/vitess/go/sqltypes"
+
+	querypb "github.com/youtube/vitess/go/vt/proto/query"
+)
+
+var (
+	_ IndexValidator = (*LookupNonUnique)(nil)
+	_ IndexValidator = (*LookupUnique)(nil)
+	_ IndexValidator = (*LookupHash)(nil)
+	_ IndexValidator = (*LookupHashUnique)(nil)
+)
+
+// IndexValidator is implemented by the vindexes that can check that
+// their backing table has the index they rely on, to catch schema
+// drift before it corrupts the vindex or slows it down.
+type IndexValidator interface {
+	ValidateIndex(vcursor VCursor) error
+}
+
+const tableIndexesQuery = "select index_name, non_unique, column_name from information_schema.statistics where table_schema = database() and table_name = :table_name order by index_name, seq_in_index"
+
+// MissingIndexError is returned by the ValidateIndex of a unique
+// vindex whose table has no unique index on its from columns, which
+// lets Create insert a second mapping for an id and breaks Map.
+type MissingIndexError struct {
+	Vindex  string
+	Table   string
+	Columns []string
+	// Indexes describes the indexes that the table has.
+	Indexes []string
+}
+
+func (e *MissingIndexError) Error() string {
+	return fmt.Sprintf("lookup.ValidateIndex: table %s of unique vindex %s has no unique index on its from columns, want unique key (%s), have: %s", e.Table, e.Vindex, strings.Join(e.Columns, ", "), strings.Join(e.Indexes, ", "))
+}
+
+// tableIndex is an index of the vindex table.
+type tableIndex struct {
+	name    string
+	unique  bool
+	columns []string
+}
+
+func (ti *tableIndex) String() string {
+	kind := "key"
+	if ti.unique {
+		kind = "unique key"
+	}
+	return fmt.Sprintf("%s %s (%s)", kind, ti.name, strings.Join(ti.columns, ", "))
+}
+
+// validateIndex reads the indexes of the table from information_schema,
+// with the same limitations as EstimateRows. If unique is true, it fails
+// with a *MissingIndexError unless a unique index only has from columns.
+// Otherwise, it logs a warning if no index starts with the first from
+// column, which Map and Verify query by. In both cases, it fails if an
+// index named by the index_hint of the vindex is missing.
+func (lkp *lookupInternal) validateIndex(vcursor VCursor, unique bool) error {
+	indexes, err := lkp.tableIndexes(vcursor)
+	if err != nil {
+		return err
+	}
+	if err := lkp.checkIndexHint(indexes); err != nil {
+		return err
+	}
+	if unique {
+		for _, index := range indexes {
+			if index.unique && lkp.fromColumnsOnly(index.columns) {
+				return nil
+			}
+		}
+		e := &MissingIndexError{
+			Vindex:  lkp.name,
+			Table:   lkp.Table,
+			Columns: lkp.FromColumns,
+		}
+		for _, index := range indexes {
+			e.Indexes = append(e.Indexes, index.String())
+		}
+		return e
+	}
+	for _, index := range indexes {
+		if strings.EqualFold(index.columns[0], lkp.FromColumns[0]) {
+			return nil
+		}
+	}
+	log.Warningf("lookup.ValidateIndex: table %s of vindex %s has no index on %s, which Map and Verify query by, want key (%s)", lkp.Table, lkp.name, lkp.FromColumns[0], lkp.FromColumns[0])
+	return nil
+}
+
+// tableIndexes returns the indexes of the table.
+func (lkp *lookupInternal) tableIndexes(vcursor VCursor) ([]*tableIndex, error) {
+	bindVars := map[string]*querypb.BindVariable{
+		"table_name": sqltypes.StringBindVariable(unqualifiedTable(lkp.Table)),
+	}
+	result, err := lkp.executeRead(vcursor, "VindexValidateIndex", tableIndexesQuery, bindVars, false /* isDML */)
+	if err != nil {
+		return nil, fmt.Errorf("lookup.ValidateIndex: %v", err)
+	}
+	if len(result.Rows) == 0 {
+		return nil, fmt.Errorf("lookup.ValidateIndex: table %s not found or has no index", lkp.Table)
+	}
+	var indexes []*tableIndex
+	for _, row := range result.Rows {
+		if len(row) != 3 {
+			return nil, fmt.Errorf("lookup.ValidateIndex: got %d columns from information_schema, want 3", len(row))
+		}
+		name := row[0].ToString()
+		if len(indexes) == 0 || indexes[len(indexes)-1].name != name {
+			nonUnique, err := sqltypes.ToInt64(row[1])
+			if err != nil {
+				return nil, fmt.Errorf("lookup.ValidateIndex: %v", err)
+			}
+			indexes = append(indexes, &tableIndex{name: name, unique: nonUnique == 0})
+		}
+		index := indexes[len(indexes)-1]
+		index.columns = append(index.columns, row[2].ToString())
+	}
+	return indexes, nil
+}
+
+// fromColumnsOnly returns true if all the columns are from columns.
+func (lkp *lookupInternal) fromColumnsOnly(columns []string) bool {
+	for _, column := range columns {
+		found := false
+		for _, from := range lkp.FromColumns {
+			if strings.EqualFold(column, from) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
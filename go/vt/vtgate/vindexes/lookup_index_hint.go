@@ -0,0 +1,87 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// indexHintRegexp matches the index_hint param: USE INDEX or FORCE
+// INDEX, and a list of index names in parentheses.
+var indexHintRegexp = regexp.MustCompile(`(?i)^\s*(use|force)\s+index\s*\(([^()]*)\)\s*$`)
+
+// indexNameRegexp matches an index name of index_hint.
+var indexNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_$]+$`)
+
+// initIndexHint initializes IndexHint from the index_hint param, in
+// its canonical form, like "force index (`idx_from`)". It must be called
+// once QueryBuilder is set, since a custom query builder's queries
+// cannot be hinted.
+func (lkp *lookupInternal) initIndexHint(lookupQueryParams map[string]string) error {
+	hint := lookupQueryParams["index_hint"]
+	if hint == "" {
+		return nil
+	}
+	if lkp.QueryBuilder != "" {
+		return fmt.Errorf("index_hint cannot be used with query_builder %s", lkp.QueryBuilder)
+	}
+	match := indexHintRegexp.FindStringSubmatch(hint)
+	if match == nil {
+		return fmt.Errorf("index_hint must be like 'use index (name)' or 'force index (name)': '%s'", hint)
+	}
+	var names, quoted []string
+	for _, name := range strings.Split(match[2], ",") {
+		name = strings.TrimSpace(name)
+		if !indexNameRegexp.MatchString(name) {
+			return fmt.Errorf("index_hint has an invalid index name: '%s'", hint)
+		}
+		names = append(names, name)
+		quoted = append(quoted, quoteIdent(name))
+	}
+	lkp.IndexHint = fmt.Sprintf("%s index (%s)", strings.ToLower(match[1]), strings.Join(quoted, ", "))
+	lkp.indexHintNames = names
+	return nil
+}
+
+// withIndexHint returns query, a query of the default query builder,
+// with IndexHint after its table.
+func (lkp *lookupInternal) withIndexHint(query string) string {
+	if lkp.IndexHint == "" {
+		return query
+	}
+	from := " from " + quoteIdent(lkp.Table) + " "
+	return strings.Replace(query, from, from+lkp.IndexHint+" ", 1)
+}
+
+// checkIndexHint fails if an index of IndexHint is not in indexes.
+func (lkp *lookupInternal) checkIndexHint(indexes []*tableIndex) error {
+	for _, name := range lkp.indexHintNames {
+		found := false
+		for _, index := range indexes {
+			if strings.EqualFold(index.name, name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("lookup.ValidateIndex: table %s of vindex %s has no index %s, which its index_hint names", lkp.Table, lkp.name, name)
+		}
+	}
+	return nil
+}
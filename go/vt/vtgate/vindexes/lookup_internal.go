@@ -18,147 +18,1672 @@ package vindexes
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/sync2"
+	"github.com/youtube/vitess/go/vt/concurrency"
+	"github.com/youtube/vitess/go/vt/logutil"
 
 	querypb "github.com/youtube/vitess/go/vt/proto/query"
 )
 
+// lookupParams are the params recognized by all the lookup vindexes.
+// Unless allow_unknown_params is true, Init fails if it's passed any
+// param that is not in the list of its vindex type, which adds the
+// params of the type to these, like lookupNonUniqueParams.
+var lookupParams = []string{
+	"table",
+	"from",
+	"to",
+	"autocommit",
+	"source_pk_column",
+	"deadlock_retries",
+	"allow_unknown_params",
+	"from_list",
+	"full_scan_threshold",
+	"cache_size",
+	"cache_ttl",
+	"json_hex",
+	"delete_by_source_pk",
+	"shard_key_column",
+	"shard_key_prefix",
+	"self_test_id",
+	"warn_on_empty_map",
+	"verify_before_create",
+	"retry_on_missing_table",
+	"estimate_rows_ttl",
+	"estimate_rows_count",
+	"commit_batch_size",
+	"prepared_statements",
+	"query_builder",
+	"ttl_column",
+	"ttl_column_type",
+	"log_queries",
+	"log_queries_redact",
+	"adaptive_cost",
+	"adaptive_cost_min",
+	"adaptive_cost_max",
+	"adaptive_cost_unit",
+	"adaptive_cost_smoothing",
+	"connection_pool",
+	"read_only",
+	"consolidate_lookups",
+	"max_inflight_mutations",
+	"collation_check",
+	"upsert_only_changed",
+	"require_qualified_table",
+	"read_cell",
+	"dedupe_ids",
+	"created_at_column",
+	"updated_at_column",
+	"write_only_dry_run",
+	"error_context",
+	"snapshot_reads",
+	"delete_missing",
+	"index_hint",
+}
+
+// lookupNonUniqueParams are the params recognized by the lookup
+// vindexes.
+var lookupNonUniqueParams = withLookupParams(
+	"write_only",
+	"write_only_cost",
+	"distinct",
+	"coalesce_ranges",
+	"lookup_id_ranges",
+	"scatter_on_error",
+	"ksid_encoding",
+	"to_hash",
+	"prefix_match",
+	"async_writes",
+	"async_queue_size",
+	"pending_create_timeout",
+)
+
+// lookupUniqueParams are the params recognized by the lookup_unique
+// vindexes.
+var lookupUniqueParams = withLookupParams(
+	"on_missing",
+	"strict_unique_verify",
+	"allow_multi",
+	"write_only",
+	"ksid_encoding",
+	"to_hash",
+	"async_writes",
+	"async_queue_size",
+	"pending_create_timeout",
+)
+
+// lookupHashParams are the params recognized by the lookup_hash
+// vindexes, which store the keyspace id as a number.
+var lookupHashParams = withLookupParams(
+	"write_only",
+	"write_only_cost",
+)
+
+// lookupHashUniqueParams are the params recognized by the
+// lookup_hash_unique vindexes.
+var lookupHashUniqueParams = withLookupParams(
+	"write_only",
+)
+
+// withLookupParams returns params along with lookupParams.
+func withLookupParams(params ...string) []string {
+	return append(append([]string(nil), lookupParams...), params...)
+}
+
+// lookupEmptyMaps counts, by vindex, the Map calls of the vindexes
+// with warn_on_empty_map for which none of the ids had a mapping.
+var lookupEmptyMaps = newSinkCounters("VindexLookupEmptyMaps")
+
+// lookupDedupedIDs counts, by vindex, the ids of the Map calls of the
+// vindexes with dedupe_ids that reused the result of an earlier id of
+// the same call.
+var lookupDedupedIDs = newSinkCounters("VindexLookupDedupedIDs")
+
+// lookupDryRunRows counts, by vindex, the rows that the vindexes with
+// write_only_dry_run would have inserted.
+var lookupDryRunRows = newSinkCounters("VindexLookupDryRunRows")
+
+// defaultWriteOnlyCost is the cost of a write_only lookup vindex.
+// It reflects the full scatter done by its Map.
+const defaultWriteOnlyCost = 100
+
 // lookupInternal implements the functions for the Lookup vindexes.
 type lookupInternal struct {
-	Table         string   `json:"table"`
-	FromColumns   []string `json:"from_columns"`
-	To            string   `json:"to"`
-	Autocommit    bool     `json:"autocommit,omitempty"`
-	Upsert        bool     `json:"upsert,omitempty"`
+	Table       string   `json:"table"`
+	FromColumns []string `json:"from_columns"`
+	To          string   `json:"to"`
+	Autocommit  bool     `json:"autocommit,omitempty"`
+	Upsert      bool     `json:"upsert,omitempty"`
+	// RequireQualifiedTable makes Init fail if Table is not
+	// qualified by a keyspace.
+	RequireQualifiedTable bool `json:"require_qualified_table,omitempty"`
+	// UpsertOnlyChanged makes the upsert of Create leave an existing
+	// row as is if its to value does not change, instead of also
+	// updating its other columns, like its source pk.
+	UpsertOnlyChanged bool `json:"upsert_only_changed,omitempty"`
+	// SourcePKColumn, if set, is the column that records the primary
+	// key of the source row for which a lookup entry was created.
+	// It does not participate in the from->to mapping.
+	SourcePKColumn string `json:"source_pk_column,omitempty"`
+	// DeleteBySourcePK makes DeleteWithSourcePK delete rows by
+	// SourcePKColumn instead of by their from values.
+	DeleteBySourcePK bool `json:"delete_by_source_pk,omitempty"`
+	// DeleteMissing is what Delete does for a row that has no mapping
+	// to the deleted value: nothing if it's empty or "ignore", or fail
+	// with a *NotFoundError if it's "error".
+	DeleteMissing string `json:"delete_missing,omitempty"`
+	// CreatedAtColumn and UpdatedAtColumn, if set, are columns that
+	// record when each row was created and last updated. Create sets
+	// them to NOW(), and its upsert only sets UpdatedAtColumn. Like
+	// SourcePKColumn, they don't participate in the mapping.
+	CreatedAtColumn string `json:"created_at_column,omitempty"`
+	UpdatedAtColumn string `json:"updated_at_column,omitempty"`
+	// KsidEncoding is the name of the KsidCodec used by the vindex.
+	// It's only recorded here for display.
+	KsidEncoding string `json:"ksid_encoding,omitempty"`
+	// ToHash is true if the table stores the md5 hash of the
+	// keyspace ids instead of the keyspace ids. It's only recorded
+	// here for display, like KsidEncoding.
+	ToHash bool `json:"to_hash,omitempty"`
+	// QueryBuilder is the name of the LookupQueryBuilder that built
+	// the queries, if it's not the default one.
+	QueryBuilder string `json:"query_builder,omitempty"`
+	// DeadlockRetries is the number of times an autocommit
+	// mutation is retried if it fails due to a deadlock.
+	DeadlockRetries int `json:"deadlock_retries,omitempty"`
+	// CommitBatchSize, if not zero, is the maximum number of rows
+	// that an autocommit Create inserts per transaction. Larger
+	// Creates are split into several inserts.
+	CommitBatchSize int `json:"commit_batch_size,omitempty"`
+	// AsyncWrites makes Create and Update queue their inserts and
+	// return, for a background worker to execute them later. It
+	// requires Autocommit. The vindex is then only eventually
+	// consistent, and its errors are only logged.
+	// DrainAsyncWrites must be called on shutdown. AsyncQueueSize is
+	// the number of mutations that can be queued before the next one
+	// blocks.
+	AsyncWrites    bool `json:"async_writes,omitempty"`
+	AsyncQueueSize int  `json:"async_queue_size,omitempty"`
+	// MaxInflightMutations, if not zero, is the maximum number of
+	// mutations that the vindex executes at once. The others wait.
+	MaxInflightMutations int `json:"max_inflight_mutations,omitempty"`
+	// ConsolidateLookups makes concurrent lookups of the same id
+	// share one query. See consolidatedFetchOne. Like a cached result,
+	// a shared result can come from the query of another session.
+	ConsolidateLookups bool `json:"consolidate_lookups,omitempty"`
+	// DedupeIDs makes Lookup look up the ids that are repeated in
+	// one call once, and return the same result for each of them.
+	DedupeIDs bool `json:"dedupe_ids,omitempty"`
+	// ReadOnly makes Create, Update and Delete fail, to freeze the
+	// table while it's validated. Map and Verify are not affected.
+	ReadOnly bool `json:"read_only,omitempty"`
+	// ErrorContext makes the operations wrap their errors in an
+	// *OperationError, which tells the vindex, the operation and its
+	// inputs.
+	ErrorContext bool `json:"error_context,omitempty"`
+	// WriteOnlyDryRun makes the inserts of a write_only vindex be
+	// logged, with dryRunLog, and counted instead of executed.
+	WriteOnlyDryRun bool `json:"write_only_dry_run,omitempty"`
+	// PendingCreateTimeout is the time after which the transaction
+	// of a PendingCreate that is not finished is rolled back. Zero
+	// means defaultPendingCreateTimeout.
+	PendingCreateTimeout time.Duration `json:"pending_create_timeout,omitempty"`
+	// ConnectionPool is the name of the connection pool that the
+	// autocommit queries are executed on, if the VCursor is a
+	// PooledVCursor.
+	ConnectionPool string `json:"connection_pool,omitempty"`
+	// ReadCell is the cell that the queries of Map and Verify are
+	// executed in, if the VCursor is a CellVCursor. They're then
+	// executed outside of the transaction, and may lag behind the
+	// primary.
+	ReadCell string `json:"read_cell,omitempty"`
+	// SnapshotReads makes the queries of Map and Verify be executed in
+	// the transaction of the session, if the VCursor is a
+	// SnapshotVCursor that is in one. See snapshotRead.
+	SnapshotReads bool `json:"snapshot_reads,omitempty"`
+	// IndexHint is the USE INDEX or FORCE INDEX clause of the
+	// queries of Map and Verify, if any. indexHintNames are the
+	// names of its indexes, whose renames must be coordinated with
+	// the vschema, since MySQL fails the queries of a missing index.
+	IndexHint      string `json:"index_hint,omitempty"`
+	indexHintNames []string
+	// RetryOnMissingTable is the number of times the queries of
+	// Lookup and Verify are retried if the table doesn't exist,
+	// which can briefly happen during an online DDL.
+	RetryOnMissingTable int `json:"retry_on_missing_table,omitempty"`
+	// LogQueries makes the vindex log each query it executes, with
+	// its bind variables, at verbosity 2. LogQueriesRedact replaces
+	// the from values in the logged bind variables.
+	LogQueries       bool `json:"log_queries,omitempty"`
+	LogQueriesRedact bool `json:"log_queries_redact,omitempty"`
+	// AdaptiveCost makes Cost follow the latency of the lookups
+	// of Map. See adaptiveCost.
+	AdaptiveCost bool `json:"adaptive_cost,omitempty"`
+	// FromList, if set, specifies that the from column holds a
+	// list of values in the specified format: "csv" or "json".
+	// Each element of the list is stored as a separate row.
+	FromList string `json:"from_list,omitempty"`
+	// PrefixMatch makes Lookup return the rows whose from value
+	// starts with the given id, instead of the ones that are equal to
+	// it. See initPrefixMatch.
+	PrefixMatch bool `json:"prefix_match,omitempty"`
+	// FullScanThreshold, if not zero, is the number of ids above
+	// which Lookup reads the entire table once and filters the rows
+	// itself, instead of issuing one query per id.
+	FullScanThreshold int `json:"full_scan_threshold,omitempty"`
+	// ShardKeyColumn, if set, is a column of the table that holds
+	// a value derived from the (first) from value, and by which the
+	// table is sharded. Create fills it, and Verify filters on it so
+	// that it only goes to one shard. ShardKeyPrefix is the number of
+	// leading bytes of the from value stored in it, or 0 for all of it.
+	ShardKeyColumn string `json:"shard_key_column,omitempty"`
+	ShardKeyPrefix int    `json:"shard_key_prefix,omitempty"`
+	// SelfTestID, if set, is the from value of the entry that SelfTest
+	// creates, verifies and deletes. It must not be used by any row.
+	SelfTestID string `json:"self_test_id,omitempty"`
+	// CollationCheck, if set, makes SelfTest check the collation of
+	// the from columns: "warn" logs a mismatch, and "error" fails.
+	CollationCheck string `json:"collation_check,omitempty"`
+	// WarnOnEmptyMap makes Lookup log a warning, at most once a
+	// minute, and increment VindexLookupEmptyMaps if none of its
+	// ids has a mapping. This often means that the vindex is
+	// misconfigured or that its table was not backfilled.
+	WarnOnEmptyMap bool `json:"warn_on_empty_map,omitempty"`
+	// VerifyBeforeCreate makes Create look up the from values first.
+	// It fails with a *ConflictError if one of them already maps to a
+	// different to value, and skips the rows that already exist.
+	VerifyBeforeCreate bool `json:"verify_before_create,omitempty"`
+	// EstimateRowsTTL is how long EstimateRows caches its estimate,
+	// or 0 for defaultEstimateRowsTTL.
+	// EstimateRowsCount makes it count the rows of the table instead
+	// of reading the statistics of information_schema.
+	EstimateRowsTTL   time.Duration `json:"estimate_rows_ttl,omitempty"`
+	EstimateRowsCount bool          `json:"estimate_rows_count,omitempty"`
+	// CacheSize, if not zero, is the maximum number of from values
+	// whose lookup results are cached. CacheTTL limits how long an
+	// entry is cached. A zero CacheTTL means entries don't expire.
+	CacheSize int           `json:"cache_size,omitempty"`
+	CacheTTL  time.Duration `json:"cache_ttl,omitempty"`
+	// TTLColumn, if set, is a column of the table that holds the
+	// cache TTL of each row. TTLColumnType is its type: "seconds" for
+	// a number of seconds, or "unix_expiry" for an expiration time in
+	// seconds since the epoch. A from value is cached until the
+	// earliest expiration of its rows, or for CacheTTL if none of its
+	// rows has a value.
+	TTLColumn     string `json:"ttl_column,omitempty"`
+	TTLColumnType string `json:"ttl_column_type,omitempty"`
+	// JSONHex makes SnapshotCache write the values of the cached rows,
+	// which are mostly keyspace ids, as hex strings instead of base64,
+	// so that snapshots can be read and diffed.
+	JSONHex       bool `json:"json_hex,omitempty"`
+	name          string
+	cache         *lookupCache
+	estimate      *rowEstimate
+	emptyMapLog   *logutil.ThrottledLogger
+	dryRunLog     *logutil.ThrottledLogger
+	backoff       BackoffPolicy
+	errorMapper   ErrorMapper
 	sel, ver, del string
+	rev, scan     string
+	delPK         string
+	delFrom       string
+	// unique is set for the unique vindexes, where an Update with an
+	// empty keyspace id can delete the row of the old values, whatever
+	// its to value, since it's the only one.
+	unique bool
+	// cacheInvalidator is set by SetCacheInvalidator.
+	cacheInvalidator CacheInvalidator
+	// ins is the insert query of the query builder, if any.
+	ins string
+	// selPrefix and selPrefixFrom are the queries of PrefixMatch,
+	// with and without an upper bound.
+	selPrefix, selPrefixFrom string
+	// consolidator is set if ConsolidateLookups is set.
+	consolidator *sync2.Consolidator
+	// mutations is set if MaxInflightMutations is set.
+	mutations *mutationLimit
+	// async is the queue of Create if AsyncWrites is set.
+	async *asyncQueue
+	// adaptive is the adaptive cost if AdaptiveCost is set.
+	adaptive *adaptiveCost
+	// options contains the values of the custom options set by the
+	// vindex, by name. See RegisterLookupOption.
+	options map[string]interface{}
 }
 
-func (lkp *lookupInternal) Init(lookupQueryParams map[string]string, autocommit, upsert bool) error {
-	lkp.Table = lookupQueryParams["table"]
-	lkp.To = lookupQueryParams["to"]
+// Init initializes lkp from lookupQueryParams. params are the params
+// recognized by the type of the vindex, like lookupNonUniqueParams.
+// Each group of options is parsed by its own init function.
+func (lkp *lookupInternal) Init(name string, lookupQueryParams map[string]string, params []string, autocommit, upsert bool) error {
+	allowUnknown, err := boolFromMap(lookupQueryParams, "allow_unknown_params")
+	if err != nil {
+		return err
+	}
+	if !allowUnknown {
+		if unknown := unknownParams(lookupQueryParams, append(customLookupParams(), params...)); len(unknown) != 0 {
+			return fmt.Errorf("unknown params for lookup vindex on table %s: %s", lookupQueryParams["table"], strings.Join(unknown, ", "))
+		}
+	}
+
+	lkp.name = name
+	lkp.Autocommit = autocommit
+	lkp.Upsert = upsert
+	if err := lkp.initTable(lookupQueryParams); err != nil {
+		return err
+	}
+	if err := lkp.initWrites(lookupQueryParams); err != nil {
+		return err
+	}
+	if err := lkp.initReads(lookupQueryParams); err != nil {
+		return err
+	}
+	if err := lkp.initCache(lookupQueryParams); err != nil {
+		return err
+	}
+	if err := lkp.initDiagnostics(lookupQueryParams); err != nil {
+		return err
+	}
+	if err := lkp.initQueries(lookupQueryParams); err != nil {
+		return err
+	}
+	if err := lkp.parseCustomOptions(lookupQueryParams); err != nil {
+		return err
+	}
+	if lkp.AsyncWrites {
+		size := lkp.AsyncQueueSize
+		if size == 0 {
+			size = defaultAsyncQueueSize
+		}
+		lkp.async = newAsyncQueue(lkp, size)
+	}
+	return nil
+}
+
+// initTable parses the options that describe the table and its columns.
+func (lkp *lookupInternal) initTable(m map[string]string) error {
+	var err error
+	lkp.Table = m["table"]
+	lkp.RequireQualifiedTable, err = boolFromMap(m, "require_qualified_table")
+	if err != nil {
+		return err
+	}
+	if lkp.RequireQualifiedTable && !isQualifiedTable(lkp.Table) {
+		return fmt.Errorf("table %s of vindex %s must be qualified by its keyspace, like ks.%s, since require_qualified_table is set", lkp.Table, lkp.name, lkp.Table)
+	}
+	lkp.To = m["to"]
 	var fromColumns []string
-	for _, from := range strings.Split(lookupQueryParams["from"], ",") {
+	for _, from := range strings.Split(m["from"], ",") {
 		fromColumns = append(fromColumns, strings.TrimSpace(from))
 	}
 	lkp.FromColumns = fromColumns
+	lkp.SourcePKColumn = m["source_pk_column"]
+	lkp.KsidEncoding = m["ksid_encoding"]
+	lkp.ToHash, err = boolFromMap(m, "to_hash")
+	if err != nil {
+		return err
+	}
+	if lkp.ToHash && lkp.KsidEncoding != "" {
+		return fmt.Errorf("to_hash cannot be used with ksid_encoding for vindex table %s", lkp.Table)
+	}
+	lkp.FromList = m["from_list"]
+	switch lkp.FromList {
+	case "":
+	case "csv", "json":
+		if len(lkp.FromColumns) != 1 {
+			return fmt.Errorf("from_list is only supported for a single from column: %v", lkp.FromColumns)
+		}
+	default:
+		return fmt.Errorf("from_list value must be 'csv' or 'json': '%s'", lkp.FromList)
+	}
+	lkp.ShardKeyColumn = m["shard_key_column"]
+	lkp.ShardKeyPrefix, err = intFromMap(m, "shard_key_prefix")
+	if err != nil {
+		return err
+	}
+	if lkp.ShardKeyPrefix != 0 && lkp.ShardKeyColumn == "" {
+		return fmt.Errorf("shard_key_prefix requires shard_key_column for vindex table %s", lkp.Table)
+	}
+	return nil
+}
 
-	lkp.Autocommit = autocommit
-	lkp.Upsert = upsert
+// initWrites parses the options of Create, Update and Delete.
+func (lkp *lookupInternal) initWrites(m map[string]string) error {
+	var err error
+	lkp.DeleteBySourcePK, err = boolFromMap(m, "delete_by_source_pk")
+	if err != nil {
+		return err
+	}
+	if lkp.DeleteBySourcePK && lkp.SourcePKColumn == "" {
+		return fmt.Errorf("delete_by_source_pk requires source_pk_column for vindex table %s", lkp.Table)
+	}
+	lkp.DeleteMissing = m["delete_missing"]
+	switch lkp.DeleteMissing {
+	case "", deleteMissingIgnore:
+	case deleteMissingError:
+		if lkp.Autocommit {
+			return fmt.Errorf("delete_missing cannot be %s with autocommit, whose Delete is a no-op, for vindex table %s", deleteMissingError, lkp.Table)
+		}
+	default:
+		return fmt.Errorf("delete_missing value must be %s or %s: '%s'", deleteMissingIgnore, deleteMissingError, lkp.DeleteMissing)
+	}
+	lkp.DeadlockRetries, err = intFromMap(m, "deadlock_retries")
+	if err != nil {
+		return err
+	}
+	lkp.CommitBatchSize, err = intFromMap(m, "commit_batch_size")
+	if err != nil {
+		return err
+	}
+	if lkp.CommitBatchSize != 0 && !lkp.Autocommit {
+		return fmt.Errorf("commit_batch_size requires autocommit for vindex table %s", lkp.Table)
+	}
+	lkp.ReadOnly, err = boolFromMap(m, "read_only")
+	if err != nil {
+		return err
+	}
+	if err := lkp.initAsyncWrites(m); err != nil {
+		return err
+	}
+	lkp.MaxInflightMutations, err = intFromMap(m, "max_inflight_mutations")
+	if err != nil {
+		return err
+	}
+	if lkp.MaxInflightMutations != 0 {
+		lkp.mutations = newMutationLimit(lkp, lkp.MaxInflightMutations)
+	}
+	if timeout := m["pending_create_timeout"]; timeout != "" {
+		if lkp.PendingCreateTimeout, err = time.ParseDuration(timeout); err != nil || lkp.PendingCreateTimeout <= 0 {
+			return fmt.Errorf("pending_create_timeout value must be a positive duration: '%s'", timeout)
+		}
+	}
+	lkp.UpsertOnlyChanged, err = boolFromMap(m, "upsert_only_changed")
+	if err != nil {
+		return err
+	}
+	if lkp.UpsertOnlyChanged && !lkp.Upsert {
+		return fmt.Errorf("upsert_only_changed requires the upserts of a non-unique autocommit vindex for vindex table %s", lkp.Table)
+	}
+	lkp.VerifyBeforeCreate, err = boolFromMap(m, "verify_before_create")
+	if err != nil {
+		return err
+	}
+	lkp.WriteOnlyDryRun, err = boolFromMap(m, "write_only_dry_run")
+	if err != nil {
+		return err
+	}
+	if lkp.WriteOnlyDryRun {
+		writeOnly, err := boolFromMap(m, "write_only")
+		if err != nil {
+			return err
+		}
+		if !writeOnly {
+			return fmt.Errorf("write_only_dry_run requires write_only for vindex table %s", lkp.Table)
+		}
+		lkp.dryRunLog = logutil.NewThrottledLogger("VindexLookupDryRun "+lkp.name, time.Minute)
+	}
+	return nil
+}
+
+// initAsyncWrites parses async_writes and async_queue_size. The queue
+// itself is created at the end of Init, once the vindex is complete.
+func (lkp *lookupInternal) initAsyncWrites(m map[string]string) error {
+	var err error
+	lkp.AsyncWrites, err = boolFromMap(m, "async_writes")
+	if err != nil {
+		return err
+	}
+	if lkp.AsyncWrites && !lkp.Autocommit {
+		return fmt.Errorf("async_writes requires autocommit, since the transaction of a queued mutation is gone by the time it's executed, for vindex table %s", lkp.Table)
+	}
+	if lkp.AsyncWrites && lkp.DeleteBySourcePK {
+		return fmt.Errorf("delete_by_source_pk cannot be used with async_writes for vindex table %s", lkp.Table)
+	}
+	if lkp.AsyncWrites && lkp.ReadOnly {
+		return fmt.Errorf("read_only cannot be used with async_writes for vindex table %s", lkp.Table)
+	}
+	lkp.AsyncQueueSize, err = intFromMap(m, "async_queue_size")
+	if err != nil {
+		return err
+	}
+	if lkp.AsyncQueueSize != 0 && !lkp.AsyncWrites {
+		return fmt.Errorf("async_queue_size requires async_writes for vindex table %s", lkp.Table)
+	}
+	return nil
+}
+
+// initReads parses the options of how Map and Verify read the table.
+func (lkp *lookupInternal) initReads(m map[string]string) error {
+	var err error
+	lkp.ConsolidateLookups, err = boolFromMap(m, "consolidate_lookups")
+	if err != nil {
+		return err
+	}
+	if lkp.ConsolidateLookups {
+		lkp.consolidator = sync2.NewConsolidator()
+	}
+	lkp.DedupeIDs, err = boolFromMap(m, "dedupe_ids")
+	if err != nil {
+		return err
+	}
+	lkp.ConnectionPool = m["connection_pool"]
+	if lkp.ConnectionPool != "" && !lkp.Autocommit {
+		return fmt.Errorf("connection_pool requires autocommit for vindex table %s", lkp.Table)
+	}
+	lkp.ReadCell = m["read_cell"]
+	lkp.SnapshotReads, err = boolFromMap(m, "snapshot_reads")
+	if err != nil {
+		return err
+	}
+	if lkp.SnapshotReads && lkp.Autocommit {
+		return fmt.Errorf("snapshot_reads cannot be used with autocommit, whose writes are not in the transaction, for vindex table %s", lkp.Table)
+	}
+	lkp.RetryOnMissingTable, err = intFromMap(m, "retry_on_missing_table")
+	if err != nil {
+		return err
+	}
+	if _, ok := m["prepared_statements"]; ok {
+		return fmt.Errorf("prepared_statements is not supported: vtgate cannot execute prepared statements, which need a MySQL connection of their own, for vindex table %s", lkp.Table)
+	}
+	lkp.PrefixMatch, err = boolFromMap(m, "prefix_match")
+	if err != nil {
+		return err
+	}
+	lkp.FullScanThreshold, err = intFromMap(m, "full_scan_threshold")
+	if err != nil {
+		return err
+	}
+	if lkp.adaptive, err = adaptiveCostFromMap(m); err != nil {
+		return err
+	}
+	lkp.AdaptiveCost = lkp.adaptive != nil
+	return nil
+}
+
+// initCache parses the options of the cache of Map, and of EstimateRows.
+func (lkp *lookupInternal) initCache(m map[string]string) error {
+	var err error
+	lkp.CacheSize, err = intFromMap(m, "cache_size")
+	if err != nil {
+		return err
+	}
+	if ttl := m["cache_ttl"]; ttl != "" {
+		if lkp.CacheTTL, err = time.ParseDuration(ttl); err != nil {
+			return fmt.Errorf("cache_ttl value must be a duration: '%s'", ttl)
+		}
+	}
+	if lkp.CacheSize > 0 {
+		lkp.cache = newLookupCache(lkp.name, lkp.CacheSize, lkp.CacheTTL)
+	}
+	lkp.JSONHex, err = boolFromMap(m, "json_hex")
+	if err != nil {
+		return err
+	}
+	lkp.TTLColumn = m["ttl_column"]
+	if lkp.TTLColumn != "" {
+		if lkp.cache == nil {
+			return fmt.Errorf("ttl_column requires cache_size")
+		}
+		lkp.TTLColumnType = m["ttl_column_type"]
+		if lkp.TTLColumnType == "" {
+			lkp.TTLColumnType = ttlSeconds
+		}
+		if lkp.TTLColumnType != ttlSeconds && lkp.TTLColumnType != ttlUnixExpiry {
+			return fmt.Errorf("ttl_column_type value must be %s or %s: '%s'", ttlSeconds, ttlUnixExpiry, lkp.TTLColumnType)
+		}
+	} else if _, ok := m["ttl_column_type"]; ok {
+		return fmt.Errorf("ttl_column_type requires ttl_column")
+	}
+	if ttl := m["estimate_rows_ttl"]; ttl != "" {
+		if lkp.EstimateRowsTTL, err = time.ParseDuration(ttl); err != nil {
+			return fmt.Errorf("estimate_rows_ttl value must be a duration: '%s'", ttl)
+		}
+	}
+	lkp.EstimateRowsCount, err = boolFromMap(m, "estimate_rows_count")
+	if err != nil {
+		return err
+	}
+	lkp.estimate = &rowEstimate{}
+	return nil
+}
+
+// initDiagnostics parses the options of logging, errors and SelfTest.
+func (lkp *lookupInternal) initDiagnostics(m map[string]string) error {
+	var err error
+	lkp.LogQueries, err = boolFromMap(m, "log_queries")
+	if err != nil {
+		return err
+	}
+	lkp.LogQueriesRedact, err = boolFromMap(m, "log_queries_redact")
+	if err != nil {
+		return err
+	}
+	if lkp.LogQueriesRedact && !lkp.LogQueries {
+		return fmt.Errorf("log_queries_redact requires log_queries for vindex table %s", lkp.Table)
+	}
+	lkp.WarnOnEmptyMap, err = boolFromMap(m, "warn_on_empty_map")
+	if err != nil {
+		return err
+	}
+	if lkp.WarnOnEmptyMap {
+		lkp.emptyMapLog = logutil.NewThrottledLogger("VindexLookupEmptyMap "+lkp.name, time.Minute)
+	}
+	lkp.ErrorContext, err = boolFromMap(m, "error_context")
+	if err != nil {
+		return err
+	}
+	lkp.SelfTestID = m["self_test_id"]
+	if lkp.SelfTestID != "" {
+		if len(lkp.FromColumns) != 1 {
+			return fmt.Errorf("self_test_id is only supported for a single from column: %v", lkp.FromColumns)
+		}
+		// The entry created by SelfTest could not be deleted.
+		if lkp.Autocommit {
+			return fmt.Errorf("self_test_id cannot be used with autocommit for vindex table %s", lkp.Table)
+		}
+	}
+	lkp.CollationCheck = m["collation_check"]
+	switch lkp.CollationCheck {
+	case "", "warn", "error":
+	default:
+		return fmt.Errorf("collation_check must be warn or error: '%s'", lkp.CollationCheck)
+	}
+	return nil
+}
+
+// initQueries builds the queries of the vindex, with its query_builder
+// if it has one, once the other options are parsed.
+func (lkp *lookupInternal) initQueries(m map[string]string) error {
+	builder, err := queryBuilderFromMap(m)
+	if err != nil {
+		return err
+	}
+	queries, err := builder.BuildQueries(lkp.Table, lkp.FromColumns, lkp.To)
+	if err == nil {
+		err = queries.validate(lkp.FromColumns, lkp.To)
+	}
+	if err != nil {
+		return fmt.Errorf("query_builder %s: %v", m["query_builder"], err)
+	}
+	if _, ok := builder.(DefaultLookupQueryBuilder); !ok {
+		lkp.QueryBuilder = m["query_builder"]
+		if lkp.ShardKeyColumn != "" {
+			return fmt.Errorf("shard_key_column cannot be used with query_builder %s", lkp.QueryBuilder)
+		}
+		if queries.Insert != "" && lkp.SourcePKColumn != "" {
+			return fmt.Errorf("source_pk_column cannot be used with the insert query of query_builder %s", lkp.QueryBuilder)
+		}
+		if queries.Insert != "" && lkp.UpsertOnlyChanged {
+			return fmt.Errorf("upsert_only_changed cannot be used with the insert query of query_builder %s", lkp.QueryBuilder)
+		}
+		if lkp.TTLColumn != "" {
+			return fmt.Errorf("ttl_column cannot be used with query_builder %s", lkp.QueryBuilder)
+		}
+	}
+	if err := lkp.initTimestampColumns(m, queries.Insert != ""); err != nil {
+		return err
+	}
+	if err := lkp.initIndexHint(m); err != nil {
+		return err
+	}
+	lkp.sel = queries.Lookup
+	if lkp.TTLColumn != "" {
+		lkp.sel = fmt.Sprintf("select %s, %s from %s where %s = :%s", quoteIdent(lkp.To), quoteIdent(lkp.TTLColumn), quoteIdent(lkp.Table), quoteIdent(lkp.FromColumns[0]), lkp.FromColumns[0])
+	}
+	lkp.ver = queries.Verify
+	if lkp.ShardKeyColumn != "" {
+		lkp.ver = fmt.Sprintf("select %s from %s where %s = :%s and %s = :%s and %s = :%s", quoteIdent(lkp.FromColumns[0]), quoteIdent(lkp.Table), quoteIdent(lkp.ShardKeyColumn), lkp.ShardKeyColumn, quoteIdent(lkp.FromColumns[0]), lkp.FromColumns[0], quoteIdent(lkp.To), lkp.To)
+	}
+	lkp.sel = lkp.withIndexHint(lkp.sel)
+	lkp.ver = lkp.withIndexHint(lkp.ver)
+	lkp.del = queries.Delete
+	lkp.ins = queries.Insert
+	lkp.delFrom = lkp.initDelStmt(false /* withTo */)
+	lkp.rev = fmt.Sprintf("select %s from %s where %s = :%s", quoteIdent(lkp.FromColumns[0]), quoteIdent(lkp.Table), quoteIdent(lkp.To), lkp.To)
+	if lkp.DeleteBySourcePK {
+		lkp.delPK = fmt.Sprintf("delete from %s where %s = :%s and %s = :%s", quoteIdent(lkp.Table), quoteIdent(lkp.SourcePKColumn), lkp.SourcePKColumn, quoteIdent(lkp.To), lkp.To)
+	}
+	lkp.scan = fmt.Sprintf("select %s, %s from %s", quoteIdent(lkp.FromColumns[0]), quoteIdent(lkp.To), quoteIdent(lkp.Table))
+	return lkp.initPrefixMatch()
+}
+
+// Lookup performs a lookup for the ids.
+// If FromList is set, an id can be a list, and the result
+// contains the rows of all its elements. A NULL id has no rows.
+// Its latency is recorded in VindexLookupMapLatency.
+func (lkp *lookupInternal) Lookup(vcursor VCursor, ids []sqltypes.Value) ([]*sqltypes.Result, error) {
+	start := time.Now()
+	results, err := lkp.lookup(vcursor, ids)
+	recordLookupLatency(vcursor, lkp.name, time.Since(start))
+	if err == nil && lkp.WarnOnEmptyMap {
+		lkp.checkEmptyMap(ids, results)
+	}
+	return results, lkp.mapError("Map", ids, err)
+}
+
+func (lkp *lookupInternal) lookup(vcursor VCursor, ids []sqltypes.Value) ([]*sqltypes.Result, error) {
+	if lkp.FullScanThreshold > 0 && len(ids) > lkp.FullScanThreshold && lkp.FromList == "" {
+		return lkp.lookupFullScan(vcursor, ids)
+	}
+	var seen map[string]*sqltypes.Result
+	if lkp.DedupeIDs {
+		seen = make(map[string]*sqltypes.Result, len(ids))
+	}
+	results := make([]*sqltypes.Result, 0, len(ids))
+	for _, id := range ids {
+		var key string
+		var dedupe bool
+		if seen != nil {
+			key, dedupe = valueKey(id)
+		}
+		if result, ok := seen[key]; dedupe && ok {
+			lookupDedupedIDs.Add(lkp.name, 1)
+			results = append(results, result)
+			continue
+		}
+		result, err := lkp.lookupID(vcursor, id)
+		if err != nil {
+			return nil, fmt.Errorf("lookup.Map: %v", err)
+		}
+		if dedupe {
+			seen[key] = result
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// lookupID returns the rows of id, or of the elements of id if FromList
+// is set.
+func (lkp *lookupInternal) lookupID(vcursor VCursor, id sqltypes.Value) (*sqltypes.Result, error) {
+	if lkp.FromList == "" {
+		return lkp.lookupOne(vcursor, id)
+	}
+	elems, err := splitFromList(lkp.FromList, id)
+	if err != nil {
+		return nil, err
+	}
+	result := &sqltypes.Result{}
+	for _, elem := range elems {
+		elemResult, err := lkp.lookupOne(vcursor, elem)
+		if err != nil {
+			return nil, err
+		}
+		result.Fields = elemResult.Fields
+		result.Rows = append(result.Rows, elemResult.Rows...)
+		result.RowsAffected += elemResult.RowsAffected
+	}
+	return result, nil
+}
+
+// checkEmptyMap warns if none of the non-empty ids has a mapping.
+func (lkp *lookupInternal) checkEmptyMap(ids []sqltypes.Value, results []*sqltypes.Result) {
+	if len(ids) == 0 {
+		return
+	}
+	for _, result := range results {
+		if len(result.Rows) != 0 {
+			return
+		}
+	}
+	lookupEmptyMaps.Add(lkp.name, 1)
+	lkp.emptyMapLog.Warningf("none of the %d ids have a mapping in table %s, e.g. %v", len(ids), lkp.Table, ids[0])
+}
+
+// lookupFullScan performs a lookup for the ids by reading the
+// entire table and filtering the rows in memory. The returned
+// results have the same shape as the ones of a regular Lookup.
+// Values are matched on their string representation, which means
+// that the comparison is binary, irrespective of the collation of
+// the from column.
+func (lkp *lookupInternal) lookupFullScan(vcursor VCursor, ids []sqltypes.Value) ([]*sqltypes.Result, error) {
+	result, err := lkp.executeRead(vcursor, "VindexLookup", lkp.scan, nil, false /* isDML */)
+	if err != nil {
+		return nil, fmt.Errorf("lookup.Map: %v", err)
+	}
+	if err := lkp.checkRows(result, 2); err != nil {
+		return nil, fmt.Errorf("lookup.Map: %v", err)
+	}
+	var fields []*querypb.Field
+	if len(result.Fields) == 2 {
+		fields = result.Fields[1:]
+	}
+	rowsByID := make(map[string][][]sqltypes.Value)
+	for _, row := range result.Rows {
+		if key, ok := valueKey(row[0]); ok {
+			rowsByID[key] = append(rowsByID[key], row[1:])
+		}
+	}
+	results := make([]*sqltypes.Result, 0, len(ids))
+	for _, id := range ids {
+		var rows [][]sqltypes.Value
+		if key, ok := valueKey(id); ok {
+			rows = rowsByID[key]
+		}
+		results = append(results, &sqltypes.Result{
+			Fields:       fields,
+			Rows:         rows,
+			RowsAffected: uint64(len(rows)),
+		})
+	}
+	return results, nil
+}
+
+func (lkp *lookupInternal) lookupOne(vcursor VCursor, id sqltypes.Value) (*sqltypes.Result, error) {
+	key, ok := valueKey(id)
+	if !ok {
+		return &sqltypes.Result{}, nil
+	}
+	if lkp.PrefixMatch {
+		return lkp.fetchPrefix(vcursor, id)
+	}
+	// A snapshot read cannot use the results of other sessions.
+	snapshot := lkp.snapshotRead(vcursor)
+	if lkp.cache != nil && !snapshot {
+		if result, ok := lkp.cache.Get(key); ok {
+			return result, nil
+		}
+	}
+	if lkp.consolidator != nil && !snapshot {
+		return lkp.consolidatedFetchOne(vcursor, key, id)
+	}
+	return lkp.fetchOne(vcursor, key, id)
+}
+
+// snapshotRead returns true if the queries of Map and Verify read the
+// snapshot of the transaction of vcursor: SnapshotReads is set, and
+// vcursor is a SnapshotVCursor in a transaction. They're then executed
+// in the transaction, and not cached, so that the reads of a transaction
+// see its own writes, and no mapping committed by another session
+// appears between them. Otherwise, they're executed as usual.
+func (lkp *lookupInternal) snapshotRead(vcursor VCursor) bool {
+	if !lkp.SnapshotReads {
+		return false
+	}
+	snapshot, ok := vcursor.(SnapshotVCursor)
+	return ok && snapshot.InTransaction()
+}
+
+// fetchOne reads the rows of id, whose key is key, from the table,
+// and caches them.
+func (lkp *lookupInternal) fetchOne(vcursor VCursor, key string, id sqltypes.Value) (*sqltypes.Result, error) {
+	bindVars := map[string]*querypb.BindVariable{
+		lkp.FromColumns[0]: sqltypes.ValueBindVariable(id),
+	}
+	var start time.Time
+	if lkp.adaptive != nil {
+		start = time.Now()
+	}
+	// The generation is read before the query, so that its result is
+	// not cached if the cache is invalidated while it runs.
+	cache := lkp.cache
+	if cache != nil && lkp.snapshotRead(vcursor) {
+		cache = nil
+	}
+	var generation int64
+	if cache != nil {
+		generation = cache.currentGeneration()
+	}
+	result, err := lkp.executeRead(vcursor, "VindexLookup", lkp.sel, bindVars, false /* isDML */)
+	if err != nil {
+		return nil, err
+	}
+	if err := lkp.checkRows(result, 1); err != nil {
+		return nil, err
+	}
+	if lkp.adaptive != nil {
+		lkp.adaptive.record(time.Since(start))
+	}
+	if lkp.TTLColumn != "" {
+		result, ttl, ok := lkp.splitTTL(result)
+		if ok && cache != nil {
+			cache.setAt(key, result, ttl, generation)
+		}
+		return result, nil
+	}
+	if cache != nil {
+		cache.setAt(key, result, cache.ttl, generation)
+	}
+	return result, nil
+}
+
+// The values of ttl_column_type.
+const (
+	ttlSeconds    = "seconds"
+	ttlUnixExpiry = "unix_expiry"
+)
+
+// The values of delete_missing.
+const (
+	deleteMissingIgnore = "ignore"
+	deleteMissingError  = "error"
+)
+
+// splitTTL removes the TTLColumn from a result of lkp.sel, and returns
+// how long the result can be cached: until the earliest expiration of
+// its rows, or CacheTTL if none of them has a TTL. It returns false if
+// a row has already expired, in which case the result must not be
+// cached. Values that aren't integers are treated like NULLs.
+func (lkp *lookupInternal) splitTTL(result *sqltypes.Result) (*sqltypes.Result, time.Duration, bool) {
+	stripped := &sqltypes.Result{
+		Rows:         make([][]sqltypes.Value, 0, len(result.Rows)),
+		RowsAffected: result.RowsAffected,
+	}
+	if len(result.Fields) != 0 {
+		stripped.Fields = result.Fields[:1]
+	}
+	ttl, found := time.Duration(0), false
+	for _, row := range result.Rows {
+		stripped.Rows = append(stripped.Rows, row[:1])
+		if len(row) < 2 || row[1].IsNull() {
+			continue
+		}
+		v, err := sqltypes.ToInt64(row[1])
+		if err != nil {
+			continue
+		}
+		rowTTL := time.Duration(v) * time.Second
+		if lkp.TTLColumnType == ttlUnixExpiry {
+			rowTTL = time.Unix(v, 0).Sub(lkp.cache.now())
+		}
+		if !found || rowTTL < ttl {
+			ttl, found = rowTTL, true
+		}
+	}
+	if !found {
+		return stripped, lkp.CacheTTL, true
+	}
+	return stripped, ttl, ttl > 0
+}
+
+// checkRows fails if a row of result, read from the table of the
+// vindex, has fewer than columns values. A broken backing table, like
+// a view whose definition changed, can return such rows, which would
+// otherwise make the vindex panic when it reads them.
+func (lkp *lookupInternal) checkRows(result *sqltypes.Result, columns int) error {
+	for i, row := range result.Rows {
+		if len(row) < columns {
+			return fmt.Errorf("malformed result from table %s of vindex %s: row %d has %d columns, want %d", lkp.Table, lkp.name, i, len(row), columns)
+		}
+	}
+	return nil
+}
+
+// cost returns the cost of the vindex, which is static unless
+// AdaptiveCost is set.
+func (lkp *lookupInternal) cost(static int) int {
+	if lkp.adaptive == nil {
+		return static
+	}
+	return lkp.adaptive.cost(static)
+}
+
+// invalidate removes the cached results of the from values of rowsColValues.
+func (lkp *lookupInternal) invalidate(rowsColValues [][]sqltypes.Value) {
+	if lkp.cache == nil {
+		return
+	}
+	for _, row := range rowsColValues {
+		if key, ok := valueKey(row[0]); ok {
+			lkp.cache.Delete(key)
+		}
+	}
+}
+
+// ReverseLookup performs a lookup of the from values for the
+// specified to values. Like Lookup, only the first from column
+// is returned for multi-column vindexes.
+func (lkp *lookupInternal) ReverseLookup(vcursor VCursor, values []sqltypes.Value) ([]*sqltypes.Result, error) {
+	results := make([]*sqltypes.Result, 0, len(values))
+	for _, value := range values {
+		bindVars := map[string]*querypb.BindVariable{
+			lkp.To: sqltypes.ValueBindVariable(value),
+		}
+		lkp.logQuery("VindexReverseLookup", lkp.rev, bindVars)
+		var err error
+		var result *sqltypes.Result
+		if lkp.Autocommit {
+			result, err = lkp.executeAutocommit(vcursor, "VindexReverseLookup", lkp.rev, bindVars, false /* isDML */)
+		} else {
+			result, err = vcursor.Execute("VindexReverseLookup", lkp.rev, bindVars, false /* isDML */)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("lookup.ReverseMap: %v", err)
+		}
+		if err := lkp.checkRows(result, 1); err != nil {
+			return nil, fmt.Errorf("lookup.ReverseMap: %v", err)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Verify returns true if ids map to values.
+// If FromList is set, an id can be a list, and it's
+// verified if any of its elements maps to the value.
+// A NULL id is never verified.
+func (lkp *lookupInternal) Verify(vcursor VCursor, ids, values []sqltypes.Value) ([]bool, error) {
+	out, err := lkp.verify(vcursor, ids, values)
+	return out, lkp.mapError("Verify", ids, err)
+}
+
+// verify implements Verify.
+func (lkp *lookupInternal) verify(vcursor VCursor, ids, values []sqltypes.Value) ([]bool, error) {
+	out := make([]bool, len(ids))
+	for i, id := range ids {
+		elems := []sqltypes.Value{id}
+		if lkp.FromList != "" {
+			var err error
+			if elems, err = splitFromList(lkp.FromList, id); err != nil {
+				return nil, fmt.Errorf("lookup.Verify: %v", err)
+			}
+		}
+		for _, elem := range elems {
+			ok, err := lkp.verifyOne(vcursor, elem, values[i])
+			if err != nil {
+				return nil, fmt.Errorf("lookup.Verify: %v", err)
+			}
+			if ok {
+				out[i] = true
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+func (lkp *lookupInternal) verifyOne(vcursor VCursor, id, value sqltypes.Value) (bool, error) {
+	if id.IsNull() {
+		return false, nil
+	}
+	bindVars := map[string]*querypb.BindVariable{
+		lkp.FromColumns[0]: sqltypes.ValueBindVariable(id),
+		lkp.To:             sqltypes.ValueBindVariable(value),
+	}
+	if lkp.ShardKeyColumn != "" {
+		bindVars[lkp.ShardKeyColumn] = sqltypes.ValueBindVariable(lkp.shardKey(id))
+	}
+	result, err := lkp.executeRead(vcursor, "VindexVerify", lkp.ver, bindVars, true /* isDML */)
+	if err != nil {
+		return false, err
+	}
+	return len(result.Rows) != 0, nil
+}
+
+// VerifyMappings returns all the rows of each id, for a Verify that
+// must see every mapping of an id, like the one of
+// strict_unique_verify. Unlike Lookup, it always reads the table: it
+// skips the cache and the consolidator, and it's not counted in the
+// stats of Map. A NULL id has no rows.
+func (lkp *lookupInternal) VerifyMappings(vcursor VCursor, ids []sqltypes.Value) ([]*sqltypes.Result, error) {
+	results := make([]*sqltypes.Result, 0, len(ids))
+	for _, id := range ids {
+		result, err := lkp.verifyMappingsOne(vcursor, id)
+		if err != nil {
+			return nil, lkp.mapError("Verify", ids, fmt.Errorf("lookup.Verify: %v", err))
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (lkp *lookupInternal) verifyMappingsOne(vcursor VCursor, id sqltypes.Value) (*sqltypes.Result, error) {
+	if id.IsNull() {
+		return &sqltypes.Result{}, nil
+	}
+	bindVars := map[string]*querypb.BindVariable{
+		lkp.FromColumns[0]: sqltypes.ValueBindVariable(id),
+	}
+	result, err := lkp.executeRead(vcursor, "VindexVerify", lkp.sel, bindVars, false /* isDML */)
+	if err != nil {
+		return nil, err
+	}
+	if err := lkp.checkRows(result, 1); err != nil {
+		return nil, err
+	}
+	if lkp.TTLColumn == "" {
+		return result, nil
+	}
+	// The ttl column isn't part of the mapping.
+	stripped := &sqltypes.Result{RowsAffected: result.RowsAffected}
+	if len(result.Fields) != 0 {
+		stripped.Fields = result.Fields[:1]
+	}
+	for _, row := range result.Rows {
+		stripped.Rows = append(stripped.Rows, row[:1])
+	}
+	return stripped, nil
+}
+
+// Create creates an association between rowsColValues and toValues by inserting rows in the vindex table.
+// rowsColValues contains all the rows that are being inserted.
+// For each row, we store the value of each column defined in the vindex.
+// toValues contains the keyspace_id of each row being inserted.
+// Given a vindex with two columns and the following insert:
+//
+// INSERT INTO table_a (colum_a, column_b, column_c) VALUES (value_a0, value_b0, value_c0), (value_a1, value_b1, value_c1);
+// If we assume that the primary vindex is on column_c. The call to create will look like this:
+// Create(vcursor, [[value_a0, value_b0,], [value_a1, value_b1]], [binary(value_c0), binary(value_c1)])
+// Notice that toValues contains the computed binary value of the keyspace_id.
+func (lkp *lookupInternal) Create(vcursor VCursor, rowsColValues [][]sqltypes.Value, toValues []sqltypes.Value, ignoreMode bool) error {
+	_, err := lkp.createWithSourcePK(vcursor, rowsColValues, toValues, nil, ignoreMode)
+	return lkp.mapError("Create", rowsColValues, err)
+}
+
+// CreateWithSourcePK is like Create, but it additionally stores sourcePKs
+// in the source_pk_column of the vindex table. sourcePKs must contain the
+// primary key of the source row for each row in rowsColValues. If sourcePKs
+// is nil, the source_pk_column is not written.
+//
+// If AsyncWrites is set, the rows are queued after their values are
+// checked, and the insert errors are not returned.
+func (lkp *lookupInternal) CreateWithSourcePK(vcursor VCursor, rowsColValues [][]sqltypes.Value, toValues, sourcePKs []sqltypes.Value, ignoreMode bool) error {
+	_, err := lkp.createWithSourcePK(vcursor, rowsColValues, toValues, sourcePKs, ignoreMode)
+	return lkp.mapError("Create", rowsColValues, err)
+}
+
+// createWithSourcePK implements CreateWithSourcePK, and returns the
+// number of rows affected by the inserts, which is 0 if the rows are
+// queued.
+func (lkp *lookupInternal) createWithSourcePK(vcursor VCursor, rowsColValues [][]sqltypes.Value, toValues, sourcePKs []sqltypes.Value, ignoreMode bool) (uint64, error) {
+	if err := lkp.checkWritable("Create"); err != nil {
+		return 0, err
+	}
+	if sourcePKs != nil {
+		if lkp.SourcePKColumn == "" {
+			return 0, fmt.Errorf("lookup.Create: source_pk_column is not configured for vindex table %s", lkp.Table)
+		}
+		if len(sourcePKs) != len(toValues) {
+			return 0, fmt.Errorf("lookup.Create: got %d source pk values for %d rows", len(sourcePKs), len(toValues))
+		}
+	}
+	if err := lkp.checkFromValues(rowsColValues); err != nil {
+		return 0, fmt.Errorf("lookup.Create: %v", err)
+	}
+	if lkp.async != nil {
+		return 0, lkp.enqueueAsync(vcursor, &asyncOp{
+			rowsColValues: rowsColValues,
+			toValues:      toValues,
+			sourcePKs:     sourcePKs,
+			ignoreMode:    ignoreMode,
+		})
+	}
+	release, err := lkp.acquireMutation(vcursor, "Create")
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return lkp.create(vcursor, rowsColValues, toValues, sourcePKs, ignoreMode)
+}
+
+// create inserts the rows of CreateWithSourcePK once they're checked,
+// and returns the number of rows affected.
+func (lkp *lookupInternal) create(vcursor VCursor, rowsColValues [][]sqltypes.Value, toValues, sourcePKs []sqltypes.Value, ignoreMode bool) (uint64, error) {
+	if lkp.FromList != "" {
+		var err error
+		if rowsColValues, toValues, sourcePKs, err = lkp.expandFromList(rowsColValues, toValues, sourcePKs); err != nil {
+			return 0, fmt.Errorf("lookup.Create: %v", err)
+		}
+		if len(toValues) == 0 {
+			return 0, nil
+		}
+	}
+	if lkp.VerifyBeforeCreate {
+		var err error
+		if rowsColValues, toValues, sourcePKs, err = lkp.dropExisting(vcursor, rowsColValues, toValues, sourcePKs, ignoreMode); err != nil {
+			return 0, err
+		}
+		if len(toValues) == 0 {
+			return 0, nil
+		}
+	}
+	lkp.invalidate(rowsColValues)
+	defer lkp.publishInvalidation(rowsColValues)
+	if lkp.Autocommit && lkp.CommitBatchSize > 0 && len(toValues) > lkp.CommitBatchSize {
+		return lkp.insertBatches(vcursor, rowsColValues, toValues, sourcePKs, ignoreMode)
+	}
+	result, err := lkp.insert(vcursor, rowsColValues, toValues, sourcePKs, ignoreMode)
+	if err != nil {
+		return 0, fmt.Errorf("lookup.Create: %v", err)
+	}
+	return result.RowsAffected, nil
+}
+
+// insertBatches inserts the rows in autocommit transactions of up to
+// CommitBatchSize rows each. It stops at the first batch that fails:
+// the batches before it remain committed, and the error says which
+// rows they covered. It returns the number of rows affected by all the
+// batches.
+func (lkp *lookupInternal) insertBatches(vcursor VCursor, rowsColValues [][]sqltypes.Value, toValues, sourcePKs []sqltypes.Value, ignoreMode bool) (uint64, error) {
+	batches := (len(toValues) + lkp.CommitBatchSize - 1) / lkp.CommitBatchSize
+	var affected uint64
+	for start := 0; start < len(toValues); start += lkp.CommitBatchSize {
+		end := start + lkp.CommitBatchSize
+		if end > len(toValues) {
+			end = len(toValues)
+		}
+		var batchPKs []sqltypes.Value
+		if sourcePKs != nil {
+			batchPKs = sourcePKs[start:end]
+		}
+		result, err := lkp.insert(vcursor, rowsColValues[start:end], toValues[start:end], batchPKs, ignoreMode)
+		if err != nil {
+			batch := start/lkp.CommitBatchSize + 1
+			committed := "no rows were committed"
+			if start > 0 {
+				committed = fmt.Sprintf("rows 0 to %d were committed", start-1)
+			}
+			return 0, fmt.Errorf("lookup.Create: batch %d of %d (rows %d to %d) failed, %s: %v", batch, batches, start, end-1, committed, err)
+		}
+		affected += result.RowsAffected
+	}
+	return affected, nil
+}
+
+// insert inserts the rows with a single statement, or with the
+// insert query of the query builder, once per row.
+func (lkp *lookupInternal) insert(vcursor VCursor, rowsColValues [][]sqltypes.Value, toValues, sourcePKs []sqltypes.Value, ignoreMode bool) (*sqltypes.Result, error) {
+	if lkp.ins != "" {
+		if lkp.WriteOnlyDryRun {
+			return lkp.dryRunInsert(lkp.ins, len(toValues)), nil
+		}
+		return lkp.insertEach(vcursor, rowsColValues, toValues)
+	}
+	buf := new(bytes.Buffer)
+	if ignoreMode {
+		fmt.Fprintf(buf, "insert ignore into %s(", quoteIdent(lkp.Table))
+	} else {
+		fmt.Fprintf(buf, "insert into %s(", quoteIdent(lkp.Table))
+	}
+	for _, col := range lkp.FromColumns {
+		fmt.Fprintf(buf, "%s, ", quoteIdent(col))
+	}
+	if lkp.ShardKeyColumn != "" {
+		fmt.Fprintf(buf, "%s, ", quoteIdent(lkp.ShardKeyColumn))
+	}
+	if sourcePKs != nil {
+		fmt.Fprintf(buf, "%s, ", quoteIdent(lkp.SourcePKColumn))
+	}
+	timestamps := lkp.timestampColumns()
+	for _, col := range timestamps {
+		fmt.Fprintf(buf, "%s, ", quoteIdent(col))
+	}
+	fmt.Fprintf(buf, "%s) values(", quoteIdent(lkp.To))
+
+	bindVars := make(map[string]*querypb.BindVariable, 2*len(rowsColValues))
+	for rowIdx := range toValues {
+		colIds := rowsColValues[rowIdx]
+		if rowIdx != 0 {
+			buf.WriteString(", (")
+		}
+		for colIdx, colID := range colIds {
+			fromStr := lkp.FromColumns[colIdx] + strconv.Itoa(rowIdx)
+			bindVars[fromStr] = sqltypes.ValueBindVariable(colID)
+			buf.WriteString(":" + fromStr + ", ")
+		}
+		if lkp.ShardKeyColumn != "" {
+			keyStr := lkp.ShardKeyColumn + strconv.Itoa(rowIdx)
+			bindVars[keyStr] = sqltypes.ValueBindVariable(lkp.shardKey(colIds[0]))
+			buf.WriteString(":" + keyStr + ", ")
+		}
+		if sourcePKs != nil {
+			pkStr := lkp.SourcePKColumn + strconv.Itoa(rowIdx)
+			bindVars[pkStr] = sqltypes.ValueBindVariable(sourcePKs[rowIdx])
+			buf.WriteString(":" + pkStr + ", ")
+		}
+		for range timestamps {
+			buf.WriteString("now(), ")
+		}
+		toStr := lkp.To + strconv.Itoa(rowIdx)
+		buf.WriteString(":" + toStr + ")")
+		bindVars[toStr] = sqltypes.ValueBindVariable(toValues[rowIdx])
+	}
+
+	if lkp.Upsert {
+		fmt.Fprintf(buf, " on duplicate key update ")
+		for _, col := range lkp.FromColumns {
+			fmt.Fprintf(buf, "%s=%s, ", quoteIdent(col), lkp.upsertValue(col))
+		}
+		if sourcePKs != nil {
+			fmt.Fprintf(buf, "%s=%s, ", quoteIdent(lkp.SourcePKColumn), lkp.upsertValue(lkp.SourcePKColumn))
+		}
+		if lkp.UpdatedAtColumn != "" {
+			fmt.Fprintf(buf, "%s=%s, ", quoteIdent(lkp.UpdatedAtColumn), lkp.upsertUpdatedAt())
+		}
+		fmt.Fprintf(buf, "%s=values(%s)", quoteIdent(lkp.To), quoteIdent(lkp.To))
+	}
+
+	if lkp.WriteOnlyDryRun {
+		return lkp.dryRunInsert(buf.String(), len(toValues)), nil
+	}
+	if lkp.Autocommit {
+		return lkp.executeAutocommitWithRetry(vcursor, "VindexCreate", buf.String(), bindVars, true /* isDML */)
+	}
+	lkp.logQuery("VindexCreate", buf.String(), bindVars)
+	return vcursor.Execute("VindexCreate", buf.String(), bindVars, true /* isDML */)
+}
+
+// dryRunInsert records an insert of rows rows with query that
+// WriteOnlyDryRun skips, and returns its result: no row is affected.
+// The bind variables are not logged, since they may be sensitive.
+func (lkp *lookupInternal) dryRunInsert(query string, rows int) *sqltypes.Result {
+	lookupDryRunRows.Add(lkp.name, int64(rows))
+	lkp.dryRunLog.Infof("vindex %s skipped the insert of %d rows into %s, since write_only_dry_run is set: %s", lkp.name, rows, lkp.Table, query)
+	return &sqltypes.Result{}
+}
+
+// upsertValue returns what the upsert of Create assigns to col. With
+// UpsertOnlyChanged, col keeps its value unless the to value changes.
+// MySQL assigns the columns in order, so the to column, which is
+// assigned last, still has its old value when col is assigned. An
+// upsert that does not change the to value then changes nothing, and
+// affects 0 rows.
+func (lkp *lookupInternal) upsertValue(col string) string {
+	if !lkp.UpsertOnlyChanged {
+		return fmt.Sprintf("values(%s)", quoteIdent(col))
+	}
+	to := quoteIdent(lkp.To)
+	return fmt.Sprintf("if(%s <=> values(%s), %s, values(%s))", to, to, quoteIdent(col), quoteIdent(col))
+}
+
+// upsertUpdatedAt returns what the upsert of Create assigns to the
+// UpdatedAtColumn. Like upsertValue, with UpsertOnlyChanged, it keeps
+// its value unless the to value changes.
+func (lkp *lookupInternal) upsertUpdatedAt() string {
+	if !lkp.UpsertOnlyChanged {
+		return "now()"
+	}
+	to := quoteIdent(lkp.To)
+	return fmt.Sprintf("if(%s <=> values(%s), %s, now())", to, to, quoteIdent(lkp.UpdatedAtColumn))
+}
+
+// ConflictError is returned by Create if verify_before_create is set,
+// and an id already maps to a different keyspace id.
+type ConflictError struct {
+	Vindex   string
+	ID       sqltypes.Value
+	Existing sqltypes.Value
+	New      sqltypes.Value
+}
 
-	// TODO @rafael: update sel and ver to support multi column vindexes. This will be done
-	// as part of face 2 of https://github.com/youtube/vitess/issues/3481
-	// For now multi column behaves as a single column for Map and Verify operations
-	lkp.sel = fmt.Sprintf("select %s from %s where %s = :%s", lkp.To, lkp.Table, lkp.FromColumns[0], lkp.FromColumns[0])
-	lkp.ver = fmt.Sprintf("select %s from %s where %s = :%s and %s = :%s", lkp.FromColumns[0], lkp.Table, lkp.FromColumns[0], lkp.FromColumns[0], lkp.To, lkp.To)
-	lkp.del = lkp.initDelStmt()
-	return nil
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("lookup.Create: id %v already maps to %v in vindex %s, cannot map it to %v", e.ID, e.Existing, e.Vindex, e.New)
 }
 
-// Lookup performs a lookup for the ids.
-func (lkp *lookupInternal) Lookup(vcursor VCursor, ids []sqltypes.Value) ([]*sqltypes.Result, error) {
-	results := make([]*sqltypes.Result, 0, len(ids))
-	for _, id := range ids {
+// dropExisting looks up the from value of each row, and drops the rows
+// that already have a mapping to their to value. If a from value maps to
+// other to values, it returns a *ConflictError, unless ignoreMode is set,
+// in which case the row is dropped too.
+func (lkp *lookupInternal) dropExisting(vcursor VCursor, rowsColValues [][]sqltypes.Value, toValues, sourcePKs []sqltypes.Value, ignoreMode bool) ([][]sqltypes.Value, []sqltypes.Value, []sqltypes.Value, error) {
+	var newRows [][]sqltypes.Value
+	var newToValues, newPKs []sqltypes.Value
+	for i, row := range rowsColValues {
 		bindVars := map[string]*querypb.BindVariable{
-			lkp.FromColumns[0]: sqltypes.ValueBindVariable(id),
+			lkp.FromColumns[0]: sqltypes.ValueBindVariable(row[0]),
 		}
+		lkp.logQuery("VindexCreate", lkp.sel, bindVars)
 		var err error
 		var result *sqltypes.Result
 		if lkp.Autocommit {
-			result, err = vcursor.ExecuteAutocommit("VindexLookup", lkp.sel, bindVars, false /* isDML */)
+			result, err = lkp.executeAutocommit(vcursor, "VindexCreate", lkp.sel, bindVars, false /* isDML */)
 		} else {
-			result, err = vcursor.Execute("VindexLookup", lkp.sel, bindVars, false /* isDML */)
+			result, err = vcursor.Execute("VindexCreate", lkp.sel, bindVars, false /* isDML */)
 		}
 		if err != nil {
-			return nil, fmt.Errorf("lookup.Map: %v", err)
+			return nil, nil, nil, fmt.Errorf("lookup.Create: %v", err)
+		}
+		if err := lkp.checkRows(result, 1); err != nil {
+			return nil, nil, nil, fmt.Errorf("lookup.Create: %v", err)
+		}
+		if len(result.Rows) != 0 {
+			if hasValue(result, toValues[i]) || ignoreMode {
+				continue
+			}
+			return nil, nil, nil, &ConflictError{Vindex: lkp.name, ID: row[0], Existing: result.Rows[0][0], New: toValues[i]}
+		}
+		newRows = append(newRows, row)
+		newToValues = append(newToValues, toValues[i])
+		if sourcePKs != nil {
+			newPKs = append(newPKs, sourcePKs[i])
 		}
-		results = append(results, result)
 	}
-	return results, nil
+	return newRows, newToValues, newPKs, nil
 }
 
-// Verify returns true if ids map to values.
-func (lkp *lookupInternal) Verify(vcursor VCursor, ids, values []sqltypes.Value) ([]bool, error) {
-	out := make([]bool, len(ids))
-	for i, id := range ids {
-		bindVars := map[string]*querypb.BindVariable{
-			lkp.FromColumns[0]: sqltypes.ValueBindVariable(id),
-			lkp.To:             sqltypes.ValueBindVariable(values[i]),
+// hasValue returns true if the first column of a row of result is v.
+func hasValue(result *sqltypes.Result, v sqltypes.Value) bool {
+	for _, row := range result.Rows {
+		if valuesEqual(row[0], v) {
+			return true
 		}
-		var err error
+	}
+	return false
+}
+
+// CreateWithStatus is like Create, but it returns what it did with each
+// row. MySQL only reports the number of rows affected by a statement,
+// so it inserts each row with its own statement, and derives the status
+// of the row from that number: 1 is CreateInserted, 2 is CreateUpdated
+// (an upsert that changed the existing row), and 0 is CreateIgnored (an
+// insert ignore of an existing row, or an upsert that left it as is).
+// If the connections of vttablet have CLIENT_FOUND_ROWS, an upsert that
+// leaves a row as is also reports 1, and is then seen as CreateInserted.
+// from_list is not supported, since a row would map to several
+// statuses. On error, it returns the statuses of the rows before the
+// one that failed.
+func (lkp *lookupInternal) CreateWithStatus(vcursor VCursor, rowsColValues [][]sqltypes.Value, toValues []sqltypes.Value, ignoreMode bool) ([]CreateStatus, error) {
+	statuses, err := lkp.createWithStatus(vcursor, rowsColValues, toValues, ignoreMode)
+	return statuses, lkp.mapError("Create", rowsColValues, err)
+}
+
+// createWithStatus implements CreateWithStatus.
+func (lkp *lookupInternal) createWithStatus(vcursor VCursor, rowsColValues [][]sqltypes.Value, toValues []sqltypes.Value, ignoreMode bool) ([]CreateStatus, error) {
+	if err := lkp.checkWritable("Create"); err != nil {
+		return nil, err
+	}
+	if lkp.FromList != "" {
+		return nil, fmt.Errorf("lookup.Create: CreateWithStatus does not support from_list for vindex table %s", lkp.Table)
+	}
+	if len(rowsColValues) != len(toValues) {
+		return nil, fmt.Errorf("lookup.Create: got %d to values for %d rows", len(toValues), len(rowsColValues))
+	}
+	if err := lkp.checkFromValues(rowsColValues); err != nil {
+		return nil, fmt.Errorf("lookup.Create: %v", err)
+	}
+	release, err := lkp.acquireMutation(vcursor, "Create")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	defer lkp.publishInvalidation(rowsColValues)
+	statuses := make([]CreateStatus, 0, len(toValues))
+	for i := range toValues {
+		rows, values := rowsColValues[i:i+1], toValues[i:i+1]
+		if lkp.VerifyBeforeCreate {
+			if rows, values, _, err = lkp.dropExisting(vcursor, rows, values, nil, ignoreMode); err != nil {
+				return statuses, err
+			}
+			if len(values) == 0 {
+				statuses = append(statuses, CreateIgnored)
+				continue
+			}
+		}
+		lkp.invalidate(rows)
+		result, err := lkp.insert(vcursor, rows, values, nil, ignoreMode)
+		if err != nil {
+			return statuses, fmt.Errorf("lookup.Create: row %d: %v", i, err)
+		}
+		switch result.RowsAffected {
+		case 0:
+			statuses = append(statuses, CreateIgnored)
+		case 2:
+			statuses = append(statuses, CreateUpdated)
+		default:
+			statuses = append(statuses, CreateInserted)
+		}
+	}
+	return statuses, nil
+}
+
+// insertEach executes the insert query of the query builder for each
+// row, and returns the total number of rows affected.
+func (lkp *lookupInternal) insertEach(vcursor VCursor, rowsColValues [][]sqltypes.Value, toValues []sqltypes.Value) (*sqltypes.Result, error) {
+	total := &sqltypes.Result{}
+	for rowIdx, row := range rowsColValues {
+		bindVars := make(map[string]*querypb.BindVariable, len(row)+1)
+		for colIdx, colID := range row {
+			bindVars[lkp.FromColumns[colIdx]] = sqltypes.ValueBindVariable(colID)
+		}
+		bindVars[lkp.To] = sqltypes.ValueBindVariable(toValues[rowIdx])
 		var result *sqltypes.Result
+		var err error
 		if lkp.Autocommit {
-			result, err = vcursor.ExecuteAutocommit("VindexVerify", lkp.ver, bindVars, true /* isDML */)
+			result, err = lkp.executeAutocommitWithRetry(vcursor, "VindexCreate", lkp.ins, bindVars, true /* isDML */)
 		} else {
-			result, err = vcursor.Execute("VindexVerify", lkp.ver, bindVars, true /* isDML */)
+			lkp.logQuery("VindexCreate", lkp.ins, bindVars)
+			result, err = vcursor.Execute("VindexCreate", lkp.ins, bindVars, true /* isDML */)
 		}
 		if err != nil {
-			return nil, fmt.Errorf("lookup.Verify: %v", err)
+			return nil, err
 		}
-		out[i] = (len(result.Rows) != 0)
+		total.RowsAffected += result.RowsAffected
 	}
-	return out, nil
+	return total, nil
 }
 
-// Create creates an association between rowsColValues and toValues by inserting rows in the vindex table.
-// rowsColValues contains all the rows that are being inserted.
-// For each row, we store the value of each column defined in the vindex.
-// toValues contains the keyspace_id of each row being inserted.
-// Given a vindex with two columns and the following insert:
-//
-// INSERT INTO table_a (colum_a, column_b, column_c) VALUES (value_a0, value_b0, value_c0), (value_a1, value_b1, value_c1);
-// If we assume that the primary vindex is on column_c. The call to create will look like this:
-// Create(vcursor, [[value_a0, value_b0,], [value_a1, value_b1]], [binary(value_c0), binary(value_c1)])
-// Notice that toValues contains the computed binary value of the keyspace_id.
-func (lkp *lookupInternal) Create(vcursor VCursor, rowsColValues [][]sqltypes.Value, toValues []sqltypes.Value, ignoreMode bool) error {
-	buf := new(bytes.Buffer)
-	if ignoreMode {
-		fmt.Fprintf(buf, "insert ignore into %s(", lkp.Table)
-	} else {
-		fmt.Fprintf(buf, "insert into %s(", lkp.Table)
-	}
-	for _, col := range lkp.FromColumns {
-		fmt.Fprintf(buf, "%s, ", col)
+// BatchCreateOptions controls how BatchCreate inserts its rows.
+type BatchCreateOptions struct {
+	// BatchSize is the maximum number of rows inserted by one
+	// statement. If zero, all the rows are inserted at once.
+	BatchSize int
+	// Concurrency is the maximum number of batches inserted in
+	// parallel. It's only honored in autocommit mode, since the
+	// statements of a transaction cannot run concurrently. If zero
+	// or one, the batches are inserted sequentially, in order.
+	Concurrency int
+	IgnoreMode  bool
+}
+
+// CreateStatus is what CreateWithStatus did with a row.
+type CreateStatus int
+
+const (
+	// CreateInserted means that the row was inserted.
+	CreateInserted = CreateStatus(iota)
+	// CreateUpdated means that the upsert of an autocommit vindex
+	// updated an existing row of the from value.
+	CreateUpdated
+	// CreateIgnored means that the row was not written: it already
+	// existed, and either ignoreMode was set, or the upsert found it
+	// already had the new values, or verify_before_create skipped it.
+	CreateIgnored
+)
+
+func (s CreateStatus) String() string {
+	switch s {
+	case CreateInserted:
+		return "inserted"
+	case CreateUpdated:
+		return "updated"
+	case CreateIgnored:
+		return "ignored"
 	}
-	fmt.Fprintf(buf, "%s) values(", lkp.To)
+	return fmt.Sprintf("CreateStatus(%d)", int(s))
+}
 
-	bindVars := make(map[string]*querypb.BindVariable, 2*len(rowsColValues))
-	for rowIdx := range toValues {
-		colIds := rowsColValues[rowIdx]
-		if rowIdx != 0 {
-			buf.WriteString(", (")
+// VerifyOptions controls a single call to VerifyWithOptions.
+type VerifyOptions struct {
+	// ForceLookup makes Verify consult the table for all the ids,
+	// even if the vindex is write_only or has lookup_id_ranges. This
+	// lets a migration tool validate a backfill while the vindex is
+	// still write_only for routing.
+	ForceLookup bool
+}
+
+// BatchCreate is like CreateWithSourcePK, but it inserts the rows in
+// batches, as specified by options. It's meant for backfilling large
+// numbers of rows. All the rows are checked before the first batch, so
+// that malformed input doesn't leave a partial backfill. If a batch
+// fails, the batches that didn't start yet are skipped, and the first
+// error is returned.
+func (lkp *lookupInternal) BatchCreate(vcursor VCursor, rowsColValues [][]sqltypes.Value, toValues, sourcePKs []sqltypes.Value, options BatchCreateOptions) error {
+	return lkp.mapError("Create", rowsColValues, lkp.batchCreate(vcursor, rowsColValues, toValues, sourcePKs, options))
+}
+
+// batchCreate implements BatchCreate.
+func (lkp *lookupInternal) batchCreate(vcursor VCursor, rowsColValues [][]sqltypes.Value, toValues, sourcePKs []sqltypes.Value, options BatchCreateOptions) error {
+	if err := lkp.checkWritable("Create"); err != nil {
+		return err
+	}
+	if len(rowsColValues) != len(toValues) {
+		return fmt.Errorf("lookup.Create: got %d to values for %d rows", len(toValues), len(rowsColValues))
+	}
+	if sourcePKs != nil {
+		if lkp.SourcePKColumn == "" {
+			return fmt.Errorf("lookup.Create: source_pk_column is not configured for vindex table %s", lkp.Table)
 		}
-		for colIdx, colID := range colIds {
-			fromStr := lkp.FromColumns[colIdx] + strconv.Itoa(rowIdx)
-			bindVars[fromStr] = sqltypes.ValueBindVariable(colID)
-			buf.WriteString(":" + fromStr + ", ")
+		if len(sourcePKs) != len(toValues) {
+			return fmt.Errorf("lookup.Create: got %d source pk values for %d rows", len(sourcePKs), len(toValues))
 		}
-		toStr := lkp.To + strconv.Itoa(rowIdx)
-		buf.WriteString(":" + toStr + ")")
-		bindVars[toStr] = sqltypes.ValueBindVariable(toValues[rowIdx])
+	}
+	if err := lkp.checkFromValues(rowsColValues); err != nil {
+		return fmt.Errorf("lookup.Create: %v", err)
+	}
+	batchSize := options.BatchSize
+	if batchSize <= 0 || batchSize > len(toValues) {
+		batchSize = len(toValues)
+	}
+	if batchSize == 0 {
+		return nil
+	}
+	createBatch := func(start int) error {
+		end := start + batchSize
+		if end > len(toValues) {
+			end = len(toValues)
+		}
+		var batchPKs []sqltypes.Value
+		if sourcePKs != nil {
+			batchPKs = sourcePKs[start:end]
+		}
+		_, err := lkp.createWithSourcePK(vcursor, rowsColValues[start:end], toValues[start:end], batchPKs, options.IgnoreMode)
+		return err
 	}
 
-	if lkp.Upsert {
-		fmt.Fprintf(buf, " on duplicate key update ")
-		for _, col := range lkp.FromColumns {
-			fmt.Fprintf(buf, "%s=values(%s), ", col, col)
+	if options.Concurrency <= 1 || !lkp.Autocommit {
+		for start := 0; start < len(toValues); start += batchSize {
+			if err := createBatch(start); err != nil {
+				return err
+			}
 		}
-		fmt.Fprintf(buf, "%s=values(%s)", lkp.To, lkp.To)
+		return nil
 	}
 
-	var err error
-	if lkp.Autocommit {
-		_, err = vcursor.ExecuteAutocommit("VindexCreate", buf.String(), bindVars, true /* isDML */)
-	} else {
-		_, err = vcursor.Execute("VindexCreate", buf.String(), bindVars, true /* isDML */)
+	starts := make(chan int)
+	rec := &concurrency.FirstErrorRecorder{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < options.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range starts {
+				rec.RecordError(createBatch(start))
+			}
+		}()
 	}
-	if err != nil {
-		return fmt.Errorf("lookup.Create: %v", err)
+	for start := 0; start < len(toValues) && !rec.HasErrors(); start += batchSize {
+		starts <- start
 	}
-	return nil
+	close(starts)
+	wg.Wait()
+	return rec.Error()
 }
 
 // Delete deletes the association between ids and value.
@@ -176,46 +1701,555 @@ func (lkp *lookupInternal) Create(vcursor VCursor, rowsColValues [][]sqltypes.Va
 //
 // A call to Delete would look like this:
 // Delete(vcursor, [[valuea, valueb]], 52CB7B1B31B2222E)
+//
+// If DeleteMissing is "error", Delete fails with a *NotFoundError for
+// the first row that has no mapping to value. The rows before it are
+// deleted: the failure is meant to fail the statement.
 func (lkp *lookupInternal) Delete(vcursor VCursor, rowsColValues [][]sqltypes.Value, value sqltypes.Value) error {
+	_, err := lkp.delete(vcursor, rowsColValues, value, false /* anyValue */, lkp.failDeleteMissing())
+	return lkp.mapError("Delete", rowsColValues, err)
+}
+
+// failDeleteMissing returns true if Delete fails for the rows that
+// have no mapping.
+func (lkp *lookupInternal) failDeleteMissing() bool {
+	return lkp.DeleteMissing == deleteMissingError
+}
+
+// delete deletes the rows of rowsColValues that map to value or,
+// if anyValue is true, all the rows of rowsColValues. It returns
+// the number of rows deleted, which is 0 in autocommit mode.
+// If failOnMissing is true, a row that has nothing to delete fails
+// it with a *NotFoundError.
+func (lkp *lookupInternal) delete(vcursor VCursor, rowsColValues [][]sqltypes.Value, value sqltypes.Value, anyValue, failOnMissing bool) (uint64, error) {
+	if err := lkp.checkWritable("Delete"); err != nil {
+		return 0, err
+	}
+	if err := lkp.checkFromValues(rowsColValues); err != nil {
+		return 0, fmt.Errorf("lookup.Delete: %v", err)
+	}
 	// In autocommit mode, it's not safe to delete. So, it's a no-op.
 	if lkp.Autocommit {
-		return nil
+		return 0, nil
+	}
+	release, err := lkp.acquireMutation(vcursor, "Delete")
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return lkp.deleteRows(vcursor, rowsColValues, value, anyValue, failOnMissing)
+}
+
+// deleteRows executes the deletes of delete, once the rows are checked,
+// and returns the number of rows deleted.
+func (lkp *lookupInternal) deleteRows(vcursor VCursor, rowsColValues [][]sqltypes.Value, value sqltypes.Value, anyValue, failOnMissing bool) (uint64, error) {
+	if lkp.FromList != "" {
+		var err error
+		if rowsColValues, _, _, err = lkp.expandFromList(rowsColValues, nil, nil); err != nil {
+			return 0, fmt.Errorf("lookup.Delete: %v", err)
+		}
 	}
+	lkp.invalidate(rowsColValues)
+	defer lkp.publishInvalidation(rowsColValues)
+	var affected uint64
 	for _, column := range rowsColValues {
 		bindVars := make(map[string]*querypb.BindVariable, len(rowsColValues))
 		for colIdx, columnValue := range column {
 			bindVars[lkp.FromColumns[colIdx]] = sqltypes.ValueBindVariable(columnValue)
 		}
-		bindVars[lkp.To] = sqltypes.ValueBindVariable(value)
-		_, err := vcursor.Execute("VindexDelete", lkp.del, bindVars, true /* isDML */)
+		query := lkp.delFrom
+		if !anyValue {
+			query = lkp.del
+			bindVars[lkp.To] = sqltypes.ValueBindVariable(value)
+		}
+		lkp.logQuery("VindexDelete", query, bindVars)
+		result, err := vcursor.Execute("VindexDelete", query, bindVars, true /* isDML */)
+		if err != nil {
+			return 0, fmt.Errorf("lookup.Delete: %v", err)
+		}
+		if failOnMissing && result.RowsAffected == 0 {
+			return 0, &NotFoundError{Vindex: lkp.name, Row: column}
+		}
+		affected += result.RowsAffected
+	}
+	return affected, nil
+}
+
+// DeleteWithSourcePK is like Delete, but if DeleteBySourcePK is set,
+// the rows are deleted by the primary key of their source row instead
+// of by their from values. This is useful if the from columns are not
+// indexed. sourcePKs must contain the primary key of the source row for
+// each row in rowsColValues. If sourcePKs is nil, it behaves like Delete.
+func (lkp *lookupInternal) DeleteWithSourcePK(vcursor VCursor, rowsColValues [][]sqltypes.Value, value sqltypes.Value, sourcePKs []sqltypes.Value) error {
+	if !lkp.DeleteBySourcePK || sourcePKs == nil {
+		return lkp.Delete(vcursor, rowsColValues, value)
+	}
+	return lkp.mapError("Delete", rowsColValues, lkp.deleteBySourcePK(vcursor, rowsColValues, value, sourcePKs))
+}
+
+// deleteBySourcePK implements DeleteWithSourcePK if DeleteBySourcePK
+// is set.
+func (lkp *lookupInternal) deleteBySourcePK(vcursor VCursor, rowsColValues [][]sqltypes.Value, value sqltypes.Value, sourcePKs []sqltypes.Value) error {
+	if err := lkp.checkWritable("Delete"); err != nil {
+		return err
+	}
+	if err := lkp.checkFromValues(rowsColValues); err != nil {
+		return fmt.Errorf("lookup.Delete: %v", err)
+	}
+	// In autocommit mode, it's not safe to delete. So, it's a no-op.
+	if lkp.Autocommit {
+		return nil
+	}
+	if len(sourcePKs) != len(rowsColValues) {
+		return fmt.Errorf("lookup.Delete: got %d source pk values for %d rows", len(sourcePKs), len(rowsColValues))
+	}
+	release, err := lkp.acquireMutation(vcursor, "Delete")
+	if err != nil {
+		return err
+	}
+	defer release()
+	if lkp.cache != nil {
+		invalidated := rowsColValues
+		if lkp.FromList != "" {
+			var err error
+			if invalidated, _, _, err = lkp.expandFromList(rowsColValues, nil, nil); err != nil {
+				return fmt.Errorf("lookup.Delete: %v", err)
+			}
+		}
+		lkp.invalidate(invalidated)
+		defer lkp.publishInvalidation(invalidated)
+	}
+	// A source row with a from_list has one row per element
+	// of the list, which are all deleted at once here.
+	for i, sourcePK := range sourcePKs {
+		bindVars := map[string]*querypb.BindVariable{
+			lkp.SourcePKColumn: sqltypes.ValueBindVariable(sourcePK),
+			lkp.To:             sqltypes.ValueBindVariable(value),
+		}
+		lkp.logQuery("VindexDelete", lkp.delPK, bindVars)
+		result, err := vcursor.Execute("VindexDelete", lkp.delPK, bindVars, true /* isDML */)
 		if err != nil {
 			return fmt.Errorf("lookup.Delete: %v", err)
 		}
+		if lkp.failDeleteMissing() && result.RowsAffected == 0 {
+			return &NotFoundError{Vindex: lkp.name, Row: rowsColValues[i]}
+		}
 	}
 	return nil
 }
 
 // Update implements the update functionality.
+// If ksid is empty, the mapping of oldValues is deleted, whatever
+// its to value, and newValues are ignored. This is only allowed for
+// the unique vindexes: the old values of a non-unique vindex can map
+// to more than one keyspace id, and all of them would be deleted.
+// Otherwise, newValues must not be empty.
 func (lkp *lookupInternal) Update(vcursor VCursor, oldValues []sqltypes.Value, ksid sqltypes.Value, newValues []sqltypes.Value) error {
-	if err := lkp.Delete(vcursor, [][]sqltypes.Value{oldValues}, ksid); err != nil {
-		return err
+	_, err := lkp.update(vcursor, oldValues, ksid, newValues)
+	return lkp.mapError("Update", oldValues, err)
+}
+
+// update implements Update, and returns the number of rows affected
+// by its Delete and its Create.
+func (lkp *lookupInternal) update(vcursor VCursor, oldValues []sqltypes.Value, ksid sqltypes.Value, newValues []sqltypes.Value) (uint64, error) {
+	if err := lkp.checkWritable("Update"); err != nil {
+		return 0, err
+	}
+	if err := lkp.checkFromValues([][]sqltypes.Value{oldValues}); err != nil {
+		return 0, fmt.Errorf("lookup.Update: old values: %v", err)
+	}
+	if ksid.Len() == 0 {
+		if !lkp.unique {
+			return 0, fmt.Errorf("lookup.Update: empty keyspace id for %v, which would delete all its keyspace ids in non-unique vindex %s", oldValues, lkp.name)
+		}
+		return lkp.delete(vcursor, [][]sqltypes.Value{oldValues}, ksid, true /* anyValue */, false /* failOnMissing */)
+	}
+	if len(newValues) == 0 {
+		return 0, fmt.Errorf("lookup.Update: no new values for %v", oldValues)
+	}
+	if err := lkp.checkFromValues([][]sqltypes.Value{newValues}); err != nil {
+		return 0, fmt.Errorf("lookup.Update: new values: %v", err)
+	}
+	deleted, err := lkp.delete(vcursor, [][]sqltypes.Value{oldValues}, ksid, false /* anyValue */, false /* failOnMissing */)
+	if err != nil {
+		return 0, err
+	}
+	created, err := lkp.createWithSourcePK(vcursor, [][]sqltypes.Value{newValues}, []sqltypes.Value{ksid}, nil, false /* ignoreMode */)
+	if err != nil {
+		return 0, err
+	}
+	return deleted + created, nil
+}
+
+// checkWritable fails if the vindex is ReadOnly. It's checked before
+// anything else, so that a mutation fails even where it would be a
+// no-op, like a Delete in autocommit mode.
+func (lkp *lookupInternal) checkWritable(method string) error {
+	if lkp.ReadOnly {
+		return fmt.Errorf("lookup.%s: vindex %s is read-only", method, lkp.name)
+	}
+	return nil
+}
+
+// Flush waits until the mutations that were queued because of
+// AsyncWrites before the call have been executed. It returns right away if the
+// vindex doesn't have AsyncWrites.
+func (lkp *lookupInternal) Flush() {
+	if lkp.async != nil {
+		lkp.async.Flush()
+	}
+}
+
+// Reset clears the cached lookup results and, if resetStats is true,
+// resets the stats of the vindex: VindexLookupCacheEvictions,
+// VindexLookupEmptyMaps and VindexLookupMapLatency, with its exemplars.
+// The configuration is preserved, including the backoff policy. It's
+// safe to call concurrently with the other methods, but a concurrent
+// Map can cache a result read before Reset.
+func (lkp *lookupInternal) Reset(resetStats bool) {
+	if lkp.cache != nil {
+		lkp.cache.Clear()
+	}
+	if !resetStats {
+		return
+	}
+	for _, reason := range []string{evictTTL, evictSize, evictGeneration} {
+		lookupCacheEvictions.Reset([]string{lkp.name, reason})
+	}
+	lookupEmptyMaps.Reset(lkp.name)
+	resetLookupLatency(lkp.name)
+}
+
+// MarshalJSON returns a JSON representation of lookupInternal.
+func (lkp *lookupInternal) MarshalJSON() ([]byte, error) {
+	// Use a different type to prevent infinite recursion.
+	type lookupJSON lookupInternal
+	return json.Marshal((*lookupJSON)(lkp))
+}
+
+// expandFromList replaces every row whose from value is a list with
+// one row per element of the list. toValues and sourcePKs, if not nil,
+// are expanded accordingly.
+func (lkp *lookupInternal) expandFromList(rowsColValues [][]sqltypes.Value, toValues, sourcePKs []sqltypes.Value) ([][]sqltypes.Value, []sqltypes.Value, []sqltypes.Value, error) {
+	var outRows [][]sqltypes.Value
+	var outTo, outPKs []sqltypes.Value
+	for rowIdx, row := range rowsColValues {
+		if len(row) != 1 {
+			return nil, nil, nil, fmt.Errorf("got %d from values, want 1 for from_list", len(row))
+		}
+		elems, err := splitFromList(lkp.FromList, row[0])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, elem := range elems {
+			outRows = append(outRows, []sqltypes.Value{elem})
+			if toValues != nil {
+				outTo = append(outTo, toValues[rowIdx])
+			}
+			if sourcePKs != nil {
+				outPKs = append(outPKs, sourcePKs[rowIdx])
+			}
+		}
+	}
+	return outRows, outTo, outPKs, nil
+}
+
+// shardKey returns the value of the ShardKeyColumn for a from value.
+// A prefix is returned as varbinary.
+func (lkp *lookupInternal) shardKey(from sqltypes.Value) sqltypes.Value {
+	raw := from.ToBytes()
+	if lkp.ShardKeyPrefix == 0 || len(raw) <= lkp.ShardKeyPrefix {
+		return from
+	}
+	return sqltypes.MakeTrusted(sqltypes.VarBinary, raw[:lkp.ShardKeyPrefix])
+}
+
+// checkFromValues verifies that every row of rowsColValues has one
+// value per from column. The values are bound individually, each
+// with its own type, so the columns of a row may be of mixed types.
+// It's checked before building any query, since a row of the wrong
+// width would otherwise produce a malformed one.
+func (lkp *lookupInternal) checkFromValues(rowsColValues [][]sqltypes.Value) error {
+	for rowIdx, row := range rowsColValues {
+		if len(row) != len(lkp.FromColumns) {
+			return fmt.Errorf("got %d from values in row %d, want %d", len(row), rowIdx, len(lkp.FromColumns))
+		}
+	}
+	return nil
+}
+
+// SetBackoffPolicy sets the BackoffPolicy used between retries.
+func (lkp *lookupInternal) SetBackoffPolicy(backoff BackoffPolicy) {
+	lkp.backoff = backoff
+}
+
+func (lkp *lookupInternal) backoffPolicy() BackoffPolicy {
+	if lkp.backoff == nil {
+		return DefaultBackoffPolicy
+	}
+	return lkp.backoff
+}
+
+// SetErrorMapper sets the ErrorMapper of the errors returned by Map,
+// Verify, Create, Update and Delete.
+func (lkp *lookupInternal) SetErrorMapper(mapper ErrorMapper) {
+	lkp.errorMapper = mapper
+}
+
+// mapError returns err mapped by the ErrorMapper for method, or nil if
+// err is nil. With ErrorContext, err is first wrapped in an
+// *OperationError that summarizes inputs, the ids or rows of method.
+func (lkp *lookupInternal) mapError(method string, inputs interface{}, err error) error {
+	if err == nil {
+		return nil
+	}
+	if lkp.ErrorContext {
+		err = lkp.operationError(method, inputs, err)
 	}
-	return lkp.Create(vcursor, [][]sqltypes.Value{newValues}, []sqltypes.Value{ksid}, false /* ignoreMode */)
+	mapper := lkp.errorMapper
+	if mapper == nil {
+		mapper = DefaultErrorMapper
+	}
+	return mapper.MapError(lkp.name, method, err)
+}
+
+// executeAutocommit executes the query in autocommit mode, on the
+// ConnectionPool if it's set and vcursor is a PooledVCursor, and on
+// the shared pool of vcursor otherwise.
+func (lkp *lookupInternal) executeAutocommit(vcursor VCursor, method string, query string, bindVars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
+	if lkp.ConnectionPool != "" {
+		if pooled, ok := vcursor.(PooledVCursor); ok {
+			return pooled.ExecuteAutocommitInPool(lkp.ConnectionPool, method, query, bindVars, isDML)
+		}
+	}
+	return vcursor.ExecuteAutocommit(method, query, bindVars, isDML)
+}
+
+// executeAutocommitWithRetry executes the query in autocommit mode and
+// retries it up to DeadlockRetries times if it fails due to a deadlock.
+// Retries are only safe in autocommit mode: inside a transaction, a
+// deadlock rolls back the entire transaction. So the queries of
+// CreatePending, which are in one, are not retried. The retries draw
+// from the RetryBudget of the request, if any, and stop when its
+// context is done. See waitRetry.
+func (lkp *lookupInternal) executeAutocommitWithRetry(vcursor VCursor, method string, query string, bindVars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
+	lkp.logQuery(method, query, bindVars)
+	retries := lkp.DeadlockRetries
+	if _, ok := vcursor.(txVCursor); ok {
+		retries = 0
+	}
+	for attempt := 1; ; attempt++ {
+		result, err := lkp.executeAutocommit(vcursor, method, query, bindVars, isDML)
+		if err == nil || attempt > retries || !isDeadlock(err) {
+			return result, err
+		}
+		delay, ok := lkp.nextRetry(vcursor, attempt)
+		if !ok {
+			return result, err
+		}
+		if err := waitRetry(vcursor, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// executeRead executes a query of Lookup or Verify, in autocommit mode
+// if the vindex is autocommit. If it fails because the table doesn't
+// exist, it's retried up to RetryOnMissingTable times, within the
+// RetryBudget of the request, if any, until its context is done. With
+// ReadCell, the queries of Lookup and Verify are executed in that
+// cell if vcursor supports it, which takes precedence, unless they are
+// snapshot reads.
+func (lkp *lookupInternal) executeRead(vcursor VCursor, method string, query string, bindVars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
+	lkp.logQuery(method, query, bindVars)
+	var cell CellVCursor
+	if lkp.ReadCell != "" && (method == "VindexLookup" || method == "VindexVerify") && !lkp.snapshotRead(vcursor) {
+		cell, _ = vcursor.(CellVCursor)
+	}
+	for attempt := 1; ; attempt++ {
+		var result *sqltypes.Result
+		var err error
+		if cell != nil {
+			result, err = cell.ExecuteInCell(lkp.ReadCell, method, query, bindVars, isDML)
+		} else if lkp.Autocommit {
+			result, err = lkp.executeAutocommit(vcursor, method, query, bindVars, isDML)
+		} else {
+			result, err = vcursor.Execute(method, query, bindVars, isDML)
+		}
+		if err == nil || attempt > lkp.RetryOnMissingTable || !isMissingTable(err) {
+			return result, err
+		}
+		delay, ok := lkp.nextRetry(vcursor, attempt)
+		if !ok {
+			return result, err
+		}
+		if err := waitRetry(vcursor, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// isQualifiedTable returns true if table is of the form keyspace.table,
+// with or without backquotes.
+func isQualifiedTable(table string) bool {
+	parts := strings.Split(strings.Replace(table, "`", "", -1), ".")
+	return len(parts) == 2 && parts[0] != "" && parts[1] != ""
+}
+
+// isMissingTable returns true if err was caused by a table
+// that doesn't exist (errno 1146).
+func isMissingTable(err error) bool {
+	return strings.Contains(err.Error(), "(errno 1146)")
+}
+
+// isDeadlock returns true if err was caused by a MySQL deadlock (errno 1213).
+func isDeadlock(err error) bool {
+	return strings.Contains(err.Error(), "(errno 1213)")
 }
 
-func (lkp *lookupInternal) initDelStmt() string {
+func (lkp *lookupInternal) initDelStmt(withTo bool) string {
 	var delBuffer bytes.Buffer
-	fmt.Fprintf(&delBuffer, "delete from %s where ", lkp.Table)
+	fmt.Fprintf(&delBuffer, "delete from %s where ", quoteIdent(lkp.Table))
 	for colIdx, column := range lkp.FromColumns {
 		if colIdx != 0 {
 			delBuffer.WriteString(" and ")
 		}
-		delBuffer.WriteString(column + " = :" + column)
+		delBuffer.WriteString(quoteIdent(column) + " = :" + column)
+	}
+	if withTo {
+		delBuffer.WriteString(" and " + quoteIdent(lkp.To) + " = :" + lkp.To)
 	}
-	delBuffer.WriteString(" and " + lkp.To + " = :" + lkp.To)
 	return delBuffer.String()
 }
 
+// quoteIdent backtick-quotes name so that it can be safely used in a
+// generated query, even if it's a reserved word. If name is qualified,
+// like keyspace.table, every part is quoted separately. A name that
+// already contains backticks is assumed to be quoted and is returned
+// as is.
+func quoteIdent(name string) string {
+	if strings.Contains(name, "`") {
+		return name
+	}
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = "`" + part + "`"
+	}
+	return strings.Join(parts, ".")
+}
+
+// valueKey returns the key of v in the cache and the maps of the
+// vindex, and false if v is NULL. Like in SQL, NULL is not equal to
+// any value, including another NULL, so it has no key: if it had one,
+// two NULLs, or a NULL and the value with the same key, like the empty
+// string, would collide. A NULL from value is never cached or matched.
+func valueKey(v sqltypes.Value) (string, bool) {
+	if v.IsNull() {
+		return "", false
+	}
+	return v.ToString(), true
+}
+
+// valuesEqual returns true if a and b have the same bytes, and neither
+// is NULL.
+func valuesEqual(a, b sqltypes.Value) bool {
+	if a.IsNull() || b.IsNull() {
+		return false
+	}
+	return bytes.Equal(a.ToBytes(), b.ToBytes())
+}
+
+// splitFromList splits a list-valued from value into its elements.
+// For "csv", the value is split on commas, and surrounding spaces
+// and empty elements are dropped. For "json", the value must be a JSON
+// array of strings or numbers; a value that is not an array is treated
+// as a single element. A NULL value has no elements.
+func splitFromList(format string, v sqltypes.Value) ([]sqltypes.Value, error) {
+	if v.IsNull() {
+		return nil, nil
+	}
+	var out []sqltypes.Value
+	switch format {
+	case "csv":
+		for _, elem := range strings.Split(v.ToString(), ",") {
+			elem = strings.TrimSpace(elem)
+			if elem == "" {
+				continue
+			}
+			out = append(out, sqltypes.NewVarChar(elem))
+		}
+	case "json":
+		str := strings.TrimSpace(v.ToString())
+		if !strings.HasPrefix(str, "[") {
+			return []sqltypes.Value{v}, nil
+		}
+		decoder := json.NewDecoder(strings.NewReader(str))
+		decoder.UseNumber()
+		var elems []interface{}
+		if err := decoder.Decode(&elems); err != nil {
+			return nil, fmt.Errorf("invalid json list %s: %v", str, err)
+		}
+		for _, elem := range elems {
+			switch elem := elem.(type) {
+			case string:
+				out = append(out, sqltypes.NewVarChar(elem))
+			case json.Number:
+				if i, err := elem.Int64(); err == nil {
+					out = append(out, sqltypes.NewInt64(i))
+				} else {
+					out = append(out, sqltypes.NewVarChar(elem.String()))
+				}
+			default:
+				return nil, fmt.Errorf("unsupported element %v in json list %s", elem, str)
+			}
+		}
+	default:
+		return []sqltypes.Value{v}, nil
+	}
+	return out, nil
+}
+
+// unknownParams returns the sorted list of keys in m that are not in known.
+func unknownParams(m map[string]string, known []string) []string {
+	var unknown []string
+	for key := range m {
+		found := false
+		for _, k := range known {
+			if key == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// intFromMap returns the value of key in m, which must be a
+// non-negative integer, or 0 if it's not set.
+func intFromMap(m map[string]string, key string) (int, error) {
+	val, ok := m[key]
+	if !ok {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("%s value must be a non-negative integer: '%s'", key, val)
+	}
+	return i, nil
+}
+
+// writeOnlyCostFromMap returns the cost of a write_only lookup vindex.
+func writeOnlyCostFromMap(m map[string]string) (int, error) {
+	if _, ok := m["write_only_cost"]; !ok {
+		return defaultWriteOnlyCost, nil
+	}
+	return intFromMap(m, "write_only_cost")
+}
+
 func boolFromMap(m map[string]string, key string) (bool, error) {
 	val, ok := m[key]
 	if !ok {
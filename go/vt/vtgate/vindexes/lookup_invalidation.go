@@ -0,0 +1,103 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+// CacheInvalidator publishes the cache invalidations of the lookup
+// vindexes to the other vtgates, whose caches would otherwise keep
+// the results that a mutation of this vtgate made stale until their
+// cache_ttl. The transport, like a pub/sub system, is provided by the
+// deployment. The vtgates that receive an invalidation pass it to
+// InvalidateLookupCache.
+//
+// A mutation removes the keys it changes from the local cache before
+// it's executed, and publishes them once it's done, whether it failed
+// or not, since a failed mutation may still have changed some rows.
+// Without autocommit, the mutation is part of the transaction of the
+// session, which the vindex doesn't see committed: the keys are then
+// published before the commit, and another vtgate can cache the
+// previous state in between. So the invalidations shorten the window
+// during which the other vtgates are stale, but don't close it, and
+// cache_ttl still bounds it. An invalidation that is lost is also
+// only bounded by cache_ttl.
+type CacheInvalidator interface {
+	// Invalidate is called with the name of the vindex and the cache
+	// keys of the from values that a mutation changed. It's called
+	// synchronously by the mutation, so it must not block, and handle
+	// its own errors.
+	Invalidate(vindex string, keys []string)
+}
+
+// CacheInvalidatorFunc adapts a function to a CacheInvalidator.
+type CacheInvalidatorFunc func(vindex string, keys []string)
+
+// Invalidate is part of the CacheInvalidator interface.
+func (f CacheInvalidatorFunc) Invalidate(vindex string, keys []string) {
+	f(vindex, keys)
+}
+
+// DefaultCacheInvalidator is the CacheInvalidator used by lookup
+// vindexes unless another one is set. It does nothing, so that only
+// the local cache is invalidated.
+var DefaultCacheInvalidator CacheInvalidator = CacheInvalidatorFunc(func(vindex string, keys []string) {})
+
+// InvalidateLookupCache removes the keys from the cache of the lookup
+// vindex named vindex, if it has one. It's meant to apply the
+// invalidations published by the CacheInvalidator of another vtgate.
+func InvalidateLookupCache(vindex string, keys []string) {
+	lookupCachesMu.Lock()
+	c := lookupCaches[vindex]
+	lookupCachesMu.Unlock()
+	if c == nil {
+		return
+	}
+	for _, key := range keys {
+		c.Delete(key)
+	}
+}
+
+// SetCacheInvalidator sets the CacheInvalidator that publishes the
+// cache invalidations of the mutations. If not set,
+// DefaultCacheInvalidator is used.
+func (lkp *lookupInternal) SetCacheInvalidator(invalidator CacheInvalidator) {
+	lkp.cacheInvalidator = invalidator
+}
+
+// publishInvalidation publishes the cache keys of the from values of
+// rowsColValues with the CacheInvalidator, if the vindex has a cache.
+func (lkp *lookupInternal) publishInvalidation(rowsColValues [][]sqltypes.Value) {
+	if lkp.cache == nil {
+		return
+	}
+	keys := make([]string, 0, len(rowsColValues))
+	for _, row := range rowsColValues {
+		if key, ok := valueKey(row[0]); ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	invalidator := lkp.cacheInvalidator
+	if invalidator == nil {
+		invalidator = DefaultCacheInvalidator
+	}
+	invalidator.Invalidate(lkp.name, keys)
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"time"
+
+	"github.com/youtube/vitess/go/stats"
+)
+
+// lookupLatencyCutoffs are the buckets, in microseconds, of the
+// latency of a Map call.
+var lookupLatencyCutoffs = []int64{100, 250, 500, 1000, 2500, 5000, 10000, 25000, 50000, 100000, 250000, 500000, 1000000}
+
+// lookupLatencies contains the latency histograms by vindex name.
+// VindexLookupMapLatency has, for each lookup vindex, the histogram
+// of the time, in microseconds, that the lookups of its Map calls
+// take, including their retries. With an ExemplarSink, the values
+// carry the trace of their request.
+var lookupLatencies = newVindexHistograms("VindexLookupMapLatency", lookupLatencyCutoffs)
+
+// recordLookupLatency adds the latency of a lookup of the vindex, for
+// the request of vcursor, to its histogram.
+func recordLookupLatency(vcursor VCursor, name string, latency time.Duration) {
+	observeTimed(vcursor, "VindexLookupMapLatency", name, int64(latency/time.Microsecond))
+}
+
+// resetLookupLatency drops the histogram of the vindex. A new one
+// is created on its next Map call.
+func resetLookupLatency(name string) {
+	metrics().ResetHistogram("VindexLookupMapLatency", name)
+}
+
+// lookupLatency returns the histogram of the vindex in the stats.
+func lookupLatency(name string) *stats.Histogram {
+	return lookupLatencies.get(name)
+}
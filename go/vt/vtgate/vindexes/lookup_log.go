@@ -0,0 +1,102 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+
+	"github.com/youtube/vitess/go/sqltypes"
+
+	querypb "github.com/youtube/vitess/go/vt/proto/query"
+)
+
+// redactedValue replaces the from values in the logged bind variables
+// of the vindexes with log_queries_redact.
+const redactedValue = "<redacted>"
+
+// queryLogf logs a query of a vindex with log_queries. It's a variable
+// so that tests can capture the queries.
+var queryLogf = func(format string, args ...interface{}) {
+	if log.V(2) {
+		log.Infof(format, args...)
+	}
+}
+
+// logQuery logs query and its bind variables if LogQueries is set.
+// It's called before each query of the vindex is executed, and costs
+// a field check otherwise.
+func (lkp *lookupInternal) logQuery(method, query string, bindVars map[string]*querypb.BindVariable) {
+	if !lkp.LogQueries {
+		return
+	}
+	queryLogf("vindex %s: %s: %s %s", lkp.name, method, query, lkp.formatBindVars(bindVars))
+}
+
+// formatBindVars formats bindVars as a sorted list of name=value,
+// redacting the from values if LogQueriesRedact is set.
+func (lkp *lookupInternal) formatBindVars(bindVars map[string]*querypb.BindVariable) string {
+	names := make([]string, 0, len(bindVars))
+	for name := range bindVars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := &bytes.Buffer{}
+	buf.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(name)
+		buf.WriteString("=")
+		if lkp.LogQueriesRedact && lkp.isFromBindVar(name) {
+			buf.WriteString(redactedValue)
+			continue
+		}
+		if v, err := sqltypes.BindVariableToValue(bindVars[name]); err == nil {
+			v.EncodeSQL(buf)
+		} else {
+			buf.WriteString(bindVars[name].String())
+		}
+	}
+	buf.WriteString("}")
+	return buf.String()
+}
+
+// isFromBindVar returns true if name is the bind variable of a from
+// column, or of the shard key column, which is derived from the from
+// value. The bind variables of the rows of an insert have the row
+// number as suffix.
+func (lkp *lookupInternal) isFromBindVar(name string) bool {
+	name = trimDigits(name)
+	if lkp.ShardKeyColumn != "" && name == trimDigits(lkp.ShardKeyColumn) {
+		return true
+	}
+	for _, from := range lkp.FromColumns {
+		if name == trimDigits(from) {
+			return true
+		}
+	}
+	return false
+}
+
+func trimDigits(s string) string {
+	return strings.TrimRightFunc(s, func(r rune) bool { return r >= '0' && r <= '9' })
+}
@@ -0,0 +1,337 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/youtube/vitess/go/stats"
+	"github.com/youtube/vitess/go/trace"
+)
+
+// MetricsSink receives the metrics of the lookup vindexes, to export
+// them to a monitoring system other than the stats package, like
+// Prometheus. The metrics keep the names of their stats, like
+// "VindexLookupEmptyMaps", and the first of their labels is always the
+// vindex name. The default sink updates the stats; SetMetricsSink
+// replaces it. A sink must be safe for concurrent use.
+type MetricsSink interface {
+	// AddCounter adds delta to the counter name for labels.
+	AddCounter(name string, labels []string, delta int64)
+	// ResetCounter sets the counter name for labels back to 0, for
+	// the Reset of a vindex. A sink can ignore it if its counters
+	// must not decrease.
+	ResetCounter(name string, labels []string)
+	// Observe adds value to the histogram name of vindex.
+	Observe(name, vindex string, value int64)
+	// ResetHistogram drops the histogram name of vindex.
+	ResetHistogram(name, vindex string)
+	// RegisterGauge registers the gauge name, whose current values by
+	// vindex are returned by values. It's called once per gauge.
+	RegisterGauge(name string, values func() map[string]int64)
+}
+
+// Exemplar identifies the trace of a value observed in a histogram,
+// so that a bucket can be linked to a request that fell in it, like
+// the exemplars of OpenMetrics.
+type Exemplar struct {
+	TraceID string
+	SpanID  string
+}
+
+// ExemplarSink is a MetricsSink that supports exemplars. The timing
+// histograms of the lookup vindexes, like VindexLookupMapLatency, are
+// observed with ObserveWithExemplar instead of Observe when the sink
+// implements it and the request of the value is traced by a tracing
+// plugin that exposes its ids (see trace.IdentifiedSpan). Otherwise,
+// they're observed without an exemplar. The default sink is one: it
+// keeps the last exemplar of each bucket of a histogram, which it
+// publishes as the stat of the histogram followed by "Exemplars",
+// like VindexLookupMapLatencyExemplars.
+type ExemplarSink interface {
+	MetricsSink
+	// ObserveWithExemplar adds value to the histogram name of vindex,
+	// with the exemplar of its trace.
+	ObserveWithExemplar(name, vindex string, value int64, exemplar Exemplar)
+}
+
+var (
+	metricsMu sync.Mutex
+	// metricsSink is the current sink.
+	metricsSink MetricsSink = &statsMetricsSink{published: make(map[string]bool)}
+	// lookupGauges contains the gauges of the lookup vindexes by name,
+	// to register them with a new sink.
+	lookupGauges = make(map[string]func() map[string]int64)
+)
+
+// SetMetricsSink makes the lookup vindexes report their metrics to sink
+// instead of the stats package, and registers their gauges with it. It
+// should be called at startup: the counters already in the stats are
+// not carried over. The stats stay published, but the counters and
+// histograms are no longer updated.
+func SetMetricsSink(sink MetricsSink) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metricsSink = sink
+	for name, values := range lookupGauges {
+		sink.RegisterGauge(name, values)
+	}
+}
+
+// metrics returns the current sink.
+func metrics() MetricsSink {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	return metricsSink
+}
+
+// observeTimed adds value to the histogram name of vindex, with the
+// exemplar of the trace of the request of vcursor if the sink is an
+// ExemplarSink, the VCursor is a ContextVCursor, and its context has
+// a span with ids.
+func observeTimed(vcursor VCursor, name, vindex string, value int64) {
+	sink := metrics()
+	if exemplarSink, ok := sink.(ExemplarSink); ok {
+		if cvc, ok := vcursor.(ContextVCursor); ok {
+			if traceID, spanID, ok := trace.IDsFromContext(cvc.Context()); ok {
+				exemplarSink.ObserveWithExemplar(name, vindex, value, Exemplar{TraceID: traceID, SpanID: spanID})
+				return
+			}
+		}
+	}
+	sink.Observe(name, vindex, value)
+}
+
+// registerLookupGauge registers a gauge with the current sink, and
+// with the sinks set later.
+func registerLookupGauge(name string, values func() map[string]int64) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	lookupGauges[name] = values
+	metricsSink.RegisterGauge(name, values)
+}
+
+var (
+	// statsCounters and statsMultiCounters contain, by name, the
+	// stats that the default sink updates. They're only written
+	// at init.
+	statsCounters      = make(map[string]*stats.Counters)
+	statsMultiCounters = make(map[string]*stats.MultiCounters)
+	// statsHistograms contains, by name, the histograms that the
+	// default sink updates.
+	statsHistograms = make(map[string]*vindexHistograms)
+)
+
+// sinkCounters is a counter by vindex reported to the MetricsSink.
+type sinkCounters struct {
+	name string
+}
+
+// newSinkCounters creates the counter name, and its stat.
+func newSinkCounters(name string) *sinkCounters {
+	statsCounters[name] = stats.NewCounters(name)
+	return &sinkCounters{name: name}
+}
+
+func (c *sinkCounters) Add(vindex string, delta int64) {
+	metrics().AddCounter(c.name, []string{vindex}, delta)
+}
+
+func (c *sinkCounters) Reset(vindex string) {
+	metrics().ResetCounter(c.name, []string{vindex})
+}
+
+// Counts returns the values of the stat.
+func (c *sinkCounters) Counts() map[string]int64 {
+	return statsCounters[c.name].Counts()
+}
+
+// sinkMultiCounters is a counter by vindex and other labels reported
+// to the MetricsSink.
+type sinkMultiCounters struct {
+	name string
+}
+
+// newSinkMultiCounters creates the counter name, and its stat with
+// the labels, the first of which is the vindex.
+func newSinkMultiCounters(name string, labels []string) *sinkMultiCounters {
+	statsMultiCounters[name] = stats.NewMultiCounters(name, labels)
+	return &sinkMultiCounters{name: name}
+}
+
+func (c *sinkMultiCounters) Add(labels []string, delta int64) {
+	metrics().AddCounter(c.name, labels, delta)
+}
+
+func (c *sinkMultiCounters) Reset(labels []string) {
+	metrics().ResetCounter(c.name, labels)
+}
+
+// Counts returns the values of the stat.
+func (c *sinkMultiCounters) Counts() map[string]int64 {
+	return statsMultiCounters[c.name].Counts()
+}
+
+// vindexHistograms is a histogram stat by vindex. A histogram is
+// created on the first value of its vindex, and kept when the vindex
+// is rebuilt by a VSchema reload.
+type vindexHistograms struct {
+	cutoffs []int64
+
+	mu       sync.Mutex
+	byVindex map[string]*stats.Histogram
+	// exemplars contains the last exemplar of each bucket, by vindex
+	// and bucket label.
+	exemplars map[string]map[string]bucketExemplar
+}
+
+// bucketExemplar is the last exemplar of a bucket, with its value.
+type bucketExemplar struct {
+	Exemplar
+	Value int64
+}
+
+// newVindexHistograms creates the histograms name, and publishes them
+// with their exemplars.
+func newVindexHistograms(name string, cutoffs []int64) *vindexHistograms {
+	h := &vindexHistograms{
+		cutoffs:   cutoffs,
+		byVindex:  make(map[string]*stats.Histogram),
+		exemplars: make(map[string]map[string]bucketExemplar),
+	}
+	stats.Publish(name, expvar.Func(func() interface{} {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		byVindex := make(map[string]*stats.Histogram, len(h.byVindex))
+		for vindex, histogram := range h.byVindex {
+			byVindex[vindex] = histogram
+		}
+		return byVindex
+	}))
+	stats.Publish(name+"Exemplars", expvar.Func(func() interface{} {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		exemplars := make(map[string]map[string]bucketExemplar, len(h.exemplars))
+		for vindex, byBucket := range h.exemplars {
+			exemplars[vindex] = make(map[string]bucketExemplar, len(byBucket))
+			for bucket, exemplar := range byBucket {
+				exemplars[vindex][bucket] = exemplar
+			}
+		}
+		return exemplars
+	}))
+	statsHistograms[name] = h
+	return h
+}
+
+// get returns the histogram of vindex, and creates it if needed.
+func (h *vindexHistograms) get(vindex string) *stats.Histogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	histogram, ok := h.byVindex[vindex]
+	if !ok {
+		histogram = stats.NewHistogram("", h.cutoffs)
+		h.byVindex[vindex] = histogram
+	}
+	return histogram
+}
+
+// setExemplar makes exemplar the last one of the bucket of value.
+func (h *vindexHistograms) setExemplar(vindex string, value int64, exemplar Exemplar) {
+	histogram := h.get(vindex)
+	labels := histogram.Labels()
+	bucket := labels[len(labels)-1]
+	for i, cutoff := range h.cutoffs {
+		if value <= cutoff {
+			bucket = labels[i]
+			break
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.exemplars[vindex] == nil {
+		h.exemplars[vindex] = make(map[string]bucketExemplar)
+	}
+	h.exemplars[vindex][bucket] = bucketExemplar{Exemplar: exemplar, Value: value}
+}
+
+func (h *vindexHistograms) reset(vindex string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.byVindex, vindex)
+	delete(h.exemplars, vindex)
+}
+
+// statsMetricsSink is the default MetricsSink. It updates the stats
+// created by newSinkCounters, newSinkMultiCounters and
+// newVindexHistograms, and publishes the gauges. It's an ExemplarSink.
+type statsMetricsSink struct {
+	mu sync.Mutex
+	// published contains the gauges already published, since a
+	// stat can only be published once.
+	published map[string]bool
+}
+
+func (s *statsMetricsSink) AddCounter(name string, labels []string, delta int64) {
+	if c, ok := statsCounters[name]; ok {
+		c.Add(labels[0], delta)
+		return
+	}
+	if c, ok := statsMultiCounters[name]; ok {
+		c.Add(labels, delta)
+	}
+}
+
+func (s *statsMetricsSink) ResetCounter(name string, labels []string) {
+	if c, ok := statsCounters[name]; ok {
+		c.Set(labels[0], 0)
+		return
+	}
+	if c, ok := statsMultiCounters[name]; ok {
+		c.Set(labels, 0)
+	}
+}
+
+func (s *statsMetricsSink) Observe(name, vindex string, value int64) {
+	if h, ok := statsHistograms[name]; ok {
+		h.get(vindex).Add(value)
+	}
+}
+
+func (s *statsMetricsSink) ObserveWithExemplar(name, vindex string, value int64, exemplar Exemplar) {
+	if h, ok := statsHistograms[name]; ok {
+		h.get(vindex).Add(value)
+		h.setExemplar(vindex, value, exemplar)
+	}
+}
+
+func (s *statsMetricsSink) ResetHistogram(name, vindex string) {
+	if h, ok := statsHistograms[name]; ok {
+		h.reset(vindex)
+	}
+}
+
+func (s *statsMetricsSink) RegisterGauge(name string, values func() map[string]int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.published[name] {
+		return
+	}
+	s.published[name] = true
+	stats.Publish(name, stats.CountersFunc(values))
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"fmt"
+
+	log "github.com/golang/glog"
+
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+var (
+	_ Mover = (*LookupNonUnique)(nil)
+	_ Mover = (*LookupUnique)(nil)
+)
+
+// Mover is implemented by the vindexes that can atomically move
+// entries from one keyspace id to another.
+type Mover interface {
+	Move(vcursor VCursor, rowsColValues [][]sqltypes.Value, oldKsid, newKsid []byte) error
+}
+
+// Move deletes the rows of rowsColValues that map to oldValue, and
+// creates them with newValue, in one transaction, so that their mapping
+// is never missing. Unlike Update, the from values stay the same.
+//
+// Without autocommit, both are executed in the transaction of vcursor,
+// which the caller must roll back if Move fails, as for any DML. In
+// autocommit mode, where Delete is a no-op, they're executed in a
+// transaction of their own, which requires a TransactionalVCursor, and
+// which is rolled back if either fails, leaving the original mapping
+// intact. The Create ignores async_writes. Move holds one mutation slot
+// of max_inflight_mutations until the transaction is finished.
+func (lkp *lookupInternal) Move(vcursor VCursor, rowsColValues [][]sqltypes.Value, oldValue, newValue sqltypes.Value) error {
+	if err := lkp.checkWritable("Move"); err != nil {
+		return err
+	}
+	if err := lkp.checkFromValues(rowsColValues); err != nil {
+		return fmt.Errorf("lookup.Move: %v", err)
+	}
+	release, err := lkp.acquireMutation(vcursor, "Move")
+	if err != nil {
+		return err
+	}
+	defer release()
+	if !lkp.Autocommit {
+		return lkp.move(vcursor, rowsColValues, oldValue, newValue)
+	}
+	transactional, ok := vcursor.(TransactionalVCursor)
+	if !ok {
+		return fmt.Errorf("lookup.Move: vindex %s cannot move entries in autocommit mode without a TransactionalVCursor", lkp.name)
+	}
+	invalidated := rowsColValues
+	if lkp.FromList != "" {
+		if invalidated, _, _, err = lkp.expandFromList(rowsColValues, nil, nil); err != nil {
+			return fmt.Errorf("lookup.Move: %v", err)
+		}
+	}
+	tx, err := transactional.Begin()
+	if err != nil {
+		return fmt.Errorf("lookup.Move: begin: %v", err)
+	}
+	if err := lkp.move(txVCursor{tx: tx}, rowsColValues, oldValue, newValue); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.Warningf("rollback of failed Move of vindex %s failed: %v", lkp.name, rbErr)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("lookup.Move: commit: %v", err)
+	}
+	// A Map may have cached the state of the entries during the
+	// transaction.
+	lkp.invalidate(invalidated)
+	lkp.publishInvalidation(invalidated)
+	return nil
+}
+
+// move executes the Delete and the Create of Move with vcursor.
+func (lkp *lookupInternal) move(vcursor VCursor, rowsColValues [][]sqltypes.Value, oldValue, newValue sqltypes.Value) error {
+	if _, err := lkp.deleteRows(vcursor, rowsColValues, oldValue, false /* anyValue */, false /* failOnMissing */); err != nil {
+		return err
+	}
+	newValues := make([]sqltypes.Value, len(rowsColValues))
+	for i := range newValues {
+		newValues[i] = newValue
+	}
+	_, err := lkp.create(vcursor, rowsColValues, newValues, nil, false /* ignoreMode */)
+	return err
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	lookupMutationLimitsMu sync.Mutex
+	// lookupMutationLimits contains the live limits by vindex name.
+	lookupMutationLimits = make(map[string]*mutationLimit)
+)
+
+func init() {
+	registerLookupGauge("VindexLookupInflightMutations", func() map[string]int64 {
+		lookupMutationLimitsMu.Lock()
+		defer lookupMutationLimitsMu.Unlock()
+		counts := make(map[string]int64, len(lookupMutationLimits))
+		for name, l := range lookupMutationLimits {
+			counts[name] = int64(len(l.slots))
+		}
+		return counts
+	})
+}
+
+// A ContextVCursor is a VCursor that knows the context of its request.
+// The lookup vindexes with max_inflight_mutations stop waiting for a
+// mutation slot when it's done. Otherwise, they wait until one is free.
+// All the lookup vindexes draw their retries from the RetryBudget of
+// the context, if any, and stop waiting for them when it's done.
+type ContextVCursor interface {
+	VCursor
+	Context() context.Context
+}
+
+// mutationLimit caps the number of mutations that a lookup vindex
+// executes at once. Each one holds a slot of slots.
+type mutationLimit struct {
+	slots chan struct{}
+}
+
+// newMutationLimit creates the limit of lkp and registers it,
+// replacing any previous limit of the same name.
+func newMutationLimit(lkp *lookupInternal, size int) *mutationLimit {
+	l := &mutationLimit{slots: make(chan struct{}, size)}
+	lookupMutationLimitsMu.Lock()
+	lookupMutationLimits[lkp.name] = l
+	lookupMutationLimitsMu.Unlock()
+	return l
+}
+
+// acquireMutation waits for a mutation slot if MaxInflightMutations is
+// set, and returns the function that releases it. It fails if the
+// context of vcursor is done first.
+func (lkp *lookupInternal) acquireMutation(vcursor VCursor, method string) (func(), error) {
+	if lkp.mutations == nil {
+		return func() {}, nil
+	}
+	release := func() { <-lkp.mutations.slots }
+	select {
+	case lkp.mutations.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	// A nil done never fires.
+	var ctx context.Context
+	var done <-chan struct{}
+	if cvc, ok := vcursor.(ContextVCursor); ok {
+		ctx = cvc.Context()
+		done = ctx.Done()
+	}
+	select {
+	case lkp.mutations.slots <- struct{}{}:
+		return release, nil
+	case <-done:
+		return nil, fmt.Errorf("lookup.%s: gave up waiting for one of the %d mutation slots of vindex %s: %v", method, lkp.MaxInflightMutations, lkp.name, ctx.Err())
+	}
+}
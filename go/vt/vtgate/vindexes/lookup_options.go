@@ -0,0 +1,100 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"fmt"
+	"sort"
+)
+
+// LookupOptionParser parses and validates the value of a custom option
+// of the lookup vindexes, like the option of a LookupQueryBuilder or a
+// KsidCodec registered by an extension. It's called by the Init of each
+// vindex that sets the option, after the built-in options are parsed,
+// with the name of the vindex, the value of the option, and all the
+// params of the vindex, which it must not modify. An error fails the
+// creation of the vindex. The returned value is what LookupOption
+// returns for the vindex. A parser can be called concurrently, for
+// different vindexes, when a VSchema is loaded.
+type LookupOptionParser func(vindex, value string, params map[string]string) (interface{}, error)
+
+// lookupOptionParsers contains the custom options by name. It's only
+// written at init.
+var lookupOptionParsers = make(map[string]LookupOptionParser)
+
+// RegisterLookupOption registers the custom option name of the lookup
+// vindexes, and its parser. It must be called at init. It panics if
+// name is a built-in option, which takes precedence, or if it's
+// already registered.
+func RegisterLookupOption(name string, parser LookupOptionParser) {
+	for _, params := range [][]string{lookupNonUniqueParams, lookupUniqueParams, lookupHashParams, lookupHashUniqueParams} {
+		for _, param := range params {
+			if param == name {
+				panic(fmt.Sprintf("lookup option %s is a built-in option", name))
+			}
+		}
+	}
+	if _, ok := lookupOptionParsers[name]; ok {
+		panic(fmt.Sprintf("lookup option %s is already registered", name))
+	}
+	lookupOptionParsers[name] = parser
+}
+
+// LookupOption returns the value parsed by the LookupOptionParser of the
+// custom option name for the lookup vindex v. It returns false if v is
+// not a lookup vindex, or doesn't set the option.
+func LookupOption(v Vindex, name string) (interface{}, bool) {
+	lkp, err := lookupInternalOf(v)
+	if err != nil {
+		return nil, false
+	}
+	value, ok := lkp.options[name]
+	return value, ok
+}
+
+// customLookupParams returns the names of the custom options, to accept
+// them along with the params of the vindex type.
+func customLookupParams() []string {
+	names := make([]string, 0, len(lookupOptionParsers))
+	for name := range lookupOptionParsers {
+		names = append(names, name)
+	}
+	return names
+}
+
+// parseCustomOptions runs the parsers of the custom options set in
+// params, in the order of their names, and stores their values.
+func (lkp *lookupInternal) parseCustomOptions(params map[string]string) error {
+	var names []string
+	for name := range lookupOptionParsers {
+		if _, ok := params[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, err := lookupOptionParsers[name](lkp.name, params[name], params)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if lkp.options == nil {
+			lkp.options = make(map[string]interface{})
+		}
+		lkp.options[name] = value
+	}
+	return nil
+}
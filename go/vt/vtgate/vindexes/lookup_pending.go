@@ -0,0 +1,210 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/youtube/vitess/go/sqltypes"
+
+	querypb "github.com/youtube/vitess/go/vt/proto/query"
+)
+
+var (
+	_ PendingCreator = (*LookupNonUnique)(nil)
+	_ PendingCreator = (*LookupUnique)(nil)
+)
+
+// defaultPendingCreateTimeout is the time after which a PendingCreate
+// that was neither committed nor rolled back is rolled back, unless
+// pending_create_timeout is set.
+const defaultPendingCreateTimeout = 30 * time.Second
+
+// lookupPendingTimeouts counts, by vindex, the PendingCreates that
+// were rolled back because they timed out.
+var lookupPendingTimeouts = newSinkCounters("VindexLookupPendingCreateTimeouts")
+
+// A TransactionalVCursor is a VCursor that can execute queries in a
+// transaction of their own, separate from the session, which the caller
+// commits or rolls back later. Lookup vindexes need it for CreatePending.
+type TransactionalVCursor interface {
+	VCursor
+	// Begin starts a transaction. It must remain usable after the
+	// request is done, until it's committed or rolled back.
+	Begin() (VCursorTx, error)
+}
+
+// VCursorTx is a transaction started by TransactionalVCursor.Begin.
+// Either Commit or Rollback must be called once, to release it.
+type VCursorTx interface {
+	Execute(method string, query string, bindvars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error)
+	Commit() error
+	Rollback() error
+}
+
+// PendingCreator is implemented by the vindexes that can insert
+// entries in a transaction of their own, and defer its commit.
+type PendingCreator interface {
+	CreatePending(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksids [][]byte, ignoreMode bool) (*PendingCreate, error)
+}
+
+// PendingCreate is the handle of the entries inserted by CreatePending,
+// whose transaction is still open. This lets the caller commit the
+// entries only once the statement that owns them is durable, and roll
+// them back if it fails, so that the table never has entries without
+// rows, even briefly. If neither Commit nor Rollback is called within
+// the pending_create_timeout of the vindex, the entries are rolled back,
+// and Commit then fails. Since MySQL holds the locks of the inserted
+// rows until then, the caller should finish the handle promptly.
+type PendingCreate struct {
+	lkp  *lookupInternal
+	tx   VCursorTx
+	rows [][]sqltypes.Value
+
+	mu    sync.Mutex
+	timer *time.Timer
+	// done is set once the transaction is finished, and state
+	// says how: "committed", "rolled back" or "timed out".
+	done  bool
+	state string
+}
+
+// Commit commits the entries. It fails if the handle is already
+// finished, in which case the entries are not committed unless the
+// handle was committed before.
+func (p *PendingCreate) Commit() error {
+	if err := p.finish("committed"); err != nil {
+		return err
+	}
+	if err := p.tx.Commit(); err != nil {
+		return fmt.Errorf("lookup.Create: commit: %v", err)
+	}
+	// A Map may have cached the absence of the entries before they
+	// were committed.
+	p.lkp.invalidate(p.rows)
+	p.lkp.publishInvalidation(p.rows)
+	return nil
+}
+
+// Rollback rolls the entries back. It's a no-op if the handle is
+// already finished, so that it can be deferred after CreatePending
+// and before Commit.
+func (p *PendingCreate) Rollback() error {
+	if err := p.finish("rolled back"); err != nil {
+		return nil
+	}
+	if err := p.tx.Rollback(); err != nil {
+		return fmt.Errorf("lookup.Create: rollback: %v", err)
+	}
+	return nil
+}
+
+// timeout rolls the entries back if the handle is not finished.
+func (p *PendingCreate) timeout() {
+	if err := p.finish("timed out"); err != nil {
+		return
+	}
+	lookupPendingTimeouts.Add(p.lkp.name, 1)
+	if err := p.tx.Rollback(); err != nil {
+		log.Warningf("rollback of timed out pending Create of vindex %s failed: %v", p.lkp.name, err)
+	}
+}
+
+// finish marks the handle as finished with state. It fails if it
+// already was.
+func (p *PendingCreate) finish(state string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return fmt.Errorf("lookup.Create: pending create of vindex %s is already %s", p.lkp.name, p.state)
+	}
+	p.done = true
+	p.state = state
+	p.timer.Stop()
+	return nil
+}
+
+// txVCursor executes all the queries of a VCursor in tx.
+type txVCursor struct {
+	tx VCursorTx
+}
+
+func (vc txVCursor) Execute(method string, query string, bindvars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
+	return vc.tx.Execute(method, query, bindvars, isDML)
+}
+
+func (vc txVCursor) ExecuteAutocommit(method string, query string, bindvars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
+	return vc.tx.Execute(method, query, bindvars, isDML)
+}
+
+// CreatePending is like Create, but it inserts the rows in a new
+// transaction of vcursor, which must be a TransactionalVCursor, and
+// returns the handle that commits it. The rows are inserted right away,
+// also with async_writes. If the insert fails, the transaction is rolled
+// back and the error is returned. In autocommit mode, the insert is not
+// retried on deadlock, since that rolls back the transaction. The insert
+// holds a mutation slot of max_inflight_mutations, but the handle doesn't.
+func (lkp *lookupInternal) CreatePending(vcursor VCursor, rowsColValues [][]sqltypes.Value, toValues []sqltypes.Value, ignoreMode bool) (*PendingCreate, error) {
+	if err := lkp.checkWritable("Create"); err != nil {
+		return nil, err
+	}
+	transactional, ok := vcursor.(TransactionalVCursor)
+	if !ok {
+		return nil, fmt.Errorf("lookup.Create: vindex %s cannot defer the commit of a Create without a TransactionalVCursor", lkp.name)
+	}
+	if err := lkp.checkFromValues(rowsColValues); err != nil {
+		return nil, fmt.Errorf("lookup.Create: %v", err)
+	}
+	rows := rowsColValues
+	if lkp.FromList != "" {
+		var err error
+		if rows, _, _, err = lkp.expandFromList(rowsColValues, nil, nil); err != nil {
+			return nil, fmt.Errorf("lookup.Create: %v", err)
+		}
+	}
+	release, err := lkp.acquireMutation(vcursor, "Create")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	tx, err := transactional.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("lookup.Create: begin: %v", err)
+	}
+	if _, err := lkp.create(txVCursor{tx: tx}, rowsColValues, toValues, nil, ignoreMode); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.Warningf("rollback of failed pending Create of vindex %s failed: %v", lkp.name, rbErr)
+		}
+		return nil, err
+	}
+	p := &PendingCreate{lkp: lkp, tx: tx, rows: rows}
+	p.mu.Lock()
+	p.timer = time.AfterFunc(lkp.pendingCreateTimeout(), p.timeout)
+	p.mu.Unlock()
+	return p, nil
+}
+
+func (lkp *lookupInternal) pendingCreateTimeout() time.Duration {
+	if lkp.PendingCreateTimeout == 0 {
+		return defaultPendingCreateTimeout
+	}
+	return lkp.PendingCreateTimeout
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/youtube/vitess/go/sqltypes"
+
+	querypb "github.com/youtube/vitess/go/vt/proto/query"
+)
+
+// initPrefixMatch checks that PrefixMatch can be used with the other
+// options of the vindex, and builds its queries. The queries compare
+// the from column with the bounds of the prefix, so that MySQL can
+// scan a range of an index whose leading column is the from column.
+func (lkp *lookupInternal) initPrefixMatch() error {
+	if !lkp.PrefixMatch {
+		return nil
+	}
+	switch {
+	case len(lkp.FromColumns) != 1:
+		return fmt.Errorf("prefix_match is only supported for a single from column: %v", lkp.FromColumns)
+	case lkp.FromList != "":
+		return fmt.Errorf("prefix_match cannot be used with from_list for vindex table %s", lkp.Table)
+	case lkp.CacheSize != 0:
+		// The cache is keyed and invalidated by exact from value.
+		return fmt.Errorf("prefix_match cannot be used with cache_size for vindex table %s", lkp.Table)
+	case lkp.ConsolidateLookups:
+		return fmt.Errorf("prefix_match cannot be used with consolidate_lookups for vindex table %s", lkp.Table)
+	case lkp.FullScanThreshold != 0:
+		return fmt.Errorf("prefix_match cannot be used with full_scan_threshold for vindex table %s", lkp.Table)
+	case lkp.QueryBuilder != "":
+		return fmt.Errorf("prefix_match cannot be used with query_builder %s", lkp.QueryBuilder)
+	}
+	from := lkp.FromColumns[0]
+	lkp.selPrefixFrom = fmt.Sprintf("select %s from %s where %s >= :%s_start", quoteIdent(lkp.To), quoteIdent(lkp.Table), quoteIdent(from), from)
+	lkp.selPrefix = fmt.Sprintf("%s and %s < :%s_end", lkp.selPrefixFrom, quoteIdent(from), from)
+	return nil
+}
+
+// fetchPrefix reads the rows whose from value starts with prefix.
+// The bounds are bound as varbinary, which makes MySQL compare the
+// bytes of the from values, whatever their collation.
+func (lkp *lookupInternal) fetchPrefix(vcursor VCursor, prefix sqltypes.Value) (*sqltypes.Result, error) {
+	from := lkp.FromColumns[0]
+	start := prefix.ToBytes()
+	bindVars := map[string]*querypb.BindVariable{
+		from + "_start": sqltypes.BytesBindVariable(start),
+	}
+	query := lkp.selPrefixFrom
+	if end := prefixEnd(start); end != nil {
+		bindVars[from+"_end"] = sqltypes.BytesBindVariable(end)
+		query = lkp.selPrefix
+	}
+	var begin time.Time
+	if lkp.adaptive != nil {
+		begin = time.Now()
+	}
+	result, err := lkp.executeRead(vcursor, "VindexLookup", query, bindVars, false /* isDML */)
+	if err != nil {
+		return nil, err
+	}
+	if err := lkp.checkRows(result, 1); err != nil {
+		return nil, err
+	}
+	if lkp.adaptive != nil {
+		lkp.adaptive.record(time.Since(begin))
+	}
+	return result, nil
+}
+
+// prefixEnd returns the smallest value that is greater than all the
+// values that start with prefix, which is the exclusive upper bound of
+// the range of prefix. It drops the trailing 0xff bytes of prefix, which
+// cannot be incremented, and increments the last remaining byte: the end
+// of "ab" is "ac", and the end of "a\xff" is "b". It returns nil if
+// there's no such value, that is if prefix is empty or only has 0xff
+// bytes, in which case the range has no upper bound.
+func prefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			end := make([]byte, i+1)
+			copy(end, prefix)
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
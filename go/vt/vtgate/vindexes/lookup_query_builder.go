@@ -0,0 +1,148 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LookupQueries are the queries of a lookup vindex. Their bind
+// variables are named after the columns of the vindex. Lookup selects
+// the 'to' values of the id bound as the first from column. Verify
+// selects the rows of that id and of the 'to' value bound as the 'to'
+// column. Delete deletes the rows of the values bound as all the from
+// columns and the 'to' column.
+//
+// Insert is optional. If set, Create executes it once per row, with the
+// same bind variables as Delete, instead of inserting all the rows with
+// one statement, and it's responsible for any upsert or ignore behavior.
+// The other queries, like those of ReverseMap and full scans, are always
+// the standard ones.
+type LookupQueries struct {
+	Lookup string
+	Verify string
+	Delete string
+	Insert string
+}
+
+// A LookupQueryBuilder builds the queries of the lookup vindexes that
+// name it in their query_builder param. It lets the vindexes use a
+// backing table that's queried differently, like a view.
+type LookupQueryBuilder interface {
+	BuildQueries(table string, fromColumns []string, to string) (*LookupQueries, error)
+}
+
+var lookupQueryBuilders = make(map[string]LookupQueryBuilder)
+
+func init() {
+	RegisterLookupQueryBuilder("default", DefaultLookupQueryBuilder{})
+}
+
+// RegisterLookupQueryBuilder registers a LookupQueryBuilder under the
+// specified name, which can then be used as the query_builder of lookup
+// vindexes. A duplicate name will generate a panic.
+func RegisterLookupQueryBuilder(name string, builder LookupQueryBuilder) {
+	if _, ok := lookupQueryBuilders[name]; ok {
+		panic(fmt.Sprintf("lookup query builder %s is already registered", name))
+	}
+	lookupQueryBuilders[name] = builder
+}
+
+// queryBuilderFromMap returns the LookupQueryBuilder named by the
+// query_builder param. It defaults to DefaultLookupQueryBuilder.
+func queryBuilderFromMap(m map[string]string) (LookupQueryBuilder, error) {
+	name, ok := m["query_builder"]
+	if !ok {
+		return DefaultLookupQueryBuilder{}, nil
+	}
+	builder, ok := lookupQueryBuilders[name]
+	if !ok {
+		return nil, fmt.Errorf("query_builder %q is not registered", name)
+	}
+	return builder, nil
+}
+
+// DefaultLookupQueryBuilder builds the standard queries of the lookup
+// vindexes. It's the "default" query_builder.
+type DefaultLookupQueryBuilder struct{}
+
+// BuildQueries is part of the LookupQueryBuilder interface.
+func (DefaultLookupQueryBuilder) BuildQueries(table string, fromColumns []string, to string) (*LookupQueries, error) {
+	// TODO @rafael: update Lookup and Verify to support multi column vindexes. This will be done
+	// as part of face 2 of https://github.com/youtube/vitess/issues/3481
+	// For now multi column behaves as a single column for Map and Verify operations
+	from := fromColumns[0]
+	del := fmt.Sprintf("delete from %s where ", quoteIdent(table))
+	for _, column := range fromColumns {
+		del += quoteIdent(column) + " = :" + column + " and "
+	}
+	return &LookupQueries{
+		Lookup: fmt.Sprintf("select %s from %s where %s = :%s", quoteIdent(to), quoteIdent(table), quoteIdent(from), from),
+		Verify: fmt.Sprintf("select %s from %s where %s = :%s and %s = :%s", quoteIdent(from), quoteIdent(table), quoteIdent(from), from, quoteIdent(to), to),
+		Delete: del + quoteIdent(to) + " = :" + to,
+	}, nil
+}
+
+// validate checks that the queries reference the bind
+// variables they're executed with.
+func (q *LookupQueries) validate(fromColumns []string, to string) error {
+	allColumns := append(append([]string(nil), fromColumns...), to)
+	checks := []struct {
+		name, query string
+		bindVars    []string
+	}{
+		{"Lookup", q.Lookup, fromColumns[:1]},
+		{"Verify", q.Verify, []string{fromColumns[0], to}},
+		{"Delete", q.Delete, allColumns},
+		{"Insert", q.Insert, allColumns},
+	}
+	for _, check := range checks {
+		if check.query == "" {
+			if check.name == "Insert" {
+				continue
+			}
+			return fmt.Errorf("%s query is empty", check.name)
+		}
+		for _, bindVar := range check.bindVars {
+			if !referencesBindVar(check.query, bindVar) {
+				return fmt.Errorf("%s query %q does not reference :%s", check.name, check.query, bindVar)
+			}
+		}
+	}
+	return nil
+}
+
+// referencesBindVar returns true if query contains :name, not
+// followed by another character of an identifier.
+func referencesBindVar(query, name string) bool {
+	ref := ":" + name
+	for {
+		i := strings.Index(query, ref)
+		if i < 0 {
+			return false
+		}
+		query = query[i+len(ref):]
+		if query == "" || !isIdentChar(query[0]) {
+			return true
+		}
+	}
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+var (
+	_ VSchemaReloadHook = (*LookupNonUnique)(nil)
+	_ VSchemaReloadHook = (*LookupUnique)(nil)
+	_ VSchemaReloadHook = (*LookupHash)(nil)
+	_ VSchemaReloadHook = (*LookupHashUnique)(nil)
+)
+
+// VSchemaReloadHook is implemented by the vindexes that keep state
+// derived from their config or their backend, which a VSchema reload
+// can make stale. NotifyVSchemaReload calls it.
+type VSchemaReloadHook interface {
+	// OnVSchemaReload is called after the VSchema that contains the
+	// vindex was loaded. If vcursor is not nil, the vindex also checks
+	// its config against its backend. It must be safe to call
+	// concurrently with the other methods of the vindex.
+	OnVSchemaReload(vcursor VCursor) error
+}
+
+var (
+	lookupReloadMu sync.Mutex
+	// lookupReloadConfigs contains the config of each lookup vindex, by
+	// name, as of its last OnVSchemaReload.
+	lookupReloadConfigs = make(map[string]string)
+)
+
+// NotifyVSchemaReload calls OnVSchemaReload, without a VCursor, on the
+// vindexes of vschema that implement VSchemaReloadHook, in the order of
+// their keyspaces and names. Errors are logged. It then closes the
+// async_writes queues of the vindexes of the previous VSchema.
+func NotifyVSchemaReload(vschema *VSchema) {
+	var keyspaces []string
+	for ksName := range vschema.Keyspaces {
+		keyspaces = append(keyspaces, ksName)
+	}
+	sort.Strings(keyspaces)
+	for _, ksName := range keyspaces {
+		ks := vschema.Keyspaces[ksName]
+		var names []string
+		for name := range ks.Vindexes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			hook, ok := ks.Vindexes[name].(VSchemaReloadHook)
+			if !ok {
+				continue
+			}
+			if err := hook.OnVSchemaReload(nil); err != nil {
+				log.Warningf("OnVSchemaReload of vindex %s in keyspace %s failed: %v", name, ksName, err)
+			}
+		}
+	}
+	retireAsyncQueues(vschema)
+}
+
+// OnVSchemaReload invalidates the state of the vindex if its config
+// changed since its last call, or if it's the first one for its name:
+// it bumps the generation of its cache, which drops the cached entries,
+// even from a Map that is running, and forgets the estimate of
+// EstimateRows. If vcursor is not nil, it then reads a row of the table
+// and checks its collation, like SelfTest without self_test_id, and if
+// that fails, the next call checks again. It does nothing else if the
+// config didn't change, which makes it cheap to call on every reload.
+func (lkp *lookupInternal) OnVSchemaReload(vcursor VCursor) error {
+	data, err := json.Marshal(lkp)
+	if err != nil {
+		return fmt.Errorf("lookup.OnVSchemaReload: %v", err)
+	}
+	config := string(data)
+	lookupReloadMu.Lock()
+	previous, ok := lookupReloadConfigs[lkp.name]
+	lookupReloadConfigs[lkp.name] = config
+	lookupReloadMu.Unlock()
+	if ok && previous == config {
+		return nil
+	}
+
+	if lkp.cache != nil {
+		lkp.cache.bumpGeneration()
+	}
+	lkp.estimate.mu.Lock()
+	lkp.estimate.expires = time.Time{}
+	lkp.estimate.mu.Unlock()
+	if vcursor == nil {
+		return nil
+	}
+	err = lkp.selfTestRead(vcursor)
+	if err == nil {
+		err = lkp.checkCollation(vcursor)
+	}
+	if err != nil {
+		lookupReloadMu.Lock()
+		delete(lookupReloadConfigs, lkp.name)
+		lookupReloadMu.Unlock()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"fmt"
+
+	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/key"
+
+	topodatapb "github.com/youtube/vitess/go/vt/proto/topodata"
+)
+
+// ReshardMismatch is a row of a lookup table that would not route
+// correctly after a reshard cutover, as reported by VerifyReshard.
+type ReshardMismatch struct {
+	From sqltypes.Value
+	To   sqltypes.Value
+	// Ksid is the keyspace id of To, or nil if it couldn't be decoded.
+	Ksid []byte
+	// Sources and Targets are the number of source and target
+	// keyranges that contain Ksid.
+	Sources int
+	Targets int
+}
+
+func (m *ReshardMismatch) String() string {
+	switch {
+	case m.Ksid == nil:
+		return fmt.Sprintf("from %v: cannot decode keyspace id %v", m.From, m.To)
+	case m.Sources == 0:
+		return fmt.Sprintf("from %v: keyspace id %x is in %d target keyranges but in no source keyrange", m.From, m.Ksid, m.Targets)
+	}
+	return fmt.Sprintf("from %v: keyspace id %x is in %d target keyranges, want 1", m.From, m.Ksid, m.Targets)
+}
+
+// VerifyReshard checks that the rows of the table of the lookup vindex v
+// still route to exactly one shard once the source keyranges of a
+// reshard are replaced with the target keyranges. It calls fn for every
+// row whose keyspace id is in a source keyrange but in zero or several
+// target keyranges, which means that the targets have a gap or overlap,
+// and for every row whose keyspace id is in a target keyrange but in no
+// source keyrange, whose data the target shards don't have. The rows
+// outside of both are not affected by the reshard, and are skipped.
+//
+// The table is streamed like in DiffLookups, in batches of batchSize
+// rows. If maxMismatches is not zero, VerifyReshard stops with an error
+// after that many mismatches. If fn returns an error, it stops and
+// returns the error. A to_hash vindex cannot be verified, since its
+// table doesn't have the keyspace ids.
+func VerifyReshard(vcursor VCursor, v Vindex, sources, targets []*topodatapb.KeyRange, batchSize, maxMismatches int, fn func(*ReshardMismatch) error) error {
+	if batchSize <= 0 {
+		return fmt.Errorf("lookup.VerifyReshard: batch size must be positive: %d", batchSize)
+	}
+	if len(sources) == 0 || len(targets) == 0 {
+		return fmt.Errorf("lookup.VerifyReshard: got %d source and %d target keyranges, want at least one of each", len(sources), len(targets))
+	}
+	lkp, decode, err := ksidDecoderOf("VerifyReshard", v)
+	if err != nil {
+		return err
+	}
+	scanner := newLookupScanner(vcursor, lkp, batchSize)
+	mismatches := 0
+	for {
+		row, err := scanner.peek()
+		if err != nil {
+			return fmt.Errorf("lookup.VerifyReshard: %v", err)
+		}
+		if row == nil {
+			return nil
+		}
+		scanner.next()
+		m := &ReshardMismatch{From: row[0], To: row[1]}
+		if ksid, err := decode(row[1]); err == nil {
+			m.Ksid = ksid
+			m.Sources = countKeyRanges(sources, ksid)
+			m.Targets = countKeyRanges(targets, ksid)
+			if m.Sources == 0 && m.Targets == 0 || m.Sources != 0 && m.Targets == 1 {
+				continue
+			}
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+		mismatches++
+		if maxMismatches > 0 && mismatches >= maxMismatches {
+			return fmt.Errorf("lookup.VerifyReshard: stopped after %d mismatches", mismatches)
+		}
+	}
+}
+
+// ksidDecoderOf returns the lookupInternal of v, and a function
+// that decodes the keyspace ids of its to column. method prefixes
+// its errors.
+func ksidDecoderOf(method string, v Vindex) (*lookupInternal, func(sqltypes.Value) ([]byte, error), error) {
+	decodeHash := func(to sqltypes.Value) ([]byte, error) {
+		num, err := sqltypes.ToUint64(to)
+		if err != nil {
+			return nil, err
+		}
+		return vhash(num), nil
+	}
+	switch v := v.(type) {
+	case *LookupNonUnique:
+		if v.lkp.ToHash {
+			return nil, nil, fmt.Errorf("lookup.%s: vindex %s has to_hash, its table doesn't have the keyspace ids", method, v)
+		}
+		return &v.lkp, func(to sqltypes.Value) ([]byte, error) { return decodeKsid(v.codec, to) }, nil
+	case *LookupUnique:
+		return &v.lkp, func(to sqltypes.Value) ([]byte, error) { return decodeKsid(v.codec, to) }, nil
+	case *LookupHash:
+		return &v.lkp, decodeHash, nil
+	case *LookupHashUnique:
+		return &v.lkp, decodeHash, nil
+	}
+	return nil, nil, fmt.Errorf("lookup.%s: %s is not a lookup vindex", method, v)
+}
+
+// countKeyRanges returns the number of keyranges that contain ksid.
+func countKeyRanges(keyRanges []*topodatapb.KeyRange, ksid []byte) int {
+	n := 0
+	for _, kr := range keyRanges {
+		if key.KeyRangeContains(kr, ksid) {
+			n++
+		}
+	}
+	return n
+}
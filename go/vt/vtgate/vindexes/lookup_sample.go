@@ -0,0 +1,231 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/key"
+
+	querypb "github.com/youtube/vitess/go/vt/proto/query"
+)
+
+var (
+	// lookupSampledRows and lookupSampleInconsistencies count, by
+	// vindex, the rows checked by SampleVerify, and the ones that
+	// were inconsistent.
+	lookupSampledRows           = newSinkCounters("VindexLookupSampledRows")
+	lookupSampleInconsistencies = newSinkCounters("VindexLookupSampleInconsistencies")
+)
+
+// maxSampleExamples is the number of inconsistent rows that a
+// SampleReport describes.
+const maxSampleExamples = 10
+
+// sampleZ is the z-score of the 95% confidence interval of a
+// SampleReport.
+const sampleZ = 1.96
+
+// SampleCheck returns true if the row of a lookup table that maps from
+// to ksid is consistent, for instance because the source row of from
+// is in the shard of ksid.
+type SampleCheck func(from sqltypes.Value, ksid []byte) (bool, error)
+
+// SampleReport is the result of a SampleVerify.
+type SampleReport struct {
+	Vindex string
+	// Rate is the fraction of rows that was requested.
+	Rate float64
+	// Sampled is the number of rows that were checked, and
+	// Inconsistent the number of them that were not consistent.
+	Sampled      int
+	Inconsistent int
+	// Examples describes the first inconsistent rows.
+	Examples []string
+}
+
+// InconsistencyRate returns the fraction of the sampled rows that
+// were inconsistent, or 0 if no row was sampled.
+func (r *SampleReport) InconsistencyRate() float64 {
+	if r.Sampled == 0 {
+		return 0
+	}
+	return float64(r.Inconsistent) / float64(r.Sampled)
+}
+
+// ConfidenceInterval returns the Wilson score interval of the
+// inconsistency rate of the entire table at 95% confidence. Unlike
+// the usual rate +/- margin, it stays within [0, 1] and is not empty
+// when no row was inconsistent: with n sampled rows that were all
+// consistent, its upper bound is about 3.8/n. It's [0, 1] if no row
+// was sampled.
+func (r *SampleReport) ConfidenceInterval() (low, high float64) {
+	if r.Sampled == 0 {
+		return 0, 1
+	}
+	n := float64(r.Sampled)
+	p := r.InconsistencyRate()
+	z2 := sampleZ * sampleZ
+	denom := 1 + z2/n
+	center := (p + z2/(2*n)) / denom
+	margin := sampleZ * math.Sqrt(p*(1-p)/n+z2/(4*n*n)) / denom
+	return math.Max(0, center-margin), math.Min(1, center+margin)
+}
+
+func (r *SampleReport) String() string {
+	low, high := r.ConfidenceInterval()
+	return fmt.Sprintf("vindex %s: %d of %d sampled rows inconsistent (%.4f%%, 95%% confidence interval %.4f%%-%.4f%%)", r.Vindex, r.Inconsistent, r.Sampled, 100*r.InconsistencyRate(), 100*low, 100*high)
+}
+
+// SampleVerify checks a random sample of the rows of the table of the
+// lookup vindex v, instead of all of them, to monitor its consistency
+// cheaply. Each row is selected with probability rate, which must be
+// in (0, 1], and checked with check. If check is nil, a row is
+// consistent if Map of v returns its keyspace id for its from value,
+// which catches the rows that Map cannot decode or misses, like
+// because of a stale cache. A caller that knows the source table can
+// pass a check that compares the row with it. The rows are counted in
+// VindexLookupSampledRows and VindexLookupSampleInconsistencies.
+//
+// The statistical caveats are:
+//
+// The rows are selected by rand() in MySQL, so the table is still
+// read entirely. The sample saves the checks, and the transfer of
+// the rows, not the scan.
+//
+// The sample size is random, of rate times the number of rows on
+// average, and the interval of the report is for its actual size.
+// A small sample gives a wide interval, which is the honest answer:
+// no inconsistency in 100 rows only bounds the rate to about 4%.
+//
+// The interval assumes that the rows are inconsistent independently
+// of each other. Inconsistencies that cluster, like the rows of a
+// failed bulk Create, are either mostly missed or over-represented by
+// a given sample. And, at 95% confidence, one report in 20 is expected
+// to have an interval that misses the real rate.
+//
+// The rows are checked after they're read, so the ones that change in
+// between, like by a concurrent Update, can be reported as
+// inconsistent. A low rate of such transient inconsistencies is
+// expected on a busy table.
+//
+// A to_hash vindex cannot be checked, since its table doesn't have
+// the keyspace ids.
+func SampleVerify(vcursor VCursor, v Vindex, rate float64, check SampleCheck) (*SampleReport, error) {
+	if rate <= 0 || rate > 1 {
+		return nil, fmt.Errorf("lookup.SampleVerify: sample rate must be in (0, 1]: %v", rate)
+	}
+	lkp, decode, err := ksidDecoderOf("SampleVerify", v)
+	if err != nil {
+		return nil, err
+	}
+	if check == nil {
+		check = mapSampleCheck(vcursor, v)
+	}
+	query := fmt.Sprintf("select %s, %s from %s where rand() < :sample_rate", quoteIdent(lkp.FromColumns[0]), quoteIdent(lkp.To), quoteIdent(lkp.Table))
+	bindVars := map[string]*querypb.BindVariable{
+		"sample_rate": sqltypes.Float64BindVariable(rate),
+	}
+	result, err := lkp.executeRead(vcursor, "VindexSampleVerify", query, bindVars, false /* isDML */)
+	if err != nil {
+		return nil, fmt.Errorf("lookup.SampleVerify: %v", err)
+	}
+	if err := lkp.checkRows(result, 2); err != nil {
+		return nil, fmt.Errorf("lookup.SampleVerify: %v", err)
+	}
+	report := &SampleReport{
+		Vindex:  lkp.name,
+		Rate:    rate,
+		Sampled: len(result.Rows),
+	}
+	for _, row := range result.Rows {
+		var example string
+		ksid, err := decode(row[1])
+		if err != nil {
+			example = fmt.Sprintf("from %v: cannot decode keyspace id %v: %v", row[0], row[1], err)
+		} else {
+			ok, err := check(row[0], ksid)
+			if err != nil {
+				return nil, fmt.Errorf("lookup.SampleVerify: from %v: %v", row[0], err)
+			}
+			if ok {
+				continue
+			}
+			example = fmt.Sprintf("from %v: keyspace id %x is inconsistent", row[0], ksid)
+		}
+		report.Inconsistent++
+		if len(report.Examples) < maxSampleExamples {
+			report.Examples = append(report.Examples, example)
+		}
+	}
+	lookupSampledRows.Add(lkp.name, int64(report.Sampled))
+	lookupSampleInconsistencies.Add(lkp.name, int64(report.Inconsistent))
+	return report, nil
+}
+
+// mapSampleCheck returns the SampleCheck that compares the keyspace
+// id of a row with the result of Map of v for its from value.
+func mapSampleCheck(vcursor VCursor, v Vindex) SampleCheck {
+	return func(from sqltypes.Value, ksid []byte) (bool, error) {
+		switch v := v.(type) {
+		case Unique:
+			out, err := v.Map(vcursor, []sqltypes.Value{from})
+			if err != nil {
+				return false, err
+			}
+			return bytes.Equal(out[0], ksid), nil
+		case NonUnique:
+			out, err := v.Map(vcursor, []sqltypes.Value{from})
+			if err != nil {
+				return false, err
+			}
+			if out[0].Range != nil {
+				return key.KeyRangeContains(out[0].Range, ksid), nil
+			}
+			for _, id := range out[0].IDs {
+				if bytes.Equal(id, ksid) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		return false, fmt.Errorf("vindex %s has no Map", v)
+	}
+}
+
+// RunSampleVerify runs SampleVerify every interval until ctx is done,
+// and calls fn with the report or the error of each run. It blocks, so
+// it's meant to be run in its own goroutine. vcursor must stay usable
+// for as long as it runs, unlike the VCursor of a request.
+func RunSampleVerify(ctx context.Context, vcursor VCursor, v Vindex, rate float64, interval time.Duration, check SampleCheck, fn func(*SampleReport, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn(SampleVerify(vcursor, v, rate, check))
+		}
+	}
+}
@@ -0,0 +1,347 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/youtube/vitess/go/sqltypes"
+
+	querypb "github.com/youtube/vitess/go/vt/proto/query"
+)
+
+var (
+	_ NonUnique = (*LookupScoped)(nil)
+	_ Lookup    = (*LookupScoped)(nil)
+)
+
+func init() {
+	Register("lookup_scoped", NewLookupScoped)
+}
+
+// scopeVindexPrefix prefixes the params of the first stage vindex
+// of a LookupScoped.
+const scopeVindexPrefix = "scope_vindex."
+
+// lookupScopedParams are the params that a LookupScoped accepts, in
+// addition to the ones of its first stage vindex. The other params of
+// lookup vindexes don't apply to its Map and Verify.
+var lookupScopedParams = map[string]bool{
+	"table":                   true,
+	"from":                    true,
+	"to":                      true,
+	"autocommit":              true,
+	"ksid_encoding":           true,
+	"deadlock_retries":        true,
+	"retry_on_missing_table":  true,
+	"log_queries":             true,
+	"log_queries_redact":      true,
+	"connection_pool":         true,
+	"read_only":               true,
+	"require_qualified_table": true,
+	"read_cell":               true,
+	"error_context":           true,
+	"snapshot_reads":          true,
+	"scope_vindex":            true,
+	"scope_column":            true,
+}
+
+// LookupScoped is a non-unique lookup vindex whose rows are scoped
+// by a value that another vindex, its first stage, derives from the
+// id, like the hash of a tenant id. The value flows in two stages:
+// the first stage vindex maps the id to a keyspace id, the scope,
+// and the lookup table maps the id and its scope to the keyspace ids
+// of the vindex. The table stores the scope in the scope column, next
+// to the from column, and every query filters on both. If the table
+// is sharded by the scope column, the queries of an id go to a single
+// shard, which vtgate cannot do by itself when the planner chains the
+// two vindexes.
+type LookupScoped struct {
+	name string
+	// scope is the first stage vindex. It's Unique.
+	scope       Vindex
+	scopeColumn string
+	codec       KsidCodec
+	// sel and ver are the queries of Map and Verify.
+	sel, ver string
+	lkp      lookupInternal
+}
+
+// NewLookupScoped creates a LookupScoped vindex.
+// The supplied map has the following required fields:
+//   table: name of the backing table. It can be qualified by the keyspace.
+//   from: the column of the id. It must be a single column.
+//   to: name of the to column, which holds the keyspace ids.
+//   scope_vindex: the type of the first stage vindex, like "hash". It must be a
+//     registered unique vindex. Its params are the params of the vindex that
+//     start with "scope_vindex.", without the prefix, and its name is the name
+//     of the vindex followed by "_scope".
+//   scope_column: the column of the table that holds the scope of each id,
+//     which is the keyspace id that the first stage vindex maps it to, as
+//     varbinary.
+//
+// The following fields are optional:
+//   autocommit, ksid_encoding, deadlock_retries, retry_on_missing_table,
+//     log_queries, log_queries_redact, connection_pool, read_only, require_qualified_table,
+//     read_cell, error_context, snapshot_reads: see NewLookup.
+//
+// Map derives the scope of each id, and returns the keyspace ids of the rows of
+// the id in that scope. An id that the first stage doesn't map has no keyspace
+// id, and Verify returns false for it. Create, Delete and Update derive the
+// scope of their from values the same way, and write it in the scope column,
+// so the first stage must not change the scope of an id while the table has
+// rows for it. Other params fail, since they don't apply to the scoped queries.
+func NewLookupScoped(name string, m map[string]string) (Vindex, error) {
+	ls := &LookupScoped{name: name}
+	scopeParams := make(map[string]string)
+	lookupParams := make(map[string]string)
+	for k, v := range m {
+		switch {
+		case strings.HasPrefix(k, scopeVindexPrefix):
+			scopeParams[strings.TrimPrefix(k, scopeVindexPrefix)] = v
+		case !lookupScopedParams[k]:
+			return nil, fmt.Errorf("lookup_scoped does not support param %s", k)
+		case k != "scope_vindex" && k != "scope_column":
+			lookupParams[k] = v
+		}
+	}
+	if m["scope_vindex"] == "" || m["scope_column"] == "" {
+		return nil, fmt.Errorf("lookup_scoped requires scope_vindex and scope_column")
+	}
+	if strings.Contains(m["from"], ",") {
+		return nil, fmt.Errorf("lookup_scoped only supports a single from column: %s", m["from"])
+	}
+	var err error
+	ls.scope, err = CreateVindex(m["scope_vindex"], name+"_scope", scopeParams)
+	if err != nil {
+		return nil, fmt.Errorf("scope_vindex %s: %v", m["scope_vindex"], err)
+	}
+	if !IsUnique(ls.scope) {
+		return nil, fmt.Errorf("scope_vindex %s is not a unique vindex", m["scope_vindex"])
+	}
+	ls.scopeColumn = m["scope_column"]
+	ls.codec, err = ksidCodecFromMap(m)
+	if err != nil {
+		return nil, err
+	}
+	autocommit, err := boolFromMap(m, "autocommit")
+	if err != nil {
+		return nil, err
+	}
+	// The scope is the second from column, so that Create, Delete and
+	// Update write and match it.
+	lookupParams["from"] = m["from"] + "," + ls.scopeColumn
+	// The params were checked against lookupScopedParams already.
+	known := make([]string, 0, len(lookupParams))
+	for k := range lookupParams {
+		known = append(known, k)
+	}
+	if err := ls.lkp.Init(name, lookupParams, known, autocommit, autocommit /* upsert */); err != nil {
+		return nil, err
+	}
+	from, to := ls.lkp.FromColumns[0], ls.lkp.To
+	ls.sel = fmt.Sprintf("select %s from %s where %s = :%s and %s = :%s", quoteIdent(to), quoteIdent(ls.lkp.Table), quoteIdent(ls.scopeColumn), ls.scopeColumn, quoteIdent(from), from)
+	ls.ver = fmt.Sprintf("select %s from %s where %s = :%s and %s = :%s and %s = :%s", quoteIdent(from), quoteIdent(ls.lkp.Table), quoteIdent(ls.scopeColumn), ls.scopeColumn, quoteIdent(from), from, quoteIdent(to), to)
+	return ls, nil
+}
+
+// String returns the name of the vindex.
+func (ls *LookupScoped) String() string {
+	return ls.name
+}
+
+// Cost returns the cost of the lookup, 20, plus the cost of the first
+// stage vindex.
+func (ls *LookupScoped) Cost() int {
+	return 20 + ls.scope.Cost()
+}
+
+// scopes returns the scope of each id, or a NULL value for the ids
+// that are NULL or that the first stage vindex doesn't map.
+func (ls *LookupScoped) scopes(vcursor VCursor, ids []sqltypes.Value) ([]sqltypes.Value, error) {
+	out := make([]sqltypes.Value, len(ids))
+	var mapIDs []sqltypes.Value
+	for _, id := range ids {
+		if !id.IsNull() {
+			mapIDs = append(mapIDs, id)
+		}
+	}
+	if len(mapIDs) == 0 {
+		return out, nil
+	}
+	ksids, err := ls.scope.(Unique).Map(vcursor, mapIDs)
+	if err != nil {
+		return nil, fmt.Errorf("scope_vindex %s: %v", ls.scope, err)
+	}
+	for i, id := range ids {
+		if id.IsNull() {
+			continue
+		}
+		if ksid := ksids[0]; ksid != nil {
+			out[i] = sqltypes.MakeTrusted(sqltypes.VarBinary, ksid)
+		}
+		ksids = ksids[1:]
+	}
+	return out, nil
+}
+
+// Map returns the keyspace ids of the rows of the ids in their scopes.
+func (ls *LookupScoped) Map(vcursor VCursor, ids []sqltypes.Value) ([]Ksids, error) {
+	out, err := ls.lookup(vcursor, ids)
+	return out, ls.lkp.mapError("Map", ids, err)
+}
+
+// lookup implements Map.
+func (ls *LookupScoped) lookup(vcursor VCursor, ids []sqltypes.Value) ([]Ksids, error) {
+	scopes, err := ls.scopes(vcursor, ids)
+	if err != nil {
+		return nil, fmt.Errorf("lookup.Map: %v", err)
+	}
+	out := make([]Ksids, 0, len(ids))
+	for i, id := range ids {
+		if scopes[i].IsNull() {
+			out = append(out, Ksids{})
+			continue
+		}
+		bindVars := map[string]*querypb.BindVariable{
+			ls.scopeColumn:        sqltypes.ValueBindVariable(scopes[i]),
+			ls.lkp.FromColumns[0]: sqltypes.ValueBindVariable(id),
+		}
+		result, err := ls.lkp.executeRead(vcursor, "VindexLookup", ls.sel, bindVars, false /* isDML */)
+		if err != nil {
+			return nil, fmt.Errorf("lookup.Map: %v", err)
+		}
+		if err := ls.lkp.checkRows(result, 1); err != nil {
+			return nil, fmt.Errorf("lookup.Map: %v", err)
+		}
+		ksids := make([][]byte, 0, len(result.Rows))
+		for _, row := range result.Rows {
+			ksid, err := decodeKsid(ls.codec, row[0])
+			if err != nil {
+				return nil, err
+			}
+			ksids = append(ksids, ksid)
+		}
+		out = append(out, Ksids{IDs: ksids})
+	}
+	return out, nil
+}
+
+// Verify returns true if the ids map to the keyspace ids in their
+// scopes.
+func (ls *LookupScoped) Verify(vcursor VCursor, ids []sqltypes.Value, ksids [][]byte) ([]bool, error) {
+	out, err := ls.verify(vcursor, ids, ksids)
+	return out, ls.lkp.mapError("Verify", ids, err)
+}
+
+// verify implements Verify.
+func (ls *LookupScoped) verify(vcursor VCursor, ids []sqltypes.Value, ksids [][]byte) ([]bool, error) {
+	if len(ids) != len(ksids) {
+		return nil, fmt.Errorf("lookup.Verify: got %d keyspace ids for %d ids", len(ksids), len(ids))
+	}
+	scopes, err := ls.scopes(vcursor, ids)
+	if err != nil {
+		return nil, fmt.Errorf("lookup.Verify: %v", err)
+	}
+	out := make([]bool, len(ids))
+	for i, id := range ids {
+		if scopes[i].IsNull() {
+			continue
+		}
+		bindVars := map[string]*querypb.BindVariable{
+			ls.scopeColumn:        sqltypes.ValueBindVariable(scopes[i]),
+			ls.lkp.FromColumns[0]: sqltypes.ValueBindVariable(id),
+			ls.lkp.To:             sqltypes.ValueBindVariable(ksidToValue(ls.codec, ksids[i])),
+		}
+		result, err := ls.lkp.executeRead(vcursor, "VindexVerify", ls.ver, bindVars, false /* isDML */)
+		if err != nil {
+			return nil, fmt.Errorf("lookup.Verify: %v", err)
+		}
+		out[i] = len(result.Rows) != 0
+	}
+	return out, nil
+}
+
+// scopedRows returns the rows of from values, of a single column,
+// followed by their scopes. It fails if an id has no scope, since
+// its row could not be found by Map.
+func (ls *LookupScoped) scopedRows(vcursor VCursor, method string, rowsColValues [][]sqltypes.Value) ([][]sqltypes.Value, error) {
+	ids := make([]sqltypes.Value, 0, len(rowsColValues))
+	for rowIdx, row := range rowsColValues {
+		if len(row) != 1 {
+			return nil, fmt.Errorf("lookup.%s: got %d from values in row %d, want 1", method, len(row), rowIdx)
+		}
+		ids = append(ids, row[0])
+	}
+	scopes, err := ls.scopes(vcursor, ids)
+	if err != nil {
+		return nil, fmt.Errorf("lookup.%s: %v", method, err)
+	}
+	rows := make([][]sqltypes.Value, 0, len(ids))
+	for i, id := range ids {
+		if scopes[i].IsNull() {
+			return nil, fmt.Errorf("lookup.%s: scope_vindex %s has no keyspace id for %v", method, ls.scope, id)
+		}
+		rows = append(rows, []sqltypes.Value{id, scopes[i]})
+	}
+	return rows, nil
+}
+
+// Create reserves the ids by inserting them, with their scopes, into
+// the vindex table.
+func (ls *LookupScoped) Create(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksids [][]byte, ignoreMode bool) error {
+	rows, err := ls.scopedRows(vcursor, "Create", rowsColValues)
+	if err != nil {
+		return err
+	}
+	return ls.lkp.Create(vcursor, rows, ksidsToValues(ls.codec, ksids), ignoreMode)
+}
+
+// Delete deletes the entries of the ids in their scopes.
+func (ls *LookupScoped) Delete(vcursor VCursor, rowsColValues [][]sqltypes.Value, ksid []byte) error {
+	rows, err := ls.scopedRows(vcursor, "Delete", rowsColValues)
+	if err != nil {
+		return err
+	}
+	return ls.lkp.Delete(vcursor, rows, ksidToValue(ls.codec, ksid))
+}
+
+// Update updates the entry in the vindex table. The old and new values
+// can have different scopes. Like the other non-unique vindexes, it
+// fails if ksid is empty.
+func (ls *LookupScoped) Update(vcursor VCursor, oldValues []sqltypes.Value, ksid []byte, newValues []sqltypes.Value) error {
+	oldRows, err := ls.scopedRows(vcursor, "Update", [][]sqltypes.Value{oldValues})
+	if err != nil {
+		return err
+	}
+	newRow := newValues
+	if len(ksid) != 0 {
+		newRows, err := ls.scopedRows(vcursor, "Update", [][]sqltypes.Value{newValues})
+		if err != nil {
+			return err
+		}
+		newRow = newRows[0]
+	}
+	return ls.lkp.Update(vcursor, oldRows[0], ksidToValue(ls.codec, ksid), newRow)
+}
+
+// MarshalJSON returns a JSON representation of LookupScoped. Its from
+// columns end with the scope column.
+func (ls *LookupScoped) MarshalJSON() ([]byte, error) {
+	return ls.lkp.MarshalJSON()
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+var (
+	_ SelfTester = (*LookupNonUnique)(nil)
+	_ SelfTester = (*LookupUnique)(nil)
+	_ SelfTester = (*LookupHash)(nil)
+	_ SelfTester = (*LookupHashUnique)(nil)
+
+	_ SelfTestReporter = (*LookupNonUnique)(nil)
+	_ SelfTestReporter = (*LookupUnique)(nil)
+	_ SelfTestReporter = (*LookupHash)(nil)
+	_ SelfTestReporter = (*LookupHashUnique)(nil)
+)
+
+// SelfTester is implemented by the vindexes that can check
+// that their backing table is usable, typically at deploy time,
+// to catch permission or schema issues.
+type SelfTester interface {
+	SelfTest(vcursor VCursor) error
+}
+
+// selfTestKsid is the keyspace id of the entry created by SelfTest.
+// It has 8 bytes, so that the lookup_hash vindexes can store it.
+var selfTestKsid = []byte("selftest")
+
+// selfTest reads a row of the table of the lookup vindex v, and checks
+// the collation of its from columns if collation_check is set. If the
+// self_test_id param is set, it then creates an entry for it, verifies
+// it and deletes it, in the transaction of vcursor. It stops at the
+// first failure.
+func selfTest(vcursor VCursor, v Vindex, lkp *lookupInternal) error {
+	if err := lkp.selfTestRead(vcursor); err != nil {
+		return err
+	}
+	if err := lkp.checkCollation(vcursor); err != nil {
+		return err
+	}
+	if lkp.selfTestWriteSkipped() != "" {
+		return nil
+	}
+	return selfTestWrite(vcursor, v, lkp)
+}
+
+// selfTestRead reads a row of the table, which checks that it can be
+// reached, and that it has the from and to columns.
+func (lkp *lookupInternal) selfTestRead(vcursor VCursor) error {
+	query := lkp.scan + " limit 1"
+	lkp.logQuery("VindexSelfTest", query, nil)
+	var err error
+	if lkp.Autocommit {
+		_, err = lkp.executeAutocommit(vcursor, "VindexSelfTest", query, nil, false /* isDML */)
+	} else {
+		_, err = vcursor.Execute("VindexSelfTest", query, nil, false /* isDML */)
+	}
+	if err != nil {
+		return fmt.Errorf("lookup.SelfTest: %v", err)
+	}
+	return nil
+}
+
+// selfTestWriteSkipped returns why selfTestWrite is not run, if it's not.
+func (lkp *lookupInternal) selfTestWriteSkipped() string {
+	switch {
+	case lkp.SelfTestID == "":
+		return "self_test_id is not set"
+	case lkp.ReadOnly:
+		// A read_only vindex cannot create the entry.
+		return "the vindex is read-only"
+	}
+	return ""
+}
+
+// selfTestWrite creates the entry of self_test_id, verifies it and
+// deletes it, which checks the permissions of the vindex on its table.
+func selfTestWrite(vcursor VCursor, v Vindex, lkp *lookupInternal) error {
+	id := selfTestValue(lkp.SelfTestID)
+	rows := [][]sqltypes.Value{{id}}
+	lookup := v.(Lookup)
+	if err := lookup.Create(vcursor, rows, [][]byte{selfTestKsid}, false /* ignoreMode */); err != nil {
+		return fmt.Errorf("lookup.SelfTest: %v", err)
+	}
+	// With async_writes, the entry is only created by the worker.
+	lkp.Flush()
+	verified, err := v.Verify(vcursor, []sqltypes.Value{id}, [][]byte{selfTestKsid})
+	if err == nil && !verified[0] {
+		err = fmt.Errorf("entry for %s not found after it was created", lkp.SelfTestID)
+	}
+	// The entry is deleted even if it couldn't be verified.
+	if delErr := lookup.Delete(vcursor, rows, selfTestKsid); err == nil {
+		err = delErr
+	}
+	if err != nil {
+		return fmt.Errorf("lookup.SelfTest: %v", err)
+	}
+	return nil
+}
+
+// SelfTestStatus is the result of a check of a SelfTestReport.
+type SelfTestStatus int
+
+const (
+	// SelfTestPassed means that the check found no issue.
+	SelfTestPassed = SelfTestStatus(iota)
+	// SelfTestFailed means that the check found an issue that makes
+	// SelfTest fail.
+	SelfTestFailed
+	// SelfTestWarned means that the check found an issue that SelfTest
+	// only logs, like a collation mismatch without collation_check set
+	// to "error".
+	SelfTestWarned
+	// SelfTestSkipped means that the check doesn't apply to the vindex.
+	SelfTestSkipped
+)
+
+func (s SelfTestStatus) String() string {
+	switch s {
+	case SelfTestPassed:
+		return "passed"
+	case SelfTestFailed:
+		return "failed"
+	case SelfTestWarned:
+		return "warned"
+	case SelfTestSkipped:
+		return "skipped"
+	}
+	return fmt.Sprintf("SelfTestStatus(%d)", int(s))
+}
+
+// SelfTestCheck is a check of a SelfTestReport.
+type SelfTestCheck struct {
+	// Name is "read", which checks that the table can be reached and
+	// has the from and to columns; "index", which runs ValidateIndex;
+	// "collation", which runs ValidateCollation; or "write", which
+	// creates, verifies and deletes the entry of self_test_id to check
+	// the permissions on the table.
+	Name   string
+	Status SelfTestStatus
+	// Detail is the issue found by the check, or why it was skipped.
+	Detail string
+}
+
+// SelfTestReport is the result of all the checks of SelfTestReport,
+// in the order they ran.
+type SelfTestReport struct {
+	Vindex string
+	Checks []SelfTestCheck
+}
+
+// Err returns an error listing the failed checks of the report, or
+// nil if none failed.
+func (r *SelfTestReport) Err() error {
+	var failed []string
+	for _, check := range r.Checks {
+		if check.Status == SelfTestFailed {
+			failed = append(failed, check.Name+": "+check.Detail)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("lookup.SelfTest: %d of %d checks failed for vindex %s: %s", len(failed), len(r.Checks), r.Vindex, strings.Join(failed, "; "))
+}
+
+// SelfTestReporter is implemented by the vindexes that can run all the
+// checks of SelfTest, and more, and report each of them, instead of
+// stopping at the first failure. This gives the operator the complete
+// list of issues of a vindex in one run, while SelfTest fails fast.
+type SelfTestReporter interface {
+	SelfTestReport(vcursor VCursor) *SelfTestReport
+}
+
+// selfTestReport runs the checks of selfTest, and the ValidateIndex of
+// the vindex, which is unique if unique is true, and reports all of
+// them. Unlike selfTest, it always checks the collation, but a
+// mismatch only fails the check if collation_check is "error".
+func selfTestReport(vcursor VCursor, v Vindex, lkp *lookupInternal, unique bool) *SelfTestReport {
+	r := &SelfTestReport{Vindex: lkp.name}
+	add := func(name string, err error) {
+		check := SelfTestCheck{Name: name, Status: SelfTestPassed}
+		if err != nil {
+			check.Status = SelfTestFailed
+			check.Detail = err.Error()
+		}
+		r.Checks = append(r.Checks, check)
+	}
+	add("read", lkp.selfTestRead(vcursor))
+	add("index", lkp.validateIndex(vcursor, unique))
+	err := lkp.validateCollation(vcursor)
+	add("collation", err)
+	if _, ok := err.(*CollationError); ok && lkp.CollationCheck != "error" {
+		r.Checks[len(r.Checks)-1].Status = SelfTestWarned
+	}
+	if reason := lkp.selfTestWriteSkipped(); reason != "" {
+		r.Checks = append(r.Checks, SelfTestCheck{Name: "write", Status: SelfTestSkipped, Detail: reason})
+	} else {
+		add("write", selfTestWrite(vcursor, v, lkp))
+	}
+	return r
+}
+
+// selfTestValue returns the self_test_id as an int64 if it's
+// a number, and as a varchar otherwise.
+func selfTestValue(id string) sqltypes.Value {
+	if v, err := strconv.ParseInt(id, 10, 64); err == nil {
+		return sqltypes.NewInt64(v)
+	}
+	return sqltypes.NewVarChar(id)
+}
@@ -17,13 +17,24 @@ limitations under the License.
 package vindexes
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"strings"
+	"golang.org/x/net/context"
 
 	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/trace"
+	"github.com/youtube/vitess/go/vt/sqlparser"
 
 	querypb "github.com/youtube/vitess/go/vt/proto/query"
 	topodatapb "github.com/youtube/vitess/go/vt/proto/topodata"
@@ -33,11 +44,17 @@ import (
 // They also test lookupInternal functionality.
 
 type vcursor struct {
-	mustFail    bool
-	numRows     int
-	result      *sqltypes.Result
-	queries     []*querypb.BoundQuery
-	autocommits int
+	mustFail         bool
+	numDeadlocks     int
+	numMissingTables int
+	numRows          int
+	result           *sqltypes.Result
+	queries          []*querypb.BoundQuery
+	autocommits      int
+	// insertsAffected and deletesAffected, if set, are the
+	// RowsAffected of the next inserts and deletes.
+	insertsAffected []uint64
+	deletesAffected []uint64
 }
 
 func (vc *vcursor) Execute(method string, query string, bindvars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
@@ -57,6 +74,14 @@ func (vc *vcursor) execute(method string, query string, bindvars map[string]*que
 	if vc.mustFail {
 		return nil, errors.New("execute failed")
 	}
+	if vc.numDeadlocks > 0 {
+		vc.numDeadlocks--
+		return nil, errors.New("Deadlock found when trying to get lock; try restarting transaction (errno 1213) (sqlstate 40001)")
+	}
+	if vc.numMissingTables > 0 {
+		vc.numMissingTables--
+		return nil, errors.New("Table 'vt_ks.t' doesn't exist (errno 1146) (sqlstate 42S02)")
+	}
 	switch {
 	case strings.HasPrefix(query, "select"):
 		if vc.result != nil {
@@ -73,9 +98,19 @@ func (vc *vcursor) execute(method string, query string, bindvars map[string]*que
 		}
 		return result, nil
 	case strings.HasPrefix(query, "insert"):
-		return &sqltypes.Result{InsertID: 1}, nil
+		result := &sqltypes.Result{InsertID: 1}
+		if len(vc.insertsAffected) != 0 {
+			result.RowsAffected = vc.insertsAffected[0]
+			vc.insertsAffected = vc.insertsAffected[1:]
+		}
+		return result, nil
 	case strings.HasPrefix(query, "delete"):
-		return &sqltypes.Result{}, nil
+		result := &sqltypes.Result{}
+		if len(vc.deletesAffected) != 0 {
+			result.RowsAffected = vc.deletesAffected[0]
+			vc.deletesAffected = vc.deletesAffected[1:]
+		}
+		return result, nil
 	}
 	panic("unexpected")
 }
@@ -103,11 +138,90 @@ func TestLookupNonUniqueNew(t *testing.T) {
 	}
 }
 
+func TestLookupNonUniqueUnknownParams(t *testing.T) {
+	_, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":     "t",
+		"from":      "fromc",
+		"to":        "toc",
+		"autocomit": "true",
+		"writeonly": "true",
+	})
+	want := "unknown params for lookup vindex on table t: autocomit, writeonly"
+	if err == nil || err.Error() != want {
+		t.Errorf("Create(unknown params): %v, want %s", err, want)
+	}
+
+	_, err = CreateVindex("lookup", "lookup", map[string]string{
+		"table":                "t",
+		"from":                 "fromc",
+		"to":                   "toc",
+		"autocomit":            "true",
+		"allow_unknown_params": "true",
+	})
+	if err != nil {
+		t.Errorf("Create(allow_unknown_params): %v, want nil", err)
+	}
+
+	// The params of the other vindex types are unknown.
+	testcases := []struct {
+		vindexType, param string
+	}{
+		{"lookup", "on_missing"},
+		{"lookup_unique", "distinct"},
+		{"lookup_hash", "allow_multi"},
+		{"lookup_hash_unique", "on_missing"},
+		{"lookup_hash_unique", "strict_unique_verify"},
+		{"lookup_hash_unique", "write_only_cost"},
+	}
+	for _, tcase := range testcases {
+		_, err := CreateVindex(tcase.vindexType, tcase.vindexType, map[string]string{
+			"table":     "t",
+			"from":      "fromc",
+			"to":        "toc",
+			tcase.param: "error",
+		})
+		want := "unknown params for lookup vindex on table t: " + tcase.param
+		if err == nil || err.Error() != want {
+			t.Errorf("CreateVindex(%s, %s): %v, want %s", tcase.vindexType, tcase.param, err, want)
+		}
+	}
+}
+
 func TestLookupNonUniqueCost(t *testing.T) {
 	lookupNonUnique := createLookup(t, "lookup", false)
 	if lookupNonUnique.Cost() != 20 {
 		t.Errorf("Cost(): %d, want 20", lookupNonUnique.Cost())
 	}
+
+	lookupNonUnique = createLookup(t, "lookup", true)
+	if lookupNonUnique.Cost() != 100 {
+		t.Errorf("Cost(write_only): %d, want 100", lookupNonUnique.Cost())
+	}
+
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":           "t",
+		"from":            "fromc",
+		"to":              "toc",
+		"write_only":      "true",
+		"write_only_cost": "50",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lookupNonUnique.Cost() != 50 {
+		t.Errorf("Cost(write_only_cost): %d, want 50", lookupNonUnique.Cost())
+	}
+
+	_, err = CreateVindex("lookup", "lookup", map[string]string{
+		"table":           "t",
+		"from":            "fromc",
+		"to":              "toc",
+		"write_only_cost": "-1",
+	})
+	want := "write_only_cost value must be a non-negative integer: '-1'"
+	if err == nil || err.Error() != want {
+		t.Errorf("Create(bad_cost): %v, want %s", err, want)
+	}
 }
 
 func TestLookupNonUniqueString(t *testing.T) {
@@ -141,12 +255,12 @@ func TestLookupNonUniqueMap(t *testing.T) {
 	}
 
 	wantqueries := []*querypb.BoundQuery{{
-		Sql: "select toc from t where fromc = :fromc",
+		Sql: "select `toc` from `t` where `fromc` = :fromc",
 		BindVariables: map[string]*querypb.BindVariable{
 			"fromc": sqltypes.Int64BindVariable(1),
 		},
 	}, {
-		Sql: "select toc from t where fromc = :fromc",
+		Sql: "select `toc` from `t` where `fromc` = :fromc",
 		BindVariables: map[string]*querypb.BindVariable{
 			"fromc": sqltypes.Int64BindVariable(2),
 		},
@@ -197,12 +311,12 @@ func TestLookupNonUniqueMapAutocommit(t *testing.T) {
 	}
 
 	wantqueries := []*querypb.BoundQuery{{
-		Sql: "select toc from t where fromc = :fromc",
+		Sql: "select `toc` from `t` where `fromc` = :fromc",
 		BindVariables: map[string]*querypb.BindVariable{
 			"fromc": sqltypes.Int64BindVariable(1),
 		},
 	}, {
-		Sql: "select toc from t where fromc = :fromc",
+		Sql: "select `toc` from `t` where `fromc` = :fromc",
 		BindVariables: map[string]*querypb.BindVariable{
 			"fromc": sqltypes.Int64BindVariable(2),
 		},
@@ -245,6 +359,56 @@ func TestLookupNonUniqueMapAbsent(t *testing.T) {
 	}
 }
 
+func TestLookupNonUniqueReverseMap(t *testing.T) {
+	lookupNonUnique := createLookup(t, "lookup", false)
+	vc := &vcursor{numRows: 2}
+
+	got, err := lookupNonUnique.(*LookupNonUnique).ReverseMap(vc, [][]byte{[]byte("test1"), []byte("test2")})
+	if err != nil {
+		t.Error(err)
+	}
+	want := [][]sqltypes.Value{
+		{sqltypes.NewInt64(1), sqltypes.NewInt64(2)},
+		{sqltypes.NewInt64(1), sqltypes.NewInt64(2)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReverseMap(): %v, want %v", got, want)
+	}
+
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: "select `fromc` from `t` where `toc` = :toc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"toc": sqltypes.BytesBindVariable([]byte("test1")),
+		},
+	}, {
+		Sql: "select `fromc` from `t` where `toc` = :toc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"toc": sqltypes.BytesBindVariable([]byte("test2")),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("lookup.ReverseMap queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	vc = &vcursor{numRows: 0}
+	got, err = lookupNonUnique.(*LookupNonUnique).ReverseMap(vc, [][]byte{[]byte("test1")})
+	if err != nil {
+		t.Error(err)
+	}
+	want = [][]sqltypes.Value{{}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReverseMap(absent): %#v, want %#v", got, want)
+	}
+
+	// Test query fail.
+	vc.mustFail = true
+	_, err = lookupNonUnique.(*LookupNonUnique).ReverseMap(vc, [][]byte{[]byte("test1")})
+	wantErr := "lookup.ReverseMap: execute failed"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("ReverseMap(query fail) err: %v, want %s", err, wantErr)
+	}
+}
+
 func TestLookupNonUniqueVerify(t *testing.T) {
 	lookupNonUnique := createLookup(t, "lookup", false)
 	vc := &vcursor{numRows: 1}
@@ -255,13 +419,13 @@ func TestLookupNonUniqueVerify(t *testing.T) {
 	}
 
 	wantqueries := []*querypb.BoundQuery{{
-		Sql: "select fromc from t where fromc = :fromc and toc = :toc",
+		Sql: "select `fromc` from `t` where `fromc` = :fromc and `toc` = :toc",
 		BindVariables: map[string]*querypb.BindVariable{
 			"fromc": sqltypes.Int64BindVariable(1),
 			"toc":   sqltypes.BytesBindVariable([]byte("test1")),
 		},
 	}, {
-		Sql: "select fromc from t where fromc = :fromc and toc = :toc",
+		Sql: "select `fromc` from `t` where `fromc` = :fromc and `toc` = :toc",
 		BindVariables: map[string]*querypb.BindVariable{
 			"fromc": sqltypes.Int64BindVariable(2),
 			"toc":   sqltypes.BytesBindVariable([]byte("test2")),
@@ -295,6 +459,20 @@ func TestLookupNonUniqueVerify(t *testing.T) {
 	if !reflect.DeepEqual(got, wantBools) {
 		t.Errorf("lookup.Verify(writeOnly): %v, want %v", got, wantBools)
 	}
+
+	// ForceLookup consults the table even in writeOnly mode.
+	vc.numRows = 0
+	got, err = lookupNonUnique.(*LookupNonUnique).VerifyWithOptions(vc, []sqltypes.Value{sqltypes.NewInt64(1), sqltypes.NewInt64(2)}, [][]byte{[]byte("test1"), []byte("test2")}, VerifyOptions{ForceLookup: true})
+	if err != nil {
+		t.Error(err)
+	}
+	if got, want := len(vc.queries), 2; got != want {
+		t.Errorf("lookup.Verify(ForceLookup) queries: %v, want %d", vc.queries, want)
+	}
+	wantBools = []bool{false, false}
+	if !reflect.DeepEqual(got, wantBools) {
+		t.Errorf("lookup.Verify(ForceLookup): %v, want %v", got, wantBools)
+	}
 }
 
 func TestLookupNonUniqueVerifyAutocommit(t *testing.T) {
@@ -315,13 +493,13 @@ func TestLookupNonUniqueVerifyAutocommit(t *testing.T) {
 	}
 
 	wantqueries := []*querypb.BoundQuery{{
-		Sql: "select fromc from t where fromc = :fromc and toc = :toc",
+		Sql: "select `fromc` from `t` where `fromc` = :fromc and `toc` = :toc",
 		BindVariables: map[string]*querypb.BindVariable{
 			"fromc": sqltypes.Int64BindVariable(1),
 			"toc":   sqltypes.BytesBindVariable([]byte("test1")),
 		},
 	}, {
-		Sql: "select fromc from t where fromc = :fromc and toc = :toc",
+		Sql: "select `fromc` from `t` where `fromc` = :fromc and `toc` = :toc",
 		BindVariables: map[string]*querypb.BindVariable{
 			"fromc": sqltypes.Int64BindVariable(2),
 			"toc":   sqltypes.BytesBindVariable([]byte("test2")),
@@ -336,6 +514,62 @@ func TestLookupNonUniqueVerifyAutocommit(t *testing.T) {
 	}
 }
 
+func TestLookupNonUniqueShardKey(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":            "t",
+		"from":             "fromc",
+		"to":               "toc",
+		"shard_key_column": "prefix",
+		"shard_key_prefix": "2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{numRows: 1}
+
+	_, err = lookupNonUnique.Verify(vc, []sqltypes.Value{sqltypes.NewVarChar("abc")}, [][]byte{[]byte("test1")})
+	if err != nil {
+		t.Error(err)
+	}
+	err = lookupNonUnique.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewVarChar("abc")}, {sqltypes.NewVarChar("d")}}, [][]byte{[]byte("test1"), []byte("test2")}, false /* ignoreMode */)
+	if err != nil {
+		t.Error(err)
+	}
+
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: "select `fromc` from `t` where `prefix` = :prefix and `fromc` = :fromc and `toc` = :toc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"prefix": sqltypes.BytesBindVariable([]byte("ab")),
+			"fromc":  sqltypes.StringBindVariable("abc"),
+			"toc":    sqltypes.BytesBindVariable([]byte("test1")),
+		},
+	}, {
+		Sql: "insert into `t`(`fromc`, `prefix`, `toc`) values(:fromc0, :prefix0, :toc0), (:fromc1, :prefix1, :toc1)",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc0":  sqltypes.StringBindVariable("abc"),
+			"prefix0": sqltypes.BytesBindVariable([]byte("ab")),
+			"toc0":    sqltypes.BytesBindVariable([]byte("test1")),
+			"fromc1":  sqltypes.StringBindVariable("d"),
+			"prefix1": sqltypes.StringBindVariable("d"),
+			"toc1":    sqltypes.BytesBindVariable([]byte("test2")),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("lookup queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	_, err = CreateVindex("lookup", "lookup", map[string]string{
+		"table":            "t",
+		"from":             "fromc",
+		"to":               "toc",
+		"shard_key_prefix": "2",
+	})
+	want := "shard_key_prefix requires shard_key_column for vindex table t"
+	if err == nil || err.Error() != want {
+		t.Errorf("Create(no shard_key_column): %v, want %s", err, want)
+	}
+}
+
 func TestLookupNonUniqueCreate(t *testing.T) {
 	lookupNonUnique := createLookup(t, "lookup", false)
 	vc := &vcursor{}
@@ -346,7 +580,7 @@ func TestLookupNonUniqueCreate(t *testing.T) {
 	}
 
 	wantqueries := []*querypb.BoundQuery{{
-		Sql: "insert into t(fromc, toc) values(:fromc0, :toc0), (:fromc1, :toc1)",
+		Sql: "insert into `t`(`fromc`, `toc`) values(:fromc0, :toc0), (:fromc1, :toc1)",
 		BindVariables: map[string]*querypb.BindVariable{
 			"fromc0": sqltypes.Int64BindVariable(1),
 			"toc0":   sqltypes.BytesBindVariable([]byte("test1")),
@@ -365,7 +599,7 @@ func TestLookupNonUniqueCreate(t *testing.T) {
 		t.Error(err)
 	}
 
-	wantqueries[0].Sql = "insert ignore into t(fromc, toc) values(:fromc0, :toc0), (:fromc1, :toc1)"
+	wantqueries[0].Sql = "insert ignore into `t`(`fromc`, `toc`) values(:fromc0, :toc0), (:fromc1, :toc1)"
 	if !reflect.DeepEqual(vc.queries, wantqueries) {
 		t.Errorf("lookup.Create queries:\n%v, want\n%v", vc.queries, wantqueries)
 	}
@@ -406,7 +640,7 @@ func TestLookupNonUniqueCreateAutocommit(t *testing.T) {
 	}
 
 	wantqueries := []*querypb.BoundQuery{{
-		Sql: "insert into t(from1, from2, toc) values(:from10, :from20, :toc0), (:from11, :from21, :toc1) on duplicate key update from1=values(from1), from2=values(from2), toc=values(toc)",
+		Sql: "insert into `t`(`from1`, `from2`, `toc`) values(:from10, :from20, :toc0), (:from11, :from21, :toc1) on duplicate key update `from1`=values(`from1`), `from2`=values(`from2`), `toc`=values(`toc`)",
 		BindVariables: map[string]*querypb.BindVariable{
 			"from10": sqltypes.Int64BindVariable(1),
 			"from20": sqltypes.Int64BindVariable(2),
@@ -425,103 +659,5573 @@ func TestLookupNonUniqueCreateAutocommit(t *testing.T) {
 	}
 }
 
-func TestLookupNonUniqueDelete(t *testing.T) {
-	lookupNonUnique := createLookup(t, "lookup", false)
+func TestLookupNonUniqueCreateWithSourcePK(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":            "t",
+		"from":             "fromc",
+		"to":               "toc",
+		"source_pk_column": "pkc",
+		"autocommit":       "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
 	vc := &vcursor{}
 
-	err := lookupNonUnique.(Lookup).Delete(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}, {sqltypes.NewInt64(2)}}, []byte("test"))
+	err = lookupNonUnique.(*LookupNonUnique).CreateWithSourcePK(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}, {sqltypes.NewInt64(2)}}, [][]byte{[]byte("test1"), []byte("test2")}, []sqltypes.Value{sqltypes.NewInt64(10), sqltypes.NewInt64(20)}, false /* ignoreMode */)
 	if err != nil {
 		t.Error(err)
 	}
 
 	wantqueries := []*querypb.BoundQuery{{
-		Sql: "delete from t where fromc = :fromc and toc = :toc",
-		BindVariables: map[string]*querypb.BindVariable{
-			"fromc": sqltypes.Int64BindVariable(1),
-			"toc":   sqltypes.BytesBindVariable([]byte("test")),
-		},
-	}, {
-		Sql: "delete from t where fromc = :fromc and toc = :toc",
+		Sql: "insert into `t`(`fromc`, `pkc`, `toc`) values(:fromc0, :pkc0, :toc0), (:fromc1, :pkc1, :toc1) on duplicate key update `fromc`=values(`fromc`), `pkc`=values(`pkc`), `toc`=values(`toc`)",
 		BindVariables: map[string]*querypb.BindVariable{
-			"fromc": sqltypes.Int64BindVariable(2),
-			"toc":   sqltypes.BytesBindVariable([]byte("test")),
+			"fromc0": sqltypes.Int64BindVariable(1),
+			"pkc0":   sqltypes.Int64BindVariable(10),
+			"toc0":   sqltypes.BytesBindVariable([]byte("test1")),
+			"fromc1": sqltypes.Int64BindVariable(2),
+			"pkc1":   sqltypes.Int64BindVariable(20),
+			"toc1":   sqltypes.BytesBindVariable([]byte("test2")),
 		},
 	}}
 	if !reflect.DeepEqual(vc.queries, wantqueries) {
-		t.Errorf("lookup.Delete queries:\n%v, want\n%v", vc.queries, wantqueries)
+		t.Errorf("lookup.CreateWithSourcePK queries:\n%v, want\n%v", vc.queries, wantqueries)
 	}
 
-	// Test query fail.
-	vc.mustFail = true
-	err = lookupNonUnique.(Lookup).Delete(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, []byte("\x16k@\xb4J\xbaK\xd6"))
-	want := "lookup.Delete: execute failed"
+	// Plain Create does not write the source pk column.
+	vc.queries = nil
+	err = lookupNonUnique.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test1")}, true /* ignoreMode */)
+	if err != nil {
+		t.Error(err)
+	}
+	wantSQL := "insert ignore into `t`(`fromc`, `toc`) values(:fromc0, :toc0) on duplicate key update `fromc`=values(`fromc`), `toc`=values(`toc`)"
+	if got := vc.queries[0].Sql; got != wantSQL {
+		t.Errorf("lookup.Create query: %s, want %s", got, wantSQL)
+	}
+
+	// Mismatched source pk count.
+	err = lookupNonUnique.(*LookupNonUnique).CreateWithSourcePK(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test1")}, []sqltypes.Value{}, false /* ignoreMode */)
+	want := "lookup.Create: got 0 source pk values for 1 rows"
 	if err == nil || err.Error() != want {
-		t.Errorf("lookupNonUnique(query fail) err: %v, want %s", err, want)
+		t.Errorf("CreateWithSourcePK(mismatch) err: %v, want %s", err, want)
+	}
+
+	// source_pk_column not configured.
+	lookupNonUnique = createLookup(t, "lookup", false)
+	err = lookupNonUnique.(*LookupNonUnique).CreateWithSourcePK(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test1")}, []sqltypes.Value{sqltypes.NewInt64(10)}, false /* ignoreMode */)
+	want = "lookup.Create: source_pk_column is not configured for vindex table t"
+	if err == nil || err.Error() != want {
+		t.Errorf("CreateWithSourcePK(unconfigured) err: %v, want %s", err, want)
 	}
-	vc.mustFail = false
 }
 
-func TestLookupNonUniqueDeleteAutocommit(t *testing.T) {
+type zeroBackoff struct{}
+
+func (zeroBackoff) NextDelay(int) time.Duration { return 0 }
+
+func TestLookupNonUniqueCreateDeadlockRetry(t *testing.T) {
 	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
-		"table":      "t",
-		"from":       "fromc",
-		"to":         "toc",
-		"autocommit": "true",
+		"table":            "t",
+		"from":             "fromc",
+		"to":               "toc",
+		"autocommit":       "true",
+		"deadlock_retries": "2",
 	})
-	vc := &vcursor{}
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookupNonUnique.(*LookupNonUnique).SetBackoffPolicy(zeroBackoff{})
 
-	err = lookupNonUnique.(Lookup).Delete(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}, {sqltypes.NewInt64(2)}}, []byte("test"))
+	vc := &vcursor{numDeadlocks: 2}
+	err = lookupNonUnique.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test1")}, false /* ignoreMode */)
 	if err != nil {
 		t.Error(err)
 	}
+	if got, want := vc.autocommits, 3; got != want {
+		t.Errorf("Create(deadlock) autocommits: %d, want %d", got, want)
+	}
 
-	wantqueries := []*querypb.BoundQuery(nil)
-	if !reflect.DeepEqual(vc.queries, wantqueries) {
-		t.Errorf("lookup.Delete queries:\n%v, want\n%v", vc.queries, wantqueries)
+	vc = &vcursor{numDeadlocks: 3}
+	err = lookupNonUnique.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test1")}, false /* ignoreMode */)
+	want := "lookup.Create: Deadlock found when trying to get lock; try restarting transaction (errno 1213) (sqlstate 40001)"
+	if err == nil || err.Error() != want {
+		t.Errorf("Create(deadlock) err: %v, want %s", err, want)
+	}
+	if got, want := vc.autocommits, 3; got != want {
+		t.Errorf("Create(deadlock) autocommits: %d, want %d", got, want)
+	}
+
+	// Deadlocks are not retried outside autocommit.
+	lookupNonUnique = createLookup(t, "lookup", false)
+	vc = &vcursor{numDeadlocks: 1}
+	err = lookupNonUnique.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test1")}, false /* ignoreMode */)
+	if err == nil {
+		t.Errorf("Create(deadlock, no autocommit): nil, want error")
+	}
+
+	_, err = CreateVindex("lookup", "lookup", map[string]string{
+		"table":            "t",
+		"from":             "fromc",
+		"to":               "toc",
+		"deadlock_retries": "-1",
+	})
+	want = "deadlock_retries value must be a non-negative integer: '-1'"
+	if err == nil || err.Error() != want {
+		t.Errorf("Create(bad deadlock_retries) err: %v, want %s", err, want)
 	}
 }
 
-func TestLookupNonUniqueUpdate(t *testing.T) {
-	lookupNonUnique := createLookup(t, "lookup", false)
+func TestLookupNonUniqueCommitBatchSize(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":             "t",
+		"from":              "fromc",
+		"to":                "toc",
+		"autocommit":        "true",
+		"commit_batch_size": "2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
 	vc := &vcursor{}
 
-	err := lookupNonUnique.(Lookup).Update(vc, []sqltypes.Value{sqltypes.NewInt64(1)}, []byte("test"), []sqltypes.Value{sqltypes.NewInt64(2)})
+	err = lookupNonUnique.(Lookup).Create(
+		vc,
+		[][]sqltypes.Value{{sqltypes.NewInt64(1)}, {sqltypes.NewInt64(2)}, {sqltypes.NewInt64(3)}},
+		[][]byte{[]byte("test1"), []byte("test2"), []byte("test3")},
+		false /* ignoreMode */)
 	if err != nil {
 		t.Error(err)
 	}
-
 	wantqueries := []*querypb.BoundQuery{{
-		Sql: "delete from t where fromc = :fromc and toc = :toc",
+		Sql: "insert into `t`(`fromc`, `toc`) values(:fromc0, :toc0), (:fromc1, :toc1) on duplicate key update `fromc`=values(`fromc`), `toc`=values(`toc`)",
 		BindVariables: map[string]*querypb.BindVariable{
-			"fromc": sqltypes.Int64BindVariable(1),
-			"toc":   sqltypes.BytesBindVariable([]byte("test")),
+			"fromc0": sqltypes.Int64BindVariable(1),
+			"toc0":   sqltypes.BytesBindVariable([]byte("test1")),
+			"fromc1": sqltypes.Int64BindVariable(2),
+			"toc1":   sqltypes.BytesBindVariable([]byte("test2")),
 		},
 	}, {
-		Sql: "insert into t(fromc, toc) values(:fromc0, :toc0)",
+		Sql: "insert into `t`(`fromc`, `toc`) values(:fromc0, :toc0) on duplicate key update `fromc`=values(`fromc`), `toc`=values(`toc`)",
 		BindVariables: map[string]*querypb.BindVariable{
-			"fromc0": sqltypes.Int64BindVariable(2),
-			"toc0":   sqltypes.BytesBindVariable([]byte("test")),
+			"fromc0": sqltypes.Int64BindVariable(3),
+			"toc0":   sqltypes.BytesBindVariable([]byte("test3")),
 		},
 	}}
 	if !reflect.DeepEqual(vc.queries, wantqueries) {
-		t.Errorf("lookup.Update queries:\n%v, want\n%v", vc.queries, wantqueries)
+		t.Errorf("lookup.Create queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+	if got, want := vc.autocommits, 2; got != want {
+		t.Errorf("Create(autocommit) count: %d, want %d", got, want)
+	}
+
+	// A Create that fits in one batch is a single insert.
+	vc = &vcursor{}
+	err = lookupNonUnique.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test1")}, false /* ignoreMode */)
+	if err != nil {
+		t.Error(err)
+	}
+	if got, want := vc.autocommits, 1; got != want {
+		t.Errorf("Create(autocommit) count: %d, want %d", got, want)
+	}
+
+	vc = &vcursor{mustFail: true}
+	err = lookupNonUnique.(Lookup).Create(
+		vc,
+		[][]sqltypes.Value{{sqltypes.NewInt64(1)}, {sqltypes.NewInt64(2)}, {sqltypes.NewInt64(3)}},
+		[][]byte{[]byte("test1"), []byte("test2"), []byte("test3")},
+		false /* ignoreMode */)
+	want := "lookup.Create: batch 1 of 2 (rows 0 to 1) failed, no rows were committed: execute failed"
+	if err == nil || err.Error() != want {
+		t.Errorf("lookup(query fail) err: %v, want %s", err, want)
+	}
+
+	_, err = CreateVindex("lookup", "lookup", map[string]string{
+		"table":             "t",
+		"from":              "fromc",
+		"to":                "toc",
+		"commit_batch_size": "2",
+	})
+	want = "commit_batch_size requires autocommit for vindex table t"
+	if err == nil || err.Error() != want {
+		t.Errorf("CreateVindex(commit_batch_size without autocommit) err: %v, want %s", err, want)
 	}
 }
 
-func createLookup(t *testing.T, name string, writeOnly bool) Vindex {
-	t.Helper()
-	write := "false"
-	if writeOnly {
-		write = "true"
+func TestLookupNonUniquePreparedStatements(t *testing.T) {
+	_, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":               "t",
+		"from":                "fromc",
+		"to":                  "toc",
+		"prepared_statements": "true",
+	})
+	want := "prepared_statements is not supported: vtgate cannot execute prepared statements, which need a MySQL connection of their own, for vindex table t"
+	if err == nil || err.Error() != want {
+		t.Errorf("CreateVindex(prepared_statements) err: %v, want %s", err, want)
 	}
-	l, err := CreateVindex(name, name, map[string]string{
-		"table":      "t",
-		"from":       "fromc",
-		"to":         "toc",
-		"write_only": write,
+}
+
+// pooledVCursor is a vcursor that supports named connection pools.
+type pooledVCursor struct {
+	vcursor
+	pools []string
+}
+
+func (vc *pooledVCursor) ExecuteAutocommitInPool(pool string, method string, query string, bindvars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
+	vc.pools = append(vc.pools, pool)
+	return vc.execute(method, query, bindvars, isDML)
+}
+
+func TestLookupNonUniqueConnectionPool(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":           "t",
+		"from":            "fromc",
+		"to":              "toc",
+		"autocommit":      "true",
+		"connection_pool": "lookup",
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	return l
+	vc := &pooledVCursor{vcursor: vcursor{numRows: 1}}
+
+	if _, err := lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1)}); err != nil {
+		t.Error(err)
+	}
+	if err := lookupNonUnique.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test1")}, false /* ignoreMode */); err != nil {
+		t.Error(err)
+	}
+	wantPools := []string{"lookup", "lookup"}
+	if !reflect.DeepEqual(vc.pools, wantPools) {
+		t.Errorf("pools: %v, want %v", vc.pools, wantPools)
+	}
+	if got, want := vc.autocommits, 0; got != want {
+		t.Errorf("shared pool autocommits: %d, want %d", got, want)
+	}
+
+	// A VCursor that doesn't support pools uses the shared pool.
+	shared := &vcursor{numRows: 1}
+	if _, err := lookupNonUnique.(NonUnique).Map(shared, []sqltypes.Value{sqltypes.NewInt64(1)}); err != nil {
+		t.Error(err)
+	}
+	if got, want := shared.autocommits, 1; got != want {
+		t.Errorf("shared pool autocommits: %d, want %d", got, want)
+	}
+
+	_, err = CreateVindex("lookup", "lookup", map[string]string{
+		"table":           "t",
+		"from":            "fromc",
+		"to":              "toc",
+		"connection_pool": "lookup",
+	})
+	want := "connection_pool requires autocommit for vindex table t"
+	if err == nil || err.Error() != want {
+		t.Errorf("CreateVindex(connection_pool without autocommit) err: %v, want %s", err, want)
+	}
+}
+
+// cellVCursor is a vcursor that supports executing reads in a cell.
+type cellVCursor struct {
+	vcursor
+	cells []string
+}
+
+func (vc *cellVCursor) ExecuteInCell(cell string, method string, query string, bindvars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
+	vc.cells = append(vc.cells, cell)
+	return vc.execute(method, query, bindvars, isDML)
+}
+
+func TestLookupNonUniqueReadCell(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":     "t",
+		"from":      "fromc",
+		"to":        "toc",
+		"read_cell": "cell1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &cellVCursor{vcursor: vcursor{numRows: 1}}
+
+	if _, err := lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1)}); err != nil {
+		t.Error(err)
+	}
+	if _, err := lookupNonUnique.Verify(vc, []sqltypes.Value{sqltypes.NewInt64(1)}, [][]byte{[]byte("test1")}); err != nil {
+		t.Error(err)
+	}
+	if want := []string{"cell1", "cell1"}; !reflect.DeepEqual(vc.cells, want) {
+		t.Errorf("cells: %v, want %v", vc.cells, want)
+	}
+
+	// Mutations still go to the primary.
+	if err := lookupNonUnique.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test1")}, false /* ignoreMode */); err != nil {
+		t.Error(err)
+	}
+	if err := lookupNonUnique.(Lookup).Delete(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, []byte("test1")); err != nil {
+		t.Error(err)
+	}
+	if got, want := len(vc.cells), 2; got != want {
+		t.Errorf("cells: %d, want %d", got, want)
+	}
+	if got, want := len(vc.queries), 4; got != want {
+		t.Errorf("queries: %d, want %d", got, want)
+	}
+
+	// A VCursor that doesn't support cells executes the reads as usual.
+	plain := &vcursor{numRows: 1}
+	if _, err := lookupNonUnique.(NonUnique).Map(plain, []sqltypes.Value{sqltypes.NewInt64(1)}); err != nil {
+		t.Error(err)
+	}
+	if got, want := len(plain.queries), 1; got != want {
+		t.Errorf("queries: %d, want %d", got, want)
+	}
+}
+
+type snapshotVCursor struct {
+	cellVCursor
+	inTransaction bool
+}
+
+func (vc *snapshotVCursor) InTransaction() bool {
+	return vc.inTransaction
+}
+
+func TestLookupNonUniqueSnapshotReads(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup_snapshot", map[string]string{
+		"table":          "t",
+		"from":           "fromc",
+		"to":             "toc",
+		"read_cell":      "cell1",
+		"cache_size":     "10",
+		"snapshot_reads": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []sqltypes.Value{sqltypes.NewInt64(1)}
+	vc := &snapshotVCursor{cellVCursor: cellVCursor{vcursor: vcursor{numRows: 1}}, inTransaction: true}
+
+	// In a transaction, every read is executed in it, without the cache.
+	for i := 0; i < 2; i++ {
+		if _, err := lookupNonUnique.(NonUnique).Map(vc, ids); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := lookupNonUnique.Verify(vc, ids, [][]byte{[]byte("test1")}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(vc.queries), 3; got != want {
+		t.Errorf("queries in a transaction: %d, want %d", got, want)
+	}
+	if len(vc.cells) != 0 {
+		t.Errorf("cells in a transaction: %v, want none", vc.cells)
+	}
+
+	// Outside of one, the reads are executed as usual, and cached.
+	vc.inTransaction = false
+	vc.queries = nil
+	for i := 0; i < 2; i++ {
+		if _, err := lookupNonUnique.(NonUnique).Map(vc, ids); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := len(vc.queries), 1; got != want {
+		t.Errorf("queries outside of a transaction: %d, want %d", got, want)
+	}
+	if want := []string{"cell1"}; !reflect.DeepEqual(vc.cells, want) {
+		t.Errorf("cells outside of a transaction: %v, want %v", vc.cells, want)
+	}
+
+	_, err = CreateVindex("lookup", "lookup_snapshot", map[string]string{
+		"table":          "t",
+		"from":           "fromc",
+		"to":             "toc",
+		"autocommit":     "true",
+		"snapshot_reads": "true",
+	})
+	want := "snapshot_reads cannot be used with autocommit, whose writes are not in the transaction, for vindex table t"
+	if err == nil || err.Error() != want {
+		t.Errorf("CreateVindex(autocommit): %v, want %s", err, want)
+	}
+}
+
+func TestLookupNonUniqueDedupeIDs(t *testing.T) {
+	ids := []sqltypes.Value{
+		sqltypes.NewInt64(1),
+		sqltypes.NewInt64(2),
+		sqltypes.NewInt64(1),
+		sqltypes.NULL,
+		sqltypes.NewInt64(1),
+	}
+	want := []Ksids{{
+		IDs: [][]byte{[]byte("1")},
+	}, {
+		IDs: [][]byte{[]byte("1")},
+	}, {
+		IDs: [][]byte{[]byte("1")},
+	}, {}, {
+		IDs: [][]byte{[]byte("1")},
+	}}
+	for _, tcase := range []struct {
+		dedupe      string
+		wantQueries int
+	}{{
+		dedupe:      "false",
+		wantQueries: 4,
+	}, {
+		dedupe:      "true",
+		wantQueries: 2,
+	}} {
+		lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+			"table":      "t",
+			"from":       "fromc",
+			"to":         "toc",
+			"dedupe_ids": tcase.dedupe,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vc := &vcursor{numRows: 1}
+		got, err := lookupNonUnique.(NonUnique).Map(vc, ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Map(dedupe_ids=%s): %+v, want %+v", tcase.dedupe, got, want)
+		}
+		if len(vc.queries) != tcase.wantQueries {
+			t.Errorf("Map(dedupe_ids=%s) queries: %d, want %d", tcase.dedupe, len(vc.queries), tcase.wantQueries)
+		}
+	}
+}
+
+func TestLookupNonUniqueScatterOnError(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup_scatter", map[string]string{
+		"table":            "t",
+		"from":             "fromc",
+		"to":               "toc",
+		"scatter_on_error": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []sqltypes.Value{sqltypes.NewInt64(1), sqltypes.NewInt64(2)}
+	before := lookupScatterOnError.Counts()["lookup_scatter"]
+	got, err := lookupNonUnique.(NonUnique).Map(&vcursor{mustFail: true}, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Ksids{{Range: &topodatapb.KeyRange{}}, {Range: &topodatapb.KeyRange{}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Map(): %+v, want %+v", got, want)
+	}
+	if got := lookupScatterOnError.Counts()["lookup_scatter"] - before; got != 1 {
+		t.Errorf("VindexLookupScatterOnError: %d, want 1", got)
+	}
+
+	// Without an error, Map is not affected.
+	got, err = lookupNonUnique.(NonUnique).Map(&vcursor{numRows: 1}, ids[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Ksids{{IDs: [][]byte{[]byte("1")}}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Map(): %+v, want %+v", got, want)
+	}
+
+	for _, vindexType := range []string{"lookup_unique", "lookup_hash"} {
+		_, err := CreateVindex(vindexType, vindexType, map[string]string{
+			"table":            "t",
+			"from":             "fromc",
+			"to":               "toc",
+			"scatter_on_error": "true",
+		})
+		if err == nil || !strings.Contains(err.Error(), "scatter_on_error") {
+			t.Errorf("CreateVindex(%s): %v, want a scatter_on_error error", vindexType, err)
+		}
+	}
+}
+
+func TestLookupNonUniqueWriteOnlyDryRun(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup_dry_run", map[string]string{
+		"table":              "t",
+		"from":               "fromc",
+		"to":                 "toc",
+		"write_only":         "true",
+		"write_only_dry_run": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := [][]sqltypes.Value{{sqltypes.NewInt64(1)}, {sqltypes.NewInt64(2)}}
+	ksids := [][]byte{[]byte("test1"), []byte("test2")}
+	before := lookupDryRunRows.Counts()["lookup_dry_run"]
+	vc := &vcursor{}
+	if err := lookupNonUnique.(Lookup).Create(vc, rows, ksids, false /* ignoreMode */); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := lookupNonUnique.(*LookupNonUnique).CreateWithStatus(vc, rows[:1], ksids[:1], false /* ignoreMode */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []CreateStatus{CreateIgnored}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("CreateWithStatus(): %v, want %v", statuses, want)
+	}
+	// The delete of Update runs, but not its insert.
+	if err := lookupNonUnique.(Lookup).Update(vc, rows[0], []byte("test1"), rows[1]); err != nil {
+		t.Fatal(err)
+	}
+	if len(vc.queries) != 1 || !strings.HasPrefix(vc.queries[0].Sql, "delete") {
+		t.Errorf("queries: %v, want only the delete of Update", vc.queries)
+	}
+	if got := lookupDryRunRows.Counts()["lookup_dry_run"] - before; got != 4 {
+		t.Errorf("VindexLookupDryRunRows: %d, want 4", got)
+	}
+
+	// Without write_only_dry_run, a write_only vindex still writes.
+	vc = &vcursor{}
+	if err := createLookup(t, "lookup", true).(Lookup).Create(vc, rows, ksids, false /* ignoreMode */); err != nil {
+		t.Fatal(err)
+	}
+	if len(vc.queries) != 1 || !strings.HasPrefix(vc.queries[0].Sql, "insert") {
+		t.Errorf("queries: %v, want an insert", vc.queries)
+	}
+
+	for _, vindexType := range []string{"lookup", "lookup_unique"} {
+		_, err := CreateVindex(vindexType, vindexType, map[string]string{
+			"table":              "t",
+			"from":               "fromc",
+			"to":                 "toc",
+			"write_only_dry_run": "true",
+		})
+		if want := "write_only_dry_run requires write_only for vindex table t"; err == nil || err.Error() != want {
+			t.Errorf("CreateVindex(%s): %v, want %s", vindexType, err, want)
+		}
+	}
+}
+
+func TestLookupNullFromValues(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":      "t",
+		"from":       "fromc",
+		"to":         "toc",
+		"cache_size": "10",
+		"distinct":   "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty := sqltypes.NewVarChar("")
+	vc := &vcursor{numRows: 1}
+
+	// NULL doesn't share the cache entry of the empty string,
+	// and is not looked up.
+	for i := 0; i < 2; i++ {
+		got, err := lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NULL, empty, sqltypes.NULL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []Ksids{{}, {IDs: [][]byte{[]byte("1")}}, {}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Map(NULL, '', NULL): %+v, want %+v", got, want)
+		}
+	}
+	if got, want := len(vc.queries), 1; got != want {
+		t.Errorf("queries: %d, want %d", got, want)
+	}
+
+	got, err := lookupNonUnique.Verify(vc, []sqltypes.Value{sqltypes.NULL}, [][]byte{[]byte("1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []bool{false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Verify(NULL): %v, want %v", got, want)
+	}
+
+	// Two NULL keyspace ids are not deduped by distinct.
+	vc = &vcursor{result: &sqltypes.Result{Rows: [][]sqltypes.Value{{sqltypes.NULL}, {sqltypes.NULL}}}}
+	ksids, err := lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(ksids[0].IDs), 2; got != want {
+		t.Errorf("Map(distinct NULLs): %d keyspace ids, want %d", got, want)
+	}
+
+	// A full scan doesn't match a NULL id with a NULL row,
+	// or with the row of the empty string.
+	fullScan, err := CreateVindex("lookup", "full_scan", map[string]string{
+		"table":               "t",
+		"from":                "fromc",
+		"to":                  "toc",
+		"full_scan_threshold": "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc = &vcursor{result: &sqltypes.Result{Rows: [][]sqltypes.Value{
+		{sqltypes.NULL, sqltypes.NewVarBinary("k1")},
+		{empty, sqltypes.NewVarBinary("k2")},
+	}}}
+	ksids, err = fullScan.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NULL, empty})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantKsids := []Ksids{{}, {IDs: [][]byte{[]byte("k2")}}}
+	if !reflect.DeepEqual(ksids, wantKsids) {
+		t.Errorf("full scan Map(NULL, ''): %+v, want %+v", ksids, wantKsids)
+	}
+
+	if valuesEqual(sqltypes.NULL, sqltypes.NULL) {
+		t.Error("valuesEqual(NULL, NULL): true, want false")
+	}
+}
+
+func TestLookupMalformedRows(t *testing.T) {
+	lookupNonUnique := createLookup(t, "lookup", false)
+	lookupUnique, err := CreateVindex("lookup_unique", "lookup_unique", map[string]string{
+		"table": "t",
+		"from":  "fromc",
+		"to":    "toc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookupHash, err := CreateVindex("lookup_hash", "lookup_hash", map[string]string{
+		"table": "t",
+		"from":  "fromc",
+		"to":    "toc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fullScan, err := CreateVindex("lookup", "full_scan", map[string]string{
+		"table":               "t",
+		"from":                "fromc",
+		"to":                  "toc",
+		"full_scan_threshold": "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyBeforeCreate, err := CreateVindex("lookup", "verify_before_create", map[string]string{
+		"table":                "t",
+		"from":                 "fromc",
+		"to":                   "toc",
+		"verify_before_create": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emptyRow := &sqltypes.Result{Rows: [][]sqltypes.Value{{sqltypes.NewInt64(1)}, {}}}
+	shortRow := &sqltypes.Result{Rows: [][]sqltypes.Value{{sqltypes.NewInt64(1)}}}
+	ids := []sqltypes.Value{sqltypes.NewInt64(1), sqltypes.NewInt64(2)}
+	ksids := [][]byte{[]byte("test1")}
+	testcases := []struct {
+		name   string
+		result *sqltypes.Result
+		call   func(vc VCursor) error
+		want   string
+	}{{
+		name:   "Map",
+		result: emptyRow,
+		call: func(vc VCursor) error {
+			_, err := lookupNonUnique.(NonUnique).Map(vc, ids)
+			return err
+		},
+		want: "lookup.Map: malformed result from table t of vindex lookup: row 1 has 0 columns, want 1",
+	}, {
+		name:   "unique Map",
+		result: emptyRow,
+		call: func(vc VCursor) error {
+			_, err := lookupUnique.(Unique).Map(vc, ids)
+			return err
+		},
+		want: "lookup.Map: malformed result from table t of vindex lookup_unique: row 1 has 0 columns, want 1",
+	}, {
+		name:   "lookup_hash Map",
+		result: emptyRow,
+		call: func(vc VCursor) error {
+			_, err := lookupHash.(NonUnique).Map(vc, ids)
+			return err
+		},
+		want: "lookup.Map: malformed result from table t of vindex lookup_hash: row 1 has 0 columns, want 1",
+	}, {
+		name:   "full scan Map",
+		result: shortRow,
+		call: func(vc VCursor) error {
+			_, err := fullScan.(NonUnique).Map(vc, ids)
+			return err
+		},
+		want: "lookup.Map: malformed result from table t of vindex full_scan: row 0 has 1 columns, want 2",
+	}, {
+		name:   "ReverseMap",
+		result: emptyRow,
+		call: func(vc VCursor) error {
+			_, err := lookupNonUnique.(*LookupNonUnique).ReverseMap(vc, ksids)
+			return err
+		},
+		want: "lookup.ReverseMap: malformed result from table t of vindex lookup: row 1 has 0 columns, want 1",
+	}, {
+		name:   "Create with verify_before_create",
+		result: emptyRow,
+		call: func(vc VCursor) error {
+			return verifyBeforeCreate.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, ksids, false /* ignoreMode */)
+		},
+		want: "lookup.Create: malformed result from table t of vindex verify_before_create: row 1 has 0 columns, want 1",
+	}, {
+		name:   "EstimateRows",
+		result: &sqltypes.Result{Rows: [][]sqltypes.Value{{}}},
+		call: func(vc VCursor) error {
+			_, err := lookupNonUnique.(*LookupNonUnique).EstimateRows(vc)
+			return err
+		},
+		want: "lookup.EstimateRows: malformed result from table t of vindex lookup: row 0 has 0 columns, want 1",
+	}}
+	for _, tc := range testcases {
+		err := tc.call(&vcursor{result: tc.result})
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("%s err: %v, want %s", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestLookupNonUniqueReadOnly(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":      "t",
+		"from":       "fromc",
+		"to":         "toc",
+		"autocommit": "true",
+		"read_only":  "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{numRows: 1}
+	ids := []sqltypes.Value{sqltypes.NewInt64(1)}
+	ksids := [][]byte{[]byte("test1")}
+
+	if _, err := lookupNonUnique.(NonUnique).Map(vc, ids); err != nil {
+		t.Error(err)
+	}
+	if _, err := lookupNonUnique.Verify(vc, ids, ksids); err != nil {
+		t.Error(err)
+	}
+
+	lookup := lookupNonUnique.(Lookup)
+	err = lookup.Create(vc, [][]sqltypes.Value{ids}, ksids, false /* ignoreMode */)
+	want := "lookup.Create: vindex lookup is read-only"
+	if err == nil || err.Error() != want {
+		t.Errorf("Create err: %v, want %s", err, want)
+	}
+	// Delete is a no-op in autocommit mode, but still fails.
+	err = lookup.Delete(vc, [][]sqltypes.Value{ids}, ksids[0])
+	want = "lookup.Delete: vindex lookup is read-only"
+	if err == nil || err.Error() != want {
+		t.Errorf("Delete err: %v, want %s", err, want)
+	}
+	err = lookup.Update(vc, ids, ksids[0], []sqltypes.Value{sqltypes.NewInt64(2)})
+	want = "lookup.Update: vindex lookup is read-only"
+	if err == nil || err.Error() != want {
+		t.Errorf("Update err: %v, want %s", err, want)
+	}
+	if got, want := len(vc.queries), 2; got != want {
+		t.Errorf("queries: %d, want %d (only Map and Verify)", got, want)
+	}
+
+	_, err = CreateVindex("lookup", "lookup", map[string]string{
+		"table":        "t",
+		"from":         "fromc",
+		"to":           "toc",
+		"autocommit":   "true",
+		"async_writes": "true",
+		"read_only":    "true",
+	})
+	want = "read_only cannot be used with async_writes for vindex table t"
+	if err == nil || err.Error() != want {
+		t.Errorf("CreateVindex(read_only with async_writes) err: %v, want %s", err, want)
+	}
+}
+
+func TestLookupNonUniqueCreateWithStatus(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":      "t",
+		"from":       "fromc",
+		"to":         "toc",
+		"autocommit": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{insertsAffected: []uint64{1, 2, 0}}
+	rows := [][]sqltypes.Value{{sqltypes.NewInt64(1)}, {sqltypes.NewInt64(2)}, {sqltypes.NewInt64(3)}}
+	ksids := [][]byte{[]byte("test1"), []byte("test2"), []byte("test3")}
+
+	got, err := lookupNonUnique.(*LookupNonUnique).CreateWithStatus(vc, rows, ksids, false /* ignoreMode */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CreateStatus{CreateInserted, CreateUpdated, CreateIgnored}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CreateWithStatus(): %v, want %v", got, want)
+	}
+	if got, want := len(vc.queries), 3; got != want {
+		t.Errorf("lookup.Create queries: %v, want %d", vc.queries, want)
+	}
+
+	// The statuses of the rows before a failure are returned.
+	vc = &vcursor{mustFail: true}
+	got, err = lookupNonUnique.(*LookupNonUnique).CreateWithStatus(vc, rows, ksids, false /* ignoreMode */)
+	wantErr := "lookup.Create: row 0: execute failed"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("CreateWithStatus(query fail): %v, want %s", err, wantErr)
+	}
+	if len(got) != 0 {
+		t.Errorf("CreateWithStatus(query fail): %v, want none", got)
+	}
+}
+
+func TestLookupNonUniqueUpsertOnlyChanged(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":               "t",
+		"from":                "fromc",
+		"to":                  "toc",
+		"source_pk_column":    "pkc",
+		"autocommit":          "true",
+		"upsert_only_changed": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{}
+	err = lookupNonUnique.(*LookupNonUnique).CreateWithSourcePK(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test1")}, []sqltypes.Value{sqltypes.NewInt64(10)}, false /* ignoreMode */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "insert into `t`(`fromc`, `pkc`, `toc`) values(:fromc0, :pkc0, :toc0) on duplicate key update " +
+		"`fromc`=if(`toc` <=> values(`toc`), `fromc`, values(`fromc`)), `pkc`=if(`toc` <=> values(`toc`), `pkc`, values(`pkc`)), `toc`=values(`toc`)"
+	if len(vc.queries) != 1 || vc.queries[0].Sql != want {
+		t.Errorf("lookup.CreateWithSourcePK queries:\n%v, want\n%s", vc.queries, want)
+	}
+
+	// An upsert that keeps the keyspace id affects no row.
+	vc = &vcursor{insertsAffected: []uint64{1, 0, 2}}
+	rows := [][]sqltypes.Value{{sqltypes.NewInt64(1)}, {sqltypes.NewInt64(2)}, {sqltypes.NewInt64(3)}}
+	ksids := [][]byte{[]byte("test1"), []byte("test2"), []byte("test3")}
+	statuses, err := lookupNonUnique.(*LookupNonUnique).CreateWithStatus(vc, rows, ksids, false /* ignoreMode */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []CreateStatus{CreateInserted, CreateIgnored, CreateUpdated}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("CreateWithStatus(): %v, want %v", statuses, want)
+	}
+
+	for _, tcase := range []struct {
+		vindexType string
+		params     map[string]string
+		err        string
+	}{{
+		vindexType: "lookup",
+		params:     map[string]string{"table": "t", "from": "fromc", "to": "toc", "upsert_only_changed": "true"},
+		err:        "upsert_only_changed requires the upserts of a non-unique autocommit vindex for vindex table t",
+	}, {
+		vindexType: "lookup_unique",
+		params:     map[string]string{"table": "t", "from": "fromc", "to": "toc", "autocommit": "true", "upsert_only_changed": "true"},
+		err:        "upsert_only_changed requires the upserts of a non-unique autocommit vindex for vindex table t",
+	}} {
+		_, err := CreateVindex(tcase.vindexType, "lookup", tcase.params)
+		if err == nil || err.Error() != tcase.err {
+			t.Errorf("CreateVindex(%s): %v, want %s", tcase.vindexType, err, tcase.err)
+		}
+	}
+}
+
+func TestLookupNonUniqueRetryOnMissingTable(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":                  "t",
+		"from":                   "fromc",
+		"to":                     "toc",
+		"retry_on_missing_table": "2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookupNonUnique.(*LookupNonUnique).SetBackoffPolicy(zeroBackoff{})
+	ids := []sqltypes.Value{sqltypes.NewInt64(1)}
+
+	vc := &vcursor{numRows: 1, numMissingTables: 2}
+	if _, err := lookupNonUnique.(NonUnique).Map(vc, ids); err != nil {
+		t.Error(err)
+	}
+	if got, want := len(vc.queries), 3; got != want {
+		t.Errorf("lookup.Map queries: %v, want %d", vc.queries, want)
+	}
+
+	vc = &vcursor{numRows: 1, numMissingTables: 2}
+	got, err := lookupNonUnique.Verify(vc, ids, [][]byte{[]byte("test1")})
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(got, []bool{true}) {
+		t.Errorf("lookup.Verify: %v, want [true]", got)
+	}
+
+	// Retries are bounded.
+	vc = &vcursor{numMissingTables: 3}
+	_, err = lookupNonUnique.(NonUnique).Map(vc, ids)
+	want := "lookup.Map: Table 'vt_ks.t' doesn't exist (errno 1146) (sqlstate 42S02)"
+	if err == nil || err.Error() != want {
+		t.Errorf("lookup.Map: %v, want %s", err, want)
+	}
+
+	// Other errors are not retried.
+	vc = &vcursor{numDeadlocks: 1}
+	if _, err := lookupNonUnique.(NonUnique).Map(vc, ids); err == nil {
+		t.Errorf("lookup.Map(deadlock): nil, want error")
+	}
+	if got, want := len(vc.queries), 1; got != want {
+		t.Errorf("lookup.Map(deadlock) queries: %v, want %d", vc.queries, want)
+	}
+}
+
+func TestLookupNonUniqueMixedTypes(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table": "t",
+		"from":  "fromc1, fromc2",
+		"to":    "toc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{}
+
+	err = lookupNonUnique.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1), sqltypes.NewVarBinary("a")}}, [][]byte{[]byte("test1")}, false /* ignoreMode */)
+	if err != nil {
+		t.Error(err)
+	}
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: "insert into `t`(`fromc1`, `fromc2`, `toc`) values(:fromc10, :fromc20, :toc0)",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc10": sqltypes.Int64BindVariable(1),
+			"fromc20": sqltypes.BytesBindVariable([]byte("a")),
+			"toc0":    sqltypes.BytesBindVariable([]byte("test1")),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("lookup.Create queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	vc = &vcursor{
+		result: sqltypes.MakeTestResult(sqltypes.MakeTestFields("toc", "varbinary"), "test1"),
+	}
+	got, err := lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1)})
+	if err != nil {
+		t.Error(err)
+	}
+	want := []Ksids{{IDs: [][]byte{[]byte("test1")}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Map(): %#v, want %+v", got, want)
+	}
+	ok, err := lookupNonUnique.Verify(vc, []sqltypes.Value{sqltypes.NewInt64(1)}, [][]byte{[]byte("test1")})
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(ok, []bool{true}) {
+		t.Errorf("Verify(): %v, want [true]", ok)
+	}
+	wantqueries = []*querypb.BoundQuery{{
+		Sql: "select `toc` from `t` where `fromc1` = :fromc1",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc1": sqltypes.Int64BindVariable(1),
+		},
+	}, {
+		Sql: "select `fromc1` from `t` where `fromc1` = :fromc1 and `toc` = :toc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc1": sqltypes.Int64BindVariable(1),
+			"toc":    sqltypes.BytesBindVariable([]byte("test1")),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("lookup queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	err = lookupNonUnique.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test1")}, false /* ignoreMode */)
+	wantErr := "lookup.Create: got 1 from values in row 0, want 2"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("Create(short row): %v, want %s", err, wantErr)
+	}
+}
+
+func TestLookupNonUniqueFromValuesWidth(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":               "t",
+		"from":                "fromc1,fromc2",
+		"to":                  "toc",
+		"source_pk_column":    "pk",
+		"delete_by_source_pk": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := lookupNonUnique.(*LookupNonUnique)
+	short := []sqltypes.Value{sqltypes.NewInt64(1)}
+	wide := []sqltypes.Value{sqltypes.NewInt64(1), sqltypes.NewInt64(2), sqltypes.NewInt64(3)}
+	good := []sqltypes.Value{sqltypes.NewInt64(1), sqltypes.NewInt64(2)}
+	ksid := []byte("test1")
+
+	testcases := []struct {
+		name string
+		f    func(vc VCursor) error
+		want string
+	}{{
+		name: "Create(wide row)",
+		f: func(vc VCursor) error {
+			return lookup.Create(vc, [][]sqltypes.Value{good, wide}, [][]byte{ksid, ksid}, false /* ignoreMode */)
+		},
+		want: "lookup.Create: got 3 from values in row 1, want 2",
+	}, {
+		name: "Delete(short row)",
+		f: func(vc VCursor) error {
+			return lookup.Delete(vc, [][]sqltypes.Value{short}, ksid)
+		},
+		want: "lookup.Delete: got 1 from values in row 0, want 2",
+	}, {
+		name: "Delete(wide row)",
+		f: func(vc VCursor) error {
+			return lookup.Delete(vc, [][]sqltypes.Value{wide}, ksid)
+		},
+		want: "lookup.Delete: got 3 from values in row 0, want 2",
+	}, {
+		name: "DeleteWithSourcePK(short row)",
+		f: func(vc VCursor) error {
+			return lookup.DeleteWithSourcePK(vc, [][]sqltypes.Value{short}, ksid, []sqltypes.Value{sqltypes.NewInt64(10)})
+		},
+		want: "lookup.Delete: got 1 from values in row 0, want 2",
+	}, {
+		name: "Update(short old values)",
+		f: func(vc VCursor) error {
+			return lookup.Update(vc, short, ksid, good)
+		},
+		want: "lookup.Update: old values: got 1 from values in row 0, want 2",
+	}, {
+		name: "Update(wide new values)",
+		f: func(vc VCursor) error {
+			return lookup.Update(vc, good, ksid, wide)
+		},
+		want: "lookup.Update: new values: got 3 from values in row 0, want 2",
+	}}
+	for _, tc := range testcases {
+		vc := &vcursor{}
+		err := tc.f(vc)
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("%s: %v, want %s", tc.name, err, tc.want)
+		}
+		if len(vc.queries) != 0 {
+			t.Errorf("%s: executed %v, want no queries", tc.name, vc.queries)
+		}
+	}
+}
+
+func TestLookupNonUniqueBatchCreate(t *testing.T) {
+	lookupNonUnique := createLookup(t, "lookup", false)
+	vc := &vcursor{}
+	rows := [][]sqltypes.Value{{sqltypes.NewInt64(1)}, {sqltypes.NewInt64(2)}, {sqltypes.NewInt64(3)}}
+	ksids := [][]byte{[]byte("test1"), []byte("test2"), []byte("test3")}
+
+	err := lookupNonUnique.(*LookupNonUnique).BatchCreate(vc, rows, ksids, nil, BatchCreateOptions{BatchSize: 2})
+	if err != nil {
+		t.Error(err)
+	}
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: "insert into `t`(`fromc`, `toc`) values(:fromc0, :toc0), (:fromc1, :toc1)",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc0": sqltypes.Int64BindVariable(1),
+			"toc0":   sqltypes.BytesBindVariable([]byte("test1")),
+			"fromc1": sqltypes.Int64BindVariable(2),
+			"toc1":   sqltypes.BytesBindVariable([]byte("test2")),
+		},
+	}, {
+		Sql: "insert into `t`(`fromc`, `toc`) values(:fromc0, :toc0)",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc0": sqltypes.Int64BindVariable(3),
+			"toc0":   sqltypes.BytesBindVariable([]byte("test3")),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("lookup.BatchCreate queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	// A malformed row of a later batch fails the BatchCreate before
+	// its first batch.
+	vc = &vcursor{}
+	rows[2] = []sqltypes.Value{sqltypes.NewInt64(3), sqltypes.NewInt64(4)}
+	err = lookupNonUnique.(*LookupNonUnique).BatchCreate(vc, rows, ksids, nil, BatchCreateOptions{BatchSize: 2})
+	want := "lookup.Create: got 2 from values in row 2, want 1"
+	if err == nil || err.Error() != want {
+		t.Errorf("BatchCreate(malformed): %v, want %s", err, want)
+	}
+	if len(vc.queries) != 0 {
+		t.Errorf("BatchCreate(malformed) queries: %v, want none", vc.queries)
+	}
+}
+
+// syncVCursor serializes the calls to a vcursor, and
+// fails the inserts after failAfter of them succeeded.
+type syncVCursor struct {
+	mu        sync.Mutex
+	vc        vcursor
+	inserts   int
+	failAfter int
+}
+
+func (svc *syncVCursor) Execute(method string, query string, bindvars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
+	return svc.ExecuteAutocommit(method, query, bindvars, isDML)
+}
+
+func (svc *syncVCursor) ExecuteAutocommit(method string, query string, bindvars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	svc.inserts++
+	if svc.failAfter != 0 && svc.inserts > svc.failAfter {
+		return nil, errors.New("execute failed")
+	}
+	return svc.vc.ExecuteAutocommit(method, query, bindvars, isDML)
+}
+
+func TestLookupNonUniqueBatchCreateConcurrency(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":      "t",
+		"from":       "fromc",
+		"to":         "toc",
+		"autocommit": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows [][]sqltypes.Value
+	var ksids [][]byte
+	for i := 0; i < 100; i++ {
+		rows = append(rows, []sqltypes.Value{sqltypes.NewInt64(int64(i))})
+		ksids = append(ksids, []byte("test"))
+	}
+	options := BatchCreateOptions{BatchSize: 10, Concurrency: 4}
+
+	svc := &syncVCursor{}
+	if err := lookupNonUnique.(*LookupNonUnique).BatchCreate(svc, rows, ksids, nil, options); err != nil {
+		t.Error(err)
+	}
+	if got, want := svc.inserts, 10; got != want {
+		t.Errorf("inserts: %d, want %d", got, want)
+	}
+
+	// After a failure, the remaining batches are skipped.
+	svc = &syncVCursor{failAfter: 1}
+	err = lookupNonUnique.(*LookupNonUnique).BatchCreate(svc, rows, ksids, nil, options)
+	want := "lookup.Create: execute failed"
+	if err == nil || err.Error() != want {
+		t.Errorf("BatchCreate(fail): %v, want %s", err, want)
+	}
+	if svc.inserts >= 10 {
+		t.Errorf("inserts: %d, want less than 10", svc.inserts)
+	}
+}
+
+func TestLookupNonUniqueDelete(t *testing.T) {
+	lookupNonUnique := createLookup(t, "lookup", false)
+	vc := &vcursor{}
+
+	err := lookupNonUnique.(Lookup).Delete(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}, {sqltypes.NewInt64(2)}}, []byte("test"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: "delete from `t` where `fromc` = :fromc and `toc` = :toc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc": sqltypes.Int64BindVariable(1),
+			"toc":   sqltypes.BytesBindVariable([]byte("test")),
+		},
+	}, {
+		Sql: "delete from `t` where `fromc` = :fromc and `toc` = :toc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc": sqltypes.Int64BindVariable(2),
+			"toc":   sqltypes.BytesBindVariable([]byte("test")),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("lookup.Delete queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	// Test query fail.
+	vc.mustFail = true
+	err = lookupNonUnique.(Lookup).Delete(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, []byte("\x16k@\xb4J\xbaK\xd6"))
+	want := "lookup.Delete: execute failed"
+	if err == nil || err.Error() != want {
+		t.Errorf("lookupNonUnique(query fail) err: %v, want %s", err, want)
+	}
+	vc.mustFail = false
+}
+
+func TestLookupNonUniqueDeleteWithSourcePK(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":               "t",
+		"from":                "fromc",
+		"to":                  "toc",
+		"source_pk_column":    "pk",
+		"delete_by_source_pk": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{}
+
+	err = lookupNonUnique.(*LookupNonUnique).DeleteWithSourcePK(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, []byte("test"), []sqltypes.Value{sqltypes.NewInt64(10)})
+	if err != nil {
+		t.Error(err)
+	}
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: "delete from `t` where `pk` = :pk and `toc` = :toc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"pk":  sqltypes.Int64BindVariable(10),
+			"toc": sqltypes.BytesBindVariable([]byte("test")),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("lookup.Delete queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	// Without source pks, it deletes by from.
+	vc.queries = nil
+	err = lookupNonUnique.(*LookupNonUnique).DeleteWithSourcePK(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, []byte("test"), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if got, want := vc.queries[0].Sql, "delete from `t` where `fromc` = :fromc and `toc` = :toc"; got != want {
+		t.Errorf("lookup.Delete query: %s, want %s", got, want)
+	}
+
+	err = lookupNonUnique.(*LookupNonUnique).DeleteWithSourcePK(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, []byte("test"), []sqltypes.Value{})
+	want := "lookup.Delete: got 0 source pk values for 1 rows"
+	if err == nil || err.Error() != want {
+		t.Errorf("DeleteWithSourcePK(bad count): %v, want %s", err, want)
+	}
+
+	_, err = CreateVindex("lookup", "lookup", map[string]string{
+		"table":               "t",
+		"from":                "fromc",
+		"to":                  "toc",
+		"delete_by_source_pk": "true",
+	})
+	want = "delete_by_source_pk requires source_pk_column for vindex table t"
+	if err == nil || err.Error() != want {
+		t.Errorf("Create(no source_pk_column): %v, want %s", err, want)
+	}
+}
+
+func TestLookupNonUniqueDeleteAutocommit(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":      "t",
+		"from":       "fromc",
+		"to":         "toc",
+		"autocommit": "true",
+	})
+	vc := &vcursor{}
+
+	err = lookupNonUnique.(Lookup).Delete(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}, {sqltypes.NewInt64(2)}}, []byte("test"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	wantqueries := []*querypb.BoundQuery(nil)
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("lookup.Delete queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+}
+
+func TestLookupNonUniqueDeleteMissing(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":          "t",
+		"from":           "fromc",
+		"to":             "toc",
+		"delete_missing": "error",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{deletesAffected: []uint64{1, 1}}
+
+	err = lookupNonUnique.(Lookup).Delete(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}, {sqltypes.NewInt64(2)}}, []byte("test"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The second row has no mapping.
+	vc = &vcursor{deletesAffected: []uint64{1, 0}}
+	err = lookupNonUnique.(Lookup).Delete(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}, {sqltypes.NewInt64(2)}}, []byte("test"))
+	nferr, ok := err.(*NotFoundError)
+	if !ok {
+		t.Fatalf("Delete(missing) err: %v, want *NotFoundError", err)
+	}
+	if want := []sqltypes.Value{sqltypes.NewInt64(2)}; !reflect.DeepEqual(nferr.Row, want) {
+		t.Errorf("NotFoundError.Row: %v, want %v", nferr.Row, want)
+	}
+	want := "lookup.Delete: no mapping found in vindex lookup for row [INT64(2)]"
+	if err.Error() != want {
+		t.Errorf("Delete(missing) err: %v, want %s", err, want)
+	}
+
+	// Update is not affected.
+	vc = &vcursor{}
+	err = lookupNonUnique.(Lookup).Update(vc, []sqltypes.Value{sqltypes.NewInt64(1)}, []byte("test"), []sqltypes.Value{sqltypes.NewInt64(2)})
+	if err != nil {
+		t.Errorf("Update(missing): %v", err)
+	}
+
+	// By default, Delete is idempotent.
+	lookupNonUnique = createLookup(t, "lookup", false)
+	vc = &vcursor{}
+	err = lookupNonUnique.(Lookup).Delete(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, []byte("test"))
+	if err != nil {
+		t.Errorf("Delete(missing, default): %v", err)
+	}
+
+	_, err = CreateVindex("lookup", "lookup", map[string]string{
+		"table":          "t",
+		"from":           "fromc",
+		"to":             "toc",
+		"delete_missing": "error",
+		"autocommit":     "true",
+	})
+	want = "delete_missing cannot be error with autocommit, whose Delete is a no-op, for vindex table t"
+	if err == nil || err.Error() != want {
+		t.Errorf("Create(autocommit): %v, want %s", err, want)
+	}
+
+	_, err = CreateVindex("lookup", "lookup", map[string]string{
+		"table":          "t",
+		"from":           "fromc",
+		"to":             "toc",
+		"delete_missing": "fail",
+	})
+	want = "delete_missing value must be ignore or error: 'fail'"
+	if err == nil || err.Error() != want {
+		t.Errorf("Create(bad delete_missing): %v, want %s", err, want)
+	}
+}
+
+func TestLookupNonUniqueUpdate(t *testing.T) {
+	lookupNonUnique := createLookup(t, "lookup", false)
+	vc := &vcursor{}
+
+	err := lookupNonUnique.(Lookup).Update(vc, []sqltypes.Value{sqltypes.NewInt64(1)}, []byte("test"), []sqltypes.Value{sqltypes.NewInt64(2)})
+	if err != nil {
+		t.Error(err)
+	}
+
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: "delete from `t` where `fromc` = :fromc and `toc` = :toc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc": sqltypes.Int64BindVariable(1),
+			"toc":   sqltypes.BytesBindVariable([]byte("test")),
+		},
+	}, {
+		Sql: "insert into `t`(`fromc`, `toc`) values(:fromc0, :toc0)",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc0": sqltypes.Int64BindVariable(2),
+			"toc0":   sqltypes.BytesBindVariable([]byte("test")),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("lookup.Update queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	// An empty ksid is an error: 1 has two keyspace ids, and deleting
+	// its mapping would delete both.
+	vc.queries = nil
+	err = lookupNonUnique.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}, {sqltypes.NewInt64(1)}}, [][]byte{[]byte("test1"), []byte("test2")}, false /* ignoreMode */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc.queries = nil
+	err = lookupNonUnique.(Lookup).Update(vc, []sqltypes.Value{sqltypes.NewInt64(1)}, nil, []sqltypes.Value{sqltypes.NewInt64(2)})
+	want := "lookup.Update: empty keyspace id for [INT64(1)], which would delete all its keyspace ids in non-unique vindex lookup"
+	if err == nil || err.Error() != want {
+		t.Errorf("lookup.Update(empty ksid): %v, want %s", err, want)
+	}
+	if vc.queries != nil {
+		t.Errorf("lookup.Update(empty ksid) queries: %v, want nil", vc.queries)
+	}
+	// Only the row of the given keyspace id is updated.
+	err = lookupNonUnique.(Lookup).Update(vc, []sqltypes.Value{sqltypes.NewInt64(1)}, []byte("test1"), []sqltypes.Value{sqltypes.NewInt64(2)})
+	if err != nil {
+		t.Error(err)
+	}
+	if got, want := vc.queries[0].Sql, "delete from `t` where `fromc` = :fromc and `toc` = :toc"; got != want {
+		t.Errorf("lookup.Update query: %s, want %s", got, want)
+	}
+
+	// Empty new values are an error.
+	vc.queries = nil
+	err = lookupNonUnique.(Lookup).Update(vc, []sqltypes.Value{sqltypes.NewInt64(1)}, []byte("test"), nil)
+	want = "lookup.Update: no new values for [INT64(1)]"
+	if err == nil || err.Error() != want {
+		t.Errorf("lookup.Update(empty new values): %v, want %s", err, want)
+	}
+	if vc.queries != nil {
+		t.Errorf("lookup.Update(empty new values) queries: %v, want nil", vc.queries)
+	}
+}
+
+func TestLookupNonUniqueFromList(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":     "t",
+		"from":      "fromc",
+		"to":        "toc",
+		"from_list": "json",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{}
+
+	err = lookupNonUnique.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewVarChar(`["a", 2]`)}, {sqltypes.NewVarChar(`[]`)}, {sqltypes.NewVarChar(`["c"]`)}}, [][]byte{[]byte("test1"), []byte("test2"), []byte("test3")}, false /* ignoreMode */)
+	if err != nil {
+		t.Error(err)
+	}
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: "insert into `t`(`fromc`, `toc`) values(:fromc0, :toc0), (:fromc1, :toc1), (:fromc2, :toc2)",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc0": sqltypes.StringBindVariable("a"),
+			"toc0":   sqltypes.BytesBindVariable([]byte("test1")),
+			"fromc1": sqltypes.Int64BindVariable(2),
+			"toc1":   sqltypes.BytesBindVariable([]byte("test1")),
+			"fromc2": sqltypes.StringBindVariable("c"),
+			"toc2":   sqltypes.BytesBindVariable([]byte("test3")),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("lookup.Create queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	vc = &vcursor{}
+	err = lookupNonUnique.(Lookup).Delete(vc, [][]sqltypes.Value{{sqltypes.NewVarChar(`["a", "b"]`)}}, []byte("test1"))
+	if err != nil {
+		t.Error(err)
+	}
+	if got, want := len(vc.queries), 2; got != want {
+		t.Errorf("lookup.Delete queries: %v, want %d", vc.queries, want)
+	}
+
+	// A list id returns the ksids of all its elements.
+	vc = &vcursor{numRows: 1}
+	got, err := lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewVarChar(`["a", "b"]`), sqltypes.NewVarChar("c")})
+	if err != nil {
+		t.Error(err)
+	}
+	want := []Ksids{{
+		IDs: [][]byte{[]byte("1"), []byte("1")},
+	}, {
+		IDs: [][]byte{[]byte("1")},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Map(): %#v, want %+v", got, want)
+	}
+
+	vc = &vcursor{numRows: 1}
+	gotBools, err := lookupNonUnique.Verify(vc, []sqltypes.Value{sqltypes.NewVarChar(`["a", "b"]`)}, [][]byte{[]byte("test1")})
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(gotBools, []bool{true}) {
+		t.Errorf("Verify(): %v, want [true]", gotBools)
+	}
+	// Verify stops at the first element that matches.
+	if got, want := len(vc.queries), 1; got != want {
+		t.Errorf("lookup.Verify queries: %v, want %d", vc.queries, want)
+	}
+
+	_, err = lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewVarChar(`["a"`)})
+	if err == nil || !strings.HasPrefix(err.Error(), "lookup.Map: invalid json list") {
+		t.Errorf("Map(bad json) err: %v, want invalid json list", err)
+	}
+}
+
+func TestLookupNonUniqueMapDistinct(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":    "t",
+		"from":     "fromc",
+		"to":       "toc",
+		"distinct": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{
+		result: sqltypes.MakeTestResult(sqltypes.MakeTestFields("toc", "varbinary"), "ks2", "ks1", "ks2", "ks2"),
+	}
+
+	got, err := lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Ksids{{IDs: [][]byte{[]byte("ks2"), []byte("ks1")}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Map(): %+v, want %+v", got, want)
+	}
+}
+
+func TestLookupNonUniqueWarnOnEmptyMap(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "test_warn_on_empty_map", map[string]string{
+		"table":             "t",
+		"from":              "fromc",
+		"to":                "toc",
+		"warn_on_empty_map": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []sqltypes.Value{sqltypes.NewInt64(1), sqltypes.NewInt64(2)}
+
+	if _, err := lookupNonUnique.(NonUnique).Map(&vcursor{numRows: 1}, ids); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lookupNonUnique.(NonUnique).Map(&vcursor{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := lookupEmptyMaps.Counts()["test_warn_on_empty_map"]; got != 0 {
+		t.Errorf("VindexLookupEmptyMaps: %d, want 0", got)
+	}
+	if _, err := lookupNonUnique.(NonUnique).Map(&vcursor{}, ids); err != nil {
+		t.Fatal(err)
+	}
+	if got := lookupEmptyMaps.Counts()["test_warn_on_empty_map"]; got != 1 {
+		t.Errorf("VindexLookupEmptyMaps: %d, want 1", got)
+	}
+}
+
+func TestSplitFromListCSV(t *testing.T) {
+	got, err := splitFromList("csv", sqltypes.NewVarChar(" a, b,,c "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []sqltypes.Value{sqltypes.NewVarChar("a"), sqltypes.NewVarChar("b"), sqltypes.NewVarChar("c")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitFromList(csv): %v, want %v", got, want)
+	}
+
+	got, err = splitFromList("csv", sqltypes.NULL)
+	if err != nil || got != nil {
+		t.Errorf("splitFromList(NULL): %v, %v, want nil", got, err)
+	}
+
+	_, err = CreateVindex("lookup", "lookup", map[string]string{
+		"table":     "t",
+		"from":      "from1,from2",
+		"to":        "toc",
+		"from_list": "csv",
+	})
+	wantErr := "from_list is only supported for a single from column: [from1 from2]"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("Create(from_list multi-column) err: %v, want %s", err, wantErr)
+	}
+}
+
+func TestLookupNonUniqueFullScan(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":               "t",
+		"from":                "fromc",
+		"to":                  "toc",
+		"full_scan_threshold": "2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{numRows: 1}
+
+	// At the threshold, the regular lookup is used.
+	_, err = lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1), sqltypes.NewInt64(2)})
+	if err != nil {
+		t.Error(err)
+	}
+	if got, want := len(vc.queries), 2; got != want {
+		t.Errorf("lookup.Map queries: %v, want %d", vc.queries, want)
+	}
+
+	vc = &vcursor{
+		result: sqltypes.MakeTestResult(
+			sqltypes.MakeTestFields("fromc|toc", "int64|varbinary"),
+			"1|ks1",
+			"2|ks2",
+			"1|ks3",
+		),
+	}
+	got, err := lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1), sqltypes.NewInt64(2), sqltypes.NewInt64(4)})
+	if err != nil {
+		t.Error(err)
+	}
+	want := []Ksids{{
+		IDs: [][]byte{[]byte("ks1"), []byte("ks3")},
+	}, {
+		IDs: [][]byte{[]byte("ks2")},
+	}, {}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Map(): %#v, want %+v", got, want)
+	}
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: "select `fromc`, `toc` from `t`",
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("lookup.Map queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+}
+
+func TestLookupNonUniqueReservedWords(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":      "ks.match",
+		"from":       "order",
+		"to":         "key",
+		"autocommit": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{numRows: 1}
+	ids := []sqltypes.Value{sqltypes.NewInt64(1)}
+	ksids := [][]byte{[]byte("test1")}
+
+	if _, err := lookupNonUnique.(NonUnique).Map(vc, ids); err != nil {
+		t.Error(err)
+	}
+	if _, err := lookupNonUnique.Verify(vc, ids, ksids); err != nil {
+		t.Error(err)
+	}
+	if _, err := lookupNonUnique.(*LookupNonUnique).ReverseMap(vc, ksids); err != nil {
+		t.Error(err)
+	}
+	if err := lookupNonUnique.(Lookup).Create(vc, [][]sqltypes.Value{ids}, ksids, false /* ignoreMode */); err != nil {
+		t.Error(err)
+	}
+	wantqueries := []string{
+		"select `key` from `ks`.`match` where `order` = :order",
+		"select `order` from `ks`.`match` where `order` = :order and `key` = :key",
+		"select `order` from `ks`.`match` where `key` = :key",
+		"insert into `ks`.`match`(`order`, `key`) values(:order0, :key0) on duplicate key update `order`=values(`order`), `key`=values(`key`)",
+	}
+	if len(vc.queries) != len(wantqueries) {
+		t.Fatalf("queries: %v, want %v", vc.queries, wantqueries)
+	}
+	for i, query := range vc.queries {
+		if query.Sql != wantqueries[i] {
+			t.Errorf("query[%d]: %s, want %s", i, query.Sql, wantqueries[i])
+		}
+		if _, err := sqlparser.Parse(query.Sql); err != nil {
+			t.Errorf("Parse(%s): %v", query.Sql, err)
+		}
+	}
+
+	// Delete is a no-op for autocommit, so use a regular vindex.
+	lookupNonUnique, err = CreateVindex("lookup", "lookup", map[string]string{
+		"table": "match",
+		"from":  "order",
+		"to":    "key",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc = &vcursor{}
+	if err := lookupNonUnique.(Lookup).Delete(vc, [][]sqltypes.Value{ids}, []byte("test1")); err != nil {
+		t.Error(err)
+	}
+	wantSQL := "delete from `match` where `order` = :order and `key` = :key"
+	if got := vc.queries[0].Sql; got != wantSQL {
+		t.Errorf("Delete query: %s, want %s", got, wantSQL)
+	}
+	if _, err := sqlparser.Parse(vc.queries[0].Sql); err != nil {
+		t.Errorf("Parse(%s): %v", vc.queries[0].Sql, err)
+	}
+}
+
+func TestLookupNonUniqueMarshalJSON(t *testing.T) {
+	lookupNonUnique := createLookup(t, "lookup", false)
+	got, err := json.Marshal(lookupNonUnique)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"table":"t","from_columns":["fromc"],"to":"toc"}`
+	if string(got) != want {
+		t.Errorf("MarshalJSON(): %s, want %s", got, want)
+	}
+}
+
+func createLookup(t *testing.T, name string, writeOnly bool) Vindex {
+	t.Helper()
+	write := "false"
+	if writeOnly {
+		write = "true"
+	}
+	l, err := CreateVindex(name, name, map[string]string{
+		"table":      "t",
+		"from":       "fromc",
+		"to":         "toc",
+		"write_only": write,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLookupNonUniqueIDRanges(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":            "t",
+		"from":             "fromc",
+		"to":               "toc",
+		"lookup_id_ranges": "1-2, 5-",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{numRows: 1}
+	ids := []sqltypes.Value{sqltypes.NewInt64(15), sqltypes.NewInt64(2), sqltypes.NewInt64(7)}
+
+	got, err := lookupNonUnique.(NonUnique).Map(vc, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Ksids{{
+		IDs: [][]byte{[]byte("1")},
+	}, {
+		Range: &topodatapb.KeyRange{},
+	}, {
+		IDs: [][]byte{[]byte("1")},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Map(): %+v, want %+v", got, want)
+	}
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: "select `toc` from `t` where `fromc` = :fromc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc": sqltypes.Int64BindVariable(15),
+		},
+	}, {
+		Sql: "select `toc` from `t` where `fromc` = :fromc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc": sqltypes.Int64BindVariable(7),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("lookup.Map queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	// Verify only consults the table for the ids that Map looks up.
+	vc = &vcursor{}
+	verified, err := lookupNonUnique.Verify(vc, ids, [][]byte{[]byte("test1"), []byte("test2"), []byte("test3")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []bool{false, true, false}; !reflect.DeepEqual(verified, want) {
+		t.Errorf("Verify(): %v, want %v", verified, want)
+	}
+	if got, want := len(vc.queries), 2; got != want {
+		t.Errorf("lookup.Verify queries: %v, want %d", vc.queries, want)
+	}
+
+	testcases := []struct {
+		vindexType string
+		ranges     string
+		want       string
+	}{{
+		vindexType: "lookup",
+		ranges:     "1-2,5",
+		want:       `lookup_id_ranges: range "5" must be of the form start-end`,
+	}, {
+		vindexType: "lookup",
+		ranges:     "5-1",
+		want:       `lookup_id_ranges: range "5-1" is empty`,
+	}, {
+		vindexType: "lookup_unique",
+		ranges:     "1-2",
+		want:       "lookup_id_ranges cannot be used with a unique lookup vindex, whose Map cannot scatter",
+	}, {
+		vindexType: "lookup_hash",
+		ranges:     "1-2",
+		want:       "unknown params for lookup vindex on table t: lookup_id_ranges",
+	}}
+	for _, tcase := range testcases {
+		_, err := CreateVindex(tcase.vindexType, "v", map[string]string{
+			"table":            "t",
+			"from":             "fromc",
+			"to":               "toc",
+			"lookup_id_ranges": tcase.ranges,
+		})
+		if err == nil || err.Error() != tcase.want {
+			t.Errorf("CreateVindex(%s, %s): %v, want %s", tcase.vindexType, tcase.ranges, err, tcase.want)
+		}
+	}
+}
+
+func TestLookupRequireQualifiedTable(t *testing.T) {
+	for _, table := range []string{"ks.t", "`ks`.`t`"} {
+		for _, vindexType := range []string{"lookup", "lookup_unique", "lookup_hash", "lookup_hash_unique"} {
+			if _, err := CreateVindex(vindexType, "lookup", map[string]string{
+				"table":                   table,
+				"from":                    "fromc",
+				"to":                      "toc",
+				"require_qualified_table": "true",
+			}); err != nil {
+				t.Errorf("CreateVindex(%s, %s): %v", vindexType, table, err)
+			}
+		}
+	}
+	for _, table := range []string{"t", ".t", "ks.", "a.b.c"} {
+		_, err := CreateVindex("lookup", "lookup", map[string]string{
+			"table":                   table,
+			"from":                    "fromc",
+			"to":                      "toc",
+			"require_qualified_table": "true",
+		})
+		want := fmt.Sprintf("table %s of vindex lookup must be qualified by its keyspace, like ks.%s, since require_qualified_table is set", table, table)
+		if err == nil || err.Error() != want {
+			t.Errorf("CreateVindex(%s): %v, want %s", table, err, want)
+		}
+	}
+	// The default is lenient.
+	createLookup(t, "lookup", false)
+}
+
+func createAsyncLookup(t *testing.T, name string) *LookupNonUnique {
+	t.Helper()
+	l, err := CreateVindex("lookup", name, map[string]string{
+		"table":        "t",
+		"from":         "fromc",
+		"to":           "toc",
+		"autocommit":   "true",
+		"async_writes": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l.(*LookupNonUnique)
+}
+
+func TestLookupNonUniqueAsyncWrites(t *testing.T) {
+	ln := createAsyncLookup(t, "test_async_writes")
+	vc := &vcursor{}
+	for i := 1; i <= 2; i++ {
+		err := ln.Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(int64(i))}}, [][]byte{[]byte("test")}, false /* ignoreMode */)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ln.Flush()
+	// The Creates can be merged or not, depending on
+	// how fast the worker picks them up.
+	rows := 0
+	for _, query := range vc.queries {
+		rows += len(query.BindVariables) / 2
+	}
+	if got, want := rows, 2; got != want {
+		t.Errorf("inserted rows: %d, want %d: %v", got, want, vc.queries)
+	}
+	if got, want := vc.autocommits, len(vc.queries); got != want {
+		t.Errorf("autocommits: %d, want %d", got, want)
+	}
+
+	failures := lookupAsyncErrors.Counts()["test_async_writes"]
+	vc = &vcursor{mustFail: true}
+	if err := ln.Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test")}, false /* ignoreMode */); err != nil {
+		t.Errorf("Create(async failure): %v, want nil", err)
+	}
+	ln.Flush()
+	if got, want := lookupAsyncErrors.Counts()["test_async_writes"], failures+1; got != want {
+		t.Errorf("VindexLookupAsyncErrors: %d, want %d", got, want)
+	}
+
+	// A queue that was never used is closed by the drain too.
+	unused := createAsyncLookup(t, "test_async_writes_unused")
+	defer func() {
+		lookupAsyncQueuesMu.Lock()
+		lookupAsyncDrained = false
+		lookupAsyncQueuesMu.Unlock()
+	}()
+	DrainAsyncWrites()
+	for _, ln := range []*LookupNonUnique{ln, unused} {
+		err := ln.Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test")}, false /* ignoreMode */)
+		want := fmt.Sprintf("lookup.Create: async writes of vindex %s are closed", ln.name)
+		if err == nil || err.Error() != want {
+			t.Errorf("Create(drained): %v, want %s", err, want)
+		}
+		// Flush doesn't block once the queue is closed.
+		ln.Flush()
+	}
+
+	for _, params := range []map[string]string{
+		{"autocommit": "true", "async_writes": "true", "delete_by_source_pk": "true", "source_pk_column": "pk"},
+		{"autocommit": "true", "async_queue_size": "10"},
+	} {
+		params["table"], params["from"], params["to"] = "t", "fromc", "toc"
+		if _, err := CreateVindex("lookup", "test_async_writes_bad", params); err == nil {
+			t.Errorf("CreateVindex(%v): nil error", params)
+		}
+	}
+}
+
+func TestLookupNonUniqueAsyncUpdate(t *testing.T) {
+	_, err := CreateVindex("lookup", "test_async_update", map[string]string{
+		"table":        "t",
+		"from":         "fromc",
+		"to":           "toc",
+		"async_writes": "true",
+	})
+	want := "async_writes requires autocommit, since the transaction of a queued mutation is gone by the time it's executed, for vindex table t"
+	if err == nil || err.Error() != want {
+		t.Errorf("CreateVindex(async_writes without autocommit): %v, want %s", err, want)
+	}
+
+	ln := createAsyncLookup(t, "test_async_update")
+	defer ln.lkp.async.Close()
+	vc := &vcursor{}
+	if err := ln.Update(vc, []sqltypes.Value{sqltypes.NewInt64(1)}, []byte("test"), []sqltypes.Value{sqltypes.NewInt64(2)}); err != nil {
+		t.Fatal(err)
+	}
+	ln.Flush()
+	// The Delete of an autocommit vindex is a no-op,
+	// so only the insert is queued.
+	wantSQL := []string{
+		"insert into `t`(`fromc`, `toc`) values(:fromc0, :toc0) on duplicate key update `fromc`=values(`fromc`), `toc`=values(`toc`)",
+	}
+	if len(vc.queries) != len(wantSQL) {
+		t.Fatalf("queries: %v, want %d", vc.queries, len(wantSQL))
+	}
+	for i, query := range vc.queries {
+		if query.Sql != wantSQL[i] {
+			t.Errorf("query %d: %s, want %s", i, query.Sql, wantSQL[i])
+		}
+	}
+	if got, want := vc.autocommits, len(wantSQL); got != want {
+		t.Errorf("autocommits: %d, want %d", got, want)
+	}
+}
+
+func TestLookupAsyncQueueLazyStart(t *testing.T) {
+	ln := createAsyncLookup(t, "test_async_lazy_start")
+	registered := func() bool {
+		lookupAsyncQueuesMu.Lock()
+		defer lookupAsyncQueuesMu.Unlock()
+		_, ok := lookupAsyncQueues[&ln.lkp]
+		return ok
+	}
+	if registered() {
+		t.Errorf("queue is registered before its first mutation")
+	}
+	// Flush and Close don't wait for a worker that was never started.
+	ln.Flush()
+	ln.lkp.async.Close()
+
+	ln = createAsyncLookup(t, "test_async_lazy_start")
+	defer ln.lkp.async.Close()
+	if err := ln.Create(&vcursor{}, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test")}, false /* ignoreMode */); err != nil {
+		t.Fatal(err)
+	}
+	if !registered() {
+		t.Errorf("queue is not registered after its first mutation")
+	}
+}
+
+func TestLookupAsyncQueueFull(t *testing.T) {
+	ln := createAsyncLookup(t, "test_async_full")
+	q := ln.lkp.async
+	// Without a worker, the queue fills up.
+	q.mu.Lock()
+	q.started = true
+	q.mu.Unlock()
+	for i := 0; i < cap(q.ops); i++ {
+		q.ops <- &asyncOp{done: make(chan struct{})}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	vc := budgetVCursor{vcursor: &vcursor{}, ctx: ctx}
+	err := ln.Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test")}, false /* ignoreMode */)
+	want := "lookup.Create: gave up waiting for room in the async writes queue of vindex test_async_full: context canceled"
+	if err == nil || err.Error() != want {
+		t.Errorf("Create(full): %v, want %s", err, want)
+	}
+
+	// Close fails the mutations that wait for room, instead of
+	// waiting for them.
+	errs := make(chan error)
+	go func() {
+		errs <- ln.Create(&vcursor{}, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test")}, false /* ignoreMode */)
+	}()
+	go q.Close()
+	want = "lookup.Create: async writes of vindex test_async_full are closed"
+	if err := <-errs; err == nil || err.Error() != want {
+		t.Errorf("Create(closing): %v, want %s", err, want)
+	}
+	// The worker executes the queued ops, and Close returns.
+	go q.run()
+	<-q.stopped
+}
+
+func TestLookupAsyncQueueExecute(t *testing.T) {
+	ln := createAsyncLookup(t, "test_async_execute")
+	defer ln.lkp.async.Close()
+	vc1, vc2 := &vcursor{}, &vcursor{}
+	op := func(vc *vcursor, id int64, ignoreMode bool) *asyncOp {
+		return &asyncOp{
+			vcursor:       vc,
+			rowsColValues: [][]sqltypes.Value{{sqltypes.NewInt64(id)}},
+			toValues:      []sqltypes.Value{sqltypes.NewVarBinary("test")},
+			ignoreMode:    ignoreMode,
+		}
+	}
+	done := make(chan struct{})
+	ln.lkp.async.execute([]*asyncOp{
+		op(vc1, 1, false),
+		op(vc1, 2, false),
+		{done: done},
+		op(vc1, 3, false),
+		op(vc1, 4, true),
+		op(vc2, 5, true),
+	})
+	select {
+	case <-done:
+	default:
+		t.Errorf("flush marker was not closed")
+	}
+	wantSQL := []string{
+		"insert into `t`(`fromc`, `toc`) values(:fromc0, :toc0), (:fromc1, :toc1) on duplicate key update `fromc`=values(`fromc`), `toc`=values(`toc`)",
+		"insert into `t`(`fromc`, `toc`) values(:fromc0, :toc0) on duplicate key update `fromc`=values(`fromc`), `toc`=values(`toc`)",
+		"insert ignore into `t`(`fromc`, `toc`) values(:fromc0, :toc0) on duplicate key update `fromc`=values(`fromc`), `toc`=values(`toc`)",
+	}
+	if len(vc1.queries) != len(wantSQL) {
+		t.Fatalf("vc1 queries: %v, want %d", vc1.queries, len(wantSQL))
+	}
+	for i, query := range vc1.queries {
+		if query.Sql != wantSQL[i] {
+			t.Errorf("vc1 query %d: %s, want %s", i, query.Sql, wantSQL[i])
+		}
+	}
+	if got, want := len(vc2.queries), 1; got != want {
+		t.Errorf("vc2 queries: %v, want %d", vc2.queries, want)
+	}
+}
+
+func TestLookupAsyncQueuesSameName(t *testing.T) {
+	// Two keyspaces can have a vindex of the same name.
+	ln1 := createAsyncLookup(t, "test_async_same_name")
+	ln2 := createAsyncLookup(t, "test_async_same_name")
+	vc := &vcursor{}
+	for _, ln := range []*LookupNonUnique{ln1, ln2} {
+		if err := ln.Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test")}, false /* ignoreMode */); err != nil {
+			t.Errorf("Create: %v", err)
+		}
+		ln.Flush()
+	}
+
+	// A reload closes the queues of the vindexes it replaced.
+	vschema := func(vindex Vindex) *VSchema {
+		return &VSchema{Keyspaces: map[string]*KeyspaceSchema{
+			"ks1": {Vindexes: map[string]Vindex{"test_async_same_name": ln1}},
+			"ks2": {Vindexes: map[string]Vindex{"test_async_same_name": vindex}},
+		}}
+	}
+	NotifyVSchemaReload(vschema(ln2))
+	ln3 := createAsyncLookup(t, "test_async_same_name")
+	defer ln3.lkp.async.Close()
+	NotifyVSchemaReload(vschema(ln3))
+	defer ln1.lkp.async.Close()
+	<-ln2.lkp.async.stopped
+	if err := ln1.Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test")}, false /* ignoreMode */); err != nil {
+		t.Errorf("Create(kept): %v", err)
+	}
+	err := ln2.Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test")}, false /* ignoreMode */)
+	want := "lookup.Create: async writes of vindex test_async_same_name are closed"
+	if err == nil || err.Error() != want {
+		t.Errorf("Create(replaced): %v, want %s", err, want)
+	}
+}
+
+func TestLookupCacheStats(t *testing.T) {
+	c := newLookupCache("test_cache_stats", 1, time.Minute)
+	result := sqltypes.MakeTestResult(sqltypes.MakeTestFields("toc", "varbinary"), "ks1")
+
+	c.Set("1", result)
+	c.Get("1")
+	c.Get("2")
+	c.Get("1")
+	// 1 is evicted, and Delete is not an eviction.
+	c.Set("2", result)
+	c.Delete("2")
+	c.Get("2")
+
+	var got *CacheStats
+	for _, s := range LookupCacheStats() {
+		if s.Vindex == "test_cache_stats" {
+			got = s
+		}
+	}
+	want := &CacheStats{
+		Vindex:    "test_cache_stats",
+		Capacity:  1,
+		Hits:      2,
+		Misses:    2,
+		Evictions: 1,
+		HitRatio:  0.5,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LookupCacheStats: %+v, want %+v", got, want)
+	}
+
+	stats := LookupCacheStats()
+	for i := 1; i < len(stats); i++ {
+		if stats[i-1].Vindex >= stats[i].Vindex {
+			t.Errorf("LookupCacheStats: %s before %s, want sorted by vindex", stats[i-1].Vindex, stats[i].Vindex)
+		}
+	}
+}
+
+func TestLookupCacheEviction(t *testing.T) {
+	c := newLookupCache("test_cache_eviction", 2, time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	result := sqltypes.MakeTestResult(sqltypes.MakeTestFields("toc", "varbinary"), "ks1")
+
+	c.Set("1", result)
+	c.Set("2", result)
+	if _, ok := c.Get("1"); !ok {
+		t.Errorf("Get(1): not found")
+	}
+	// 2 is now the least recently used.
+	c.Set("3", result)
+	if _, ok := c.Get("2"); ok {
+		t.Errorf("Get(2): found, want evicted")
+	}
+	if got, want := c.Len(), int64(2); got != want {
+		t.Errorf("Len(): %d, want %d", got, want)
+	}
+	if got, want := c.Bytes(), 2*resultSize("1", result); got != want {
+		t.Errorf("Bytes(): %d, want %d", got, want)
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.Get("1"); ok {
+		t.Errorf("Get(1): found, want expired")
+	}
+	c.Delete("3")
+	if got, want := c.Len(), int64(0); got != want {
+		t.Errorf("Len(): %d, want %d", got, want)
+	}
+	if got, want := c.Bytes(), int64(0); got != want {
+		t.Errorf("Bytes(): %d, want %d", got, want)
+	}
+
+	counts := lookupCacheEvictions.Counts()
+	if got, want := counts["test_cache_eviction.Size"], int64(1); got != want {
+		t.Errorf("size evictions: %d, want %d", got, want)
+	}
+	if got, want := counts["test_cache_eviction.TTL"], int64(1); got != want {
+		t.Errorf("TTL evictions: %d, want %d", got, want)
+	}
+	if got, want := lookupCacheCounts((*lookupCache).Len)["test_cache_eviction"], int64(0); got != want {
+		t.Errorf("VindexLookupCacheEntries: %d, want %d", got, want)
+	}
+}
+
+func TestLookupNonUniqueCache(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "test_cache", map[string]string{
+		"table":      "t",
+		"from":       "fromc",
+		"to":         "toc",
+		"cache_size": "10",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{numRows: 1}
+	ids := []sqltypes.Value{sqltypes.NewInt64(1), sqltypes.NewInt64(2)}
+
+	for i := 0; i < 2; i++ {
+		if _, err := lookupNonUnique.(NonUnique).Map(vc, ids); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := len(vc.queries), 2; got != want {
+		t.Errorf("lookup.Map queries: %v, want %d", vc.queries, want)
+	}
+
+	// Create must invalidate the cached entry.
+	err = lookupNonUnique.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test")}, false /* ignoreMode */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc.queries = nil
+	if _, err := lookupNonUnique.(NonUnique).Map(vc, ids); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(vc.queries), 1; got != want {
+		t.Errorf("lookup.Map queries: %v, want %d", vc.queries, want)
+	}
+
+	_, err = CreateVindex("lookup", "test_cache", map[string]string{
+		"table":     "t",
+		"from":      "fromc",
+		"to":        "toc",
+		"cache_ttl": "1x",
+	})
+	want := "cache_ttl value must be a duration: '1x'"
+	if err == nil || err.Error() != want {
+		t.Errorf("Create(bad_ttl): %v, want %s", err, want)
+	}
+}
+
+func TestLookupCacheGeneration(t *testing.T) {
+	c := newLookupCache("test_cache_generation", 2, 0)
+	result := sqltypes.MakeTestResult(sqltypes.MakeTestFields("toc", "varbinary"), "ks1")
+
+	c.Set("1", result)
+	BumpLookupCacheGeneration()
+	// The stale entry is still there until it's read.
+	if got, want := c.Len(), int64(1); got != want {
+		t.Errorf("Len(): %d, want %d", got, want)
+	}
+	if _, ok := c.Get("1"); ok {
+		t.Errorf("Get(1): found, want stale")
+	}
+	if got, want := c.Len(), int64(0); got != want {
+		t.Errorf("Len(): %d, want %d", got, want)
+	}
+	c.Set("1", result)
+	if _, ok := c.Get("1"); !ok {
+		t.Errorf("Get(1): not found")
+	}
+	if got, want := lookupCacheEvictions.Counts()["test_cache_generation.Generation"], int64(1); got != want {
+		t.Errorf("generation evictions: %d, want %d", got, want)
+	}
+}
+
+func TestLookupNonUniqueReset(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "test_reset", map[string]string{
+		"table":             "t",
+		"from":              "fromc",
+		"to":                "toc",
+		"cache_size":        "10",
+		"warn_on_empty_map": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := lookupNonUnique.(*LookupNonUnique)
+	vc := &vcursor{}
+	ids := []sqltypes.Value{sqltypes.NewInt64(1)}
+	if _, err := ln.Map(vc, ids); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reset without stats only clears the cache.
+	ln.Reset(false)
+	if _, err := ln.Map(vc, ids); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(vc.queries), 2; got != want {
+		t.Errorf("lookup.Map queries: %v, want %d", vc.queries, want)
+	}
+	if got, want := lookupEmptyMaps.Counts()["test_reset"], int64(2); got != want {
+		t.Errorf("VindexLookupEmptyMaps: %d, want %d", got, want)
+	}
+
+	ln.Reset(true)
+	if got, want := lookupCacheCounts((*lookupCache).Len)["test_reset"], int64(0); got != want {
+		t.Errorf("VindexLookupCacheEntries: %d, want %d", got, want)
+	}
+	if got, want := lookupEmptyMaps.Counts()["test_reset"], int64(0); got != want {
+		t.Errorf("VindexLookupEmptyMaps: %d, want %d", got, want)
+	}
+	if got, want := lookupFanout("test_reset").Count(), int64(0); got != want {
+		t.Errorf("fan-out count: %d, want %d", got, want)
+	}
+}
+
+func TestLookupNonUniqueCacheSnapshot(t *testing.T) {
+	params := map[string]string{
+		"table":      "t",
+		"from":       "fromc",
+		"to":         "toc",
+		"cache_size": "10",
+	}
+	lookupNonUnique, err := CreateVindex("lookup", "test_snapshot", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{numRows: 1}
+	ids := []sqltypes.Value{sqltypes.NewInt64(1), sqltypes.NewInt64(2)}
+	want, err := lookupNonUnique.(NonUnique).Map(vc, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := lookupNonUnique.(*LookupNonUnique).SnapshotCache(buf); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.String()
+
+	// A new vindex with the same params gets a warm cache.
+	restored, err := CreateVindex("lookup", "test_snapshot_restored", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := restored.(*LookupNonUnique).RestoreCache(strings.NewReader(snapshot))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("RestoreCache(): %d entries, want 2", n)
+	}
+	vc = &vcursor{}
+	got, err := restored.(NonUnique).Map(vc, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Map(): %v, want %v", got, want)
+	}
+	if len(vc.queries) != 0 {
+		t.Errorf("lookup.Map queries: %v, want none", vc.queries)
+	}
+
+	// A snapshot of another table, or of another version, is discarded.
+	params["table"] = "t2"
+	other, err := CreateVindex("lookup", "test_snapshot_other", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.(*LookupNonUnique).RestoreCache(strings.NewReader(snapshot))
+	if err == nil || !strings.Contains(err.Error(), "incompatible with vindex test_snapshot_other") {
+		t.Errorf("RestoreCache(other table): %v, want incompatible", err)
+	}
+	_, err = other.(*LookupNonUnique).RestoreCache(strings.NewReader(strings.Replace(snapshot, `"version":1`, `"version":0`, 1)))
+	wantErr := "lookup.RestoreCache: snapshot has version 0, want 1"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("RestoreCache(old version): %v, want %s", err, wantErr)
+	}
+	if got := lookupCacheCounts((*lookupCache).Len)["test_snapshot_other"]; got != 0 {
+		t.Errorf("VindexLookupCacheEntries: %d, want 0", got)
+	}
+
+	// With json_hex, the values are in hex, and the snapshot can be
+	// restored by a vindex without it.
+	params["table"] = "t"
+	params["json_hex"] = "true"
+	hexed, err := CreateVindex("lookup", "test_snapshot_hex", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hexed.(NonUnique).Map(&vcursor{numRows: 1}, ids); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := hexed.(*LookupNonUnique).SnapshotCache(buf); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot := buf.String(); !strings.Contains(snapshot, `"hex":"31"`) || strings.Contains(snapshot, `"value"`) {
+		t.Errorf("SnapshotCache(json_hex): %s, want hex values", snapshot)
+	}
+	delete(params, "json_hex")
+	restored, err = CreateVindex("lookup", "test_snapshot_hex_restored", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restored.(*LookupNonUnique).RestoreCache(buf); err != nil {
+		t.Fatal(err)
+	}
+	vc = &vcursor{}
+	got, err = restored.(NonUnique).Map(vc, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Map(json_hex): %v, want %v", got, want)
+	}
+	if len(vc.queries) != 0 {
+		t.Errorf("lookup.Map queries: %v, want none", vc.queries)
+	}
+
+	uncached := createLookup(t, "lookup", false)
+	wantErr = "lookup.SnapshotCache: vindex lookup has no cache"
+	if err := uncached.(*LookupNonUnique).SnapshotCache(buf); err == nil || err.Error() != wantErr {
+		t.Errorf("SnapshotCache(no cache): %v, want %s", err, wantErr)
+	}
+}
+
+func TestLookupCacheSnapshotTTL(t *testing.T) {
+	c := newLookupCache("test_snapshot_ttl", 10, time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	result := sqltypes.MakeTestResult(sqltypes.MakeTestFields("toc", "varbinary"), "ks1")
+	c.Set("1", result)
+	now = now.Add(30 * time.Second)
+	c.Set("2", result)
+	entries := c.snapshot()
+
+	// Restored entries keep their expiration time.
+	restored := newLookupCache("test_snapshot_ttl_restored", 10, time.Minute)
+	restored.now = func() time.Time { return now.Add(40 * time.Second) }
+	if got, want := restored.restore(entries), 1; got != want {
+		t.Errorf("restore(): %d entries, want %d", got, want)
+	}
+	if _, ok := restored.Get("2"); !ok {
+		t.Errorf("Get(2): not found")
+	}
+	restored.now = func() time.Time { return now.Add(time.Minute) }
+	if _, ok := restored.Get("2"); ok {
+		t.Errorf("Get(2): found, want expired")
+	}
+}
+
+func TestLookupNonUniqueCacheTTLColumn(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "test_cache_ttl_column", map[string]string{
+		"table":      "t",
+		"from":       "fromc",
+		"to":         "toc",
+		"cache_size": "10",
+		"cache_ttl":  "1m",
+		"ttl_column": "ttl",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lkp := &lookupNonUnique.(*LookupNonUnique).lkp
+	now := time.Now()
+	lkp.cache.now = func() time.Time { return now }
+	fields := sqltypes.MakeTestFields("toc|ttl", "varbinary|int64")
+	vc := &vcursor{}
+	id := []sqltypes.Value{sqltypes.NewInt64(1)}
+	mapID := func(result *sqltypes.Result) {
+		t.Helper()
+		vc.result = result
+		if _, err := lookupNonUnique.(NonUnique).Map(vc, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The earliest expiry of the rows applies.
+	vc.queries = nil
+	mapID(sqltypes.MakeTestResult(fields, "ks1|3600", "ks2|10"))
+	wantQuery := "select `toc`, `ttl` from `t` where `fromc` = :fromc"
+	if len(vc.queries) != 1 || vc.queries[0].Sql != wantQuery {
+		t.Errorf("lookup.Map queries: %v, want %s", vc.queries, wantQuery)
+	}
+	result, ok := lkp.cache.Get("1")
+	if !ok {
+		t.Fatalf("Get(1): not found")
+	}
+	wantResult := sqltypes.MakeTestResult(sqltypes.MakeTestFields("toc", "varbinary"), "ks1", "ks2")
+	if !reflect.DeepEqual(result, wantResult) {
+		t.Errorf("Get(1): %v, want %v", result, wantResult)
+	}
+	now = now.Add(10 * time.Second)
+	if _, ok := lkp.cache.Get("1"); ok {
+		t.Errorf("Get(1): found, want expired")
+	}
+
+	// NULL TTLs fall back to cache_ttl.
+	mapID(sqltypes.MakeTestResult(fields, "ks1|null"))
+	now = now.Add(59 * time.Second)
+	if _, ok := lkp.cache.Get("1"); !ok {
+		t.Errorf("Get(1): not found")
+	}
+	now = now.Add(time.Second)
+	if _, ok := lkp.cache.Get("1"); ok {
+		t.Errorf("Get(1): found, want expired")
+	}
+
+	// A non-positive TTL prevents caching.
+	mapID(sqltypes.MakeTestResult(fields, "ks1|0"))
+	if _, ok := lkp.cache.Get("1"); ok {
+		t.Errorf("Get(1): found, want not cached")
+	}
+
+	unixExpiry, err := CreateVindex("lookup", "test_cache_ttl_column", map[string]string{
+		"table":           "t",
+		"from":            "fromc",
+		"to":              "toc",
+		"cache_size":      "10",
+		"ttl_column":      "expires",
+		"ttl_column_type": "unix_expiry",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lkp = &unixExpiry.(*LookupNonUnique).lkp
+	lkp.cache.now = func() time.Time { return now }
+	vc.result = sqltypes.MakeTestResult(fields, "ks1|"+strconv.FormatInt(now.Unix()+30, 10))
+	if _, err := unixExpiry.(NonUnique).Map(vc, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lkp.cache.Get("1"); !ok {
+		t.Errorf("Get(1): not found")
+	}
+	now = now.Add(30 * time.Second)
+	if _, ok := lkp.cache.Get("1"); ok {
+		t.Errorf("Get(1): found, want expired")
+	}
+
+	for params, wantErr := range map[string]string{
+		"ttl_column=ttl":                                        "ttl_column requires cache_size",
+		"cache_size=10,ttl_column_type=seconds":                 "ttl_column_type requires ttl_column",
+		"cache_size=10,ttl_column=ttl,ttl_column_type=datetime": "ttl_column_type value must be seconds or unix_expiry: 'datetime'",
+	} {
+		m := map[string]string{"table": "t", "from": "fromc", "to": "toc"}
+		for _, param := range strings.Split(params, ",") {
+			kv := strings.SplitN(param, "=", 2)
+			m[kv[0]] = kv[1]
+		}
+		if _, err := CreateVindex("lookup", "test_cache_ttl_column", m); err == nil || err.Error() != wantErr {
+			t.Errorf("CreateVindex(%s): %v, want %s", params, err, wantErr)
+		}
+	}
+}
+
+func TestLookupChecksum(t *testing.T) {
+	rows := [][]sqltypes.Value{
+		{sqltypes.NewInt64(1), sqltypes.NewVarBinary("a")},
+		{sqltypes.NewInt64(2), sqltypes.NULL},
+	}
+	changed := [][]sqltypes.Value{
+		{sqltypes.NewInt64(1), sqltypes.NewVarBinary("a")},
+		{sqltypes.NewInt64(2), sqltypes.NewVarBinary("")},
+	}
+	vc := &pageVCursor{pages: map[string][]*sqltypes.Result{
+		"t": {{Rows: rows}},
+		"u": {{Rows: rows}},
+		"v": {{Rows: changed}},
+	}}
+	checksum := func(table string) []byte {
+		v, err := CreateVindex("lookup", table, map[string]string{
+			"table": table,
+			"from":  "fromc",
+			"to":    "toc",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := v.(*LookupNonUnique).Checksum(vc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	want := sha256.Sum256([]byte("" +
+		"\x00\x00\x00\x00\x00\x00\x00\x011" +
+		"\x00\x00\x00\x00\x00\x00\x00\x01a" +
+		"\x00\x00\x00\x00\x00\x00\x00\x012" +
+		"\xff\xff\xff\xff\xff\xff\xff\xff"))
+	got := checksum("t")
+	if !bytes.Equal(got, want[:]) {
+		t.Errorf("Checksum(t): %x, want %x", got, want)
+	}
+	if got := checksum("u"); !bytes.Equal(got, want[:]) {
+		t.Errorf("Checksum(u): %x, want %x", got, want)
+	}
+	// NULL and empty must not have the same checksum.
+	if got := checksum("v"); bytes.Equal(got, want[:]) {
+		t.Errorf("Checksum(v): %x, want a different checksum", got)
+	}
+	wantQueries := []*querypb.BoundQuery{{
+		Sql: "select `fromc`, `toc` from `t` order by `fromc`, `toc` limit 1000",
+	}}
+	if !reflect.DeepEqual(vc.queries[:1], wantQueries) {
+		t.Errorf("Checksum queries:\n%v, want\n%v", vc.queries[:1], wantQueries)
+	}
+
+	lookupUnique := createLookup(t, "lookup_unique", false)
+	_, err := lookupUnique.(*LookupUnique).Checksum(&vcursor{numRows: 1})
+	wantErr := "lookup.Checksum: malformed result from table t of vindex lookup_unique: row 0 has 1 columns, want 2"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("Checksum(): %v, want %s", err, wantErr)
+	}
+}
+
+func TestCoalesceKsids(t *testing.T) {
+	testcases := []struct {
+		ksids [][]byte
+		want  *topodatapb.KeyRange
+	}{{
+		ksids: [][]byte{{0x01}},
+	}, {
+		ksids: [][]byte{{0x03}, {0x01}, {0x02}, {0x02}},
+		want:  &topodatapb.KeyRange{Start: []byte{0x01}, End: []byte{0x04}},
+	}, {
+		ksids: [][]byte{{0x00, 0xff}, {0x01, 0x00}},
+		want:  &topodatapb.KeyRange{Start: []byte{0x00, 0xff}, End: []byte{0x01, 0x01}},
+	}, {
+		ksids: [][]byte{{0xfe}, {0xff}},
+		want:  &topodatapb.KeyRange{Start: []byte{0xfe}},
+	}, {
+		// Not contiguous.
+		ksids: [][]byte{{0x01}, {0x03}},
+	}, {
+		// Not of the same length.
+		ksids: [][]byte{{0x01}, {0x01, 0x00}},
+	}, {
+		ksids: [][]byte{{}, {}},
+	}}
+	for _, tcase := range testcases {
+		if got := coalesceKsids(tcase.ksids); !reflect.DeepEqual(got, tcase.want) {
+			t.Errorf("coalesceKsids(%x): %v, want %v", tcase.ksids, got, tcase.want)
+		}
+	}
+}
+
+func TestLookupNonUniqueCoalesceRanges(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":           "t",
+		"from":            "fromc",
+		"to":              "toc",
+		"coalesce_ranges": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{numRows: 3}
+	got, err := lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Ksids{{Range: &topodatapb.KeyRange{Start: []byte("1"), End: []byte("4")}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Map(): %+v, want %+v", got, want)
+	}
+
+	vc = &vcursor{numRows: 1}
+	got, err = lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []Ksids{{IDs: [][]byte{[]byte("1")}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Map(one row): %+v, want %+v", got, want)
+	}
+
+	_, err = CreateVindex("lookup_hash", "lookup_hash", map[string]string{
+		"table":           "t",
+		"from":            "fromc",
+		"to":              "toc",
+		"coalesce_ranges": "true",
+	})
+	wantErr := "unknown params for lookup vindex on table t: coalesce_ranges"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("CreateVindex(lookup_hash): %v, want %s", err, wantErr)
+	}
+}
+
+func TestLookupValidateCollation(t *testing.T) {
+	fields := sqltypes.MakeTestFields("column_name|collation_name", "varchar|varchar")
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table": "ks.t",
+		"from":  "fromc,fromd",
+		"to":    "toc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator := lookupNonUnique.(CollationValidator)
+
+	// A column without a collation is not a string.
+	result := sqltypes.MakeTestResult(fields, "FROMC|utf8mb4_bin", "fromd|", "toc|binary")
+	result.Rows[1][1] = sqltypes.NULL
+	vc := &vcursor{result: result}
+	if err := validator.ValidateCollation(vc); err != nil {
+		t.Error(err)
+	}
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: fromCollationsQuery,
+		BindVariables: map[string]*querypb.BindVariable{
+			"table_name": sqltypes.StringBindVariable("t"),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("ValidateCollation queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	vc = &vcursor{result: sqltypes.MakeTestResult(fields, "fromc|utf8mb4_general_ci", "fromd|latin1_bin")}
+	err = validator.ValidateCollation(vc)
+	want := "lookup.ValidateCollation: table ks.t of vindex lookup has from columns with a non-binary collation, " +
+		"which matches values that the vindex tells apart: fromc utf8mb4_general_ci; want binary or a _bin collation"
+	if err == nil || err.Error() != want {
+		t.Errorf("ValidateCollation(case-insensitive): %v, want %s", err, want)
+	}
+	if _, ok := err.(*CollationError); !ok {
+		t.Errorf("ValidateCollation(case-insensitive): %T, want *CollationError", err)
+	}
+
+	vc = &vcursor{result: sqltypes.MakeTestResult(fields, "fromc|utf8mb4_bin")}
+	err = validator.ValidateCollation(vc)
+	want = "lookup.ValidateCollation: table ks.t not found or has no column fromd"
+	if err == nil || err.Error() != want {
+		t.Errorf("ValidateCollation(missing column): %v, want %s", err, want)
+	}
+}
+
+func TestLookupSelfTestCollationCheck(t *testing.T) {
+	fields := sqltypes.MakeTestFields("column_name|collation_name", "varchar|varchar")
+	vc := &vcursor{result: sqltypes.MakeTestResult(fields, "fromc|utf8_general_ci")}
+	for _, check := range []string{"", "warn", "error"} {
+		lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+			"table":           "t",
+			"from":            "fromc",
+			"to":              "toc",
+			"collation_check": check,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = lookupNonUnique.(SelfTester).SelfTest(vc)
+		if check == "error" {
+			if _, ok := err.(*CollationError); !ok {
+				t.Errorf("SelfTest(collation_check=error): %v, want *CollationError", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("SelfTest(collation_check=%s): %v, want nil", check, err)
+		}
+	}
+
+	_, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":           "t",
+		"from":            "fromc",
+		"to":              "toc",
+		"collation_check": "strict",
+	})
+	want := "collation_check must be warn or error: 'strict'"
+	if err == nil || err.Error() != want {
+		t.Errorf("CreateVindex(bad collation_check) err: %v, want %s", err, want)
+	}
+}
+
+func TestCreateLookupFromProvider(t *testing.T) {
+	params := map[string]string{
+		"table": "t",
+		"from":  "fromc",
+		"to":    "toc",
+	}
+	provider := MapLookupConfigProvider{"lkp": params}
+
+	got, err := CreateLookupFromProvider("lookup_unique", "lkp", provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := CreateVindex("lookup_unique", "lkp", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CreateLookupFromProvider: %+v, want %+v", got, want)
+	}
+
+	_, err = CreateLookupFromProvider("lookup", "missing", provider)
+	wantErr := "lookup config for vindex missing: no params for vindex missing"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("CreateLookupFromProvider(missing): %v, want %s", err, wantErr)
+	}
+
+	_, err = CreateLookupFromProvider("hash", "lkp", provider)
+	wantErr = "vindexType \"hash\" is not a lookup vindex"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("CreateLookupFromProvider(hash): %v, want %s", err, wantErr)
+	}
+}
+
+// blockingVCursor is a vcursor whose queries block until release
+// is closed. Each query sends to started when it starts.
+type blockingVCursor struct {
+	started chan struct{}
+	release chan struct{}
+
+	mu      sync.Mutex
+	queries int
+}
+
+func (vc *blockingVCursor) Execute(method string, query string, bindvars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
+	vc.mu.Lock()
+	vc.queries++
+	vc.mu.Unlock()
+	vc.started <- struct{}{}
+	<-vc.release
+	return &sqltypes.Result{
+		Fields:       sqltypes.MakeTestFields("col", "varbinary"),
+		Rows:         [][]sqltypes.Value{{sqltypes.NewVarBinary("ksid")}},
+		RowsAffected: 1,
+	}, nil
+}
+
+func (vc *blockingVCursor) ExecuteAutocommit(method string, query string, bindvars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
+	return vc.Execute(method, query, bindvars, isDML)
+}
+
+func (vc *blockingVCursor) numQueries() int {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	return vc.queries
+}
+
+func TestLookupNonUniqueConsolidateLookups(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "test_consolidate_lookups", map[string]string{
+		"table":               "t",
+		"from":                "fromc",
+		"to":                  "toc",
+		"consolidate_lookups": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &blockingVCursor{
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}
+	ids := []sqltypes.Value{sqltypes.NewInt64(1)}
+	want := []Ksids{{IDs: [][]byte{[]byte("ksid")}}}
+	consolidations := lookupConsolidations.Counts()["test_consolidate_lookups"]
+
+	const lookups = 5
+	var wg sync.WaitGroup
+	for i := 0; i < lookups; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := lookupNonUnique.(NonUnique).Map(vc, ids)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Map: %+v, want %+v", got, want)
+			}
+		}()
+	}
+	// Wait until the first lookup is executing, and the others
+	// are waiting for it.
+	<-vc.started
+	for deadline := time.Now().Add(5 * time.Second); lookupConsolidations.Counts()["test_consolidate_lookups"]-consolidations != lookups-1; {
+		if time.Now().After(deadline) {
+			t.Fatal("lookups were not consolidated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(vc.release)
+	wg.Wait()
+	if got, want := vc.numQueries(), 1; got != want {
+		t.Errorf("queries: %d, want %d", got, want)
+	}
+
+	// A lookup that arrives once the query is done executes its own.
+	if _, err := lookupNonUnique.(NonUnique).Map(vc, ids); err != nil {
+		t.Error(err)
+	}
+	if got, want := vc.numQueries(), 2; got != want {
+		t.Errorf("queries: %d, want %d", got, want)
+	}
+}
+
+func TestAdaptiveCost(t *testing.T) {
+	ac, err := adaptiveCostFromMap(map[string]string{
+		"adaptive_cost":           "true",
+		"adaptive_cost_max":       "50",
+		"adaptive_cost_smoothing": "0.5",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcases := []struct {
+		latency time.Duration
+		want    int
+	}{
+		// The first sample sets the EWMA.
+		{30 * time.Millisecond, 30},
+		{40 * time.Millisecond, 35},
+		// It's clamped to the static cost.
+		{time.Millisecond, 20},
+		// And to adaptive_cost_max.
+		{time.Second, 50},
+	}
+	if got, want := ac.cost(20), 20; got != want {
+		t.Errorf("cost() before any sample: %d, want %d", got, want)
+	}
+	for _, tc := range testcases {
+		ac.record(tc.latency)
+		if got := ac.cost(20); got != tc.want {
+			t.Errorf("cost() after %v: %d, want %d", tc.latency, got, tc.want)
+		}
+	}
+
+	ac, err = adaptiveCostFromMap(map[string]string{
+		"adaptive_cost":      "true",
+		"adaptive_cost_min":  "5",
+		"adaptive_cost_unit": "10ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.record(20 * time.Millisecond)
+	if got, want := ac.cost(20), 5; got != want {
+		t.Errorf("cost(): %d, want %d", got, want)
+	}
+
+	for _, m := range []map[string]string{
+		{"adaptive_cost_max": "10"},
+		{"adaptive_cost": "true", "adaptive_cost_min": "30", "adaptive_cost_max": "10"},
+		{"adaptive_cost": "true", "adaptive_cost_unit": "0s"},
+		{"adaptive_cost": "true", "adaptive_cost_smoothing": "1.5"},
+	} {
+		if _, err := adaptiveCostFromMap(m); err == nil {
+			t.Errorf("adaptiveCostFromMap(%v): nil error", m)
+		}
+	}
+}
+
+func TestLookupNonUniqueAdaptiveCost(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":             "t",
+		"from":              "fromc",
+		"to":                "toc",
+		"adaptive_cost":     "true",
+		"adaptive_cost_min": "1",
+		"adaptive_cost_max": "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := lookupNonUnique.Cost(), 20; got != want {
+		t.Errorf("Cost() before Map: %d, want %d", got, want)
+	}
+	if _, err := lookupNonUnique.(NonUnique).Map(&vcursor{numRows: 1}, []sqltypes.Value{sqltypes.NewInt64(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := lookupNonUnique.Cost(), 1; got != want {
+		t.Errorf("Cost() after Map: %d, want %d", got, want)
+	}
+}
+
+func TestLookupNonUniqueMutationCounts(t *testing.T) {
+	counter := createLookup(t, "lookup", false).(MutationCounter)
+	rows := [][]sqltypes.Value{{sqltypes.NewInt64(1)}, {sqltypes.NewInt64(2)}}
+
+	vc := &vcursor{insertsAffected: []uint64{1}}
+	count, err := counter.CreateWithCount(vc, rows, [][]byte{[]byte("test1"), []byte("test2")}, true /* ignoreMode */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("CreateWithCount: %d, want 1", count)
+	}
+
+	// Delete issues one query per row.
+	vc = &vcursor{deletesAffected: []uint64{1, 0}}
+	count, err = counter.DeleteWithCount(vc, rows, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("DeleteWithCount: %d, want 1", count)
+	}
+
+	vc = &vcursor{insertsAffected: []uint64{1}, deletesAffected: []uint64{1}}
+	count, err = counter.UpdateWithCount(vc, []sqltypes.Value{sqltypes.NewInt64(1)}, []byte("test"), []sqltypes.Value{sqltypes.NewInt64(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("UpdateWithCount: %d, want 2", count)
+	}
+
+	// Deletes are no-ops in autocommit mode.
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":             "t",
+		"from":              "fromc",
+		"to":                "toc",
+		"autocommit":        "true",
+		"commit_batch_size": "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter = lookupNonUnique.(MutationCounter)
+	vc = &vcursor{insertsAffected: []uint64{1, 2}}
+	count, err = counter.CreateWithCount(vc, rows, [][]byte{[]byte("test1"), []byte("test2")}, false /* ignoreMode */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("CreateWithCount(batches): %d, want 3", count)
+	}
+	count, err = counter.DeleteWithCount(vc, rows, []byte("test"))
+	if err != nil || count != 0 {
+		t.Errorf("DeleteWithCount(autocommit): %d, %v, want 0, nil", count, err)
+	}
+
+	lookupNonUnique, err = CreateVindex("lookup", "test_count_async_writes", map[string]string{
+		"table":        "t",
+		"from":         "fromc",
+		"to":           "toc",
+		"autocommit":   "true",
+		"async_writes": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lookupNonUnique.(*LookupNonUnique).lkp.async.Close()
+	_, err = lookupNonUnique.(MutationCounter).CreateWithCount(&vcursor{}, rows, [][]byte{[]byte("test1"), []byte("test2")}, false /* ignoreMode */)
+	want := "lookup.Create: CreateWithCount does not support async_writes for vindex table t"
+	if err == nil || err.Error() != want {
+		t.Errorf("CreateWithCount(async_writes) err: %v, want %s", err, want)
+	}
+}
+
+// pageVCursor returns the next page of the table named in the query.
+type pageVCursor struct {
+	pages   map[string][]*sqltypes.Result
+	queries []*querypb.BoundQuery
+}
+
+func (vc *pageVCursor) Execute(method string, query string, bindvars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
+	vc.queries = append(vc.queries, &querypb.BoundQuery{
+		Sql:           query,
+		BindVariables: bindvars,
+	})
+	for table, pages := range vc.pages {
+		if strings.Contains(query, "from `"+table+"`") {
+			vc.pages[table] = pages[1:]
+			return pages[0], nil
+		}
+	}
+	panic("unexpected")
+}
+
+func (vc *pageVCursor) ExecuteAutocommit(method string, query string, bindvars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
+	return vc.Execute(method, query, bindvars, isDML)
+}
+
+func TestDiffLookups(t *testing.T) {
+	first, err := CreateVindex("lookup", "first", map[string]string{"table": "t1", "from": "fromc", "to": "toc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := CreateVindex("lookup_unique", "second", map[string]string{"table": "t2", "from": "fromc", "to": "toc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := sqltypes.MakeTestFields("fromc|toc", "int64|varbinary")
+	vc := &pageVCursor{
+		pages: map[string][]*sqltypes.Result{
+			"t1": {
+				sqltypes.MakeTestResult(fields, "1|a", "2|b"),
+				sqltypes.MakeTestResult(fields, "3|c"),
+			},
+			"t2": {
+				sqltypes.MakeTestResult(fields, "1|a", "3|c"),
+				sqltypes.MakeTestResult(fields, "4|d"),
+			},
+		},
+	}
+
+	var got []*LookupDiff
+	err = DiffLookups(vc, first, second, 2, func(diff *LookupDiff) error {
+		got = append(got, diff)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*LookupDiff{{
+		InFirst: true,
+		From:    sqltypes.NewInt64(2),
+		To:      sqltypes.NewVarBinary("b"),
+	}, {
+		InFirst: false,
+		From:    sqltypes.NewInt64(4),
+		To:      sqltypes.NewVarBinary("d"),
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffLookups: %v, want %v", got, want)
+	}
+	wantQuery := &querypb.BoundQuery{
+		Sql: "select `fromc`, `toc` from `t1` where `fromc` > :fromc or (`fromc` = :fromc and `toc` > :toc) order by `fromc`, `toc` limit 2",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc": sqltypes.Int64BindVariable(2),
+			"toc":   sqltypes.BytesBindVariable([]byte("b")),
+		},
+	}
+	if len(vc.queries) != 4 || !reflect.DeepEqual(vc.queries[2], wantQuery) {
+		t.Errorf("DiffLookups queries: %v, want %v as third query", vc.queries, wantQuery)
+	}
+
+	hash, err := CreateVindex("hash", "hash", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DiffLookups(vc, first, hash, 2, func(*LookupDiff) error { return nil })
+	wantErr := "lookup.Diff: hash is not a lookup vindex"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("DiffLookups(hash): %v, want %s", err, wantErr)
+	}
+}
+
+func createErrorContextLookup(t *testing.T, params map[string]string) Vindex {
+	t.Helper()
+	m := map[string]string{
+		"table":         "t",
+		"from":          "fromc",
+		"to":            "toc",
+		"error_context": "true",
+	}
+	for k, v := range params {
+		m[k] = v
+	}
+	v, err := CreateVindex("lookup", "lookup_context", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestLookupErrorContext(t *testing.T) {
+	lookupNonUnique := createErrorContextLookup(t, nil)
+	ids := []sqltypes.Value{sqltypes.NewInt64(1), sqltypes.NewInt64(2)}
+	_, err := lookupNonUnique.(NonUnique).Map(&vcursor{mustFail: true}, ids)
+	want := `vindex lookup_context (table t): Map of 2 values [INT64("1"), INT64("2")]: lookup.Map: execute failed`
+	if err == nil || err.Error() != want {
+		t.Errorf("Map(): %v, want %s", err, want)
+	}
+	var opErr *OperationError
+	if !errors.As(err, &opErr) {
+		t.Fatalf("Map(): %T, want an *OperationError", err)
+	}
+	if opErr.Vindex != "lookup_context" || opErr.Method != "Map" {
+		t.Errorf("OperationError: %+v, want the Map of lookup_context", opErr)
+	}
+	if want := "lookup.Map: execute failed"; errors.Unwrap(err) == nil || errors.Unwrap(err).Error() != want {
+		t.Errorf("Unwrap(): %v, want %s", errors.Unwrap(err), want)
+	}
+
+	// The inputs are truncated.
+	var rows [][]sqltypes.Value
+	var ksids [][]byte
+	for i := 0; i < 5; i++ {
+		rows = append(rows, []sqltypes.Value{sqltypes.NewVarChar(strings.Repeat("a", 40))})
+		ksids = append(ksids, []byte("test"))
+	}
+	err = lookupNonUnique.(Lookup).Create(&vcursor{mustFail: true}, rows, ksids, false /* ignoreMode */)
+	long := `VARCHAR("` + strings.Repeat("a", 32) + `"...)`
+	want = "vindex lookup_context (table t): Create of 5 rows [[" + long + "], [" + long + "], [" + long + "], ... 2 more]: lookup.Create: execute failed"
+	if err == nil || err.Error() != want {
+		t.Errorf("Create():\n%v, want\n%s", err, want)
+	}
+
+	// A typed error can still be found, also by the ErrorMapper.
+	lookupNonUnique = createErrorContextLookup(t, map[string]string{"verify_before_create": "true"})
+	var mapped error
+	lookupNonUnique.(*LookupNonUnique).SetErrorMapper(ErrorMapperFunc(func(vindex, method string, err error) error {
+		mapped = err
+		return err
+	}))
+	err = lookupNonUnique.(Lookup).Create(&vcursor{numRows: 1}, rows[:1], [][]byte{[]byte("test")}, false /* ignoreMode */)
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Errorf("Create(conflict): %v, want a *ConflictError", err)
+	}
+	if _, ok := mapped.(*OperationError); !ok {
+		t.Errorf("mapped error: %T, want an *OperationError", mapped)
+	}
+
+	// Without error_context, the errors are not wrapped.
+	_, err = createLookup(t, "lookup", false).(NonUnique).Map(&vcursor{mustFail: true}, ids)
+	if want := "lookup.Map: execute failed"; err == nil || err.Error() != want {
+		t.Errorf("Map(): %v, want %s", err, want)
+	}
+}
+
+func TestLookupSetErrorMapper(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "test_error_mapper", map[string]string{
+		"table":               "t",
+		"from":                "fromc",
+		"to":                  "toc",
+		"source_pk_column":    "pkc",
+		"delete_by_source_pk": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := lookupNonUnique.(*LookupNonUnique)
+	var mapped int
+	ln.SetErrorMapper(ErrorMapperFunc(func(vindex, method string, err error) error {
+		mapped++
+		return fmt.Errorf("%s.%s failed: %v", vindex, method, err)
+	}))
+
+	vc := &vcursor{mustFail: true}
+	ids := []sqltypes.Value{sqltypes.NewInt64(1)}
+	rows := [][]sqltypes.Value{ids}
+	ksids := [][]byte{[]byte("test1")}
+	ksid := sqltypes.NewVarBinary("test1")
+	testcases := []struct {
+		method string
+		f      func() error
+		err    string
+	}{{
+		method: "Map",
+		f: func() error {
+			_, err := ln.Map(vc, ids)
+			return err
+		},
+	}, {
+		method: "Verify",
+		f: func() error {
+			_, err := ln.Verify(vc, ids, ksids)
+			return err
+		},
+	}, {
+		method: "Create",
+		f:      func() error { return ln.Create(vc, rows, ksids, false /* ignoreMode */) },
+	}, {
+		method: "Create",
+		f: func() error {
+			_, err := ln.CreateWithStatus(vc, rows, ksids, false /* ignoreMode */)
+			return err
+		},
+		err: "lookup.Create: row 0: execute failed",
+	}, {
+		method: "Create",
+		f: func() error {
+			return ln.BatchCreate(vc, rows, ksids, nil, BatchCreateOptions{BatchSize: 1})
+		},
+	}, {
+		method: "Update",
+		f:      func() error { return ln.Update(vc, ids, []byte("test1"), []sqltypes.Value{sqltypes.NewInt64(2)}) },
+		err:    "lookup.Delete: execute failed",
+	}, {
+		method: "Delete",
+		f:      func() error { return ln.Delete(vc, rows, []byte("test1")) },
+	}, {
+		method: "Delete",
+		f: func() error {
+			return ln.lkp.DeleteWithSourcePK(vc, rows, ksid, []sqltypes.Value{sqltypes.NewInt64(10)})
+		},
+	}}
+	for _, tcase := range testcases {
+		mapped = 0
+		err := tcase.f()
+		if tcase.err == "" {
+			tcase.err = fmt.Sprintf("lookup.%s: execute failed", tcase.method)
+		}
+		want := fmt.Sprintf("test_error_mapper.%s failed: %s", tcase.method, tcase.err)
+		if err == nil || err.Error() != want {
+			t.Errorf("%s: %v, want %s", tcase.method, err, want)
+		}
+		if mapped != 1 {
+			t.Errorf("%s: mapped %d times, want 1", tcase.method, mapped)
+		}
+	}
+
+	// Successes are not mapped.
+	mapped = 0
+	if err := ln.Create(&vcursor{}, rows, ksids, false /* ignoreMode */); err != nil {
+		t.Error(err)
+	}
+	if mapped != 0 {
+		t.Errorf("Create: mapped %d times, want 0", mapped)
+	}
+}
+
+func TestLookupEstimateRows(t *testing.T) {
+	lookupUnique, err := CreateVindex("lookup_unique", "lookup_unique", map[string]string{
+		"table": "ks.t",
+		"from":  "fromc",
+		"to":    "toc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{
+		result: sqltypes.MakeTestResult(sqltypes.MakeTestFields("table_rows", "uint64"), "1000"),
+	}
+
+	// The second call is served from the cache.
+	for i := 0; i < 2; i++ {
+		got, err := lookupUnique.(*LookupUnique).EstimateRows(vc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != 1000 {
+			t.Errorf("EstimateRows: %d, want 1000", got)
+		}
+	}
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: "select table_rows from information_schema.tables where table_schema = database() and table_name = :table_name",
+		BindVariables: map[string]*querypb.BindVariable{
+			"table_name": sqltypes.StringBindVariable("t"),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("EstimateRows queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":               "t",
+		"from":                "fromc",
+		"to":                  "toc",
+		"estimate_rows_count": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc = &vcursor{result: sqltypes.MakeTestResult(sqltypes.MakeTestFields("count(*)", "int64"), "12")}
+	got, err := lookupNonUnique.(*LookupNonUnique).EstimateRows(vc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 12 {
+		t.Errorf("EstimateRows(count): %d, want 12", got)
+	}
+	if got, want := vc.queries[0].Sql, "select count(*) from `t`"; got != want {
+		t.Errorf("EstimateRows(count) query: %s, want %s", got, want)
+	}
+
+	vc = &vcursor{result: &sqltypes.Result{}}
+	lookupNonUnique.(*LookupNonUnique).lkp.EstimateRowsCount = false
+	lookupNonUnique.(*LookupNonUnique).lkp.estimate.expires = time.Time{}
+	_, err = lookupNonUnique.(*LookupNonUnique).EstimateRows(vc)
+	want := "lookup.EstimateRows: table t not found"
+	if err == nil || err.Error() != want {
+		t.Errorf("EstimateRows(not found): %v, want %s", err, want)
+	}
+}
+
+func TestExport(t *testing.T) {
+	lookup := createLookup(t, "lookup", false)
+	rows := [][]sqltypes.Value{
+		{sqltypes.NewInt64(1), sqltypes.NewVarBinary("a")},
+		{sqltypes.NewInt64(1), sqltypes.NewVarBinary("b")},
+		{sqltypes.NewInt64(2), sqltypes.NewVarBinary("a")},
+	}
+	vc := &pageVCursor{pages: map[string][]*sqltypes.Result{
+		"t": {{Rows: rows[:2]}, {Rows: rows[2:]}},
+	}}
+	page, err := Export(vc, lookup, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Rows, rows[:2]) || page.Token == "" {
+		t.Fatalf("Export(): %v, want %v and a token", page, rows[:2])
+	}
+	token := page.Token
+
+	// The token only depends on the last row, so it can be resumed by
+	// another process.
+	page, err = Export(vc, lookup, token, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Rows, rows[2:]) || page.Token != "" {
+		t.Errorf("Export(token): %v, want %v and no token", page, rows[2:])
+	}
+	wantQueries := []*querypb.BoundQuery{{
+		Sql: "select `fromc`, `toc` from `t` order by `fromc`, `toc` limit 2",
+	}, {
+		Sql: "select `fromc`, `toc` from `t` where `fromc` > :fromc or (`fromc` = :fromc and `toc` > :toc) order by `fromc`, `toc` limit 2",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc": sqltypes.Int64BindVariable(1),
+			"toc":   sqltypes.BytesBindVariable([]byte("b")),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantQueries) {
+		t.Errorf("Export queries:\n%v, want\n%v", vc.queries, wantQueries)
+	}
+
+	other, err := CreateVindex("lookup", "other", map[string]string{
+		"table": "u",
+		"from":  "fromc",
+		"to":    "toc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcases := []struct {
+		v     Vindex
+		token string
+		want  string
+	}{{
+		v:     lookup,
+		token: "not a token",
+		want:  "lookup.Export: invalid token",
+	}, {
+		v:     lookup,
+		token: "eyJ2IjoyfQ", // {"v":2}
+		want:  "lookup.Export: token version 2 is not supported, want 1",
+	}, {
+		v:     other,
+		token: token,
+		want:  "lookup.Export: token is for table t, not u",
+	}, {
+		v:    &stFU{name: "stfu"},
+		want: "lookup.Export: stfu is not a lookup vindex",
+	}}
+	for _, tcase := range testcases {
+		_, err := Export(&vcursor{}, tcase.v, tcase.token, 2)
+		if err == nil || !strings.HasPrefix(err.Error(), tcase.want) {
+			t.Errorf("Export(%s, %q): %v, want %s", tcase.v, tcase.token, err, tcase.want)
+		}
+	}
+	if _, err := Export(vc, lookup, "", 0); err == nil || err.Error() != "lookup.Export: batch size must be positive: 0" {
+		t.Errorf("Export(0): %v", err)
+	}
+}
+
+func TestLookupNonUniqueMapFanout(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "test_fanout", map[string]string{
+		"table": "t",
+		"from":  "fromc",
+		"to":    "toc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both ids map to the same 2 keyspace ids.
+	vc := &vcursor{numRows: 2}
+	ids := []sqltypes.Value{sqltypes.NewInt64(1), sqltypes.NewInt64(2)}
+	if _, err := lookupNonUnique.(NonUnique).Map(vc, ids); err != nil {
+		t.Fatal(err)
+	}
+	vc.numRows = 0
+	if _, err := lookupNonUnique.(NonUnique).Map(vc, ids); err != nil {
+		t.Fatal(err)
+	}
+
+	h := lookupFanout("test_fanout")
+	want := map[string]int64{"1": 1, "2": 1}
+	got := make(map[string]int64)
+	for label, count := range h.Counts() {
+		if count != 0 {
+			got[label] = count
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("fan-out histogram: %v, want %v", got, want)
+	}
+	if got, want := h.Total(), int64(2); got != want {
+		t.Errorf("fan-out total: %d, want %d", got, want)
+	}
+}
+
+func TestLookupIndexHint(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":      "t",
+		"from":       "fromc",
+		"to":         "toc",
+		"index_hint": " FORCE INDEX( fromc_idx )",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := lookupNonUnique.(*LookupNonUnique).lkp.IndexHint, "force index (`fromc_idx`)"; got != want {
+		t.Errorf("IndexHint: %s, want %s", got, want)
+	}
+
+	vc := &vcursor{numRows: 1}
+	if _, err := lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lookupNonUnique.Verify(vc, []sqltypes.Value{sqltypes.NewInt64(1)}, [][]byte{[]byte("test")}); err != nil {
+		t.Fatal(err)
+	}
+	// Delete is not hinted.
+	if err := lookupNonUnique.(Lookup).Delete(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, []byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	wantSQL := []string{
+		"select `toc` from `t` force index (`fromc_idx`) where `fromc` = :fromc",
+		"select `fromc` from `t` force index (`fromc_idx`) where `fromc` = :fromc and `toc` = :toc",
+		"delete from `t` where `fromc` = :fromc and `toc` = :toc",
+	}
+	if len(vc.queries) != len(wantSQL) {
+		t.Fatalf("got %d queries, want %d", len(vc.queries), len(wantSQL))
+	}
+	for i, query := range vc.queries {
+		if query.Sql != wantSQL[i] {
+			t.Errorf("query %d: %s, want %s", i, query.Sql, wantSQL[i])
+		}
+	}
+
+	lookupHash, err := CreateVindex("lookup_hash", "lookup_hash", map[string]string{
+		"table":      "ks.t",
+		"from":       "fromc",
+		"to":         "toc",
+		"index_hint": "use index (fromc_idx, PRIMARY)",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc = &vcursor{numRows: 1}
+	if _, err := lookupHash.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := vc.queries[0].Sql, "select `toc` from `ks`.`t` use index (`fromc_idx`, `PRIMARY`) where `fromc` = :fromc"; got != want {
+		t.Errorf("query: %s, want %s", got, want)
+	}
+}
+
+func TestLookupIndexHintValidateIndex(t *testing.T) {
+	fields := sqltypes.MakeTestFields("index_name|non_unique|column_name", "varchar|int64|varchar")
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":      "t",
+		"from":       "fromc",
+		"to":         "toc",
+		"index_hint": "force index (fromc_idx)",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vc := &vcursor{result: sqltypes.MakeTestResult(fields, "PRIMARY|0|id", "FROMC_IDX|1|fromc")}
+	if err := lookupNonUnique.(IndexValidator).ValidateIndex(vc); err != nil {
+		t.Error(err)
+	}
+
+	vc = &vcursor{result: sqltypes.MakeTestResult(fields, "PRIMARY|0|id", "fromc_toc_idx|1|fromc", "fromc_toc_idx|1|toc")}
+	err = lookupNonUnique.(IndexValidator).ValidateIndex(vc)
+	want := "lookup.ValidateIndex: table t of vindex lookup has no index fromc_idx, which its index_hint names"
+	if err == nil || err.Error() != want {
+		t.Errorf("ValidateIndex(missing hint index): %v, want %s", err, want)
+	}
+}
+
+func TestLookupIndexHintInvalid(t *testing.T) {
+	testcases := []struct {
+		params map[string]string
+		err    string
+	}{{
+		params: map[string]string{"index_hint": "ignore index (fromc_idx)"},
+		err:    "index_hint must be like 'use index (name)' or 'force index (name)': 'ignore index (fromc_idx)'",
+	}, {
+		params: map[string]string{"index_hint": "force index fromc_idx"},
+		err:    "index_hint must be like 'use index (name)' or 'force index (name)': 'force index fromc_idx'",
+	}, {
+		params: map[string]string{"index_hint": "use index (fromc_idx) where 1 = 1 or (a)"},
+		err:    "index_hint must be like 'use index (name)' or 'force index (name)': 'use index (fromc_idx) where 1 = 1 or (a)'",
+	}, {
+		params: map[string]string{"index_hint": "use index (`fromc_idx`)"},
+		err:    "index_hint has an invalid index name: 'use index (`fromc_idx`)'",
+	}, {
+		params: map[string]string{"index_hint": "use index ()"},
+		err:    "index_hint has an invalid index name: 'use index ()'",
+	}, {
+		params: map[string]string{"index_hint": "use index (fromc_idx)", "query_builder": "test_view"},
+		err:    "index_hint cannot be used with query_builder test_view",
+	}}
+	for _, tc := range testcases {
+		params := map[string]string{
+			"table": "t",
+			"from":  "fromc",
+			"to":    "toc",
+		}
+		for k, v := range tc.params {
+			params[k] = v
+		}
+		_, err := CreateVindex("lookup", "lookup", params)
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("CreateVindex(%v): %v, want %s", tc.params, err, tc.err)
+		}
+	}
+}
+
+func TestLookupValidateIndex(t *testing.T) {
+	fields := sqltypes.MakeTestFields("index_name|non_unique|column_name", "varchar|int64|varchar")
+	lookupUnique, err := CreateVindex("lookup_unique", "lookup_unique", map[string]string{
+		"table": "ks.t",
+		"from":  "fromc",
+		"to":    "toc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vc := &vcursor{result: sqltypes.MakeTestResult(fields, "PRIMARY|0|id", "fromc_idx|0|FROMC")}
+	if err := lookupUnique.(IndexValidator).ValidateIndex(vc); err != nil {
+		t.Error(err)
+	}
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: tableIndexesQuery,
+		BindVariables: map[string]*querypb.BindVariable{
+			"table_name": sqltypes.StringBindVariable("t"),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("ValidateIndex queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	// A unique index that also has the to column doesn't make an id unique.
+	vc = &vcursor{result: sqltypes.MakeTestResult(fields, "PRIMARY|0|id", "fromc_idx|0|fromc", "fromc_idx|0|toc", "toc_idx|1|toc")}
+	err = lookupUnique.(IndexValidator).ValidateIndex(vc)
+	want := "lookup.ValidateIndex: table ks.t of unique vindex lookup_unique has no unique index on its from columns, want unique key (fromc), " +
+		"have: unique key PRIMARY (id), unique key fromc_idx (fromc, toc), key toc_idx (toc)"
+	if err == nil || err.Error() != want {
+		t.Errorf("ValidateIndex(no unique index): %v, want %s", err, want)
+	}
+	if _, ok := err.(*MissingIndexError); !ok {
+		t.Errorf("ValidateIndex(no unique index): %T, want *MissingIndexError", err)
+	}
+
+	// A non-unique vindex only warns.
+	lookupNonUnique := createLookup(t, "lookup", false)
+	if err := lookupNonUnique.(IndexValidator).ValidateIndex(vc); err != nil {
+		t.Errorf("ValidateIndex(non-unique): %v, want nil", err)
+	}
+
+	vc = &vcursor{result: &sqltypes.Result{}}
+	err = lookupUnique.(IndexValidator).ValidateIndex(vc)
+	want = "lookup.ValidateIndex: table ks.t not found or has no index"
+	if err == nil || err.Error() != want {
+		t.Errorf("ValidateIndex(no table): %v, want %s", err, want)
+	}
+
+	vc = &vcursor{mustFail: true}
+	err = lookupUnique.(IndexValidator).ValidateIndex(vc)
+	want = "lookup.ValidateIndex: execute failed"
+	if err == nil || err.Error() != want {
+		t.Errorf("ValidateIndex(query fail): %v, want %s", err, want)
+	}
+}
+
+func TestLookupCacheInvalidator(t *testing.T) {
+	newVindex := func(name string) *LookupNonUnique {
+		v, err := CreateVindex("lookup", name, map[string]string{
+			"table":      "t",
+			"from":       "fromc",
+			"to":         "toc",
+			"cache_size": "10",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v.(*LookupNonUnique)
+	}
+	// Two vtgates with the same vindex, connected by the invalidator
+	// of the first one.
+	first := newVindex("invalidation_first")
+	second := newVindex("invalidation_second")
+	var published [][]string
+	first.SetCacheInvalidator(CacheInvalidatorFunc(func(vindex string, keys []string) {
+		if vindex != "invalidation_first" {
+			t.Errorf("Invalidate vindex: %s, want invalidation_first", vindex)
+		}
+		published = append(published, keys)
+		InvalidateLookupCache("invalidation_second", keys)
+	}))
+
+	ids := []sqltypes.Value{sqltypes.NewInt64(1), sqltypes.NewInt64(2)}
+	vc := &vcursor{numRows: 1}
+	if _, err := second.Map(vc, ids); err != nil {
+		t.Fatal(err)
+	}
+	if got := second.lkp.cache.Len(); got != 2 {
+		t.Fatalf("cache entries: %d, want 2", got)
+	}
+
+	rows := [][]sqltypes.Value{{sqltypes.NewInt64(1)}, {sqltypes.NULL}}
+	if err := first.Create(vc, rows[:1], [][]byte{[]byte("test1")}, false /* ignoreMode */); err != nil {
+		t.Fatal(err)
+	}
+	// A failed Delete publishes its keys too.
+	vc.mustFail = true
+	if err := first.Delete(vc, rows, []byte("test1")); err == nil {
+		t.Fatal("Delete: nil error")
+	}
+	want := [][]string{{"1"}, {"1"}}
+	if !reflect.DeepEqual(published, want) {
+		t.Errorf("published: %v, want %v", published, want)
+	}
+	if got := second.lkp.cache.Len(); got != 1 {
+		t.Errorf("cache entries after invalidation: %d, want 1", got)
+	}
+
+	// Without a cache, nothing is published, and the default
+	// invalidator does nothing.
+	published = nil
+	uncached := createLookup(t, "lookup", false).(*LookupNonUnique)
+	uncached.SetCacheInvalidator(first.lkp.cacheInvalidator)
+	if err := uncached.Create(&vcursor{}, rows[:1], [][]byte{[]byte("test1")}, false /* ignoreMode */); err != nil {
+		t.Fatal(err)
+	}
+	if published != nil {
+		t.Errorf("published without a cache: %v", published)
+	}
+	first.SetCacheInvalidator(nil)
+	if err := first.Create(&vcursor{}, rows[:1], [][]byte{[]byte("test1")}, false /* ignoreMode */); err != nil {
+		t.Fatal(err)
+	}
+	InvalidateLookupCache("invalidation_none", []string{"1"})
+}
+
+// fakeExemplarSink is a fakeMetricsSink that records exemplars.
+type fakeExemplarSink struct {
+	*fakeMetricsSink
+	exemplars map[string][]Exemplar
+}
+
+func (s *fakeExemplarSink) ObserveWithExemplar(name, vindex string, value int64, exemplar Exemplar) {
+	s.Observe(name, vindex, value)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exemplars[name+"."+vindex] = append(s.exemplars[name+"."+vindex], exemplar)
+}
+
+// testSpan is a span with ids.
+type testSpan struct {
+	traceID, spanID string
+}
+
+func (testSpan) StartLocal(string)            {}
+func (testSpan) StartClient(string)           {}
+func (testSpan) StartServer(string)           {}
+func (testSpan) Finish()                      {}
+func (testSpan) Annotate(string, interface{}) {}
+func (s testSpan) TraceID() string            { return s.traceID }
+func (s testSpan) SpanID() string             { return s.spanID }
+
+type testSpanKey struct{}
+
+// testSpanFactory stores its spans in the Context. Like the default
+// factory, it finds no span in the other contexts.
+type testSpanFactory struct{}
+
+func (testSpanFactory) New(parent trace.Span) trace.Span { return testSpan{} }
+
+func (testSpanFactory) FromContext(ctx context.Context) (trace.Span, bool) {
+	span, ok := ctx.Value(testSpanKey{}).(trace.Span)
+	return span, ok
+}
+
+func (testSpanFactory) NewContext(parent context.Context, span trace.Span) context.Context {
+	return context.WithValue(parent, testSpanKey{}, span)
+}
+
+func TestLookupMapLatency(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "test_latency", map[string]string{
+		"table": "t",
+		"from":  "fromc",
+		"to":    "toc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []sqltypes.Value{sqltypes.NewInt64(1)}
+	for i := 0; i < 2; i++ {
+		if _, err := lookupNonUnique.(NonUnique).Map(&vcursor{numRows: 1}, ids); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := lookupLatency("test_latency").Count(), int64(2); got != want {
+		t.Errorf("latency count: %d, want %d", got, want)
+	}
+	lookupNonUnique.(*LookupNonUnique).Reset(true /* resetStats */)
+	if got := lookupLatency("test_latency").Count(); got != 0 {
+		t.Errorf("latency count after Reset: %d, want 0", got)
+	}
+}
+
+func TestLookupMapLatencyExemplars(t *testing.T) {
+	sink := &fakeExemplarSink{
+		fakeMetricsSink: newFakeMetricsSink(),
+		exemplars:       make(map[string][]Exemplar),
+	}
+	defaultSink := metrics()
+	SetMetricsSink(sink)
+	defer SetMetricsSink(defaultSink)
+	trace.RegisterSpanFactory(testSpanFactory{})
+
+	lookupNonUnique, err := CreateVindex("lookup", "test_latency_exemplars", map[string]string{
+		"table": "t",
+		"from":  "fromc",
+		"to":    "toc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []sqltypes.Value{sqltypes.NewInt64(1)}
+	ctx := trace.NewContext(context.Background(), testSpan{traceID: "trace1", spanID: "span1"})
+	vcursors := []VCursor{
+		budgetVCursor{vcursor: &vcursor{numRows: 1}, ctx: ctx},
+		// Without a span or a context, there's no exemplar.
+		budgetVCursor{vcursor: &vcursor{numRows: 1}, ctx: context.Background()},
+		&vcursor{numRows: 1},
+	}
+	for _, vc := range vcursors {
+		if _, err := lookupNonUnique.(NonUnique).Map(vc, ids); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := len(sink.observations["VindexLookupMapLatency.test_latency_exemplars"]), 3; got != want {
+		t.Errorf("VindexLookupMapLatency observations: %d, want %d", got, want)
+	}
+	want := []Exemplar{{TraceID: "trace1", SpanID: "span1"}}
+	if got := sink.exemplars["VindexLookupMapLatency.test_latency_exemplars"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("VindexLookupMapLatency exemplars: %v, want %v", got, want)
+	}
+}
+
+func TestLookupMapLatencyDefaultSinkExemplars(t *testing.T) {
+	trace.RegisterSpanFactory(testSpanFactory{})
+
+	lookupNonUnique, err := CreateVindex("lookup", "test_latency_default_exemplars", map[string]string{
+		"table": "t",
+		"from":  "fromc",
+		"to":    "toc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := trace.NewContext(context.Background(), testSpan{traceID: "trace1", spanID: "span1"})
+	vc := budgetVCursor{vcursor: &vcursor{numRows: 1}, ctx: ctx}
+	if _, err := lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1)}); err != nil {
+		t.Fatal(err)
+	}
+	exemplars := func() map[string]bucketExemplar {
+		h := statsHistograms["VindexLookupMapLatency"]
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.exemplars["test_latency_default_exemplars"]
+	}
+	got := exemplars()
+	if len(got) != 1 {
+		t.Fatalf("VindexLookupMapLatencyExemplars: %v, want one bucket", got)
+	}
+	for bucket, exemplar := range got {
+		if want := (Exemplar{TraceID: "trace1", SpanID: "span1"}); exemplar.Exemplar != want {
+			t.Errorf("VindexLookupMapLatencyExemplars[%s]: %v, want %v", bucket, exemplar.Exemplar, want)
+		}
+		if count := lookupLatency("test_latency_default_exemplars").Counts()[bucket]; count != 1 {
+			t.Errorf("VindexLookupMapLatency[%s]: %d, want 1", bucket, count)
+		}
+	}
+
+	lookupNonUnique.(*LookupNonUnique).Reset(true)
+	if got := exemplars(); got != nil {
+		t.Errorf("VindexLookupMapLatencyExemplars after Reset: %v, want none", got)
+	}
+}
+
+func TestLookupNonUniqueLogQueries(t *testing.T) {
+	var logged []string
+	defer func(f func(string, ...interface{})) { queryLogf = f }(queryLogf)
+	queryLogf = func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+
+	params := map[string]string{
+		"table":       "t",
+		"from":        "fromc",
+		"to":          "toc",
+		"log_queries": "true",
+	}
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{numRows: 1}
+	if _, err := lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewVarChar("secret")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := lookupNonUnique.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test")}, false /* ignoreMode */); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"vindex lookup: VindexLookup: select `toc` from `t` where `fromc` = :fromc {fromc='secret'}",
+		"vindex lookup: VindexCreate: insert into `t`(`fromc`, `toc`) values(:fromc0, :toc0) {fromc0=1, toc0='test'}",
+	}
+	if !reflect.DeepEqual(logged, want) {
+		t.Errorf("logged queries:\n%q, want\n%q", logged, want)
+	}
+
+	params["log_queries_redact"] = "true"
+	lookupNonUnique, err = CreateVindex("lookup", "lookup", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged = nil
+	if _, err := lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewVarChar("secret")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := lookupNonUnique.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test")}, false /* ignoreMode */); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"vindex lookup: VindexLookup: select `toc` from `t` where `fromc` = :fromc {fromc=<redacted>}",
+		"vindex lookup: VindexCreate: insert into `t`(`fromc`, `toc`) values(:fromc0, :toc0) {fromc0=<redacted>, toc0='test'}",
+	}
+	if !reflect.DeepEqual(logged, want) {
+		t.Errorf("logged queries:\n%q, want\n%q", logged, want)
+	}
+
+	// Nothing is logged without log_queries.
+	logged = nil
+	lookupNonUnique = createLookup(t, "lookup", false)
+	if _, err := lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if logged != nil {
+		t.Errorf("logged queries: %q, want none", logged)
+	}
+
+	delete(params, "log_queries")
+	_, err = CreateVindex("lookup", "lookup", params)
+	wantErr := "log_queries_redact requires log_queries for vindex table t"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("CreateVindex(log_queries_redact): %v, want %s", err, wantErr)
+	}
+}
+
+// fakeMetricsSink records the metrics it receives.
+type fakeMetricsSink struct {
+	mu           sync.Mutex
+	counters     map[string]int64
+	observations map[string][]int64
+	gauges       map[string]func() map[string]int64
+}
+
+func newFakeMetricsSink() *fakeMetricsSink {
+	return &fakeMetricsSink{
+		counters:     make(map[string]int64),
+		observations: make(map[string][]int64),
+		gauges:       make(map[string]func() map[string]int64),
+	}
+}
+
+func (s *fakeMetricsSink) AddCounter(name string, labels []string, delta int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[name+"."+strings.Join(labels, ".")] += delta
+}
+
+func (s *fakeMetricsSink) ResetCounter(name string, labels []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.counters, name+"."+strings.Join(labels, "."))
+}
+
+func (s *fakeMetricsSink) Observe(name, vindex string, value int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observations[name+"."+vindex] = append(s.observations[name+"."+vindex], value)
+}
+
+func (s *fakeMetricsSink) ResetHistogram(name, vindex string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.observations, name+"."+vindex)
+}
+
+func (s *fakeMetricsSink) RegisterGauge(name string, values func() map[string]int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gauges[name] = values
+}
+
+func (s *fakeMetricsSink) counter(name string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counters[name]
+}
+
+func TestSetMetricsSink(t *testing.T) {
+	sink := newFakeMetricsSink()
+	defaultSink := metrics()
+	SetMetricsSink(sink)
+	defer SetMetricsSink(defaultSink)
+
+	for _, name := range []string{"VindexLookupAsyncQueueLength", "VindexLookupCacheEntries", "VindexLookupCacheBytes", "VindexLookupInflightMutations"} {
+		if sink.gauges[name] == nil {
+			t.Errorf("gauge %s was not registered", name)
+		}
+	}
+
+	lookupNonUnique, err := CreateVindex("lookup", "test_metrics_sink", map[string]string{
+		"table":             "t",
+		"from":              "fromc",
+		"to":                "toc",
+		"warn_on_empty_map": "true",
+		"cache_size":        "10",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	emptyMaps := lookupEmptyMaps.Counts()["test_metrics_sink"]
+	ids := []sqltypes.Value{sqltypes.NewInt64(1)}
+	if _, err := lookupNonUnique.(NonUnique).Map(&vcursor{}, ids); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sink.counter("VindexLookupEmptyMaps.test_metrics_sink"), int64(1); got != want {
+		t.Errorf("VindexLookupEmptyMaps: %d, want %d", got, want)
+	}
+	if got := lookupEmptyMaps.Counts()["test_metrics_sink"]; got != emptyMaps {
+		t.Errorf("stat VindexLookupEmptyMaps: %d, want %d", got, emptyMaps)
+	}
+	if got, want := sink.observations["VindexLookupMapFanout.test_metrics_sink"], []int64{0}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("VindexLookupMapFanout: %v, want %v", got, want)
+	}
+	if got, want := sink.gauges["VindexLookupCacheEntries"]()["test_metrics_sink"], int64(1); got != want {
+		t.Errorf("VindexLookupCacheEntries: %d, want %d", got, want)
+	}
+
+	lookupNonUnique.(*LookupNonUnique).Reset(true /* resetStats */)
+	if got := sink.counter("VindexLookupEmptyMaps.test_metrics_sink"); got != 0 {
+		t.Errorf("VindexLookupEmptyMaps after Reset: %d, want 0", got)
+	}
+	if got := sink.observations["VindexLookupMapFanout.test_metrics_sink"]; got != nil {
+		t.Errorf("VindexLookupMapFanout after Reset: %v, want nil", got)
+	}
+}
+
+func TestLookupNonUniqueMove(t *testing.T) {
+	rows := [][]sqltypes.Value{{sqltypes.NewInt64(1)}}
+	oldKsid, newKsid := []byte("test1"), []byte("test2")
+
+	// Without autocommit, Move uses the transaction of the session.
+	lookupNonUnique := createLookup(t, "lookup", false)
+	vc := &vcursor{}
+	if err := lookupNonUnique.(Mover).Move(vc, rows, oldKsid, newKsid); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, query := range vc.queries {
+		got = append(got, query.Sql)
+	}
+	want := []string{
+		"delete from `t` where `fromc` = :fromc and `toc` = :toc",
+		"insert into `t`(`fromc`, `toc`) values(:fromc0, :toc0)",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Move queries:\n%v, want\n%v", got, want)
+	}
+	if got, want := vc.queries[0].BindVariables["toc"], sqltypes.BytesBindVariable(oldKsid); !reflect.DeepEqual(got, want) {
+		t.Errorf("deleted toc: %v, want %v", got, want)
+	}
+	if got, want := vc.queries[1].BindVariables["toc0"], sqltypes.BytesBindVariable(newKsid); !reflect.DeepEqual(got, want) {
+		t.Errorf("inserted toc: %v, want %v", got, want)
+	}
+
+	// In autocommit mode, Move uses a transaction of its own.
+	autocommit, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":      "t",
+		"from":       "fromc",
+		"to":         "toc",
+		"autocommit": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tvc := &transactionalVCursor{}
+	if err := autocommit.(Mover).Move(tvc, rows, oldKsid, newKsid); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(tvc.queries), 2; got != want {
+		t.Errorf("queries: %d, want %d", got, want)
+	}
+	if got, want := tvc.autocommits, 0; got != want {
+		t.Errorf("autocommits: %d, want %d", got, want)
+	}
+	if committed, rolledBack := tvc.txs[0].state(); !committed || rolledBack {
+		t.Errorf("tx committed, rolled back: %v, %v, want true, false", committed, rolledBack)
+	}
+
+	// If the Create fails, the Delete is rolled back.
+	tvc = &transactionalVCursor{failInserts: true}
+	err = autocommit.(Mover).Move(tvc, rows, oldKsid, newKsid)
+	wantErr := "lookup.Create: insert failed"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("Move(failed insert) err: %v, want %s", err, wantErr)
+	}
+	if committed, rolledBack := tvc.txs[0].state(); committed || !rolledBack {
+		t.Errorf("tx committed, rolled back: %v, %v, want false, true", committed, rolledBack)
+	}
+
+	err = autocommit.(Mover).Move(&vcursor{}, rows, oldKsid, newKsid)
+	wantErr = "lookup.Move: vindex lookup cannot move entries in autocommit mode without a TransactionalVCursor"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("Move(plain vcursor) err: %v, want %s", err, wantErr)
+	}
+}
+
+// contextVCursor is a blockingVCursor with a context.
+type contextVCursor struct {
+	*blockingVCursor
+	ctx context.Context
+}
+
+func (vc contextVCursor) Context() context.Context {
+	return vc.ctx
+}
+
+func inflightMutations(name string) int64 {
+	lookupMutationLimitsMu.Lock()
+	defer lookupMutationLimitsMu.Unlock()
+	return int64(len(lookupMutationLimits[name].slots))
+}
+
+func TestLookupNonUniqueMaxInflightMutations(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "test_max_inflight_mutations", map[string]string{
+		"table":                  "t",
+		"from":                   "fromc",
+		"to":                     "toc",
+		"max_inflight_mutations": "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lkp := lookupNonUnique.(Lookup)
+	vc := &blockingVCursor{
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}
+	rows := [][]sqltypes.Value{{sqltypes.NewInt64(1)}}
+	ksids := [][]byte{[]byte("test1")}
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- lkp.Create(vc, rows, ksids, false /* ignoreMode */)
+	}()
+	<-vc.started
+	if got, want := inflightMutations("test_max_inflight_mutations"), int64(1); got != want {
+		t.Errorf("VindexLookupInflightMutations: %d, want %d", got, want)
+	}
+
+	// A mutation gives up when its context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = lkp.Delete(contextVCursor{blockingVCursor: vc, ctx: ctx}, rows, []byte("test1"))
+	want := "lookup.Delete: gave up waiting for one of the 1 mutation slots of vindex test_max_inflight_mutations: context deadline exceeded"
+	if err == nil || err.Error() != want {
+		t.Errorf("Delete err: %v, want %s", err, want)
+	}
+
+	// Without a context, it waits for the slot.
+	go func() {
+		errs <- lkp.Delete(vc, rows, []byte("test1"))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if got, want := vc.numQueries(), 1; got != want {
+		t.Errorf("queries: %d, want %d", got, want)
+	}
+	close(vc.release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if got, want := vc.numQueries(), 2; got != want {
+		t.Errorf("queries: %d, want %d", got, want)
+	}
+	if got, want := inflightMutations("test_max_inflight_mutations"), int64(0); got != want {
+		t.Errorf("VindexLookupInflightMutations: %d, want %d", got, want)
+	}
+
+	_, err = CreateVindex("lookup", "test_max_inflight_mutations", map[string]string{
+		"table":                  "t",
+		"from":                   "fromc",
+		"to":                     "toc",
+		"max_inflight_mutations": "-1",
+	})
+	want = "max_inflight_mutations value must be a non-negative integer: '-1'"
+	if err == nil || err.Error() != want {
+		t.Errorf("CreateVindex(negative max_inflight_mutations) err: %v, want %s", err, want)
+	}
+}
+
+func TestRegisterLookupOption(t *testing.T) {
+	RegisterLookupOption("test_shards", func(vindex, value string, params map[string]string) (interface{}, error) {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("must be a positive integer for vindex table %s: '%s'", params["table"], value)
+		}
+		return n, nil
+	})
+	defer delete(lookupOptionParsers, "test_shards")
+
+	for _, vindexType := range []string{"lookup", "lookup_unique", "lookup_hash", "lookup_hash_unique"} {
+		v, err := CreateVindex(vindexType, "lookup", map[string]string{
+			"table":       "t",
+			"from":        "fromc",
+			"to":          "toc",
+			"test_shards": "4",
+		})
+		if err != nil {
+			t.Fatalf("CreateVindex(%s): %v", vindexType, err)
+		}
+		if got, ok := LookupOption(v, "test_shards"); !ok || got != 4 {
+			t.Errorf("LookupOption(%s): %v, %v, want 4, true", vindexType, got, ok)
+		}
+	}
+
+	v := createLookup(t, "lookup", false)
+	if got, ok := LookupOption(v, "test_shards"); ok {
+		t.Errorf("LookupOption(not set): %v, want none", got)
+	}
+	if _, ok := LookupOption(&stFU{}, "test_shards"); ok {
+		t.Errorf("LookupOption(not a lookup vindex): found, want none")
+	}
+
+	_, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":       "t",
+		"from":        "fromc",
+		"to":          "toc",
+		"test_shards": "-1",
+	})
+	want := "test_shards: must be a positive integer for vindex table t: '-1'"
+	if err == nil || err.Error() != want {
+		t.Errorf("CreateVindex(bad option): %v, want %s", err, want)
+	}
+
+	for _, name := range []string{"table", "test_shards"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RegisterLookupOption(%s): no panic", name)
+				}
+			}()
+			RegisterLookupOption(name, nil)
+		}()
+	}
+}
+
+// transactionalVCursor is a vcursor that supports separate transactions.
+// If failInserts is set, the inserts of its transactions fail.
+type transactionalVCursor struct {
+	vcursor
+	failInserts bool
+	txs         []*fakeTx
+}
+
+func (vc *transactionalVCursor) Begin() (VCursorTx, error) {
+	tx := &fakeTx{vc: &vc.vcursor, failInserts: vc.failInserts}
+	vc.txs = append(vc.txs, tx)
+	return tx, nil
+}
+
+// fakeTx records how it's finished. Its queries are executed
+// by the vcursor it was started from.
+type fakeTx struct {
+	vc          *vcursor
+	failInserts bool
+
+	mu                    sync.Mutex
+	committed, rolledBack bool
+}
+
+func (tx *fakeTx) Execute(method string, query string, bindvars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
+	if tx.failInserts && strings.HasPrefix(query, "insert") {
+		return nil, errors.New("insert failed")
+	}
+	return tx.vc.execute(method, query, bindvars, isDML)
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.committed = true
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.rolledBack = true
+	return nil
+}
+
+func (tx *fakeTx) state() (committed, rolledBack bool) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.committed, tx.rolledBack
+}
+
+func TestLookupNonUniqueCreatePending(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":                  "t",
+		"from":                   "fromc",
+		"to":                     "toc",
+		"autocommit":             "true",
+		"deadlock_retries":       "2",
+		"pending_create_timeout": "20ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	creator := lookupNonUnique.(PendingCreator)
+	rows := [][]sqltypes.Value{{sqltypes.NewInt64(1)}}
+	ksids := [][]byte{[]byte("test1")}
+
+	// Commit.
+	vc := &transactionalVCursor{}
+	p, err := creator.CreatePending(vc, rows, ksids, false /* ignoreMode */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(vc.queries), 1; got != want {
+		t.Fatalf("queries: %d, want %d", got, want)
+	}
+	if got, want := vc.autocommits, 0; got != want {
+		t.Errorf("autocommits: %d, want %d", got, want)
+	}
+	if committed, _ := vc.txs[0].state(); committed {
+		t.Error("tx committed before Commit")
+	}
+	if err := p.Commit(); err != nil {
+		t.Error(err)
+	}
+	if err := p.Rollback(); err != nil {
+		t.Errorf("Rollback after Commit: %v, want nil", err)
+	}
+	if committed, rolledBack := vc.txs[0].state(); !committed || rolledBack {
+		t.Errorf("tx committed, rolled back: %v, %v, want true, false", committed, rolledBack)
+	}
+	want := "lookup.Create: pending create of vindex lookup is already committed"
+	if err := p.Commit(); err == nil || err.Error() != want {
+		t.Errorf("second Commit err: %v, want %s", err, want)
+	}
+
+	// Rollback.
+	vc = &transactionalVCursor{}
+	p, err = creator.CreatePending(vc, rows, ksids, false /* ignoreMode */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Rollback(); err != nil {
+		t.Error(err)
+	}
+	if committed, rolledBack := vc.txs[0].state(); committed || !rolledBack {
+		t.Errorf("tx committed, rolled back: %v, %v, want false, true", committed, rolledBack)
+	}
+
+	// Timeout.
+	timeouts := lookupPendingTimeouts.Counts()["lookup"]
+	vc = &transactionalVCursor{}
+	p, err = creator.CreatePending(vc, rows, ksids, false /* ignoreMode */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if _, rolledBack := vc.txs[0].state(); rolledBack {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("pending create was not rolled back after its timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	want = "lookup.Create: pending create of vindex lookup is already timed out"
+	if err := p.Commit(); err == nil || err.Error() != want {
+		t.Errorf("Commit after timeout err: %v, want %s", err, want)
+	}
+	if got, want := lookupPendingTimeouts.Counts()["lookup"]-timeouts, int64(1); got != want {
+		t.Errorf("VindexLookupPendingCreateTimeouts: %d, want %d", got, want)
+	}
+
+	// A failed insert is rolled back, and deadlocks are not retried.
+	vc = &transactionalVCursor{vcursor: vcursor{numDeadlocks: 1}}
+	_, err = creator.CreatePending(vc, rows, ksids, false /* ignoreMode */)
+	if err == nil || !strings.Contains(err.Error(), "errno 1213") {
+		t.Errorf("CreatePending(deadlock) err: %v, want deadlock", err)
+	}
+	if _, rolledBack := vc.txs[0].state(); !rolledBack {
+		t.Error("failed pending create was not rolled back")
+	}
+	if got, want := len(vc.queries), 1; got != want {
+		t.Errorf("queries: %d, want %d", got, want)
+	}
+
+	_, err = creator.CreatePending(&vcursor{}, rows, ksids, false /* ignoreMode */)
+	want = "lookup.Create: vindex lookup cannot defer the commit of a Create without a TransactionalVCursor"
+	if err == nil || err.Error() != want {
+		t.Errorf("CreatePending(plain vcursor) err: %v, want %s", err, want)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	testcases := []struct {
+		prefix, want []byte
+	}{{
+		prefix: []byte("ab"),
+		want:   []byte("ac"),
+	}, {
+		prefix: []byte{'a', 0xff, 0xff},
+		want:   []byte("b"),
+	}, {
+		prefix: []byte{0x00},
+		want:   []byte{0x01},
+	}, {
+		prefix: []byte{0xff, 0xff},
+	}, {
+		prefix: []byte{},
+	}}
+	for _, tcase := range testcases {
+		prefix := append([]byte(nil), tcase.prefix...)
+		if got := prefixEnd(tcase.prefix); !bytes.Equal(got, tcase.want) || (got == nil) != (tcase.want == nil) {
+			t.Errorf("prefixEnd(%x): %x, want %x", tcase.prefix, got, tcase.want)
+		}
+		if !bytes.Equal(tcase.prefix, prefix) {
+			t.Errorf("prefixEnd(%x) modified its argument", prefix)
+		}
+	}
+}
+
+func TestLookupNonUniquePrefixMatch(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":        "t",
+		"from":         "fromc",
+		"to":           "toc",
+		"prefix_match": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{numRows: 2}
+	got, err := lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{
+		sqltypes.NewVarChar("ab"),
+		sqltypes.NewVarBinary("\xff"),
+		sqltypes.NewVarChar(""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Ksids{{
+		IDs: [][]byte{[]byte("1"), []byte("2")},
+	}, {
+		IDs: [][]byte{[]byte("1"), []byte("2")},
+	}, {
+		Range: &topodatapb.KeyRange{},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Map(): %+v, want %+v", got, want)
+	}
+	wantQueries := []*querypb.BoundQuery{{
+		Sql: "select `toc` from `t` where `fromc` >= :fromc_start and `fromc` < :fromc_end",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc_start": sqltypes.BytesBindVariable([]byte("ab")),
+			"fromc_end":   sqltypes.BytesBindVariable([]byte("ac")),
+		},
+	}, {
+		Sql: "select `toc` from `t` where `fromc` >= :fromc_start",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc_start": sqltypes.BytesBindVariable([]byte("\xff")),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantQueries) {
+		t.Errorf("lookup.Map queries:\n%v, want\n%v", vc.queries, wantQueries)
+	}
+
+	testcases := []struct {
+		vindexType string
+		params     map[string]string
+		want       string
+	}{{
+		vindexType: "lookup",
+		params:     map[string]string{"from": "fromc,fromd"},
+		want:       "prefix_match is only supported for a single from column: [fromc fromd]",
+	}, {
+		vindexType: "lookup",
+		params:     map[string]string{"from": "fromc", "cache_size": "10"},
+		want:       "prefix_match cannot be used with cache_size for vindex table t",
+	}, {
+		vindexType: "lookup",
+		params:     map[string]string{"from": "fromc", "from_list": "csv"},
+		want:       "prefix_match cannot be used with from_list for vindex table t",
+	}, {
+		vindexType: "lookup",
+		params:     map[string]string{"from": "fromc", "full_scan_threshold": "10"},
+		want:       "prefix_match cannot be used with full_scan_threshold for vindex table t",
+	}, {
+		vindexType: "lookup_unique",
+		params:     map[string]string{"from": "fromc"},
+		want:       "prefix_match cannot be used with a unique lookup vindex, whose Map returns one keyspace id per id",
+	}, {
+		vindexType: "lookup_hash",
+		params:     map[string]string{"from": "fromc"},
+		want:       "unknown params for lookup vindex on table t: prefix_match",
+	}}
+	for _, tcase := range testcases {
+		params := map[string]string{
+			"table":        "t",
+			"to":           "toc",
+			"prefix_match": "true",
+		}
+		for k, v := range tcase.params {
+			params[k] = v
+		}
+		_, err := CreateVindex(tcase.vindexType, tcase.vindexType, params)
+		if err == nil || err.Error() != tcase.want {
+			t.Errorf("CreateVindex(%s, %v): %v, want %s", tcase.vindexType, tcase.params, err, tcase.want)
+		}
+	}
+}
+
+// viewQueryBuilder reads the mappings from a view, and
+// writes them to its base table.
+type viewQueryBuilder struct {
+	lookup string
+}
+
+func (b viewQueryBuilder) BuildQueries(table string, fromColumns []string, to string) (*LookupQueries, error) {
+	return &LookupQueries{
+		Lookup: b.lookup,
+		Verify: "select fromc from t_view where fromc = :fromc and toc = :toc",
+		Delete: "delete from t_base where fromc = :fromc and toc = :toc",
+		Insert: "insert into t_base(fromc, toc) values (:fromc, :toc)",
+	}, nil
+}
+
+func init() {
+	RegisterLookupQueryBuilder("test_view", viewQueryBuilder{lookup: "select toc from t_view where fromc = :fromc"})
+	RegisterLookupQueryBuilder("test_bad_bindvar", viewQueryBuilder{lookup: "select toc from t_view where fromc = :fromcol"})
+}
+
+func TestLookupQueryBuilder(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":         "t",
+		"from":          "fromc",
+		"to":            "toc",
+		"query_builder": "test_view",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{numRows: 1}
+	ln := lookupNonUnique.(*LookupNonUnique)
+	ids := []sqltypes.Value{sqltypes.NewInt64(1)}
+	ksids := [][]byte{[]byte("test1")}
+
+	if _, err := ln.Map(vc, ids); err != nil {
+		t.Error(err)
+	}
+	if _, err := ln.Verify(vc, ids, ksids); err != nil {
+		t.Error(err)
+	}
+	rows := [][]sqltypes.Value{{sqltypes.NewInt64(1)}, {sqltypes.NewInt64(2)}}
+	if err := ln.Create(vc, rows, [][]byte{[]byte("test1"), []byte("test2")}, false /* ignoreMode */); err != nil {
+		t.Error(err)
+	}
+	if err := ln.Delete(vc, rows[:1], ksids[0]); err != nil {
+		t.Error(err)
+	}
+	bindVars := func(from int64, to string) map[string]*querypb.BindVariable {
+		return map[string]*querypb.BindVariable{
+			"fromc": sqltypes.Int64BindVariable(from),
+			"toc":   sqltypes.BytesBindVariable([]byte(to)),
+		}
+	}
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: "select toc from t_view where fromc = :fromc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc": sqltypes.Int64BindVariable(1),
+		},
+	}, {
+		Sql:           "select fromc from t_view where fromc = :fromc and toc = :toc",
+		BindVariables: bindVars(1, "test1"),
+	}, {
+		Sql:           "insert into t_base(fromc, toc) values (:fromc, :toc)",
+		BindVariables: bindVars(1, "test1"),
+	}, {
+		Sql:           "insert into t_base(fromc, toc) values (:fromc, :toc)",
+		BindVariables: bindVars(2, "test2"),
+	}, {
+		Sql:           "delete from t_base where fromc = :fromc and toc = :toc",
+		BindVariables: bindVars(1, "test1"),
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("lookup queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	testcases := []struct {
+		params map[string]string
+		want   string
+	}{{
+		params: map[string]string{"query_builder": "test_bad_bindvar"},
+		want:   `query_builder test_bad_bindvar: Lookup query "select toc from t_view where fromc = :fromcol" does not reference :fromc`,
+	}, {
+		params: map[string]string{"query_builder": "test_missing"},
+		want:   `query_builder "test_missing" is not registered`,
+	}, {
+		params: map[string]string{"query_builder": "test_view", "shard_key_column": "sk"},
+		want:   "shard_key_column cannot be used with query_builder test_view",
+	}, {
+		params: map[string]string{"query_builder": "test_view", "source_pk_column": "pk"},
+		want:   "source_pk_column cannot be used with the insert query of query_builder test_view",
+	}}
+	for _, tcase := range testcases {
+		params := map[string]string{
+			"table": "t",
+			"from":  "fromc",
+			"to":    "toc",
+		}
+		for k, v := range tcase.params {
+			params[k] = v
+		}
+		_, err := CreateVindex("lookup", "lookup", params)
+		if err == nil || err.Error() != tcase.want {
+			t.Errorf("CreateVindex(%v): %v, want %s", tcase.params, err, tcase.want)
+		}
+	}
+}
+
+func TestReferencesBindVar(t *testing.T) {
+	testcases := []struct {
+		query string
+		want  bool
+	}{
+		{"select a from t where a = :a", true},
+		{"select a from t where a = :a1", false},
+		{"select a from t where a = :a1 or a = :a)", true},
+		{"select a from t where a = :b", false},
+	}
+	for _, tcase := range testcases {
+		if got := referencesBindVar(tcase.query, "a"); got != tcase.want {
+			t.Errorf("referencesBindVar(%q, a): %v, want %v", tcase.query, got, tcase.want)
+		}
+	}
+}
+
+func TestLookupOnVSchemaReload(t *testing.T) {
+	params := map[string]string{
+		"table":      "t",
+		"from":       "fromc",
+		"to":         "toc",
+		"cache_size": "10",
+	}
+	v, err := CreateVindex("lookup", "test_reload", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []sqltypes.Value{sqltypes.NewInt64(1)}
+	mapQueries := func() int {
+		t.Helper()
+		vc := &vcursor{numRows: 1}
+		if _, err := v.(NonUnique).Map(vc, ids); err != nil {
+			t.Fatal(err)
+		}
+		return len(vc.queries)
+	}
+	mapQueries()
+
+	// The first reload of a vindex invalidates its cache.
+	NotifyVSchemaReload(&VSchema{Keyspaces: map[string]*KeyspaceSchema{
+		"ks": {Vindexes: map[string]Vindex{"test_reload": v}},
+	}})
+	if got, want := mapQueries(), 1; got != want {
+		t.Errorf("Map queries after the first reload: %d, want %d", got, want)
+	}
+
+	// A reload with the same config does nothing.
+	if err := v.(VSchemaReloadHook).OnVSchemaReload(&vcursor{mustFail: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mapQueries(), 0; got != want {
+		t.Errorf("Map queries after an unchanged reload: %d, want %d", got, want)
+	}
+
+	// A vindex whose config changed is invalidated and revalidated.
+	params["cache_ttl"] = "1h"
+	if v, err = CreateVindex("lookup", "test_reload", params); err != nil {
+		t.Fatal(err)
+	}
+	mapQueries()
+	vc := &vcursor{mustFail: true}
+	err = v.(VSchemaReloadHook).OnVSchemaReload(vc)
+	if want := "lookup.SelfTest: execute failed"; err == nil || err.Error() != want {
+		t.Errorf("OnVSchemaReload(query fail): %v, want %s", err, want)
+	}
+	if got, want := mapQueries(), 1; got != want {
+		t.Errorf("Map queries after a changed reload: %d, want %d", got, want)
+	}
+	// The failed check is run again.
+	vc = &vcursor{}
+	if err := v.(VSchemaReloadHook).OnVSchemaReload(vc); err != nil {
+		t.Fatal(err)
+	}
+	if want := "select `fromc`, `toc` from `t` limit 1"; len(vc.queries) != 1 || vc.queries[0].Sql != want {
+		t.Errorf("OnVSchemaReload queries: %v, want %s", vc.queries, want)
+	}
+}
+
+func TestLookupCacheSetAtStaleGeneration(t *testing.T) {
+	c := newLookupCache("test_cache_set_at", 2, 0)
+	result := sqltypes.MakeTestResult(sqltypes.MakeTestFields("toc", "varbinary"), "ks1")
+
+	// A result read before a bump is not cached.
+	generation := c.currentGeneration()
+	c.bumpGeneration()
+	c.setAt("1", result, 0, generation)
+	if _, ok := c.Get("1"); ok {
+		t.Errorf("Get(1): found, want not cached")
+	}
+
+	c.setAt("1", result, 0, c.currentGeneration())
+	if _, ok := c.Get("1"); !ok {
+		t.Errorf("Get(1): not found, want cached")
+	}
+	// A bump of another cache doesn't affect this one.
+	newLookupCache("test_cache_set_at_other", 2, 0).bumpGeneration()
+	if _, ok := c.Get("1"); !ok {
+		t.Errorf("Get(1) after a bump of another cache: not found, want cached")
+	}
+}
+
+func TestVerifyReshard(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{"table": "t", "from": "fromc", "to": "toc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := sqltypes.MakeTestFields("fromc|toc", "int64|varbinary")
+	newVCursor := func() *pageVCursor {
+		return &pageVCursor{
+			pages: map[string][]*sqltypes.Result{
+				"t": {
+					sqltypes.MakeTestResult(fields, "1|\x10", "2|\x75"),
+					sqltypes.MakeTestResult(fields, "3|\x85", "4|\xa0"),
+					sqltypes.MakeTestResult(fields),
+				},
+			},
+		}
+	}
+	// -80 is split into -40 and 40-70, which leaves a gap,
+	// and 80-90 is a target without a source.
+	sources := []*topodatapb.KeyRange{{End: []byte{0x80}}}
+	targets := []*topodatapb.KeyRange{
+		{End: []byte{0x40}},
+		{Start: []byte{0x40}, End: []byte{0x70}},
+		{Start: []byte{0x80}, End: []byte{0x90}},
+	}
+
+	var got []string
+	err = VerifyReshard(newVCursor(), lookupNonUnique, sources, targets, 2, 0, func(m *ReshardMismatch) error {
+		got = append(got, m.String())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"from INT64(2): keyspace id 75 is in 0 target keyranges, want 1",
+		"from INT64(3): keyspace id 85 is in 1 target keyranges but in no source keyrange",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("VerifyReshard:\n%q, want\n%q", got, want)
+	}
+
+	got = nil
+	err = VerifyReshard(newVCursor(), lookupNonUnique, sources, targets, 2, 1, func(m *ReshardMismatch) error {
+		got = append(got, m.String())
+		return nil
+	})
+	wantErr := "lookup.VerifyReshard: stopped after 1 mismatches"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("VerifyReshard(max 1): %v, want %s", err, wantErr)
+	}
+	if !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("VerifyReshard(max 1):\n%q, want\n%q", got, want[:1])
+	}
+
+	toHash, err := CreateVindex("lookup", "to_hash", map[string]string{"table": "t", "from": "fromc", "to": "toc", "to_hash": "true", "write_only": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = VerifyReshard(newVCursor(), toHash, sources, targets, 2, 0, nil)
+	wantErr = "lookup.VerifyReshard: vindex to_hash has to_hash, its table doesn't have the keyspace ids"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("VerifyReshard(to_hash): %v, want %s", err, wantErr)
+	}
+}
+
+func TestSampleReportConfidenceInterval(t *testing.T) {
+	testcases := []struct {
+		sampled, inconsistent int
+		low, high             float64
+	}{{
+		sampled: 0,
+		low:     0,
+		high:    1,
+	}, {
+		sampled: 100,
+		low:     0,
+		high:    0.0370,
+	}, {
+		sampled:      100,
+		inconsistent: 10,
+		low:          0.0552,
+		high:         0.1744,
+	}, {
+		sampled:      10,
+		inconsistent: 10,
+		low:          0.7225,
+		high:         1,
+	}}
+	for _, tcase := range testcases {
+		r := &SampleReport{Sampled: tcase.sampled, Inconsistent: tcase.inconsistent}
+		low, high := r.ConfidenceInterval()
+		if math.Abs(low-tcase.low) > 1e-4 || math.Abs(high-tcase.high) > 1e-4 {
+			t.Errorf("ConfidenceInterval(%d of %d): %.4f-%.4f, want %.4f-%.4f", tcase.inconsistent, tcase.sampled, low, high, tcase.low, tcase.high)
+		}
+	}
+}
+
+func TestSampleVerify(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "test_sample_verify", map[string]string{
+		"table": "t",
+		"from":  "fromc",
+		"to":    "toc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fake vcursor returns these rows for the sample and for Map,
+	// which decodes the from values as keyspace ids, 1 and 2: the
+	// first row is consistent, but not the second one.
+	vc := &vcursor{result: &sqltypes.Result{
+		Rows: [][]sqltypes.Value{
+			{sqltypes.NewVarBinary("1"), sqltypes.NewVarBinary("1")},
+			{sqltypes.NewVarBinary("2"), sqltypes.NewVarBinary("3")},
+		},
+	}}
+	report, err := SampleVerify(vc, lookupNonUnique, 0.1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &SampleReport{
+		Vindex:       "test_sample_verify",
+		Rate:         0.1,
+		Sampled:      2,
+		Inconsistent: 1,
+		Examples:     []string{"from VARBINARY(\"2\"): keyspace id 33 is inconsistent"},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("SampleVerify(): %+v, want %+v", report, want)
+	}
+	wantQuery := &querypb.BoundQuery{
+		Sql: "select `fromc`, `toc` from `t` where rand() < :sample_rate",
+		BindVariables: map[string]*querypb.BindVariable{
+			"sample_rate": sqltypes.Float64BindVariable(0.1),
+		},
+	}
+	if !reflect.DeepEqual(vc.queries[0], wantQuery) {
+		t.Errorf("SampleVerify query: %v, want %v", vc.queries[0], wantQuery)
+	}
+	if got, want := lookupSampleInconsistencies.Counts()["test_sample_verify"], int64(1); got != want {
+		t.Errorf("VindexLookupSampleInconsistencies: %d, want %d", got, want)
+	}
+
+	// A custom check.
+	vc.queries = nil
+	report, err = SampleVerify(vc, lookupNonUnique, 1, func(from sqltypes.Value, ksid []byte) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Sampled != 2 || report.Inconsistent != 0 || len(vc.queries) != 1 {
+		t.Errorf("SampleVerify(custom check): %+v, %d queries, want 2 consistent rows and 1 query", report, len(vc.queries))
+	}
+
+	_, err = SampleVerify(vc, lookupNonUnique, 0, nil)
+	wantErr := "lookup.SampleVerify: sample rate must be in (0, 1]: 0"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("SampleVerify(0): %v, want %s", err, wantErr)
+	}
+	_, err = SampleVerify(vc, &stFU{name: "stfu"}, 0.1, nil)
+	wantErr = "lookup.SampleVerify: stfu is not a lookup vindex"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("SampleVerify(stfu): %v, want %s", err, wantErr)
+	}
+}
+
+func TestRunSampleVerify(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "test_run_sample_verify", map[string]string{
+		"table": "t",
+		"from":  "fromc",
+		"to":    "toc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	reports := make(chan *SampleReport)
+	done := make(chan struct{})
+	go func() {
+		RunSampleVerify(ctx, &vcursor{}, lookupNonUnique, 0.5, time.Millisecond, nil, func(report *SampleReport, err error) {
+			if err != nil {
+				t.Error(err)
+			}
+			select {
+			case reports <- report:
+			case <-ctx.Done():
+			}
+		})
+		close(done)
+	}()
+	for i := 0; i < 2; i++ {
+		if report := <-reports; report.Sampled != 0 {
+			t.Errorf("report %d: %+v, want no sampled row", i, report)
+		}
+	}
+	cancel()
+	<-done
+}
+
+func createLookupScoped(t *testing.T) Vindex {
+	t.Helper()
+	ls, err := CreateVindex("lookup_scoped", "lookup_scoped", map[string]string{
+		"table":        "t",
+		"from":         "fromc",
+		"to":           "toc",
+		"scope_vindex": "hash",
+		"scope_column": "scopec",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ls
+}
+
+func TestLookupScopedMap(t *testing.T) {
+	ls := createLookupScoped(t)
+	if got, want := ls.Cost(), 21; got != want {
+		t.Errorf("Cost(): %d, want %d", got, want)
+	}
+	vc := &vcursor{numRows: 2}
+	got, err := ls.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1), sqltypes.NULL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Ksids{{IDs: [][]byte{[]byte("1"), []byte("2")}}, {}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Map(): %+v, want %+v", got, want)
+	}
+	wantQueries := []*querypb.BoundQuery{{
+		Sql: "select `toc` from `t` where `scopec` = :scopec and `fromc` = :fromc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"scopec": sqltypes.BytesBindVariable([]byte("\x16\x6b\x40\xb4\x4a\xba\x4b\xd6")),
+			"fromc":  sqltypes.Int64BindVariable(1),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantQueries) {
+		t.Errorf("Map queries:\n%v, want\n%v", vc.queries, wantQueries)
+	}
+
+	vc = &vcursor{numRows: 1}
+	verified, err := ls.Verify(vc, []sqltypes.Value{sqltypes.NewInt64(1), sqltypes.NULL}, [][]byte{[]byte("test1"), []byte("test2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []bool{true, false}; !reflect.DeepEqual(verified, want) {
+		t.Errorf("Verify(): %v, want %v", verified, want)
+	}
+	wantQueries = []*querypb.BoundQuery{{
+		Sql: "select `fromc` from `t` where `scopec` = :scopec and `fromc` = :fromc and `toc` = :toc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"scopec": sqltypes.BytesBindVariable([]byte("\x16\x6b\x40\xb4\x4a\xba\x4b\xd6")),
+			"fromc":  sqltypes.Int64BindVariable(1),
+			"toc":    sqltypes.BytesBindVariable([]byte("test1")),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantQueries) {
+		t.Errorf("Verify queries:\n%v, want\n%v", vc.queries, wantQueries)
+	}
+}
+
+func TestLookupScopedCreateDelete(t *testing.T) {
+	ls := createLookupScoped(t)
+	vc := &vcursor{}
+	if err := ls.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test1")}, false /* ignoreMode */); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.(Lookup).Delete(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, []byte("test1")); err != nil {
+		t.Fatal(err)
+	}
+	scope := sqltypes.BytesBindVariable([]byte("\x16\x6b\x40\xb4\x4a\xba\x4b\xd6"))
+	wantQueries := []*querypb.BoundQuery{{
+		Sql: "insert into `t`(`fromc`, `scopec`, `toc`) values(:fromc0, :scopec0, :toc0)",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc0":  sqltypes.Int64BindVariable(1),
+			"scopec0": scope,
+			"toc0":    sqltypes.BytesBindVariable([]byte("test1")),
+		},
+	}, {
+		Sql: "delete from `t` where `fromc` = :fromc and `scopec` = :scopec and `toc` = :toc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc":  sqltypes.Int64BindVariable(1),
+			"scopec": scope,
+			"toc":    sqltypes.BytesBindVariable([]byte("test1")),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantQueries) {
+		t.Errorf("Create and Delete queries:\n%v, want\n%v", vc.queries, wantQueries)
+	}
+
+	err := ls.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NULL}}, [][]byte{[]byte("test1")}, false /* ignoreMode */)
+	want := "lookup.Create: scope_vindex lookup_scoped_scope has no keyspace id for NULL"
+	if err == nil || err.Error() != want {
+		t.Errorf("Create(NULL): %v, want %s", err, want)
+	}
+}
+
+func TestLookupScopedNew(t *testing.T) {
+	testcases := []struct {
+		params map[string]string
+		want   string
+	}{{
+		params: map[string]string{"scope_vindex": "hash"},
+		want:   "lookup_scoped requires scope_vindex and scope_column",
+	}, {
+		params: map[string]string{"scope_vindex": "hash", "scope_column": "scopec", "cache_size": "10"},
+		want:   "lookup_scoped does not support param cache_size",
+	}, {
+		params: map[string]string{"scope_vindex": "hash", "scope_column": "scopec", "from": "fromc,fromd"},
+		want:   "lookup_scoped only supports a single from column: fromc,fromd",
+	}, {
+		params: map[string]string{"scope_vindex": "unknown", "scope_column": "scopec"},
+		want:   "scope_vindex unknown: vindexType \"unknown\" not found",
+	}, {
+		params: map[string]string{
+			"scope_vindex":       "lookup",
+			"scope_column":       "scopec",
+			"scope_vindex.table": "t2",
+			"scope_vindex.from":  "fromc",
+			"scope_vindex.to":    "toc",
+		},
+		want: "scope_vindex lookup is not a unique vindex",
+	}}
+	for _, tcase := range testcases {
+		params := map[string]string{
+			"table": "t",
+			"from":  "fromc",
+			"to":    "toc",
+		}
+		for k, v := range tcase.params {
+			params[k] = v
+		}
+		_, err := CreateVindex("lookup_scoped", "lookup_scoped", params)
+		if err == nil || err.Error() != tcase.want {
+			t.Errorf("CreateVindex(%v): %v, want %s", tcase.params, err, tcase.want)
+		}
+	}
+}
+
+func TestLookupSelfTest(t *testing.T) {
+	lookupNonUnique := createLookup(t, "lookup", false)
+	vc := &vcursor{}
+	if err := lookupNonUnique.(SelfTester).SelfTest(vc); err != nil {
+		t.Error(err)
+	}
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: "select `fromc`, `toc` from `t` limit 1",
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("SelfTest queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	vc.mustFail = true
+	err := lookupNonUnique.(SelfTester).SelfTest(vc)
+	want := "lookup.SelfTest: execute failed"
+	if err == nil || err.Error() != want {
+		t.Errorf("SelfTest(query fail): %v, want %s", err, want)
+	}
+
+	lookupHashUnique, err := CreateVindex("lookup_hash_unique", "lookup", map[string]string{
+		"table":        "t",
+		"from":         "fromc",
+		"to":           "toc",
+		"self_test_id": "-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc = &vcursor{numRows: 1}
+	if err := lookupHashUnique.(SelfTester).SelfTest(vc); err != nil {
+		t.Error(err)
+	}
+	v, err := vunhash(selfTestKsid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toc := sqltypes.Uint64BindVariable(v)
+	wantqueries = []*querypb.BoundQuery{{
+		Sql: "select `fromc`, `toc` from `t` limit 1",
+	}, {
+		Sql: "insert into `t`(`fromc`, `toc`) values(:fromc0, :toc0)",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc0": sqltypes.Int64BindVariable(-1),
+			"toc0":   toc,
+		},
+	}, {
+		Sql: "select `fromc` from `t` where `fromc` = :fromc and `toc` = :toc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc": sqltypes.Int64BindVariable(-1),
+			"toc":   toc,
+		},
+	}, {
+		Sql: "delete from `t` where `fromc` = :fromc and `toc` = :toc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc": sqltypes.Int64BindVariable(-1),
+			"toc":   toc,
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("SelfTest queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	// The entry must be deleted even if it's not found.
+	vc = &vcursor{}
+	err = lookupHashUnique.(SelfTester).SelfTest(vc)
+	want = "lookup.SelfTest: entry for -1 not found after it was created"
+	if err == nil || err.Error() != want {
+		t.Errorf("SelfTest(not found): %v, want %s", err, want)
+	}
+	if got := len(vc.queries); got != 4 {
+		t.Errorf("SelfTest(not found) queries: %v, want 4", vc.queries)
+	}
+
+	_, err = CreateVindex("lookup", "lookup", map[string]string{
+		"table":        "t",
+		"from":         "fromc",
+		"to":           "toc",
+		"autocommit":   "true",
+		"self_test_id": "-1",
+	})
+	want = "self_test_id cannot be used with autocommit for vindex table t"
+	if err == nil || err.Error() != want {
+		t.Errorf("Create(autocommit): %v, want %s", err, want)
+	}
+}
+
+func TestLookupSelfTestReport(t *testing.T) {
+	lookupHashUnique, err := CreateVindex("lookup_hash_unique", "lookup", map[string]string{
+		"table":           "t",
+		"from":            "fromc",
+		"to":              "toc",
+		"self_test_id":    "-1",
+		"collation_check": "warn",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter := lookupHashUnique.(SelfTestReporter)
+
+	// The table has no rows, no index and no columns in
+	// information_schema: all the checks after the read fail.
+	vc := &vcursor{}
+	report := reporter.SelfTestReport(vc)
+	want := []SelfTestCheck{{
+		Name:   "read",
+		Status: SelfTestPassed,
+	}, {
+		Name:   "index",
+		Status: SelfTestFailed,
+		Detail: "lookup.ValidateIndex: table t not found or has no index",
+	}, {
+		Name:   "collation",
+		Status: SelfTestFailed,
+		Detail: "lookup.ValidateCollation: table t not found or has no column fromc",
+	}, {
+		Name:   "write",
+		Status: SelfTestFailed,
+		Detail: "lookup.SelfTest: entry for -1 not found after it was created",
+	}}
+	if !reflect.DeepEqual(report.Checks, want) {
+		t.Errorf("SelfTestReport:\n%+v, want\n%+v", report.Checks, want)
+	}
+	wantErr := "lookup.SelfTest: 3 of 4 checks failed for vindex lookup: index: " + want[1].Detail + "; collation: " + want[2].Detail + "; write: " + want[3].Detail
+	if err := report.Err(); err == nil || err.Error() != wantErr {
+		t.Errorf("SelfTestReport.Err():\n%v, want\n%s", err, wantErr)
+	}
+
+	// A collation mismatch only warns unless collation_check is error,
+	// and the write check is skipped without self_test_id. The index
+	// check gets the result of the collation query from the fake, and
+	// fails.
+	lookupNonUnique := createLookup(t, "lookup", false)
+	fields := sqltypes.MakeTestFields("column_name|collation_name", "varchar|varchar")
+	vc = &vcursor{result: sqltypes.MakeTestResult(fields, "fromc|utf8_general_ci")}
+	report = lookupNonUnique.(SelfTestReporter).SelfTestReport(vc)
+	statuses := make(map[string]SelfTestStatus)
+	for _, check := range report.Checks {
+		statuses[check.Name] = check.Status
+	}
+	wantStatuses := map[string]SelfTestStatus{
+		"read":      SelfTestPassed,
+		"index":     SelfTestFailed,
+		"collation": SelfTestWarned,
+		"write":     SelfTestSkipped,
+	}
+	if !reflect.DeepEqual(statuses, wantStatuses) {
+		t.Errorf("SelfTestReport statuses: %v, want %v", statuses, wantStatuses)
+	}
+	wantErr = "lookup.SelfTest: 1 of 4 checks failed for vindex lookup: index: lookup.ValidateIndex: got 2 columns from information_schema, want 3"
+	if err := report.Err(); err == nil || err.Error() != wantErr {
+		t.Errorf("SelfTestReport.Err(): %v, want %s", err, wantErr)
+	}
+}
+
+func TestLookupTimestampColumns(t *testing.T) {
+	for _, tcase := range []struct {
+		vindexType string
+		params     map[string]string
+		want       string
+	}{{
+		vindexType: "lookup",
+		params:     map[string]string{"created_at_column": "created", "updated_at_column": "updated"},
+		want:       "insert into `t`(`fromc`, `created`, `updated`, `toc`) values(:fromc0, now(), now(), :toc0), (:fromc1, now(), now(), :toc1)",
+	}, {
+		vindexType: "lookup",
+		params:     map[string]string{"created_at_column": "created", "updated_at_column": "updated", "autocommit": "true"},
+		want: "insert into `t`(`fromc`, `created`, `updated`, `toc`) values(:fromc0, now(), now(), :toc0), (:fromc1, now(), now(), :toc1) " +
+			"on duplicate key update `fromc`=values(`fromc`), `updated`=now(), `toc`=values(`toc`)",
+	}, {
+		vindexType: "lookup",
+		params:     map[string]string{"updated_at_column": "updated", "autocommit": "true", "upsert_only_changed": "true"},
+		want: "insert into `t`(`fromc`, `updated`, `toc`) values(:fromc0, now(), :toc0), (:fromc1, now(), :toc1) " +
+			"on duplicate key update `fromc`=if(`toc` <=> values(`toc`), `fromc`, values(`fromc`)), `updated`=if(`toc` <=> values(`toc`), `updated`, now()), `toc`=values(`toc`)",
+	}, {
+		vindexType: "lookup_unique",
+		params:     map[string]string{"created_at_column": "created"},
+		want:       "insert into `t`(`fromc`, `created`, `toc`) values(:fromc0, now(), :toc0), (:fromc1, now(), :toc1)",
+	}, {
+		vindexType: "lookup_hash",
+		params:     map[string]string{"updated_at_column": "updated"},
+		want:       "insert into `t`(`fromc`, `updated`, `toc`) values(:fromc0, now(), :toc0), (:fromc1, now(), :toc1)",
+	}} {
+		params := map[string]string{"table": "t", "from": "fromc", "to": "toc"}
+		for k, v := range tcase.params {
+			params[k] = v
+		}
+		v, err := CreateVindex(tcase.vindexType, "lookup", params)
+		if err != nil {
+			t.Fatalf("CreateVindex(%s, %v): %v", tcase.vindexType, tcase.params, err)
+		}
+		vc := &vcursor{}
+		rows := [][]sqltypes.Value{{sqltypes.NewInt64(1)}, {sqltypes.NewInt64(2)}}
+		ksids := [][]byte{[]byte("\x16k@\xb4J\xbaK\xd6"), []byte("\x16k@\xb4J\xbaK\xd6")}
+		if err := v.(Lookup).Create(vc, rows, ksids, false /* ignoreMode */); err != nil {
+			t.Fatalf("Create(%s, %v): %v", tcase.vindexType, tcase.params, err)
+		}
+		if len(vc.queries) != 1 || vc.queries[0].Sql != tcase.want {
+			t.Errorf("Create(%s, %v) queries:\n%v, want\n%s", tcase.vindexType, tcase.params, vc.queries, tcase.want)
+		}
+		// The timestamps are not part of the mapping.
+		if _, ok := vc.queries[0].BindVariables["created0"]; ok {
+			t.Errorf("Create(%s, %v): created_at_column is bound", tcase.vindexType, tcase.params)
+		}
+	}
+
+	for _, tcase := range []struct {
+		params map[string]string
+		want   string
+	}{{
+		params: map[string]string{"created_at_column": "toc"},
+		want:   "created_at_column toc is already used by another column of vindex table t",
+	}, {
+		params: map[string]string{"source_pk_column": "pk", "updated_at_column": "pk"},
+		want:   "updated_at_column pk is already used by another column of vindex table t",
+	}, {
+		params: map[string]string{"created_at_column": "ts", "updated_at_column": "ts"},
+		want:   "updated_at_column ts is already used by another column of vindex table t",
+	}, {
+		params: map[string]string{"query_builder": "test_view", "created_at_column": "created"},
+		want:   "created_at_column cannot be used with the insert query of query_builder test_view",
+	}} {
+		params := map[string]string{"table": "t", "from": "fromc", "to": "toc"}
+		for k, v := range tcase.params {
+			params[k] = v
+		}
+		_, err := CreateVindex("lookup", "lookup", params)
+		if err == nil || err.Error() != tcase.want {
+			t.Errorf("CreateVindex(%v): %v, want %s", tcase.params, err, tcase.want)
+		}
+	}
+}
+
+func TestLookupValidateCreate(t *testing.T) {
+	lookupUnique, err := CreateVindex("lookup_unique", "lookup_unique", map[string]string{
+		"table": "t",
+		"from":  "fromc",
+		"to":    "toc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator := lookupUnique.(CreateValidator)
+
+	rows := [][]sqltypes.Value{
+		{sqltypes.NewInt64(1)},
+		{sqltypes.NewInt64(2), sqltypes.NewInt64(3)},
+		{sqltypes.NULL},
+		{sqltypes.NewInt64(4)},
+		{sqltypes.NewInt64(1)},
+		{sqltypes.NewInt64(1)},
+	}
+	ksids := [][]byte{[]byte("a"), []byte("b"), []byte("c"), nil, []byte("a"), []byte("d")}
+	err = validator.ValidateCreate(rows, ksids)
+	e, ok := err.(*InvalidRowsError)
+	if !ok {
+		t.Fatalf("ValidateCreate: %v, want *InvalidRowsError", err)
+	}
+	if want := []int{1, 2, 3, 5}; !reflect.DeepEqual(e.Rows, want) {
+		t.Errorf("invalid rows: %v, want %v", e.Rows, want)
+	}
+	want := "lookup.ValidateCreate: 4 of 6 rows are invalid for vindex lookup_unique: " +
+		"row 1: got 2 from values, want 1; row 2: from value of fromc is NULL; row 3: empty keyspace id; " +
+		"row 5: from values [INT64(1)] are also in row 0, with a different keyspace id"
+	if err.Error() != want {
+		t.Errorf("ValidateCreate:\n%v, want\n%s", err, want)
+	}
+
+	if err := validator.ValidateCreate(rows[:1], ksids[:1]); err != nil {
+		t.Errorf("ValidateCreate(valid): %v", err)
+	}
+	err = validator.ValidateCreate(rows, ksids[:1])
+	want = "lookup.ValidateCreate: got 1 keyspace ids for 6 rows"
+	if err == nil || err.Error() != want {
+		t.Errorf("ValidateCreate(mismatch): %v, want %s", err, want)
+	}
+
+	// A non-unique vindex accepts duplicates, and a from_list is parsed.
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":     "t",
+		"from":      "fromc",
+		"to":        "toc",
+		"from_list": "json",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows = [][]sqltypes.Value{{sqltypes.NewVarChar("[1, 2]")}, {sqltypes.NewVarChar("[1")}, {sqltypes.NewVarChar("[2]")}}
+	ksids = [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	err = lookupNonUnique.(CreateValidator).ValidateCreate(rows, ksids)
+	if e, ok := err.(*InvalidRowsError); !ok || !reflect.DeepEqual(e.Rows, []int{1}) {
+		t.Errorf("ValidateCreate(from_list): %v, want row 1 invalid", err)
+	}
+
+	// The keyspace ids of a lookup_hash vindex must be unhashable.
+	lookupHash, err := CreateVindex("lookup_hash", "lookup_hash", map[string]string{
+		"table": "t",
+		"from":  "fromc",
+		"to":    "toc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lookupHash.(CreateValidator).ValidateCreate([][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("ab")})
+	want = "lookup.ValidateCreate: 1 of 1 rows are invalid for vindex lookup_hash: row 0: invalid keyspace id: 6162"
+	if err == nil || err.Error() != want {
+		t.Errorf("ValidateCreate(lookup_hash): %v, want %s", err, want)
+	}
+}
+
+func TestInvalidRowsErrorTruncated(t *testing.T) {
+	e := &InvalidRowsError{Vindex: "v", NumRows: 20}
+	for i := 0; i < 12; i++ {
+		e.Rows = append(e.Rows, i)
+		e.Problems = append(e.Problems, "bad")
+	}
+	want := "lookup.ValidateCreate: 12 of 20 rows are invalid for vindex v: row 0: bad; row 1: bad; row 2: bad; row 3: bad; " +
+		"row 4: bad; row 5: bad; row 6: bad; row 7: bad; row 8: bad; row 9: bad; and 2 more"
+	if got := e.Error(); got != want {
+		t.Errorf("Error:\n%s, want\n%s", got, want)
+	}
+}
+
+func TestPooledKsidsToValues(t *testing.T) {
+	ksids := [][]byte{[]byte("a"), []byte("b")}
+	values := pooledKsidsToValues(rawKsidCodec{}, ksids)
+	if got, want := *values, ksidsToValues(rawKsidCodec{}, ksids); !reflect.DeepEqual(got, want) {
+		t.Errorf("pooledKsidsToValues(): %v, want %v", got, want)
+	}
+	putValues(values)
+	if len(*values) != 0 || (*values)[:2][0].Raw() != nil {
+		t.Errorf("putValues did not reset the slice: %v", (*values)[:2])
+	}
+
+	// The pooled slices don't change the result of Verify, including
+	// when it fails.
+	lookupNonUnique := createLookup(t, "lookup", false)
+	for i := 0; i < 2; i++ {
+		got, err := lookupNonUnique.Verify(&vcursor{numRows: 1}, []sqltypes.Value{sqltypes.NewInt64(1)}, [][]byte{[]byte("test")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []bool{true}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Verify(): %v, want %v", got, want)
+		}
+		if _, err := lookupNonUnique.Verify(&vcursor{mustFail: true}, []sqltypes.Value{sqltypes.NewInt64(1)}, [][]byte{[]byte("test")}); err == nil {
+			t.Error("Verify(): nil error")
+		}
+	}
+}
+
+var benchKsids = [][]byte{
+	[]byte("\x16k@\xb4J\xbaK\xd6"),
+	[]byte("\x06\xe7\xea\"Βp\x8f"),
+	[]byte("N\xb1\x90ɢ\xfa\x16\x9c"),
+	[]byte("\xd2\xfd\x88g\xd5\r-\xfe"),
+}
+
+// BenchmarkKsidsToValues and BenchmarkPooledKsidsToValues compare the
+// allocations of the to values of a Verify of 4 keyspace ids. On a
+// linux/amd64 machine, before and after:
+//
+//	BenchmarkKsidsToValues        75.09 ns/op  128 B/op  1 allocs/op
+//	BenchmarkPooledKsidsToValues  41.92 ns/op    0 B/op  0 allocs/op
+func BenchmarkKsidsToValues(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ksidsToValues(rawKsidCodec{}, benchKsids)
+	}
+}
+
+func BenchmarkPooledKsidsToValues(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		putValues(pooledKsidsToValues(rawKsidCodec{}, benchKsids))
+	}
+}
+
+// toVCursor is a VCursor whose Verify queries find a row only for the
+// to values of mapped.
+type toVCursor struct {
+	vcursor
+	mapped map[string]bool
+}
+
+func (vc *toVCursor) Execute(method string, query string, bindvars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error) {
+	vc.numRows = 0
+	if bv, ok := bindvars["toc"]; ok && vc.mapped[string(bv.Value)] {
+		vc.numRows = 1
+	}
+	return vc.execute(method, query, bindvars, isDML)
+}
+
+func TestLookupNonUniqueVerifyAny(t *testing.T) {
+	verifier := createLookup(t, "lookup", false).(AnyVerifier)
+	ids := []sqltypes.Value{sqltypes.NewInt64(1), sqltypes.NewInt64(2), sqltypes.NewInt64(3)}
+	ksids := [][][]byte{
+		{[]byte("old"), []byte("new")},
+		{[]byte("new"), []byte("old")},
+		{[]byte("other")},
+	}
+
+	vc := &toVCursor{mapped: map[string]bool{"new": true}}
+	got, err := verifier.VerifyAny(vc, ids, ksids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []bool{true, true, false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("VerifyAny: %v, want %v", got, want)
+	}
+	// The second id matches its first keyspace id, and doesn't try the other.
+	if got, want := len(vc.queries), 4; got != want {
+		t.Errorf("VerifyAny queries: %d, want %d", got, want)
+	}
+
+	got, err = verifier.VerifyAny(&toVCursor{}, ids[:1], [][][]byte{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []bool{false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("VerifyAny(empty set): %v, want %v", got, want)
+	}
+
+	_, err = verifier.VerifyAny(&toVCursor{vcursor: vcursor{mustFail: true}}, ids, ksids)
+	if want := "lookup.Verify: execute failed"; err == nil || err.Error() != want {
+		t.Errorf("VerifyAny(query fail): %v, want %s", err, want)
+	}
+
+	_, err = verifier.VerifyAny(&toVCursor{}, ids, ksids[:1])
+	if want := "lookup.Verify: got 1 keyspace id sets for 3 ids"; err == nil || err.Error() != want {
+		t.Errorf("VerifyAny(mismatch): %v, want %s", err, want)
+	}
+
+	// A write_only vindex verifies the ids without a query.
+	vc = &toVCursor{}
+	got, err = createLookup(t, "lookup", true).(AnyVerifier).VerifyAny(vc, ids, ksids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []bool{true, true, true}; !reflect.DeepEqual(got, want) || len(vc.queries) != 0 {
+		t.Errorf("VerifyAny(write_only): %v with %d queries, want %v with 0", got, len(vc.queries), want)
+	}
+}
+
+func TestLookupNonUniqueVerifyStream(t *testing.T) {
+	lookupNonUnique := createLookup(t, "lookup", false)
+	verifier := lookupNonUnique.(StreamVerifier)
+	ids := []sqltypes.Value{sqltypes.NewInt64(1), sqltypes.NewInt64(2), sqltypes.NewInt64(3)}
+	ksids := [][]byte{[]byte("test1"), []byte("test2"), []byte("test3")}
+
+	vc := &vcursor{numRows: 1}
+	var got []int
+	err := verifier.VerifyStream(vc, ids, ksids, func(i int, ok bool) error {
+		if !ok {
+			t.Errorf("VerifyStream: id %d not verified", i)
+		}
+		got = append(got, i)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{0, 1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("VerifyStream indexes: %v, want %v", got, want)
+	}
+	if got, want := len(vc.queries), 3; got != want {
+		t.Errorf("VerifyStream queries: %d, want %d", got, want)
+	}
+
+	// An error of the callback stops the stream.
+	vc = &vcursor{}
+	wantErr := errors.New("stop")
+	err = verifier.VerifyStream(vc, ids, ksids, func(i int, ok bool) error {
+		if ok {
+			t.Errorf("VerifyStream: id %d verified", i)
+		}
+		return wantErr
+	})
+	if err != wantErr {
+		t.Errorf("VerifyStream(callback error): %v, want %v", err, wantErr)
+	}
+	if got, want := len(vc.queries), 1; got != want {
+		t.Errorf("VerifyStream(callback error) queries: %d, want %d", got, want)
+	}
+
+	vc = &vcursor{mustFail: true}
+	err = verifier.VerifyStream(vc, ids, ksids, func(int, bool) error { return nil })
+	if want := "lookup.Verify: execute failed"; err == nil || err.Error() != want {
+		t.Errorf("VerifyStream(query fail): %v, want %s", err, want)
+	}
+
+	err = verifier.VerifyStream(vc, ids, ksids[:1], func(int, bool) error { return nil })
+	if want := "lookup.Verify: got 1 keyspace ids for 3 ids"; err == nil || err.Error() != want {
+		t.Errorf("VerifyStream(mismatch): %v, want %s", err, want)
+	}
+
+	// A write_only vindex verifies the ids without a query.
+	vc = &vcursor{}
+	var verified int
+	err = createLookup(t, "lookup", true).(StreamVerifier).VerifyStream(vc, ids, ksids, func(i int, ok bool) error {
+		if ok {
+			verified++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified != 3 || len(vc.queries) != 0 {
+		t.Errorf("VerifyStream(write_only): %d verified with %d queries, want 3 with 0", verified, len(vc.queries))
+	}
 }
@@ -0,0 +1,64 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import "fmt"
+
+// initTimestampColumns initializes CreatedAtColumn and UpdatedAtColumn
+// from the created_at_column and updated_at_column params. customInsert
+// is true if the query builder has its own insert query, which cannot
+// set them.
+func (lkp *lookupInternal) initTimestampColumns(lookupQueryParams map[string]string, customInsert bool) error {
+	lkp.CreatedAtColumn = lookupQueryParams["created_at_column"]
+	lkp.UpdatedAtColumn = lookupQueryParams["updated_at_column"]
+	used := map[string]bool{lkp.To: true}
+	for _, col := range lkp.FromColumns {
+		used[col] = true
+	}
+	for _, col := range []string{lkp.SourcePKColumn, lkp.ShardKeyColumn, lkp.TTLColumn} {
+		if col != "" {
+			used[col] = true
+		}
+	}
+	for _, param := range []string{"created_at_column", "updated_at_column"} {
+		col := lookupQueryParams[param]
+		if col == "" {
+			continue
+		}
+		if customInsert {
+			return fmt.Errorf("%s cannot be used with the insert query of query_builder %s", param, lkp.QueryBuilder)
+		}
+		if used[col] {
+			return fmt.Errorf("%s %s is already used by another column of vindex table %s", param, col, lkp.Table)
+		}
+		used[col] = true
+	}
+	return nil
+}
+
+// timestampColumns returns the columns that Create sets to NOW(), in
+// the order of the insert.
+func (lkp *lookupInternal) timestampColumns() []string {
+	var cols []string
+	if lkp.CreatedAtColumn != "" {
+		cols = append(cols, lkp.CreatedAtColumn)
+	}
+	if lkp.UpdatedAtColumn != "" {
+		cols = append(cols, lkp.UpdatedAtColumn)
+	}
+	return cols
+}
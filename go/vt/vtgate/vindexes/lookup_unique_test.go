@@ -22,6 +22,7 @@ import (
 	"testing"
 
 	"github.com/youtube/vitess/go/sqltypes"
+
 	querypb "github.com/youtube/vitess/go/vt/proto/query"
 )
 
@@ -108,6 +109,93 @@ func TestLookupUniqueMap(t *testing.T) {
 	vc.mustFail = false
 }
 
+func TestLookupUniqueMapOnMissing(t *testing.T) {
+	lookupUnique, err := CreateVindex("lookup_unique", "lookup_unique", map[string]string{
+		"table":      "t",
+		"from":       "fromc",
+		"to":         "toc",
+		"on_missing": "error",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{numRows: 1}
+	got, err := lookupUnique.(Unique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1)})
+	if err != nil {
+		t.Error(err)
+	}
+	want := [][]byte{[]byte("1")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Map(): %#v, want %+v", got, want)
+	}
+
+	vc.numRows = 0
+	_, err = lookupUnique.(Unique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1)})
+	nferr, ok := err.(*NotFoundError)
+	if !ok {
+		t.Fatalf("Map(missing) err: %v, want *NotFoundError", err)
+	}
+	if !reflect.DeepEqual(nferr.ID, sqltypes.NewInt64(1)) {
+		t.Errorf("NotFoundError.ID: %v, want 1", nferr.ID)
+	}
+	wantErr := "lookup.Map: no mapping found in vindex lookup_unique for id INT64(1)"
+	if err.Error() != wantErr {
+		t.Errorf("Map(missing) err: %v, want %s", err, wantErr)
+	}
+
+	_, err = CreateVindex("lookup_unique", "lookup_unique", map[string]string{
+		"table":      "t",
+		"from":       "fromc",
+		"to":         "toc",
+		"on_missing": "panic",
+	})
+	wantErr = "on_missing value must be 'null' or 'error': 'panic'"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("Create(bad on_missing): %v, want %s", err, wantErr)
+	}
+}
+
+func TestLookupUniqueMapAllowMulti(t *testing.T) {
+	lookupUnique, err := CreateVindex("lookup_unique", "lookup_unique", map[string]string{
+		"table":       "t",
+		"from":        "fromc",
+		"to":          "toc",
+		"allow_multi": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{numRows: 2}
+
+	got, err := lookupUnique.(Unique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1)})
+	if err != nil {
+		t.Error(err)
+	}
+	want := [][]byte{[]byte("1")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Map(): %+v, want %+v", got, want)
+	}
+
+	gotMulti, err := lookupUnique.(*LookupUnique).MapMulti(vc, []sqltypes.Value{sqltypes.NewInt64(1)})
+	if err != nil {
+		t.Error(err)
+	}
+	wantMulti := []Ksids{{IDs: [][]byte{[]byte("1"), []byte("2")}}}
+	if !reflect.DeepEqual(gotMulti, wantMulti) {
+		t.Errorf("MapMulti(): %+v, want %+v", gotMulti, wantMulti)
+	}
+
+	vc.numRows = 0
+	gotMulti, err = lookupUnique.(*LookupUnique).MapMulti(vc, []sqltypes.Value{sqltypes.NewInt64(1)})
+	if err != nil {
+		t.Error(err)
+	}
+	wantMulti = []Ksids{{}}
+	if !reflect.DeepEqual(gotMulti, wantMulti) {
+		t.Errorf("MapMulti(): %+v, want %+v", gotMulti, wantMulti)
+	}
+}
+
 func TestLookupUniqueVerify(t *testing.T) {
 	lookupUnique := createLookup(t, "lookup_unique", false)
 	vc := &vcursor{numRows: 1}
@@ -121,6 +209,65 @@ func TestLookupUniqueVerify(t *testing.T) {
 	}
 }
 
+func TestLookupUniqueVerifyStrict(t *testing.T) {
+	lookupUnique, err := CreateVindex("lookup_unique", "lookup_unique", map[string]string{
+		"table":                "t",
+		"from":                 "fromc",
+		"to":                   "toc",
+		"strict_unique_verify": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := &vcursor{
+		result: sqltypes.MakeTestResult(sqltypes.MakeTestFields("toc", "varbinary"), "test1"),
+	}
+
+	got, err := lookupUnique.Verify(vc, []sqltypes.Value{sqltypes.NewInt64(1), sqltypes.NewInt64(2)}, [][]byte{[]byte("test1"), []byte("test2")})
+	if err != nil {
+		t.Error(err)
+	}
+	if want := []bool{true, false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Verify(): %v, want %v", got, want)
+	}
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: "select `toc` from `t` where `fromc` = :fromc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc": sqltypes.Int64BindVariable(1),
+		},
+	}, {
+		Sql: "select `toc` from `t` where `fromc` = :fromc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc": sqltypes.Int64BindVariable(2),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("lookup.Verify queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	vc.result = sqltypes.MakeTestResult(sqltypes.MakeTestFields("toc", "varbinary"), "test1", "test2")
+	_, err = lookupUnique.Verify(vc, []sqltypes.Value{sqltypes.NewInt64(1)}, [][]byte{[]byte("test1")})
+	want := "lookup.Verify: 2 mappings found in vindex lookup_unique for id INT64(1), want 1"
+	if err == nil || err.Error() != want {
+		t.Errorf("Verify(duplicate): %v, want %s", err, want)
+	}
+	if _, ok := err.(*DuplicateMappingError); !ok {
+		t.Errorf("Verify(duplicate): %T, want *DuplicateMappingError", err)
+	}
+
+	_, err = CreateVindex("lookup_unique", "lookup_unique", map[string]string{
+		"table":                "t",
+		"from":                 "fromc",
+		"to":                   "toc",
+		"strict_unique_verify": "true",
+		"from_list":            "csv",
+	})
+	want = "strict_unique_verify cannot be used with from_list"
+	if err == nil || err.Error() != want {
+		t.Errorf("Create(strict_from_list): %v, want %s", err, want)
+	}
+}
+
 func TestLookupUniqueCreate(t *testing.T) {
 	lookupUnique, err := CreateVindex("lookup_unique", "lookup_unique", map[string]string{
 		"table":      "t",
@@ -139,7 +286,7 @@ func TestLookupUniqueCreate(t *testing.T) {
 	}
 
 	wantqueries := []*querypb.BoundQuery{{
-		Sql: "insert into t(from, toc) values(:from0, :toc0)",
+		Sql: "insert into `t`(`from`, `toc`) values(:from0, :toc0)",
 		BindVariables: map[string]*querypb.BindVariable{
 			"from0": sqltypes.Int64BindVariable(1),
 			"toc0":  sqltypes.BytesBindVariable([]byte("test")),
@@ -154,6 +301,70 @@ func TestLookupUniqueCreate(t *testing.T) {
 	}
 }
 
+func TestLookupUniqueCreateVerifyBeforeCreate(t *testing.T) {
+	lookupUnique, err := CreateVindex("lookup_unique", "lookup_unique", map[string]string{
+		"table":                "t",
+		"from":                 "fromc",
+		"to":                   "toc",
+		"verify_before_create": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := [][]sqltypes.Value{{sqltypes.NewInt64(1)}}
+
+	// The select returns "1", which is identical.
+	vc := &vcursor{numRows: 1}
+	err = lookupUnique.(Lookup).Create(vc, rows, [][]byte{[]byte("1")}, false /* ignoreMode */)
+	if err != nil {
+		t.Error(err)
+	}
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: "select `toc` from `t` where `fromc` = :fromc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc": sqltypes.Int64BindVariable(1),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("lookup.Create queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+
+	vc.queries = nil
+	err = lookupUnique.(Lookup).Create(vc, rows, [][]byte{[]byte("test")}, false /* ignoreMode */)
+	want := "lookup.Create: id INT64(1) already maps to INT64(1) in vindex lookup_unique, cannot map it to VARBINARY(\"test\")"
+	if _, ok := err.(*ConflictError); !ok || err.Error() != want {
+		t.Errorf("lookup.Create(conflict): %v, want %s", err, want)
+	}
+	if got := len(vc.queries); got != 1 {
+		t.Errorf("lookup.Create(conflict) queries: %v, want 1", vc.queries)
+	}
+
+	vc.queries = nil
+	err = lookupUnique.(Lookup).Create(vc, rows, [][]byte{[]byte("test")}, true /* ignoreMode */)
+	if err != nil {
+		t.Errorf("lookup.Create(conflict, ignore): %v, want nil", err)
+	}
+	if got := len(vc.queries); got != 1 {
+		t.Errorf("lookup.Create(conflict, ignore) queries: %v, want 1", vc.queries)
+	}
+
+	vc = &vcursor{}
+	err = lookupUnique.(Lookup).Create(vc, rows, [][]byte{[]byte("test")}, false /* ignoreMode */)
+	if err != nil {
+		t.Error(err)
+	}
+	wantqueries = append(wantqueries, &querypb.BoundQuery{
+		Sql: "insert into `t`(`fromc`, `toc`) values(:fromc0, :toc0)",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc0": sqltypes.Int64BindVariable(1),
+			"toc0":   sqltypes.BytesBindVariable([]byte("test")),
+		},
+	})
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("lookup.Create queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+}
+
 func TestLookupUniqueCreateAutocommit(t *testing.T) {
 	lookupUnique := createLookup(t, "lookup_unique", false)
 	vc := &vcursor{}
@@ -191,4 +402,99 @@ func TestLookupUniqueUpdate(t *testing.T) {
 	if got, want := len(vc.queries), 2; got != want {
 		t.Errorf("vc.queries length: %v, want %v", got, want)
 	}
+
+	// An empty ksid deletes the old mapping, whatever its keyspace id.
+	vc.queries = nil
+	err = lookupUnique.(Lookup).Update(vc, []sqltypes.Value{sqltypes.NewInt64(1)}, nil, []sqltypes.Value{sqltypes.NewInt64(2)})
+	if err != nil {
+		t.Error(err)
+	}
+	wantqueries := []*querypb.BoundQuery{{
+		Sql: "delete from `t` where `fromc` = :fromc",
+		BindVariables: map[string]*querypb.BindVariable{
+			"fromc": sqltypes.Int64BindVariable(1),
+		},
+	}}
+	if !reflect.DeepEqual(vc.queries, wantqueries) {
+		t.Errorf("lookup.Update(empty ksid) queries:\n%v, want\n%v", vc.queries, wantqueries)
+	}
+}
+
+func TestLookupUniqueVerifyStrictUncached(t *testing.T) {
+	lookupUnique, err := CreateVindex("lookup_unique", "test_strict_uncached", map[string]string{
+		"table":                "t",
+		"from":                 "fromc",
+		"to":                   "toc",
+		"strict_unique_verify": "true",
+		"cache_size":           "10",
+		"warn_on_empty_map":    "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []sqltypes.Value{sqltypes.NewInt64(1)}
+	vc := &vcursor{
+		result: sqltypes.MakeTestResult(sqltypes.MakeTestFields("toc", "varbinary"), "test1"),
+	}
+	if _, err := lookupUnique.(Unique).Map(vc, ids); err != nil {
+		t.Fatal(err)
+	}
+	latencies := lookupLatency("test_strict_uncached").Count()
+
+	// A mapping added since the Map is not hidden by the cache.
+	vc.result = sqltypes.MakeTestResult(sqltypes.MakeTestFields("toc", "varbinary"), "test1", "test2")
+	_, err = lookupUnique.Verify(vc, ids, [][]byte{[]byte("test1")})
+	if _, ok := err.(*DuplicateMappingError); !ok {
+		t.Errorf("Verify(cached): %v, want a *DuplicateMappingError", err)
+	}
+	if got, want := len(vc.queries), 2; got != want {
+		t.Errorf("queries: %d, want %d", got, want)
+	}
+
+	// Verify is not counted as a Map, even without mappings.
+	vc.result = &sqltypes.Result{}
+	if _, err := lookupUnique.Verify(vc, ids, [][]byte{[]byte("test1")}); err != nil {
+		t.Error(err)
+	}
+	if got := lookupLatency("test_strict_uncached").Count(); got != latencies {
+		t.Errorf("VindexLookupMapLatency count: %d, want %d", got, latencies)
+	}
+	if got := lookupEmptyMaps.Counts()["test_strict_uncached"]; got != 0 {
+		t.Errorf("VindexLookupEmptyMaps: %d, want 0", got)
+	}
+}
+
+func TestLookupUniqueVerifyAnyStrict(t *testing.T) {
+	lookupUnique, err := CreateVindex("lookup_unique", "lookup_unique", map[string]string{
+		"table":                "t",
+		"from":                 "fromc",
+		"to":                   "toc",
+		"strict_unique_verify": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := lookupUnique.(AnyVerifier)
+	vc := &vcursor{
+		result: sqltypes.MakeTestResult(sqltypes.MakeTestFields("toc", "varbinary"), "new"),
+	}
+	ids := []sqltypes.Value{sqltypes.NewInt64(1), sqltypes.NewInt64(2)}
+	got, err := verifier.VerifyAny(vc, ids, [][][]byte{{[]byte("old"), []byte("new")}, {[]byte("old")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []bool{true, false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("VerifyAny: %v, want %v", got, want)
+	}
+	// The mapping of each id is read once.
+	if got, want := len(vc.queries), 2; got != want {
+		t.Errorf("VerifyAny queries: %d, want %d", got, want)
+	}
+
+	// Several mappings fail even if they are all acceptable.
+	vc.result = sqltypes.MakeTestResult(sqltypes.MakeTestFields("toc", "varbinary"), "old", "new")
+	_, err = verifier.VerifyAny(vc, ids[:1], [][][]byte{{[]byte("old"), []byte("new")}})
+	if _, ok := err.(*DuplicateMappingError); !ok {
+		t.Errorf("VerifyAny(duplicate): %v, want a *DuplicateMappingError", err)
+	}
 }
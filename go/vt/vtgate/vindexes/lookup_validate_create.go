@@ -0,0 +1,154 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+var (
+	_ CreateValidator = (*LookupNonUnique)(nil)
+	_ CreateValidator = (*LookupUnique)(nil)
+	_ CreateValidator = (*LookupHash)(nil)
+	_ CreateValidator = (*LookupHashUnique)(nil)
+)
+
+// CreateValidator is implemented by the vindexes that can check the
+// rows of a Create without executing it, so that an import can reject
+// a bad batch before any of its rows is inserted.
+type CreateValidator interface {
+	ValidateCreate(rowsColValues [][]sqltypes.Value, ksids [][]byte) error
+}
+
+// maxListedInvalidRows is the number of invalid rows that the message
+// of an InvalidRowsError lists.
+const maxListedInvalidRows = 10
+
+// InvalidRowsError is returned by ValidateCreate if some of the rows
+// are invalid. It has the problem of each of them, in order.
+type InvalidRowsError struct {
+	Vindex string
+	// NumRows is the number of rows that were validated.
+	NumRows int
+	// Rows are the indexes of the invalid rows, and Problems what's
+	// wrong with each of them.
+	Rows     []int
+	Problems []string
+}
+
+func (e *InvalidRowsError) Error() string {
+	var problems []string
+	for i, row := range e.Rows {
+		if i == maxListedInvalidRows {
+			problems = append(problems, fmt.Sprintf("and %d more", len(e.Rows)-i))
+			break
+		}
+		problems = append(problems, fmt.Sprintf("row %d: %s", row, e.Problems[i]))
+	}
+	return fmt.Sprintf("lookup.ValidateCreate: %d of %d rows are invalid for vindex %s: %s", len(e.Rows), e.NumRows, e.Vindex, strings.Join(problems, "; "))
+}
+
+// validateCreate runs the checks of Create on the rows, and the ones
+// that Create leaves to the table, without any query. It returns an
+// *InvalidRowsError with all the invalid rows: rows with the wrong
+// number of from values, a NULL from value, which Map never matches,
+// or a from_list that cannot be parsed; empty keyspace ids, and the
+// ones that checkKsid rejects, if it's not nil; and, if unique is true,
+// from values that are repeated with different keyspace ids, which a
+// unique index rejects. It fails right away if the vindex is read-only
+// or the number of keyspace ids is not the number of rows.
+func (lkp *lookupInternal) validateCreate(rowsColValues [][]sqltypes.Value, ksids [][]byte, unique bool, checkKsid func([]byte) error) error {
+	if err := lkp.checkWritable("ValidateCreate"); err != nil {
+		return err
+	}
+	if len(ksids) != len(rowsColValues) {
+		return fmt.Errorf("lookup.ValidateCreate: got %d keyspace ids for %d rows", len(ksids), len(rowsColValues))
+	}
+	e := &InvalidRowsError{Vindex: lkp.name, NumRows: len(rowsColValues)}
+	// seen contains the first row of each from value, if unique.
+	seen := make(map[string]int)
+	for rowIdx, row := range rowsColValues {
+		problem := lkp.validateCreateRow(row, ksids[rowIdx], checkKsid)
+		if problem == "" && unique {
+			problem = lkp.checkDuplicates(seen, rowsColValues, ksids, rowIdx)
+		}
+		if problem != "" {
+			e.Rows = append(e.Rows, rowIdx)
+			e.Problems = append(e.Problems, problem)
+		}
+	}
+	if len(e.Rows) != 0 {
+		return e
+	}
+	return nil
+}
+
+// validateCreateRow returns the problem of one row, if any.
+func (lkp *lookupInternal) validateCreateRow(row []sqltypes.Value, ksid []byte, checkKsid func([]byte) error) string {
+	if len(row) != len(lkp.FromColumns) {
+		return fmt.Sprintf("got %d from values, want %d", len(row), len(lkp.FromColumns))
+	}
+	for colIdx, v := range row {
+		if v.IsNull() {
+			return fmt.Sprintf("from value of %s is NULL", lkp.FromColumns[colIdx])
+		}
+	}
+	if lkp.FromList != "" {
+		if _, err := splitFromList(lkp.FromList, row[0]); err != nil {
+			return err.Error()
+		}
+	}
+	if len(ksid) == 0 {
+		return "empty keyspace id"
+	}
+	if checkKsid != nil {
+		if err := checkKsid(ksid); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+// checkDuplicates returns a problem if the from values of row rowIdx,
+// or any element of its from_list, already appeared in an earlier row
+// with a different keyspace id. It records them in seen otherwise.
+func (lkp *lookupInternal) checkDuplicates(seen map[string]int, rowsColValues [][]sqltypes.Value, ksids [][]byte, rowIdx int) string {
+	rows := [][]sqltypes.Value{rowsColValues[rowIdx]}
+	if lkp.FromList != "" {
+		// The list was parsed by validateCreateRow.
+		rows, _, _, _ = lkp.expandFromList(rows, nil, nil)
+	}
+	for _, row := range rows {
+		keys := make([]string, len(row))
+		for i, v := range row {
+			keys[i], _ = valueKey(v)
+		}
+		key := strings.Join(keys, "\x00")
+		if first, ok := seen[key]; ok {
+			if !bytes.Equal(ksids[first], ksids[rowIdx]) {
+				return fmt.Sprintf("from values %v are also in row %d, with a different keyspace id", row, first)
+			}
+			continue
+		}
+		seen[key] = rowIdx
+	}
+	return ""
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"sync"
+
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+// maxPooledValues is the capacity above which a slice is not returned
+// to valuesPool, so that a rare large call doesn't keep its slice alive.
+const maxPooledValues = 1024
+
+// valuesPool pools the slices of the to values that Verify and
+// ReverseMap convert their keyspace ids to. It holds pointers to the
+// slices, so that Put doesn't allocate.
+var valuesPool = sync.Pool{
+	New: func() interface{} {
+		values := make([]sqltypes.Value, 0, 16)
+		return &values
+	},
+}
+
+// pooledKsidsToValues is like ksidsToValues, but the slice comes from
+// valuesPool. It must be returned with putValues once the call that
+// uses it is done, and must not be retained: only use it for calls
+// that don't keep their values, unlike Create with async_writes.
+func pooledKsidsToValues(codec KsidCodec, ksids [][]byte) *[]sqltypes.Value {
+	values := valuesPool.Get().(*[]sqltypes.Value)
+	for _, ksid := range ksids {
+		*values = append(*values, ksidToValue(codec, ksid))
+	}
+	return values
+}
+
+// putValues returns values to valuesPool. It clears them first, so
+// that the pool doesn't keep the bytes of the keyspace ids alive.
+func putValues(values *[]sqltypes.Value) {
+	if cap(*values) > maxPooledValues {
+		return
+	}
+	for i := range *values {
+		(*values)[i] = sqltypes.Value{}
+	}
+	*values = (*values)[:0]
+	valuesPool.Put(values)
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"fmt"
+
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+var (
+	_ AnyVerifier = (*LookupNonUnique)(nil)
+	_ AnyVerifier = (*LookupUnique)(nil)
+	_ AnyVerifier = (*LookupHash)(nil)
+	_ AnyVerifier = (*LookupHashUnique)(nil)
+)
+
+// AnyVerifier is implemented by the vindexes that can verify an id
+// against several acceptable keyspace ids. During a resharding, a row
+// can be moved between its old and new keyspace id while the vindex
+// entry is updated, so a verification that accepts both doesn't fail
+// for the rows caught in between.
+type AnyVerifier interface {
+	// VerifyAny is like Verify, but ksids has a set of keyspace ids
+	// for each id in ids, and an id is verified if it maps to any of
+	// them. An id with an empty set is not verified.
+	VerifyAny(vcursor VCursor, ids []sqltypes.Value, ksids [][][]byte) ([]bool, error)
+}
+
+// verifyAny implements VerifyAny with verify, the Verify of the vindex.
+// It runs the Verify query for each keyspace id of the set of an id in
+// turn, and stops at the first one that the id maps to, so that the
+// usual case of an id that maps to the first keyspace id costs a single
+// query. The ids that a write_only or lookup_id_ranges vindex doesn't
+// look up are verified like Verify does, without a query.
+func verifyAny(verify func(VCursor, []sqltypes.Value, [][]byte) ([]bool, error), vcursor VCursor, ids []sqltypes.Value, ksids [][][]byte) ([]bool, error) {
+	if len(ksids) != len(ids) {
+		return nil, fmt.Errorf("lookup.Verify: got %d keyspace id sets for %d ids", len(ksids), len(ids))
+	}
+	out := make([]bool, len(ids))
+	for i := range ids {
+		for j := range ksids[i] {
+			verified, err := verify(vcursor, ids[i:i+1], ksids[i][j:j+1])
+			if err != nil {
+				return nil, err
+			}
+			if verified[0] {
+				out[i] = true
+				break
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"fmt"
+
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+var (
+	_ StreamVerifier = (*LookupNonUnique)(nil)
+	_ StreamVerifier = (*LookupUnique)(nil)
+	_ StreamVerifier = (*LookupHash)(nil)
+	_ StreamVerifier = (*LookupHashUnique)(nil)
+)
+
+// StreamVerifier is implemented by the vindexes that can return the
+// results of a Verify one id at a time, so that a caller verifying
+// millions of rows doesn't have to hold all of them.
+type StreamVerifier interface {
+	// VerifyStream is like Verify, but it calls cb with the index of
+	// each id in ids, and whether it maps to the keyspace id of the
+	// same index, in order. If cb returns an error, VerifyStream stops
+	// and returns it as is.
+	VerifyStream(vcursor VCursor, ids []sqltypes.Value, ksids [][]byte, cb func(i int, ok bool) error) error
+}
+
+// verifyStream implements VerifyStream with verify, the Verify of the
+// vindex, called for one id at a time. The lookup vindexes already
+// verify each id with its own query, so nothing is lost, and the ids
+// that a write_only or lookup_id_ranges vindex doesn't look up still
+// don't cost a query.
+func verifyStream(verify func(VCursor, []sqltypes.Value, [][]byte) ([]bool, error), vcursor VCursor, ids []sqltypes.Value, ksids [][]byte, cb func(i int, ok bool) error) error {
+	if len(ksids) != len(ids) {
+		return fmt.Errorf("lookup.Verify: got %d keyspace ids for %d ids", len(ksids), len(ids))
+	}
+	for i := range ids {
+		verified, err := verify(vcursor, ids[i:i+1], ksids[i:i+1])
+		if err != nil {
+			return err
+		}
+		if err := cb(i, verified[0]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// lookupRetryBudgetExhausted counts, by vindex, the retries that were
+// not attempted because the retry budget of the request was exhausted.
+var lookupRetryBudgetExhausted = newSinkCounters("VindexLookupRetryBudgetExhausted")
+
+// RetryBudget bounds the retries of the lookup vindexes for one
+// request, so that a query that goes through many vindex operations
+// cannot spend an unbounded time retrying them. All the retries of
+// the deadlocks and missing tables of the lookup vindexes draw from
+// it: each one takes one retry and its backoff delay. Once either
+// is exhausted, the operations that fail are no longer retried, and
+// return their error right away.
+//
+// A RetryBudget is created for a request and attached to its context
+// with WithRetryBudget. The lookup vindexes find it through the
+// VCursor, which must be a ContextVCursor, so it's shared by all the
+// vindexes that the request uses. Without a RetryBudget, the retries
+// are only bounded by the options of each vindex. The queued Creates
+// of async_writes run after the request, with a detached VCursor, and
+// don't draw from it. It's safe for concurrent use.
+type RetryBudget struct {
+	mu      sync.Mutex
+	retries int
+	delay   time.Duration
+}
+
+// NewRetryBudget returns a RetryBudget of retries retries, and of
+// delay of total backoff delay. A zero delay means no limit on the
+// delay.
+func NewRetryBudget(retries int, delay time.Duration) *RetryBudget {
+	if delay == 0 {
+		delay = -1
+	}
+	return &RetryBudget{retries: retries, delay: delay}
+}
+
+// Remaining returns the retries and the delay that are left. The
+// delay is negative if it's not limited.
+func (rb *RetryBudget) Remaining() (int, time.Duration) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.retries, rb.delay
+}
+
+// take takes a retry that waits for delay from the budget, and
+// returns false, without taking anything, if there's not enough left.
+func (rb *RetryBudget) take(delay time.Duration) bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.retries <= 0 || (rb.delay >= 0 && delay > rb.delay) {
+		return false
+	}
+	rb.retries--
+	if rb.delay >= 0 {
+		rb.delay -= delay
+	}
+	return true
+}
+
+type retryBudgetKey struct{}
+
+// WithRetryBudget returns a copy of ctx that carries budget.
+func WithRetryBudget(ctx context.Context, budget *RetryBudget) context.Context {
+	return context.WithValue(ctx, retryBudgetKey{}, budget)
+}
+
+// RetryBudgetFromContext returns the RetryBudget of ctx, or nil if it
+// has none.
+func RetryBudgetFromContext(ctx context.Context) *RetryBudget {
+	budget, _ := ctx.Value(retryBudgetKey{}).(*RetryBudget)
+	return budget
+}
+
+// nextRetry returns the delay before the retry attempt, and takes it
+// from the RetryBudget of the request of vcursor, if any. It returns
+// false if the budget is exhausted, in which case the operation must
+// not be retried.
+func (lkp *lookupInternal) nextRetry(vcursor VCursor, attempt int) (time.Duration, bool) {
+	delay := lkp.backoffPolicy().NextDelay(attempt)
+	cvc, ok := vcursor.(ContextVCursor)
+	if !ok {
+		return delay, true
+	}
+	if budget := RetryBudgetFromContext(cvc.Context()); budget != nil && !budget.take(delay) {
+		lookupRetryBudgetExhausted.Add(lkp.name, 1)
+		return 0, false
+	}
+	return delay, true
+}
+
+// waitRetry waits for the delay before a retry. If vcursor is a
+// ContextVCursor, it stops waiting when the context of the request is
+// done, and returns its error: the client is gone, so there is no point
+// in retrying.
+func waitRetry(vcursor VCursor, delay time.Duration) error {
+	cvc, ok := vcursor.(ContextVCursor)
+	if !ok {
+		time.Sleep(delay)
+		return nil
+	}
+	ctx := cvc.Context()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
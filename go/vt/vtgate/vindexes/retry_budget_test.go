@@ -0,0 +1,161 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+// budgetVCursor is a vcursor with a context.
+type budgetVCursor struct {
+	*vcursor
+	ctx context.Context
+}
+
+func (vc budgetVCursor) Context() context.Context {
+	return vc.ctx
+}
+
+func TestRetryBudget(t *testing.T) {
+	rb := NewRetryBudget(3, 100*time.Millisecond)
+	if !rb.take(60 * time.Millisecond) {
+		t.Error("take(60ms): false, want true")
+	}
+	// Not enough delay left: nothing is taken.
+	if rb.take(50 * time.Millisecond) {
+		t.Error("take(50ms): true, want false")
+	}
+	if retries, delay := rb.Remaining(); retries != 2 || delay != 40*time.Millisecond {
+		t.Errorf("Remaining(): %d, %v, want 2, 40ms", retries, delay)
+	}
+
+	rb = NewRetryBudget(1, 0)
+	if !rb.take(time.Hour) {
+		t.Error("take(1h): false, want true")
+	}
+	if rb.take(0) {
+		t.Error("take(0): true, want false")
+	}
+	if retries, delay := rb.Remaining(); retries != 0 || delay >= 0 {
+		t.Errorf("Remaining(): %d, %v, want 0 and a negative delay", retries, delay)
+	}
+
+	if got := RetryBudgetFromContext(context.Background()); got != nil {
+		t.Errorf("RetryBudgetFromContext(Background): %v, want nil", got)
+	}
+	if got := RetryBudgetFromContext(WithRetryBudget(context.Background(), rb)); got != rb {
+		t.Errorf("RetryBudgetFromContext(): %v, want %v", got, rb)
+	}
+}
+
+func TestLookupNonUniqueRetryBudget(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":                  "t",
+		"from":                   "fromc",
+		"to":                     "toc",
+		"retry_on_missing_table": "2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookupNonUnique.(*LookupNonUnique).SetBackoffPolicy(zeroBackoff{})
+	ids := []sqltypes.Value{sqltypes.NewInt64(1)}
+
+	// The budget is shared by the operations of the request.
+	ctx := WithRetryBudget(context.Background(), NewRetryBudget(3, 0))
+	vc := budgetVCursor{vcursor: &vcursor{numRows: 1, numMissingTables: 2}, ctx: ctx}
+	if _, err := lookupNonUnique.(NonUnique).Map(vc, ids); err != nil {
+		t.Error(err)
+	}
+	vc.numMissingTables = 2
+	_, err = lookupNonUnique.(NonUnique).Map(vc, ids)
+	want := "lookup.Map: Table 'vt_ks.t' doesn't exist (errno 1146) (sqlstate 42S02)"
+	if err == nil || err.Error() != want {
+		t.Errorf("lookup.Map: %v, want %s", err, want)
+	}
+	// 3 queries for the first Map, and 2 for the second one, which
+	// only had one retry left.
+	if got, want := len(vc.queries), 5; got != want {
+		t.Errorf("lookup.Map queries: %v, want %d", vc.queries, want)
+	}
+
+	// Once it's exhausted, the operations fail fast.
+	vc.queries = nil
+	vc.numMissingTables = 1
+	if _, err := lookupNonUnique.(NonUnique).Map(vc, ids); err == nil {
+		t.Error("lookup.Map: nil, want error")
+	}
+	if got, want := len(vc.queries), 1; got != want {
+		t.Errorf("lookup.Map queries: %v, want %d", vc.queries, want)
+	}
+}
+
+type hourBackoff struct{}
+
+func (hourBackoff) NextDelay(int) time.Duration { return time.Hour }
+
+func TestLookupNonUniqueRetryContextDone(t *testing.T) {
+	lookupNonUnique, err := CreateVindex("lookup", "lookup", map[string]string{
+		"table":            "t",
+		"from":             "fromc",
+		"to":               "toc",
+		"autocommit":       "true",
+		"deadlock_retries": "2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookupNonUnique.(*LookupNonUnique).SetBackoffPolicy(hourBackoff{})
+
+	// The request is gone: the retry doesn't wait for the backoff.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	vc := budgetVCursor{vcursor: &vcursor{numDeadlocks: 1}, ctx: ctx}
+	err = lookupNonUnique.(Lookup).Create(vc, [][]sqltypes.Value{{sqltypes.NewInt64(1)}}, [][]byte{[]byte("test1")}, false /* ignoreMode */)
+	want := "lookup.Create: context canceled"
+	if err == nil || err.Error() != want {
+		t.Errorf("Create(canceled) err: %v, want %s", err, want)
+	}
+	if got, want := vc.autocommits, 1; got != want {
+		t.Errorf("Create(canceled) autocommits: %d, want %d", got, want)
+	}
+
+	lookupNonUnique, err = CreateVindex("lookup", "lookup", map[string]string{
+		"table":                  "t",
+		"from":                   "fromc",
+		"to":                     "toc",
+		"retry_on_missing_table": "2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookupNonUnique.(*LookupNonUnique).SetBackoffPolicy(hourBackoff{})
+	vc = budgetVCursor{vcursor: &vcursor{numRows: 1, numMissingTables: 1}, ctx: ctx}
+	_, err = lookupNonUnique.(NonUnique).Map(vc, []sqltypes.Value{sqltypes.NewInt64(1)})
+	want = "lookup.Map: context canceled"
+	if err == nil || err.Error() != want {
+		t.Errorf("Map(canceled) err: %v, want %s", err, want)
+	}
+	if got, want := len(vc.queries), 1; got != want {
+		t.Errorf("Map(canceled) queries: %v, want %d", vc.queries, want)
+	}
+}
@@ -18,6 +18,8 @@ package vindexes
 
 import (
 	"fmt"
+	"sort"
+	"sync"
 
 	"github.com/youtube/vitess/go/sqltypes"
 
@@ -35,6 +37,37 @@ type VCursor interface {
 	ExecuteAutocommit(method string, query string, bindvars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error)
 }
 
+// A PooledVCursor is a VCursor that can execute an autocommit query on
+// a named connection pool, to isolate the lookup queries of a vindex
+// from the other queries, so that a slow lookup table can't exhaust the
+// shared pool. Lookup vindexes that have the connection_pool option use
+// it for their autocommit queries if their VCursor implements it, and
+// the shared pool of ExecuteAutocommit otherwise.
+type PooledVCursor interface {
+	VCursor
+	ExecuteAutocommitInPool(pool string, method string, query string, bindvars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error)
+}
+
+// A CellVCursor is a VCursor that can execute a read query in
+// autocommit mode on a tablet of a given cell, to avoid a cross-region
+// round trip. If the cell has no tablet that can serve the query, it
+// must fall back to any tablet that can. Lookup vindexes that have the
+// read_cell option use it for the queries of Map and Verify if their
+// VCursor implements it, and execute them as usual otherwise.
+type CellVCursor interface {
+	VCursor
+	ExecuteInCell(cell string, method string, query string, bindvars map[string]*querypb.BindVariable, isDML bool) (*sqltypes.Result, error)
+}
+
+// A SnapshotVCursor is a VCursor that tells whether its session is in a
+// transaction, whose connections Execute uses. Lookup vindexes that have
+// the snapshot_reads option use it to execute the queries of Map and
+// Verify in the transaction, without their cache, if there is one.
+type SnapshotVCursor interface {
+	VCursor
+	InTransaction() bool
+}
+
 // Vindex defines the interface required to register a vindex.
 // Additional to these functions, a vindex also needs
 // to satisfy the Unique or NonUnique interface.
@@ -116,6 +149,10 @@ type Lookup interface {
 	Delete(vc VCursor, rowsColValues [][]sqltypes.Value, ksid []byte) error
 
 	// Update replaces the mapping of old values with new values for a keyspace id.
+	// If ksid is empty, a unique vindex deletes the mapping of the old values instead,
+	// whatever its keyspace id, and newValues are ignored. A non-unique vindex fails,
+	// since the old values can have more than one. Otherwise, newValues must not be
+	// empty.
 	Update(vc VCursor, oldValues []sqltypes.Value, ksid []byte, newValues []sqltypes.Value) error
 }
 
@@ -124,25 +161,58 @@ type Lookup interface {
 // register a NewVindexFunc under a unique vindexType.
 type NewVindexFunc func(string, map[string]string) (Vindex, error)
 
-var registry = make(map[string]NewVindexFunc)
+var (
+	// registryMu protects registry, so that the registered vindexes
+	// can be listed while others are registered.
+	registryMu sync.RWMutex
+	registry   = make(map[string]NewVindexFunc)
+)
 
 // Register registers a vindex under the specified vindexType.
-// A duplicate vindexType will generate a panic.
+// A duplicate vindexType will generate a panic, instead of
+// shadowing the vindex that's already registered, like when a
+// plugin and the core register the same name.
 // New vindexes will be created using these functions at the
 // time of vschema loading.
 func Register(vindexType string, newVindexFunc NewVindexFunc) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
 	if _, ok := registry[vindexType]; ok {
-		panic(fmt.Sprintf("%s is already registered", vindexType))
+		panic(fmt.Sprintf("vindex type %s is already registered", vindexType))
 	}
 	registry[vindexType] = newVindexFunc
 }
 
+// Unregister removes the vindex registered under vindexType, if
+// any, so that it can be registered again. It's meant for tests.
+func Unregister(vindexType string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	delete(registry, vindexType)
+}
+
 // CreateVindex creates a vindex of the specified type using the
 // supplied params. The type must have been previously registered.
 func CreateVindex(vindexType, name string, params map[string]string) (Vindex, error) {
+	registryMu.RLock()
 	f, ok := registry[vindexType]
+	registryMu.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("vindexType %q not found", vindexType)
 	}
 	return f(name, params)
 }
+
+// RegisteredVindexes returns the sorted list of the registered
+// vindex types, like to check that the types referenced by a
+// vschema exist before applying it.
+func RegisteredVindexes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	types := make([]string, 0, len(registry))
+	for vindexType := range registry {
+		types = append(types, vindexType)
+	}
+	sort.Strings(types)
+	return types
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"fmt"
+
+	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/key"
+
+	topodatapb "github.com/youtube/vitess/go/vt/proto/topodata"
+)
+
+var (
+	_ Describer = (*LookupNonUnique)(nil)
+	_ Describer = (*LookupUnique)(nil)
+	_ Describer = (*LookupHash)(nil)
+	_ Describer = (*LookupHashUnique)(nil)
+)
+
+// RoutePlan describes how a vindex routes a set of ids, for routing
+// diagnostics like an EXPLAIN tool. It has keyspace ids and keyranges:
+// the caller resolves them to the shards of the keyspace.
+type RoutePlan struct {
+	// Vindex is the name of the vindex, and Cost its Cost.
+	Vindex string
+	Cost   int
+	// Unique is true if the vindex maps an id to at most one
+	// keyspace id.
+	Unique bool
+	// Routes has the route of each id, in the order of the ids.
+	Routes []IDRoute
+	// Scatter is true if an id is routed to the full keyrange, so
+	// that the query goes to all the shards.
+	Scatter bool
+	// Error is the error of Map that scatter_on_error replaced with
+	// the full keyrange, if any.
+	Error string
+}
+
+// IDRoute is the route of an id in a RoutePlan. An id with neither
+// keyspace ids nor a keyrange has no mapping: it's not routed anywhere.
+type IDRoute struct {
+	ID    sqltypes.Value
+	Ksids [][]byte
+	// Range is the keyrange of the id, if the vindex routes it to one
+	// instead of to keyspace ids. Reason tells why, if it's not the
+	// mapping itself: "write_only", "lookup_id_ranges", "prefix_match"
+	// or "scatter_on_error", after the option that made a lookup
+	// vindex return the full keyrange without a query.
+	Range  *topodatapb.KeyRange
+	Reason string
+}
+
+// A Describer is a vindex that can describe how it routes ids,
+// with the options that affect it.
+type Describer interface {
+	// Describe returns the RoutePlan of ids. Like Map, it may
+	// execute the read-only lookup query, but it doesn't write.
+	Describe(vcursor VCursor, ids []sqltypes.Value) (RoutePlan, error)
+}
+
+// DescribeRoute returns the RoutePlan of ids for v. It uses Describe
+// if v is a Describer, and otherwise describes the result of its Map.
+func DescribeRoute(vcursor VCursor, v Vindex, ids []sqltypes.Value) (RoutePlan, error) {
+	if d, ok := v.(Describer); ok {
+		return d.Describe(vcursor, ids)
+	}
+	return describeMap(vcursor, v, ids, nil)
+}
+
+// describeMap returns the RoutePlan of ids from the Map of v. If
+// reason is set, it returns the Reason of the ids routed to a keyrange.
+func describeMap(vcursor VCursor, v Vindex, ids []sqltypes.Value, reason func(sqltypes.Value) string) (RoutePlan, error) {
+	plan := RoutePlan{Vindex: v.String(), Cost: v.Cost()}
+	switch v := v.(type) {
+	case Unique:
+		plan.Unique = true
+		out, err := v.Map(vcursor, ids)
+		if err != nil {
+			return RoutePlan{}, err
+		}
+		for i, id := range ids {
+			route := IDRoute{ID: id}
+			if out[i] != nil {
+				route.Ksids = [][]byte{out[i]}
+			}
+			plan.Routes = append(plan.Routes, route)
+		}
+	case NonUnique:
+		out, err := v.Map(vcursor, ids)
+		if err != nil {
+			return RoutePlan{}, err
+		}
+		for i, id := range ids {
+			plan.addRoute(id, out[i], reason)
+		}
+	default:
+		return RoutePlan{}, fmt.Errorf("vindex %s has no Map", v)
+	}
+	return plan, nil
+}
+
+// addRoute adds the route of id to ksids to plan.
+func (plan *RoutePlan) addRoute(id sqltypes.Value, ksids Ksids, reason func(sqltypes.Value) string) {
+	route := IDRoute{ID: id, Ksids: ksids.IDs, Range: ksids.Range}
+	if ksids.Range != nil {
+		if reason != nil {
+			route.Reason = reason(id)
+		}
+		if !key.KeyRangeIsPartial(ksids.Range) {
+			plan.Scatter = true
+		}
+	}
+	plan.Routes = append(plan.Routes, route)
+}
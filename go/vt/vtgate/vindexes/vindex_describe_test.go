@@ -0,0 +1,160 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/youtube/vitess/go/sqltypes"
+
+	topodatapb "github.com/youtube/vitess/go/vt/proto/topodata"
+)
+
+func TestDescribeRouteFunctional(t *testing.T) {
+	hash, err := CreateVindex("hash", "hash", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DescribeRoute(nil, hash, []sqltypes.Value{sqltypes.NewInt64(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RoutePlan{
+		Vindex: "hash",
+		Cost:   1,
+		Unique: true,
+		Routes: []IDRoute{{
+			ID:    sqltypes.NewInt64(1),
+			Ksids: [][]byte{[]byte("\x16k@\xb4J\xbaK\xd6")},
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DescribeRoute(hash):\n%+v, want\n%+v", got, want)
+	}
+}
+
+func TestDescribeRouteLookup(t *testing.T) {
+	lookupNonUnique := createLookup(t, "lookup", false)
+	vc := &vcursor{numRows: 2}
+	got, err := DescribeRoute(vc, lookupNonUnique, []sqltypes.Value{sqltypes.NewInt64(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RoutePlan{
+		Vindex: "lookup",
+		Cost:   20,
+		Routes: []IDRoute{{
+			ID:    sqltypes.NewInt64(1),
+			Ksids: [][]byte{[]byte("1"), []byte("2")},
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Describe(lookup):\n%+v, want\n%+v", got, want)
+	}
+	if len(vc.queries) != 1 {
+		t.Errorf("Describe(lookup) executed %d queries, want 1", len(vc.queries))
+	}
+
+	// write_only returns the full keyrange without a query.
+	lookupNonUnique = createLookup(t, "lookup", true)
+	vc = &vcursor{numRows: 2}
+	got, err = DescribeRoute(vc, lookupNonUnique, []sqltypes.Value{sqltypes.NewInt64(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = RoutePlan{
+		Vindex: "lookup",
+		Cost:   100,
+		Routes: []IDRoute{{
+			ID:     sqltypes.NewInt64(1),
+			Range:  &topodatapb.KeyRange{},
+			Reason: "write_only",
+		}},
+		Scatter: true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Describe(write_only):\n%+v, want\n%+v", got, want)
+	}
+	if len(vc.queries) != 0 {
+		t.Errorf("Describe(write_only) executed %d queries, want 0", len(vc.queries))
+	}
+
+	// scatter_on_error reports the error it suppresses.
+	lookupNonUnique, err = CreateVindex("lookup", "lookup", map[string]string{
+		"table":            "t",
+		"from":             "fromc",
+		"to":               "toc",
+		"scatter_on_error": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = DescribeRoute(&vcursor{mustFail: true}, lookupNonUnique, []sqltypes.Value{sqltypes.NewInt64(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = RoutePlan{
+		Vindex: "lookup",
+		Cost:   20,
+		Routes: []IDRoute{{
+			ID:     sqltypes.NewInt64(1),
+			Range:  &topodatapb.KeyRange{},
+			Reason: "scatter_on_error",
+		}},
+		Scatter: true,
+		Error:   "lookup.Map: execute failed",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Describe(scatter_on_error):\n%+v, want\n%+v", got, want)
+	}
+
+	// Without scatter_on_error, the error is returned.
+	lookupNonUnique = createLookup(t, "lookup", false)
+	_, err = DescribeRoute(&vcursor{mustFail: true}, lookupNonUnique, []sqltypes.Value{sqltypes.NewInt64(1)})
+	wantErr := "lookup.Map: execute failed"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("Describe(query fail): %v, want %s", err, wantErr)
+	}
+}
+
+func TestDescribeRouteLookupUnique(t *testing.T) {
+	lookupUnique, err := CreateVindex("lookup_unique", "lookup_unique", map[string]string{
+		"table": "t",
+		"from":  "fromc",
+		"to":    "toc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An id without a mapping is not routed.
+	got, err := DescribeRoute(&vcursor{numRows: 0}, lookupUnique, []sqltypes.Value{sqltypes.NewInt64(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RoutePlan{
+		Vindex: "lookup_unique",
+		Cost:   10,
+		Unique: true,
+		Routes: []IDRoute{{
+			ID: sqltypes.NewInt64(1),
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Describe(lookup_unique):\n%+v, want\n%+v", got, want)
+	}
+}
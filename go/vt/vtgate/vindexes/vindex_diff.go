@@ -0,0 +1,103 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// ConfigDiff is an option that differs between two vindexes, as
+// reported by DiffVindexConfigs.
+type ConfigDiff struct {
+	// Field is the JSON name of the option.
+	Field string
+	// A and B are the decoded JSON values of the option in each
+	// vindex, or nil if it's not set. Numbers are json.Number.
+	A, B interface{}
+}
+
+func (d *ConfigDiff) String() string {
+	return fmt.Sprintf("%s: %s -> %s", d.Field, formatConfigValue(d.A), formatConfigValue(d.B))
+}
+
+// formatConfigValue formats v as JSON, or as <unset> if it's nil.
+func formatConfigValue(v interface{}) string {
+	if v == nil {
+		return "<unset>"
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(data)
+}
+
+// DiffVindexConfigs compares the options of two vindexes of the same
+// type, like the same vindex in two environments, and returns the ones
+// that differ, sorted by field. The options are read from MarshalJSON,
+// so the runtime state of the vindexes, like the cache of a lookup
+// vindex, which is not marshaled, is ignored. So is the vindex name.
+// A field that is a list, like from_columns, is compared as a whole.
+func DiffVindexConfigs(a, b Vindex) ([]*ConfigDiff, error) {
+	if reflect.TypeOf(a) != reflect.TypeOf(b) {
+		return nil, fmt.Errorf("cannot diff vindex %s of type %T with vindex %s of type %T", a, a, b, b)
+	}
+	fieldsA, err := configFields(a)
+	if err != nil {
+		return nil, err
+	}
+	fieldsB, err := configFields(b)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range fieldsA {
+		names = append(names, name)
+	}
+	for name := range fieldsB {
+		if _, ok := fieldsA[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var diffs []*ConfigDiff
+	for _, name := range names {
+		if !reflect.DeepEqual(fieldsA[name], fieldsB[name]) {
+			diffs = append(diffs, &ConfigDiff{Field: name, A: fieldsA[name], B: fieldsB[name]})
+		}
+	}
+	return diffs, nil
+}
+
+// configFields returns the fields of the JSON representation of v.
+func configFields(v Vindex) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal vindex %s: %v", v, err)
+	}
+	fields := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, fmt.Errorf("cannot decode the JSON representation of vindex %s: %v", v, err)
+	}
+	return fields, nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vindexes
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+func TestDiffVindexConfigs(t *testing.T) {
+	staging, err := CreateVindex("lookup", "staging", map[string]string{
+		"table":      "t",
+		"from":       "fromc",
+		"to":         "toc",
+		"cache_size": "10",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prod, err := CreateVindex("lookup", "prod", map[string]string{
+		"table":                  "t",
+		"from":                   "fromc",
+		"to":                     "toc",
+		"cache_size":             "100",
+		"deadlock_retries":       "3",
+		"autocommit":             "true",
+		"retry_on_missing_table": "2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The cache of prod is filled, which is not part of the config.
+	if _, err := prod.(NonUnique).Map(&vcursor{numRows: 1}, []sqltypes.Value{sqltypes.NewInt64(1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := DiffVindexConfigs(staging, prod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, diff := range diffs {
+		got = append(got, diff.String())
+	}
+	want := []string{
+		"autocommit: <unset> -> true",
+		"cache_size: 10 -> 100",
+		"deadlock_retries: <unset> -> 3",
+		"retry_on_missing_table: <unset> -> 2",
+		"upsert: <unset> -> true",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffVindexConfigs:\n%v, want\n%v", got, want)
+	}
+
+	diffs, err = DiffVindexConfigs(prod, prod)
+	if err != nil || diffs != nil {
+		t.Errorf("DiffVindexConfigs(same): %v, %v, want nil, nil", diffs, err)
+	}
+
+	hash, err := CreateVindex("hash", "hash", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = DiffVindexConfigs(prod, hash)
+	wantErr := "cannot diff vindex prod of type *vindexes.LookupNonUnique with vindex hash of type *vindexes.Hash"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("DiffVindexConfigs(different types) err: %v, want %s", err, wantErr)
+	}
+}
@@ -18,7 +18,9 @@ package vindexes
 
 import (
 	"encoding/json"
+	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
 
@@ -1629,3 +1631,66 @@ func TestFindSingleKeyspace(t *testing.T) {
 		t.Errorf("FindTable(\"\"): %v, want %s", err, wantErr)
 	}
 }
+
+func TestRegisterDuplicate(t *testing.T) {
+	Register("stfu_dup", NewSTFU)
+	defer Unregister("stfu_dup")
+
+	func() {
+		defer func() {
+			want := "vindex type stfu_dup is already registered"
+			if got := recover(); got != want {
+				t.Errorf("Register(stfu_dup) twice: panic %v, want %s", got, want)
+			}
+		}()
+		Register("stfu_dup", NewSTF)
+	}()
+	// The first registration is kept.
+	v, err := CreateVindex("stfu_dup", "v", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := v.(*stFU); !ok {
+		t.Errorf("CreateVindex(stfu_dup): %T, want *stFU", v)
+	}
+
+	Unregister("stfu_dup")
+	if _, err := CreateVindex("stfu_dup", "v", nil); err == nil {
+		t.Errorf("CreateVindex(stfu_dup) after Unregister: nil error")
+	}
+	Register("stfu_dup", NewSTF)
+}
+
+func TestRegisteredVindexes(t *testing.T) {
+	got := RegisteredVindexes()
+	if !sort.StringsAreSorted(got) {
+		t.Errorf("RegisteredVindexes(): %v, not sorted", got)
+	}
+	for _, want := range []string{"hash", "lookup", "stfu"} {
+		found := false
+		for _, vindexType := range got {
+			if vindexType == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("RegisteredVindexes(): %v, missing %s", got, want)
+		}
+	}
+
+	// It can be called while vindexes are registered.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			RegisteredVindexes()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		vindexType := fmt.Sprintf("stfu_concurrent%d", i)
+		Register(vindexType, NewSTFU)
+		defer Unregister(vindexType)
+	}
+	<-done
+}
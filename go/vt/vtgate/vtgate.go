@@ -44,6 +44,7 @@ import (
 	"github.com/youtube/vitess/go/vt/vterrors"
 
 	"github.com/youtube/vitess/go/vt/vtgate/gateway"
+	"github.com/youtube/vitess/go/vt/vtgate/vindexes"
 	"github.com/youtube/vitess/go/vt/vtgate/vtgateservice"
 
 	querypb "github.com/youtube/vitess/go/vt/proto/query"
@@ -155,6 +156,7 @@ func Init(ctx context.Context, hc discovery.HealthCheck, topoServer *topo.Server
 	// vschemaCounters needs to be initialized before planner to
 	// catch the initial load stats.
 	vschemaCounters = stats.NewCounters("VtgateVSchemaCounts")
+	initLookupPools()
 
 	// Build objects from low to high level.
 	// Start with the gateway. If we can't reach the topology service,
@@ -238,6 +240,7 @@ func Init(ctx context.Context, hc discovery.HealthCheck, topoServer *topo.Server
 			f(rpcVTGate)
 		}
 	})
+	servenv.OnTermSync(vindexes.DrainAsyncWrites)
 	rpcVTGate.registerDebugHealthHandler()
 	err := initQueryLogger(rpcVTGate)
 	if err != nil {
@@ -283,6 +286,7 @@ func (vtg *VTGate) Execute(ctx context.Context, session *vtgatepb.Session, sql s
 	target := vtg.executor.ParseTarget(session.TargetString)
 	statsKey := []string{"Execute", target.Keyspace, topoproto.TabletTypeLString(target.TabletType)}
 	defer vtg.timings.Record(statsKey, time.Now())
+	ctx = withRequestID(ctx)
 
 	if bvErr := sqltypes.ValidateBindVariables(bindVariables); bvErr != nil {
 		err = vterrors.Errorf(vtrpcpb.Code_INVALID_ARGUMENT, "%v", bvErr)
@@ -310,6 +314,7 @@ func (vtg *VTGate) ExecuteBatch(ctx context.Context, session *vtgatepb.Session,
 	target := vtg.executor.ParseTarget(session.TargetString)
 	statsKey := []string{"ExecuteBatch", target.Keyspace, topoproto.TabletTypeLString(target.TabletType)}
 	defer vtg.timings.Record(statsKey, time.Now())
+	ctx = withRequestID(ctx)
 
 	for _, bindVariables := range bindVariablesList {
 		if bvErr := sqltypes.ValidateBindVariables(bindVariables); bvErr != nil {
@@ -336,6 +341,7 @@ func (vtg *VTGate) StreamExecute(ctx context.Context, session *vtgatepb.Session,
 	target := vtg.executor.ParseTarget(session.TargetString)
 	statsKey := []string{"StreamExecute", target.Keyspace, topoproto.TabletTypeLString(target.TabletType)}
 	defer vtg.timings.Record(statsKey, time.Now())
+	ctx = withRequestID(ctx)
 
 	var err error
 	if bvErr := sqltypes.ValidateBindVariables(bindVariables); bvErr != nil {
@@ -43,6 +43,11 @@ type server struct {
 
 func (s *server) Ping(ctx context.Context, request *tabletmanagerdatapb.PingRequest) (response *tabletmanagerdatapb.PingResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "Ping", request, response, false /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("Ping", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.PingResponse{
 		Payload: s.agent.Ping(ctx, request.Payload),
@@ -52,6 +57,11 @@ func (s *server) Ping(ctx context.Context, request *tabletmanagerdatapb.PingRequ
 
 func (s *server) Sleep(ctx context.Context, request *tabletmanagerdatapb.SleepRequest) (response *tabletmanagerdatapb.SleepResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "Sleep", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("Sleep", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.SleepResponse{}
 	s.agent.Sleep(ctx, time.Duration(request.Duration))
@@ -60,6 +70,11 @@ func (s *server) Sleep(ctx context.Context, request *tabletmanagerdatapb.SleepRe
 
 func (s *server) ExecuteHook(ctx context.Context, request *tabletmanagerdatapb.ExecuteHookRequest) (response *tabletmanagerdatapb.ExecuteHookResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "ExecuteHook", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("ExecuteHook", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.ExecuteHookResponse{}
 	hr := s.agent.ExecuteHook(ctx, &hook.Hook{
@@ -75,6 +90,11 @@ func (s *server) ExecuteHook(ctx context.Context, request *tabletmanagerdatapb.E
 
 func (s *server) GetSchema(ctx context.Context, request *tabletmanagerdatapb.GetSchemaRequest) (response *tabletmanagerdatapb.GetSchemaResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "GetSchema", request, response, false /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("GetSchema", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.GetSchemaResponse{}
 	sd, err := s.agent.GetSchema(ctx, request.Tables, request.ExcludeTables, request.IncludeViews)
@@ -86,6 +106,11 @@ func (s *server) GetSchema(ctx context.Context, request *tabletmanagerdatapb.Get
 
 func (s *server) GetPermissions(ctx context.Context, request *tabletmanagerdatapb.GetPermissionsRequest) (response *tabletmanagerdatapb.GetPermissionsResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "GetPermissions", request, response, false /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("GetPermissions", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.GetPermissionsResponse{}
 	p, err := s.agent.GetPermissions(ctx)
@@ -101,6 +126,11 @@ func (s *server) GetPermissions(ctx context.Context, request *tabletmanagerdatap
 
 func (s *server) SetReadOnly(ctx context.Context, request *tabletmanagerdatapb.SetReadOnlyRequest) (response *tabletmanagerdatapb.SetReadOnlyResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "SetReadOnly", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("SetReadOnly", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.SetReadOnlyResponse{}
 	return response, s.agent.SetReadOnly(ctx, true)
@@ -108,6 +138,11 @@ func (s *server) SetReadOnly(ctx context.Context, request *tabletmanagerdatapb.S
 
 func (s *server) SetReadWrite(ctx context.Context, request *tabletmanagerdatapb.SetReadWriteRequest) (response *tabletmanagerdatapb.SetReadWriteResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "SetReadWrite", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("SetReadWrite", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.SetReadWriteResponse{}
 	return response, s.agent.SetReadOnly(ctx, false)
@@ -115,6 +150,11 @@ func (s *server) SetReadWrite(ctx context.Context, request *tabletmanagerdatapb.
 
 func (s *server) ChangeType(ctx context.Context, request *tabletmanagerdatapb.ChangeTypeRequest) (response *tabletmanagerdatapb.ChangeTypeResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "ChangeType", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("ChangeType", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.ChangeTypeResponse{}
 	return response, s.agent.ChangeType(ctx, request.TabletType)
@@ -122,6 +162,11 @@ func (s *server) ChangeType(ctx context.Context, request *tabletmanagerdatapb.Ch
 
 func (s *server) RefreshState(ctx context.Context, request *tabletmanagerdatapb.RefreshStateRequest) (response *tabletmanagerdatapb.RefreshStateResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "RefreshState", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("RefreshState", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.RefreshStateResponse{}
 	return response, s.agent.RefreshState(ctx)
@@ -129,6 +174,11 @@ func (s *server) RefreshState(ctx context.Context, request *tabletmanagerdatapb.
 
 func (s *server) RunHealthCheck(ctx context.Context, request *tabletmanagerdatapb.RunHealthCheckRequest) (response *tabletmanagerdatapb.RunHealthCheckResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "RunHealthCheck", request, response, false /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("RunHealthCheck", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.RunHealthCheckResponse{}
 	s.agent.RunHealthCheck(ctx)
@@ -137,6 +187,11 @@ func (s *server) RunHealthCheck(ctx context.Context, request *tabletmanagerdatap
 
 func (s *server) IgnoreHealthError(ctx context.Context, request *tabletmanagerdatapb.IgnoreHealthErrorRequest) (response *tabletmanagerdatapb.IgnoreHealthErrorResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "IgnoreHealthError", request, response, false /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("IgnoreHealthError", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.IgnoreHealthErrorResponse{}
 	return response, s.agent.IgnoreHealthError(ctx, request.Pattern)
@@ -144,6 +199,11 @@ func (s *server) IgnoreHealthError(ctx context.Context, request *tabletmanagerda
 
 func (s *server) ReloadSchema(ctx context.Context, request *tabletmanagerdatapb.ReloadSchemaRequest) (response *tabletmanagerdatapb.ReloadSchemaResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "ReloadSchema", request, response, false /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("ReloadSchema", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.ReloadSchemaResponse{}
 	return response, s.agent.ReloadSchema(ctx, request.WaitPosition)
@@ -151,6 +211,11 @@ func (s *server) ReloadSchema(ctx context.Context, request *tabletmanagerdatapb.
 
 func (s *server) PreflightSchema(ctx context.Context, request *tabletmanagerdatapb.PreflightSchemaRequest) (response *tabletmanagerdatapb.PreflightSchemaResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "PreflightSchema", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("PreflightSchema", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.PreflightSchemaResponse{}
 	results, err := s.agent.PreflightSchema(ctx, request.Changes)
@@ -162,6 +227,11 @@ func (s *server) PreflightSchema(ctx context.Context, request *tabletmanagerdata
 
 func (s *server) ApplySchema(ctx context.Context, request *tabletmanagerdatapb.ApplySchemaRequest) (response *tabletmanagerdatapb.ApplySchemaResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "ApplySchema", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("ApplySchema", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.ApplySchemaResponse{}
 	scr, err := s.agent.ApplySchema(ctx, &tmutils.SchemaChange{
@@ -180,6 +250,11 @@ func (s *server) ApplySchema(ctx context.Context, request *tabletmanagerdatapb.A
 
 func (s *server) ExecuteFetchAsDba(ctx context.Context, request *tabletmanagerdatapb.ExecuteFetchAsDbaRequest) (response *tabletmanagerdatapb.ExecuteFetchAsDbaResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "ExecuteFetchAsDba", request, response, false /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("ExecuteFetchAsDba", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.ExecuteFetchAsDbaResponse{}
 	qr, err := s.agent.ExecuteFetchAsDba(ctx, request.Query, request.DbName, int(request.MaxRows), request.DisableBinlogs, request.ReloadSchema)
@@ -192,6 +267,11 @@ func (s *server) ExecuteFetchAsDba(ctx context.Context, request *tabletmanagerda
 
 func (s *server) ExecuteFetchAsAllPrivs(ctx context.Context, request *tabletmanagerdatapb.ExecuteFetchAsAllPrivsRequest) (response *tabletmanagerdatapb.ExecuteFetchAsAllPrivsResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "ExecuteFetchAsAllPrivs", request, response, false /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("ExecuteFetchAsAllPrivs", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.ExecuteFetchAsAllPrivsResponse{}
 	qr, err := s.agent.ExecuteFetchAsAllPrivs(ctx, request.Query, request.DbName, int(request.MaxRows), request.ReloadSchema)
@@ -204,6 +284,11 @@ func (s *server) ExecuteFetchAsAllPrivs(ctx context.Context, request *tabletmana
 
 func (s *server) ExecuteFetchAsApp(ctx context.Context, request *tabletmanagerdatapb.ExecuteFetchAsAppRequest) (response *tabletmanagerdatapb.ExecuteFetchAsAppResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "ExecuteFetchAsApp", request, response, false /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("ExecuteFetchAsApp", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.ExecuteFetchAsAppResponse{}
 	qr, err := s.agent.ExecuteFetchAsApp(ctx, request.Query, int(request.MaxRows))
@@ -220,6 +305,11 @@ func (s *server) ExecuteFetchAsApp(ctx context.Context, request *tabletmanagerda
 
 func (s *server) SlaveStatus(ctx context.Context, request *tabletmanagerdatapb.SlaveStatusRequest) (response *tabletmanagerdatapb.SlaveStatusResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "SlaveStatus", request, response, false /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("SlaveStatus", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.SlaveStatusResponse{}
 	status, err := s.agent.SlaveStatus(ctx)
@@ -231,6 +321,11 @@ func (s *server) SlaveStatus(ctx context.Context, request *tabletmanagerdatapb.S
 
 func (s *server) MasterPosition(ctx context.Context, request *tabletmanagerdatapb.MasterPositionRequest) (response *tabletmanagerdatapb.MasterPositionResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "MasterPosition", request, response, false /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("MasterPosition", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.MasterPositionResponse{}
 	position, err := s.agent.MasterPosition(ctx)
@@ -242,6 +337,11 @@ func (s *server) MasterPosition(ctx context.Context, request *tabletmanagerdatap
 
 func (s *server) StopSlave(ctx context.Context, request *tabletmanagerdatapb.StopSlaveRequest) (response *tabletmanagerdatapb.StopSlaveResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "StopSlave", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("StopSlave", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.StopSlaveResponse{}
 	return response, s.agent.StopSlave(ctx)
@@ -249,6 +349,11 @@ func (s *server) StopSlave(ctx context.Context, request *tabletmanagerdatapb.Sto
 
 func (s *server) StopSlaveMinimum(ctx context.Context, request *tabletmanagerdatapb.StopSlaveMinimumRequest) (response *tabletmanagerdatapb.StopSlaveMinimumResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "StopSlaveMinimum", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("StopSlaveMinimum", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.StopSlaveMinimumResponse{}
 	position, err := s.agent.StopSlaveMinimum(ctx, request.Position, time.Duration(request.WaitTimeout))
@@ -260,6 +365,11 @@ func (s *server) StopSlaveMinimum(ctx context.Context, request *tabletmanagerdat
 
 func (s *server) StartSlave(ctx context.Context, request *tabletmanagerdatapb.StartSlaveRequest) (response *tabletmanagerdatapb.StartSlaveResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "StartSlave", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("StartSlave", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.StartSlaveResponse{}
 	return response, s.agent.StartSlave(ctx)
@@ -267,6 +377,11 @@ func (s *server) StartSlave(ctx context.Context, request *tabletmanagerdatapb.St
 
 func (s *server) TabletExternallyReparented(ctx context.Context, request *tabletmanagerdatapb.TabletExternallyReparentedRequest) (response *tabletmanagerdatapb.TabletExternallyReparentedResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "TabletExternallyReparented", request, response, false /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("TabletExternallyReparented", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.TabletExternallyReparentedResponse{}
 	return response, s.agent.TabletExternallyReparented(ctx, request.ExternalId)
@@ -278,6 +393,11 @@ func (s *server) TabletExternallyElected(ctx context.Context, request *tabletman
 
 func (s *server) GetSlaves(ctx context.Context, request *tabletmanagerdatapb.GetSlavesRequest) (response *tabletmanagerdatapb.GetSlavesResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "GetSlaves", request, response, false /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("GetSlaves", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.GetSlavesResponse{}
 	addrs, err := s.agent.GetSlaves(ctx)
@@ -289,6 +409,11 @@ func (s *server) GetSlaves(ctx context.Context, request *tabletmanagerdatapb.Get
 
 func (s *server) WaitBlpPosition(ctx context.Context, request *tabletmanagerdatapb.WaitBlpPositionRequest) (response *tabletmanagerdatapb.WaitBlpPositionResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "WaitBlpPosition", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("WaitBlpPosition", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.WaitBlpPositionResponse{}
 	return response, s.agent.WaitBlpPosition(ctx, request.BlpPosition, time.Duration(request.WaitTimeout))
@@ -296,6 +421,11 @@ func (s *server) WaitBlpPosition(ctx context.Context, request *tabletmanagerdata
 
 func (s *server) StopBlp(ctx context.Context, request *tabletmanagerdatapb.StopBlpRequest) (response *tabletmanagerdatapb.StopBlpResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "StopBlp", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("StopBlp", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.StopBlpResponse{}
 	positions, err := s.agent.StopBlp(ctx)
@@ -307,6 +437,11 @@ func (s *server) StopBlp(ctx context.Context, request *tabletmanagerdatapb.StopB
 
 func (s *server) StartBlp(ctx context.Context, request *tabletmanagerdatapb.StartBlpRequest) (response *tabletmanagerdatapb.StartBlpResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "StartBlp", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("StartBlp", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.StartBlpResponse{}
 	return response, s.agent.StartBlp(ctx)
@@ -314,6 +449,11 @@ func (s *server) StartBlp(ctx context.Context, request *tabletmanagerdatapb.Star
 
 func (s *server) RunBlpUntil(ctx context.Context, request *tabletmanagerdatapb.RunBlpUntilRequest) (response *tabletmanagerdatapb.RunBlpUntilResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "RunBlpUntil", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("RunBlpUntil", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.RunBlpUntilResponse{}
 	position, err := s.agent.RunBlpUntil(ctx, request.BlpPositions, time.Duration(request.WaitTimeout))
@@ -329,6 +469,11 @@ func (s *server) RunBlpUntil(ctx context.Context, request *tabletmanagerdatapb.R
 
 func (s *server) ResetReplication(ctx context.Context, request *tabletmanagerdatapb.ResetReplicationRequest) (response *tabletmanagerdatapb.ResetReplicationResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "ResetReplication", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("ResetReplication", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.ResetReplicationResponse{}
 	return response, s.agent.ResetReplication(ctx)
@@ -336,6 +481,11 @@ func (s *server) ResetReplication(ctx context.Context, request *tabletmanagerdat
 
 func (s *server) InitMaster(ctx context.Context, request *tabletmanagerdatapb.InitMasterRequest) (response *tabletmanagerdatapb.InitMasterResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "InitMaster", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("InitMaster", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.InitMasterResponse{}
 	position, err := s.agent.InitMaster(ctx)
@@ -347,6 +497,11 @@ func (s *server) InitMaster(ctx context.Context, request *tabletmanagerdatapb.In
 
 func (s *server) PopulateReparentJournal(ctx context.Context, request *tabletmanagerdatapb.PopulateReparentJournalRequest) (response *tabletmanagerdatapb.PopulateReparentJournalResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "PopulateReparentJournal", request, response, false /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("PopulateReparentJournal", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.PopulateReparentJournalResponse{}
 	return response, s.agent.PopulateReparentJournal(ctx, request.TimeCreatedNs, request.ActionName, request.MasterAlias, request.ReplicationPosition)
@@ -354,6 +509,11 @@ func (s *server) PopulateReparentJournal(ctx context.Context, request *tabletman
 
 func (s *server) InitSlave(ctx context.Context, request *tabletmanagerdatapb.InitSlaveRequest) (response *tabletmanagerdatapb.InitSlaveResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "InitSlave", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("InitSlave", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.InitSlaveResponse{}
 	return response, s.agent.InitSlave(ctx, request.Parent, request.ReplicationPosition, request.TimeCreatedNs)
@@ -361,6 +521,11 @@ func (s *server) InitSlave(ctx context.Context, request *tabletmanagerdatapb.Ini
 
 func (s *server) DemoteMaster(ctx context.Context, request *tabletmanagerdatapb.DemoteMasterRequest) (response *tabletmanagerdatapb.DemoteMasterResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "DemoteMaster", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("DemoteMaster", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.DemoteMasterResponse{}
 	position, err := s.agent.DemoteMaster(ctx)
@@ -372,6 +537,11 @@ func (s *server) DemoteMaster(ctx context.Context, request *tabletmanagerdatapb.
 
 func (s *server) PromoteSlaveWhenCaughtUp(ctx context.Context, request *tabletmanagerdatapb.PromoteSlaveWhenCaughtUpRequest) (response *tabletmanagerdatapb.PromoteSlaveWhenCaughtUpResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "PromoteSlaveWhenCaughtUp", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("PromoteSlaveWhenCaughtUp", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.PromoteSlaveWhenCaughtUpResponse{}
 	position, err := s.agent.PromoteSlaveWhenCaughtUp(ctx, request.Position)
@@ -383,6 +553,11 @@ func (s *server) PromoteSlaveWhenCaughtUp(ctx context.Context, request *tabletma
 
 func (s *server) SlaveWasPromoted(ctx context.Context, request *tabletmanagerdatapb.SlaveWasPromotedRequest) (response *tabletmanagerdatapb.SlaveWasPromotedResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "SlaveWasPromoted", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("SlaveWasPromoted", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.SlaveWasPromotedResponse{}
 	return response, s.agent.SlaveWasPromoted(ctx)
@@ -390,6 +565,11 @@ func (s *server) SlaveWasPromoted(ctx context.Context, request *tabletmanagerdat
 
 func (s *server) SetMaster(ctx context.Context, request *tabletmanagerdatapb.SetMasterRequest) (response *tabletmanagerdatapb.SetMasterResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "SetMaster", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("SetMaster", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.SetMasterResponse{}
 	return response, s.agent.SetMaster(ctx, request.Parent, request.TimeCreatedNs, request.ForceStartSlave)
@@ -397,6 +577,11 @@ func (s *server) SetMaster(ctx context.Context, request *tabletmanagerdatapb.Set
 
 func (s *server) SlaveWasRestarted(ctx context.Context, request *tabletmanagerdatapb.SlaveWasRestartedRequest) (response *tabletmanagerdatapb.SlaveWasRestartedResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "SlaveWasRestarted", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("SlaveWasRestarted", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.SlaveWasRestartedResponse{}
 	return response, s.agent.SlaveWasRestarted(ctx, request.Parent)
@@ -404,6 +589,11 @@ func (s *server) SlaveWasRestarted(ctx context.Context, request *tabletmanagerda
 
 func (s *server) StopReplicationAndGetStatus(ctx context.Context, request *tabletmanagerdatapb.StopReplicationAndGetStatusRequest) (response *tabletmanagerdatapb.StopReplicationAndGetStatusResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "StopReplicationAndGetStatus", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("StopReplicationAndGetStatus", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.StopReplicationAndGetStatusResponse{}
 	status, err := s.agent.StopReplicationAndGetStatus(ctx)
@@ -415,6 +605,11 @@ func (s *server) StopReplicationAndGetStatus(ctx context.Context, request *table
 
 func (s *server) PromoteSlave(ctx context.Context, request *tabletmanagerdatapb.PromoteSlaveRequest) (response *tabletmanagerdatapb.PromoteSlaveResponse, err error) {
 	defer s.agent.HandleRPCPanic(ctx, "PromoteSlave", request, response, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("PromoteSlave", request)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 	response = &tabletmanagerdatapb.PromoteSlaveResponse{}
 	position, err := s.agent.PromoteSlave(ctx)
@@ -427,6 +622,11 @@ func (s *server) PromoteSlave(ctx context.Context, request *tabletmanagerdatapb.
 func (s *server) Backup(request *tabletmanagerdatapb.BackupRequest, stream tabletmanagerservicepb.TabletManager_BackupServer) (err error) {
 	ctx := stream.Context()
 	defer s.agent.HandleRPCPanic(ctx, "Backup", request, nil, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("Backup", request)
+	defer done()
+	if err != nil {
+		return err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 
 	// create a logger, send the result back to the caller
@@ -445,6 +645,11 @@ func (s *server) Backup(request *tabletmanagerdatapb.BackupRequest, stream table
 func (s *server) RestoreFromBackup(request *tabletmanagerdatapb.RestoreFromBackupRequest, stream tabletmanagerservicepb.TabletManager_RestoreFromBackupServer) (err error) {
 	ctx := stream.Context()
 	defer s.agent.HandleRPCPanic(ctx, "RestoreFromBackup", request, nil, true /*verbose*/, &err)
+	done, err := tabletmanager.BeginRPC("RestoreFromBackup", request)
+	defer done()
+	if err != nil {
+		return err
+	}
 	ctx = callinfo.GRPCCallInfo(ctx)
 
 	// create a logger, send the result back to the caller
@@ -194,6 +194,19 @@ type ActionAgent struct {
 	// _slaveStopped remembers if we've been told to stop replicating.
 	// If it's nil, we'll try to check for the slaveStoppedFile.
 	_slaveStopped *bool
+
+	// _pauseChan is set by Pause, and closed and cleared by Resume.
+	// While it's set, actions that need the actionMutex wait for it
+	// to be closed.
+	_pauseChan chan struct{}
+
+	// _draining is set by DrainLockActions when the agent shuts down.
+	// Actions that need the actionMutex fail while it's set.
+	_draining bool
+
+	// _actionDone is set while an action holds the actionMutex, and
+	// closed by unlock, so that DrainLockActions can wait for it.
+	_actionDone chan struct{}
 }
 
 // NewActionAgent creates a new ActionAgent and registers all the
@@ -647,10 +660,17 @@ func (agent *ActionAgent) Start(ctx context.Context, mysqlHost string, mysqlPort
 	return nil
 }
 
-// Close prepares a tablet for shutdown. First we check our tablet ownership and
-// then prune the tablet topology entry of all post-init fields. This prevents
-// stale identifiers from hanging around in topology.
+// Close prepares a tablet for shutdown. First we wait, up to
+// -drain_lock_actions_timeout, for the running action to finish, and refuse
+// new ones. Then we check our tablet ownership and prune the tablet topology
+// entry of all post-init fields. This prevents stale identifiers from hanging
+// around in topology.
 func (agent *ActionAgent) Close() {
+	// let the running action, if any, finish before exiting
+	if err := agent.DrainLockActions(*drainLockActionsTimeout); err != nil {
+		log.Warningf("Failed to drain tablet manager actions: %v", err)
+	}
+
 	// cleanup initialized fields in the tablet entry
 	f := func(tablet *topodatapb.Tablet) error {
 		if err := topotools.CheckOwnership(agent.initialTablet, tablet); err != nil {
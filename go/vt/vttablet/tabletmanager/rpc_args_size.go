@@ -0,0 +1,71 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tabletmanager
+
+import (
+	"flag"
+	"fmt"
+
+	log "github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/youtube/vitess/go/stats"
+)
+
+// This file contains the guard against the tablet manager RPCs
+// whose args are too large, like the ones of a malformed client.
+
+var (
+	maxRPCArgsSize = flag.Int("tablet_manager_rpc_max_args_size", 0, "maximum size in bytes of the serialized args of a tablet manager RPC. Larger calls are rejected before they run, and their args are not logged. 0 means no limit.")
+	logRPCArgsSize = flag.Bool("tablet_manager_rpc_log_args_size", false, "log the size of the serialized args of each tablet manager RPC")
+
+	// argsSizeRejections counts the calls rejected because of the size
+	// of their args, by RPC.
+	argsSizeRejections = stats.NewCounters("TabletManagerArgsSizeRejections")
+)
+
+// ArgsSizeError is returned for the calls of an RPC whose
+// serialized args are larger than -tablet_manager_rpc_max_args_size.
+type ArgsSizeError struct {
+	Name string
+	Size int
+	Max  int
+}
+
+func (e *ArgsSizeError) Error() string {
+	return fmt.Sprintf("args of action %v are too large: %d bytes, the maximum is %d", e.Name, e.Size, e.Max)
+}
+
+// CheckArgsSize logs the serialized size of the args of the RPC if
+// -tablet_manager_rpc_log_args_size is set, and returns an
+// *ArgsSizeError if it's larger than -tablet_manager_rpc_max_args_size.
+// It must be called after HandleRPCPanic was deferred, which then
+// doesn't log the args of the rejected call. The args are only
+// serialized if one of the flags is set.
+func CheckArgsSize(name string, args proto.Message) error {
+	if *maxRPCArgsSize <= 0 && !*logRPCArgsSize {
+		return nil
+	}
+	size := proto.Size(args)
+	if *logRPCArgsSize {
+		log.Infof("TabletManager.%v args size: %d bytes", name, size)
+	}
+	if *maxRPCArgsSize > 0 && size > *maxRPCArgsSize {
+		argsSizeRejections.Add(name, 1)
+		return &ArgsSizeError{Name: name, Size: size, Max: *maxRPCArgsSize}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tabletmanager
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	tabletmanagerdatapb "github.com/youtube/vitess/go/vt/proto/tabletmanagerdata"
+)
+
+func TestCheckArgsSize(t *testing.T) {
+	args := &tabletmanagerdatapb.PingRequest{Payload: strings.Repeat("x", 100)}
+
+	// No limit by default.
+	if err := CheckArgsSize("Ping", args); err != nil {
+		t.Fatalf("CheckArgsSize without limit: %v", err)
+	}
+
+	defer func(max int) { *maxRPCArgsSize = max }(*maxRPCArgsSize)
+	size := proto.Size(args)
+	*maxRPCArgsSize = size
+	if err := CheckArgsSize("Ping", args); err != nil {
+		t.Fatalf("CheckArgsSize at the limit: %v", err)
+	}
+
+	*maxRPCArgsSize = size - 1
+	before := argsSizeRejections.Counts()["Ping"]
+	err := CheckArgsSize("Ping", args)
+	want := fmt.Sprintf("args of action Ping are too large: %d bytes, the maximum is %d", size, size-1)
+	if _, ok := err.(*ArgsSizeError); !ok || err.Error() != want {
+		t.Fatalf("CheckArgsSize over the limit: %v, want %s", err, want)
+	}
+	if got := argsSizeRejections.Counts()["Ping"] - before; got != 1 {
+		t.Errorf("TabletManagerArgsSizeRejections: %d, want 1", got)
+	}
+}
+
+func TestBeginRPC(t *testing.T) {
+	args := &tabletmanagerdatapb.PingRequest{Payload: strings.Repeat("x", 100)}
+	before := rpcTimings.Counts()["BeginRPCTest"]
+	done, err := BeginRPC("BeginRPCTest", args)
+	if err != nil {
+		t.Fatalf("BeginRPC: %v", err)
+	}
+	done()
+
+	// A rejected call is still timed.
+	defer func(max int) { *maxRPCArgsSize = max }(*maxRPCArgsSize)
+	*maxRPCArgsSize = 1
+	done, err = BeginRPC("BeginRPCTest", args)
+	if _, ok := err.(*ArgsSizeError); !ok {
+		t.Fatalf("BeginRPC over the limit: %v, want an *ArgsSizeError", err)
+	}
+	done()
+	if got := rpcTimings.Counts()["BeginRPCTest"] - before; got != 2 {
+		t.Errorf("TabletManagerRPCs: %d, want 2", got)
+	}
+}
@@ -29,13 +29,20 @@ import (
 	topodatapb "github.com/youtube/vitess/go/vt/proto/topodata"
 )
 
-// Backup takes a db backup and sends it to the BackupStorage
+// Backup takes a db backup and sends it to the BackupStorage.
+// Its progress is logged to logger, which the streaming RPC relays
+// to the client.
 func (agent *ActionAgent) Backup(ctx context.Context, concurrency int, logger logutil.Logger) error {
-	if err := agent.lock(ctx); err != nil {
-		return err
-	}
-	defer agent.unlock()
+	// create the loggers: tee to console and source
+	l := logutil.NewTeeLogger(logutil.NewConsoleLogger(), logger)
 
+	return agent.lockWithProgress(ctx, "Backup", LoggerProgressReporter(l), func(ctx context.Context, progress func(percent int, message string)) error {
+		return agent.backupLocked(ctx, concurrency, l, progress)
+	})
+}
+
+// backupLocked implements Backup, with the actionMutex held.
+func (agent *ActionAgent) backupLocked(ctx context.Context, concurrency int, l logutil.Logger, progress func(percent int, message string)) error {
 	// update our type to BACKUP
 	tablet, err := agent.TopoServer.GetTablet(ctx, agent.TabletAlias)
 	if err != nil {
@@ -54,15 +61,14 @@ func (agent *ActionAgent) Backup(ctx context.Context, concurrency int, logger lo
 		return err
 	}
 
-	// create the loggers: tee to console and source
-	l := logutil.NewTeeLogger(logutil.NewConsoleLogger(), logger)
-
 	// now we can run the backup
+	progress(10, "backing up the files")
 	dir := fmt.Sprintf("%v/%v", tablet.Keyspace, tablet.Shard)
 	name := fmt.Sprintf("%v.%v", time.Now().UTC().Format("2006-01-02.150405"), topoproto.TabletAliasString(tablet.Alias))
 	returnErr := mysqlctl.Backup(ctx, agent.MysqlDaemon, l, dir, name, concurrency, agent.hookExtraEnv())
 
 	// change our type back to the original value
+	progress(90, fmt.Sprintf("changing the tablet type back to %v", originalType))
 	_, err = topotools.ChangeType(ctx, agent.TopoServer, tablet.Alias, originalType)
 	if err != nil {
 		// failure in changing the topology type is probably worse,
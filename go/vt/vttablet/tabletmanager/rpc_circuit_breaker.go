@@ -0,0 +1,162 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tabletmanager
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/youtube/vitess/go/stats"
+)
+
+// This file contains the circuit breakers of the tablet manager RPCs.
+// There is one breaker per RPC name. A breaker opens after
+// -rpc_circuit_breaker_threshold consecutive failures of its RPC, and
+// then fails the calls for -rpc_circuit_breaker_cooldown. After that,
+// it lets a single call through to probe the RPC: if it succeeds, the
+// breaker closes, otherwise it opens again.
+
+var (
+	circuitBreakerThreshold = flag.Int("rpc_circuit_breaker_threshold", 0, "number of consecutive failures of a tablet manager RPC after which it's failed without being attempted for -rpc_circuit_breaker_cooldown. 0 disables the circuit breakers.")
+	circuitBreakerCooldown  = flag.Duration("rpc_circuit_breaker_cooldown", 30*time.Second, "how long a tablet manager RPC is failed without being attempted once its circuit breaker opens")
+
+	circuitBreakersMu sync.Mutex
+	circuitBreakers   = make(map[string]*circuitBreaker)
+
+	// circuitBreakerRejections counts the calls failed by an open breaker, by RPC.
+	circuitBreakerRejections = stats.NewCounters("TabletManagerCircuitBreakerRejections")
+)
+
+func init() {
+	// TabletManagerCircuitBreakerState is 0 if the breaker of an RPC is
+	// closed, 1 if it's open, and 2 if it's half-open (probing).
+	stats.Publish("TabletManagerCircuitBreakerState", stats.CountersFunc(func() map[string]int64 {
+		circuitBreakersMu.Lock()
+		defer circuitBreakersMu.Unlock()
+		states := make(map[string]int64, len(circuitBreakers))
+		for name, cb := range circuitBreakers {
+			states[name] = int64(cb.getState())
+		}
+		return states
+	}))
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// CircuitOpenError is returned for the calls of an RPC
+// whose circuit breaker is open.
+type CircuitOpenError struct {
+	Name string
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open for action %v", e.Name)
+}
+
+type circuitBreaker struct {
+	mu        sync.Mutex
+	state     circuitState
+	failures  int
+	openUntil time.Time
+}
+
+func getCircuitBreaker(name string) *circuitBreaker {
+	circuitBreakersMu.Lock()
+	defer circuitBreakersMu.Unlock()
+	cb, ok := circuitBreakers[name]
+	if !ok {
+		cb = &circuitBreaker{}
+		circuitBreakers[name] = cb
+	}
+	return cb
+}
+
+// CheckCircuit returns a *CircuitOpenError if the RPC should not be
+// attempted because its circuit breaker is open. It must be called
+// after HandleRPCPanic was deferred, since that's where the result
+// of the RPC is recorded.
+func CheckCircuit(name string) error {
+	if *circuitBreakerThreshold <= 0 {
+		return nil
+	}
+	if !getCircuitBreaker(name).allow(time.Now()) {
+		circuitBreakerRejections.Add(name, 1)
+		return &CircuitOpenError{Name: name}
+	}
+	return nil
+}
+
+// recordRPCResult updates the circuit breaker of the RPC with its result.
+func recordRPCResult(name string, err error) {
+	if *circuitBreakerThreshold <= 0 {
+		return
+	}
+	switch err.(type) {
+	case *CircuitOpenError, *ArgsSizeError:
+		// The RPC was not attempted.
+		return
+	}
+	getCircuitBreaker(name).record(err == nil, time.Now(), *circuitBreakerThreshold, *circuitBreakerCooldown)
+}
+
+func (cb *circuitBreaker) getState() circuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// allow returns true if a call can be attempted. Once the cooldown
+// is over, it lets one call through and half-opens the breaker.
+func (cb *circuitBreaker) allow(now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case circuitOpen:
+		if now.Before(cb.openUntil) {
+			return false
+		}
+		cb.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		// A probe is in progress.
+		return false
+	}
+	return true
+}
+
+func (cb *circuitBreaker) record(success bool, now time.Time, threshold int, cooldown time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if success {
+		cb.state = circuitClosed
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	if cb.state == circuitHalfOpen || cb.failures >= threshold {
+		cb.state = circuitOpen
+		cb.openUntil = now.Add(cooldown)
+	}
+}
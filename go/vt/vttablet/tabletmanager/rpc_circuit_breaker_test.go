@@ -0,0 +1,91 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tabletmanager
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := &circuitBreaker{}
+	now := time.Now()
+	failure := func() {
+		cb.record(false, now, 2 /* threshold */, time.Minute)
+	}
+
+	failure()
+	if !cb.allow(now) {
+		t.Fatalf("allow after 1 failure: false, want true")
+	}
+	failure()
+	if cb.allow(now) {
+		t.Fatalf("allow after 2 failures: true, want false")
+	}
+
+	// After the cooldown, a single probe is let through.
+	now = now.Add(time.Minute)
+	if !cb.allow(now) {
+		t.Fatalf("allow after cooldown: false, want true")
+	}
+	if cb.allow(now) {
+		t.Fatalf("allow during probe: true, want false")
+	}
+	// A failed probe opens the breaker again.
+	failure()
+	if got, want := cb.getState(), circuitOpen; got != want {
+		t.Fatalf("state after failed probe: %v, want %v", got, want)
+	}
+
+	now = now.Add(time.Minute)
+	if !cb.allow(now) {
+		t.Fatalf("allow after cooldown: false, want true")
+	}
+	cb.record(true, now, 2, time.Minute)
+	if got, want := cb.getState(), circuitClosed; got != want {
+		t.Fatalf("state after successful probe: %v, want %v", got, want)
+	}
+	failure()
+	if !cb.allow(now) {
+		t.Fatalf("allow after 1 failure: false, want true")
+	}
+}
+
+func TestCheckCircuit(t *testing.T) {
+	// Disabled by default.
+	for i := 0; i < 3; i++ {
+		recordRPCResult("TestCheckCircuit", errors.New("failed"))
+	}
+	if err := CheckCircuit("TestCheckCircuit"); err != nil {
+		t.Fatalf("CheckCircuit with breakers disabled: %v", err)
+	}
+
+	*circuitBreakerThreshold = 1
+	defer func() { *circuitBreakerThreshold = 0 }()
+	recordRPCResult("TestCheckCircuit", errors.New("failed"))
+	err := CheckCircuit("TestCheckCircuit")
+	want := "circuit open for action TestCheckCircuit"
+	if err == nil || err.Error() != want {
+		t.Fatalf("CheckCircuit: %v, want %v", err, want)
+	}
+	// The rejection itself doesn't count as a failure.
+	recordRPCResult("TestCheckCircuit", err)
+	if got := circuitBreakerRejections.Counts()["TestCheckCircuit"]; got != 1 {
+		t.Errorf("rejections: %v, want 1", got)
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tabletmanager
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/youtube/vitess/go/acl"
+	"github.com/youtube/vitess/go/stats"
+)
+
+// This file exports the p50, p95 and p99 latencies of the tablet
+// manager RPCs, by RPC name. They are computed from the histograms of
+// rpcTimings, so the RPCs are not timed twice.
+//
+// The percentiles are refreshed at most every
+// -tablet_manager_rpc_latency_refresh_interval, when they're read, and
+// cover the RPCs that finished since the previous refresh. An RPC that
+// didn't run in that window has no percentiles.
+//
+// Since the histograms only count the RPCs in buckets, a percentile is
+// the upper cutoff of the bucket that holds it: for instance, an RPC
+// whose p99 is 20ms is reported as 50ms. A percentile in the last,
+// unbounded bucket is reported as its lower cutoff, 10s.
+
+var rpcLatencyRefreshInterval = flag.Duration("tablet_manager_rpc_latency_refresh_interval", 1*time.Minute, "how often the percentiles of the tablet manager RPC latencies are refreshed. They cover the RPCs that finished during the interval.")
+
+// rpcLatencyPercentiles are the exported percentiles, with their names.
+var rpcLatencyPercentiles = []struct {
+	name    string
+	percent int64
+}{
+	{"P50", 50},
+	{"P95", 95},
+	{"P99", 99},
+}
+
+var rpcLatencies = newLatencyPercentiles(rpcTimings)
+
+func init() {
+	// TabletManagerRPCLatencyPercentiles are in nanoseconds, like
+	// TabletManagerRPCs, and keyed by RPC name and percentile, like
+	// ChangeType.P99.
+	stats.Publish("TabletManagerRPCLatencyPercentiles", stats.CountersFunc(func() map[string]int64 {
+		return rpcLatencies.get(time.Now(), *rpcLatencyRefreshInterval)
+	}))
+	http.Handle("/debug/tablet_manager_rpc_latency", rpcLatencies)
+}
+
+// latencyPercentiles computes the percentiles of the histograms of
+// a Timings over a refresh interval.
+type latencyPercentiles struct {
+	timings *stats.Timings
+
+	mu sync.Mutex
+	// refreshed is the time of the last refresh, and buckets the
+	// bucket counts of each histogram at that time.
+	refreshed   time.Time
+	buckets     map[string][]int64
+	percentiles map[string]int64
+}
+
+func newLatencyPercentiles(timings *stats.Timings) *latencyPercentiles {
+	return &latencyPercentiles{
+		timings:     timings,
+		buckets:     make(map[string][]int64),
+		percentiles: make(map[string]int64),
+	}
+}
+
+// get returns the percentiles, refreshed first if they're older than
+// interval.
+func (lp *latencyPercentiles) get(now time.Time, interval time.Duration) map[string]int64 {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if now.Sub(lp.refreshed) >= interval {
+		lp.refresh(now)
+	}
+	percentiles := make(map[string]int64, len(lp.percentiles))
+	for k, v := range lp.percentiles {
+		percentiles[k] = v
+	}
+	return percentiles
+}
+
+// refresh computes the percentiles of the RPCs that finished since the
+// previous refresh. lp.mu must be held.
+func (lp *latencyPercentiles) refresh(now time.Time) {
+	cutoffs := lp.timings.Cutoffs()
+	lp.percentiles = make(map[string]int64)
+	for name, hist := range lp.timings.Histograms() {
+		buckets := hist.Buckets()
+		previous := lp.buckets[name]
+		lp.buckets[name] = buckets
+		var count int64
+		window := make([]int64, len(buckets))
+		for i, b := range buckets {
+			window[i] = b
+			if previous != nil {
+				window[i] -= previous[i]
+			}
+			count += window[i]
+		}
+		if count == 0 {
+			continue
+		}
+		for _, p := range rpcLatencyPercentiles {
+			lp.percentiles[name+"."+p.name] = bucketPercentile(window, count, cutoffs, p.percent)
+		}
+	}
+	lp.refreshed = now
+}
+
+// bucketPercentile returns the upper cutoff of the bucket that holds
+// the percent percentile of the count values in buckets. The last
+// bucket has no upper cutoff, so its lower one is returned.
+func bucketPercentile(buckets []int64, count int64, cutoffs []int64, percent int64) int64 {
+	// rank is the 1-based rank of the percentile, rounded up.
+	rank := (count*percent + 99) / 100
+	var seen int64
+	for i, b := range buckets {
+		seen += b
+		if seen >= rank && i < len(cutoffs) {
+			return cutoffs[i]
+		}
+	}
+	return cutoffs[len(cutoffs)-1]
+}
+
+// ServeHTTP shows the percentiles, in milliseconds, by RPC name.
+func (lp *latencyPercentiles) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := acl.CheckAccessHTTP(r, acl.MONITORING); err != nil {
+		acl.SendError(w, err)
+		return
+	}
+	percentiles := lp.get(time.Now(), *rpcLatencyRefreshInterval)
+	byRPC := make(map[string]map[string]float64)
+	for key, ns := range percentiles {
+		i := strings.LastIndex(key, ".")
+		name, percentile := key[:i], key[i+1:]
+		if byRPC[name] == nil {
+			byRPC[name] = make(map[string]float64)
+		}
+		byRPC[name][percentile] = float64(ns) / float64(time.Millisecond)
+	}
+	data, err := json.MarshalIndent(byRPC, "", "  ")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot marshal the RPC latencies: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tabletmanager
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/stats"
+)
+
+func TestBucketPercentile(t *testing.T) {
+	cutoffs := []int64{10, 20, 30}
+	testcases := []struct {
+		buckets []int64
+		percent int64
+		want    int64
+	}{
+		{[]int64{1, 0, 0, 0}, 50, 10},
+		{[]int64{50, 50, 0, 0}, 50, 10},
+		{[]int64{50, 50, 0, 0}, 51, 20},
+		{[]int64{90, 5, 4, 1}, 95, 20},
+		{[]int64{90, 5, 4, 1}, 99, 30},
+		// The last bucket has no upper cutoff.
+		{[]int64{90, 5, 3, 2}, 99, 30},
+		{[]int64{0, 0, 0, 3}, 50, 30},
+	}
+	for _, tc := range testcases {
+		var count int64
+		for _, b := range tc.buckets {
+			count += b
+		}
+		if got := bucketPercentile(tc.buckets, count, cutoffs, tc.percent); got != tc.want {
+			t.Errorf("bucketPercentile(%v, p%d): %d, want %d", tc.buckets, tc.percent, got, tc.want)
+		}
+	}
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	timings := stats.NewTimings("")
+	lp := newLatencyPercentiles(timings)
+	now := time.Now()
+
+	for i := 0; i < 98; i++ {
+		timings.Add("ChangeType", 2*time.Millisecond)
+	}
+	timings.Add("ChangeType", 20*time.Millisecond)
+	timings.Add("ChangeType", 200*time.Millisecond)
+	timings.Add("Ping", 100*time.Microsecond)
+	want := map[string]int64{
+		"ChangeType.P50": int64(5 * time.Millisecond),
+		"ChangeType.P95": int64(5 * time.Millisecond),
+		"ChangeType.P99": int64(50 * time.Millisecond),
+		"Ping.P50":       int64(500 * time.Microsecond),
+		"Ping.P95":       int64(500 * time.Microsecond),
+		"Ping.P99":       int64(500 * time.Microsecond),
+	}
+	if got := lp.get(now, time.Minute); !reflect.DeepEqual(got, want) {
+		t.Errorf("get: %v, want %v", got, want)
+	}
+
+	// Within the interval, the percentiles are not refreshed.
+	timings.Add("Ping", 2*time.Second)
+	if got := lp.get(now.Add(30*time.Second), time.Minute); !reflect.DeepEqual(got, want) {
+		t.Errorf("get before the refresh: %v, want %v", got, want)
+	}
+
+	// After it, they only cover the RPCs since the previous refresh.
+	want = map[string]int64{
+		"Ping.P50": int64(5 * time.Second),
+		"Ping.P95": int64(5 * time.Second),
+		"Ping.P99": int64(5 * time.Second),
+	}
+	if got := lp.get(now.Add(time.Minute), time.Minute); !reflect.DeepEqual(got, want) {
+		t.Errorf("get after the refresh: %v, want %v", got, want)
+	}
+
+	// Without RPCs, there are no percentiles.
+	if got := lp.get(now.Add(2*time.Minute), time.Minute); len(got) != 0 {
+		t.Errorf("get without RPCs: %v, want none", got)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tabletmanager
+
+import (
+	"sync"
+
+	"github.com/youtube/vitess/go/vt/logutil"
+	"golang.org/x/net/context"
+)
+
+// This file contains the helpers for the long actions that report
+// their progress, like Backup. The streaming RPCs already send the
+// events of their logger to the client, so a LoggerProgressReporter
+// is enough to relay the progress to it.
+
+// Progress is an update on the progress of a long action.
+type Progress struct {
+	// Name is the name of the action, like "Backup".
+	Name string
+	// Percent is between 0 and 100.
+	Percent int
+	// Message describes the current step, and can be empty.
+	Message string
+}
+
+// ProgressReporter receives the progress of a long action.
+// It's called from the goroutines of the action, one at a time.
+type ProgressReporter func(p Progress)
+
+// LoggerProgressReporter returns a ProgressReporter that logs the
+// progress to logger.
+func LoggerProgressReporter(logger logutil.Logger) ProgressReporter {
+	return func(p Progress) {
+		if p.Message == "" {
+			logger.Infof("%v: %d%% done", p.Name, p.Percent)
+			return
+		}
+		logger.Infof("%v: %d%% done: %v", p.Name, p.Percent, p.Message)
+	}
+}
+
+// progressTracker relays the progress of one action to a reporter.
+// It drops the updates that don't move the progress forward, and
+// the ones sent after the action returned.
+type progressTracker struct {
+	name   string
+	report ProgressReporter
+
+	mu      sync.Mutex
+	percent int
+	done    bool
+}
+
+// update is the function given to the action to report its progress.
+// percent is capped to 99, since only the completion of the action
+// reports 100.
+func (pt *progressTracker) update(percent int, message string) {
+	if percent > 99 {
+		percent = 99
+	}
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if pt.done || percent < pt.percent || (percent == pt.percent && message == "") {
+		return
+	}
+	pt.percent = percent
+	pt.report(Progress{Name: pt.name, Percent: percent, Message: message})
+}
+
+// finish reports the completion of the action if it succeeded,
+// and stops relaying its updates.
+func (pt *progressTracker) finish(err error) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.done = true
+	if err == nil {
+		pt.report(Progress{Name: pt.name, Percent: 100})
+	}
+}
+
+// lockWithProgress is the variant of lock and unlock for the long
+// actions that report their progress: it runs action with the
+// actionMutex held, and relays what it gives to its progress function
+// to report. It reports 0% once the lock is taken, and 100% when
+// action succeeds. report can be nil.
+func (agent *ActionAgent) lockWithProgress(ctx context.Context, name string, report ProgressReporter, action func(ctx context.Context, progress func(percent int, message string)) error) error {
+	if err := agent.lock(ctx); err != nil {
+		return err
+	}
+	defer agent.unlock()
+
+	if report == nil {
+		report = func(Progress) {}
+	}
+	pt := &progressTracker{name: name, report: report}
+	pt.report(Progress{Name: name})
+	err := action(ctx, pt.update)
+	pt.finish(err)
+	return err
+}
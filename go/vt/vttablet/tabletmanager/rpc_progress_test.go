@@ -0,0 +1,95 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tabletmanager
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/youtube/vitess/go/vt/logutil"
+	"golang.org/x/net/context"
+)
+
+// copyAction is a test action that copies 4 chunks, and reports
+// its progress after each of them.
+func copyAction(failAt int) func(ctx context.Context, progress func(percent int, message string)) error {
+	return func(ctx context.Context, progress func(percent int, message string)) error {
+		for i := 1; i <= 4; i++ {
+			if i == failAt {
+				return errors.New("copy failed")
+			}
+			progress(i*25, "copied chunk")
+			// Going backwards is ignored.
+			progress(i*25-10, "")
+		}
+		return nil
+	}
+}
+
+func TestLockWithProgress(t *testing.T) {
+	agent := &ActionAgent{}
+	ctx := context.Background()
+
+	var got []Progress
+	report := func(p Progress) { got = append(got, p) }
+	if err := agent.lockWithProgress(ctx, "Copy", report, copyAction(0)); err != nil {
+		t.Fatalf("lockWithProgress: %v", err)
+	}
+	want := []Progress{
+		{Name: "Copy", Percent: 0},
+		{Name: "Copy", Percent: 25, Message: "copied chunk"},
+		{Name: "Copy", Percent: 50, Message: "copied chunk"},
+		{Name: "Copy", Percent: 75, Message: "copied chunk"},
+		{Name: "Copy", Percent: 99, Message: "copied chunk"},
+		{Name: "Copy", Percent: 100},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("progress:\n%v, want\n%v", got, want)
+	}
+	if agent.actionMutexLocked {
+		t.Errorf("lockWithProgress did not release the actionMutex")
+	}
+
+	// A failed action doesn't report its completion.
+	got = nil
+	if err := agent.lockWithProgress(ctx, "Copy", report, copyAction(3)); err == nil || err.Error() != "copy failed" {
+		t.Errorf("lockWithProgress: %v, want copy failed", err)
+	}
+	if last := got[len(got)-1]; last.Percent != 50 {
+		t.Errorf("last progress: %v, want 50%%", last)
+	}
+
+	// A nil reporter is allowed.
+	if err := agent.lockWithProgress(ctx, "Copy", nil, copyAction(0)); err != nil {
+		t.Errorf("lockWithProgress(nil): %v", err)
+	}
+}
+
+func TestLoggerProgressReporter(t *testing.T) {
+	logger := logutil.NewMemoryLogger()
+	report := LoggerProgressReporter(logger)
+	report(Progress{Name: "Backup", Percent: 40, Message: "copied 2 files"})
+	report(Progress{Name: "Backup", Percent: 100})
+	out := logger.String()
+	for _, want := range []string{"Backup: 40% done: copied 2 files\n", "Backup: 100% done\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("logger output %q does not contain %q", out, want)
+		}
+	}
+}
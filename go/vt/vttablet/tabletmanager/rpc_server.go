@@ -17,9 +17,17 @@ limitations under the License.
 package tabletmanager
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"runtime"
+	"strings"
+	"time"
 
 	log "github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/youtube/vitess/go/stats"
+	"github.com/youtube/vitess/go/sync2"
 	"github.com/youtube/vitess/go/tb"
 	"github.com/youtube/vitess/go/vt/callinfo"
 	"github.com/youtube/vitess/go/vt/topo/topoproto"
@@ -28,34 +36,217 @@ import (
 
 // This file contains the RPC method helpers for the tablet manager.
 
+var drainLockActionsTimeout = flag.Duration("drain_lock_actions_timeout", 10*time.Second, "how long the tablet manager waits, when shutting down, for the running action that holds the action lock to finish")
+
+// errDraining is returned by the actions that need the actionMutex
+// once the agent started shutting down.
+var errDraining = errors.New("tablet manager is shutting down, not accepting new actions")
+
+var actionQueueMaxDepth = flag.Int("tablet_manager_action_queue_max_depth", 0, "maximum number of tablet manager actions that can wait for the action lock. Further actions fail right away with a 'tablet action queue full' error. 0 means no limit.")
+
+// errActionQueueFull is returned by the actions that need the
+// actionMutex when -tablet_manager_action_queue_max_depth actions
+// are already waiting for it.
+var errActionQueueFull = errors.New("tablet action queue full")
+
+var (
+	// actionMutexWaiters is the number of actions currently waiting
+	// for the actionMutex, and actionMutexMaxWaiters the highest
+	// number observed. A sustained high number of waiters means the
+	// actions are convoying behind a slow one.
+	actionMutexWaiters    sync2.AtomicInt64
+	actionMutexMaxWaiters sync2.AtomicInt64
+
+	// actionQueueRejections counts the actions that failed with
+	// errActionQueueFull.
+	actionQueueRejections = stats.NewInt("TabletManagerActionQueueRejections")
+
+	// rpcTimings records the duration of the RPCs, by name.
+	rpcTimings = stats.NewTimings("TabletManagerRPCs")
+)
+
+func init() {
+	stats.Publish("TabletManagerActionMutexWaiters", stats.IntFunc(actionMutexWaiters.Get))
+	stats.Publish("TabletManagerActionMutexMaxWaiters", stats.IntFunc(actionMutexMaxWaiters.Get))
+}
+
+var diagnoseRPCs = flag.String("diagnose_tablet_manager_rpcs", "", "comma separated list of tablet manager RPCs, like ChangeType, for which the goroutine count and heap allocations are logged. For debugging only.")
+
 //
 // Utility functions for RPC service
 //
 
 // lock is used at the beginning of an RPC call, to lock the
 // action mutex. It returns ctx.Err() if <-ctx.Done() after the lock.
+// If the agent is paused, it waits for Resume before taking the lock.
+// If the agent is draining, it returns errDraining. If too many
+// actions are waiting for the lock, it returns errActionQueueFull.
 func (agent *ActionAgent) lock(ctx context.Context) error {
-	agent.actionMutex.Lock()
+	for {
+		if err := agent.waitIfPaused(ctx); err != nil {
+			return err
+		}
+		if agent.isDraining() {
+			return errDraining
+		}
+		if err := agent.lockActionMutex(); err != nil {
+			return err
+		}
+		if agent.isDraining() {
+			// We started draining while waiting for the lock.
+			agent.actionMutex.Unlock()
+			return errDraining
+		}
+		if agent.pauseChan() != nil {
+			// We got paused while waiting for the lock.
+			agent.actionMutex.Unlock()
+			continue
+		}
+		if !agent.startAction() {
+			// We started draining since the check.
+			agent.actionMutex.Unlock()
+			return errDraining
+		}
+		break
+	}
 	agent.actionMutexLocked = true
 
 	// After we take the lock (which could take a long time), we
 	// check the client is still here.
 	select {
 	case <-ctx.Done():
-		agent.actionMutexLocked = false
-		agent.actionMutex.Unlock()
+		agent.unlock()
 		return ctx.Err()
 	default:
 		return nil
 	}
 }
 
-// unlock is the symetrical action to lock.
+// startAction records that an action holds the actionMutex, so that
+// DrainLockActions waits for it, unless the agent is draining. The
+// check and the record are atomic, so that DrainLockActions either
+// sees the action, or makes it fail.
+func (agent *ActionAgent) startAction() bool {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	if agent._draining {
+		return false
+	}
+	agent._actionDone = make(chan struct{})
+	return true
+}
+
+// lockActionMutex locks the actionMutex, and counts the
+// caller in actionMutexWaiters while it waits for it. If
+// -tablet_manager_action_queue_max_depth callers are already
+// waiting, it returns errActionQueueFull instead of waiting, so
+// that the queue doesn't grow without bounds under overload.
+func (agent *ActionAgent) lockActionMutex() error {
+	waiters := actionMutexWaiters.Add(1)
+	defer actionMutexWaiters.Add(-1)
+	if *actionQueueMaxDepth > 0 && waiters > int64(*actionQueueMaxDepth) {
+		actionQueueRejections.Add(1)
+		return errActionQueueFull
+	}
+	for {
+		max := actionMutexMaxWaiters.Get()
+		if waiters <= max || actionMutexMaxWaiters.CompareAndSwap(max, waiters) {
+			break
+		}
+	}
+	agent.actionMutex.Lock()
+	return nil
+}
+
+// unlock is the symetrical action to lock. It signals
+// DrainLockActions that the action is done.
 func (agent *ActionAgent) unlock() {
+	agent.mutex.Lock()
+	close(agent._actionDone)
+	agent._actionDone = nil
+	agent.mutex.Unlock()
+
 	agent.actionMutexLocked = false
 	agent.actionMutex.Unlock()
 }
 
+// Pause makes all subsequent actions that need the actionMutex
+// wait until Resume is called, or until their context is done.
+// Actions that don't take the actionMutex, like the read-only
+// ones, keep running. An action that already holds the
+// actionMutex is not interrupted.
+func (agent *ActionAgent) Pause() {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	if agent._pauseChan == nil {
+		agent._pauseChan = make(chan struct{})
+	}
+}
+
+// Resume releases all the actions that are waiting because of Pause.
+func (agent *ActionAgent) Resume() {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	if agent._pauseChan != nil {
+		close(agent._pauseChan)
+		agent._pauseChan = nil
+	}
+}
+
+// pauseChan returns the channel to wait on if the agent is paused,
+// or nil.
+func (agent *ActionAgent) pauseChan() chan struct{} {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	return agent._pauseChan
+}
+
+// waitIfPaused waits until the agent is resumed, or ctx is done.
+func (agent *ActionAgent) waitIfPaused(ctx context.Context) error {
+	pauseChan := agent.pauseChan()
+	if pauseChan == nil {
+		return nil
+	}
+	select {
+	case <-pauseChan:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DrainLockActions makes all subsequent actions that need the
+// actionMutex fail, including the ones waiting for it, and waits up to
+// timeout for the action that holds it to finish. It's called when the
+// agent shuts down, so that it doesn't abort a running action, like a
+// reparent. It returns right away if no action is running, and an
+// error if the running one didn't finish in time.
+func (agent *ActionAgent) DrainLockActions(timeout time.Duration) error {
+	agent.mutex.Lock()
+	agent._draining = true
+	done := agent._actionDone
+	agent.mutex.Unlock()
+	if done == nil {
+		return nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("running action did not finish within %v", timeout)
+	}
+}
+
+// isDraining returns true once DrainLockActions was called.
+func (agent *ActionAgent) isDraining() bool {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	return agent._draining
+}
+
 // checkLock checks we have locked the actionMutex.
 func (agent *ActionAgent) checkLock() {
 	if !agent.actionMutexLocked {
@@ -67,10 +258,14 @@ func (agent *ActionAgent) checkLock() {
 func (agent *ActionAgent) HandleRPCPanic(ctx context.Context, name string, args, reply interface{}, verbose bool, err *error) {
 	// panic handling
 	if x := recover(); x != nil {
-		log.Errorf("TabletManager.%v(%v) on %v panic: %v\n%s", name, args, topoproto.TabletAliasString(agent.TabletAlias), x, tb.Stack(4))
+		log.Errorf("TabletManager.%v(%v) on %v%v panic: %v\n%s", name, args, topoproto.TabletAliasString(agent.TabletAlias), agent.rpcTargetSuffix(args), x, tb.Stack(4))
 		*err = fmt.Errorf("caught panic during %v: %v", name, x)
+		recordRPCResult(name, *err)
+		agent.countRPCByTarget(name, args, *err)
 		return
 	}
+	recordRPCResult(name, *err)
+	agent.countRPCByTarget(name, args, *err)
 
 	// quick check for fast path
 	if !verbose && *err == nil {
@@ -86,12 +281,68 @@ func (agent *ActionAgent) HandleRPCPanic(ctx context.Context, name string, args,
 
 	if *err != nil {
 		// error case
-		log.Warningf("TabletManager.%v(%v)(on %v from %v) error: %v", name, args, topoproto.TabletAliasString(agent.TabletAlias), from, (*err).Error())
+		logArgs := args
+		if _, ok := (*err).(*ArgsSizeError); ok {
+			// Don't log the args that were too large to run.
+			logArgs = "..."
+		}
+		log.Warningf("TabletManager.%v(%v)(on %v from %v%v) error: %v", name, logArgs, topoproto.TabletAliasString(agent.TabletAlias), from, agent.rpcTargetSuffix(args), (*err).Error())
 		*err = fmt.Errorf("TabletManager.%v on %v error: %v", name, topoproto.TabletAliasString(agent.TabletAlias), *err)
 	} else {
 		// success case
-		log.Infof("TabletManager.%v(%v)(on %v from %v): %#v", name, args, topoproto.TabletAliasString(agent.TabletAlias), from, reply)
+		log.Infof("TabletManager.%v(%v)(on %v from %v%v): %#v", name, args, topoproto.TabletAliasString(agent.TabletAlias), from, agent.rpcTargetSuffix(args), reply)
+	}
+}
+
+// DiagnoseRPC is called at the beginning of an RPC, and the function
+// it returns at the end of it. It records the duration of the RPC in
+// rpcTimings. If name is listed in -diagnose_tablet_manager_rpcs, the
+// change in goroutine count and the heap allocations during the RPC are
+// also logged, and a warning is logged if goroutines were leaked.
+// It is meant to be used as:
+//   defer tabletmanager.DiagnoseRPC("ChangeType")()
+func DiagnoseRPC(name string) func() {
+	start := time.Now()
+	if *diagnoseRPCs == "" || !strings.Contains(","+*diagnoseRPCs+",", ","+name+",") {
+		return func() {
+			rpcTimings.Record(name, start)
+		}
+	}
+	goroutines := runtime.NumGoroutine()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	return func() {
+		rpcTimings.Record(name, start)
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		leaked := runtime.NumGoroutine() - goroutines
+		allocated := after.TotalAlloc - before.TotalAlloc
+		heapDelta := int64(after.HeapInuse) - int64(before.HeapInuse)
+		if leaked > 0 {
+			log.Warningf("TabletManager.%v diagnostics: %d more goroutines after the call, allocated %d bytes, heap in use changed by %d bytes", name, leaked, allocated, heapDelta)
+			return
+		}
+		log.Infof("TabletManager.%v diagnostics: goroutines changed by %d, allocated %d bytes, heap in use changed by %d bytes", name, leaked, allocated, heapDelta)
+	}
+}
+
+// BeginRPC is called at the beginning of an RPC, after HandleRPCPanic
+// was deferred. It starts the diagnostics of DiagnoseRPC, and then runs
+// the checks of CheckArgsSize and CheckCircuit. The returned function
+// must be called at the end of the RPC, even if the call was rejected,
+// in which case the RPC returns the error right away.
+// It is meant to be used as:
+//   done, err := tabletmanager.BeginRPC("ChangeType", request)
+//   defer done()
+//   if err != nil {
+//     return nil, err
+//   }
+func BeginRPC(name string, args proto.Message) (func(), error) {
+	done := DiagnoseRPC(name)
+	if err := CheckArgsSize(name, args); err != nil {
+		return done, err
 	}
+	return done, CheckCircuit(name)
 }
 
 //
@@ -0,0 +1,200 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tabletmanager
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestPauseResume(t *testing.T) {
+	agent := &ActionAgent{}
+	ctx := context.Background()
+
+	// Not paused: lock goes through.
+	if err := agent.lock(ctx); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	agent.unlock()
+
+	agent.Pause()
+
+	// A paused lock returns promptly when its context expires.
+	shortCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := agent.lock(shortCtx); err != context.DeadlineExceeded {
+		t.Errorf("lock(paused): %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Resume wakes up all the waiters.
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			if err := agent.lock(ctx); err != nil {
+				done <- err
+				return
+			}
+			agent.unlock()
+			done <- nil
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("lock returned while paused: %v", err)
+	default:
+	}
+	agent.Resume()
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("lock after Resume: %v", err)
+		}
+	}
+}
+
+func TestDrainLockActions(t *testing.T) {
+	agent := &ActionAgent{}
+	ctx := context.Background()
+
+	// Hold the lock, and have another action wait for it.
+	if err := agent.lock(ctx); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	waiting := make(chan error)
+	go func() {
+		waiting <- agent.lock(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// The running action doesn't finish in time.
+	if err := agent.DrainLockActions(10 * time.Millisecond); err == nil {
+		t.Errorf("DrainLockActions: nil, want error")
+	}
+
+	// It finishes within the grace period.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		agent.unlock()
+	}()
+	if err := agent.DrainLockActions(time.Minute); err != nil {
+		t.Errorf("DrainLockActions: %v", err)
+	}
+
+	// Both the waiting and the new actions are refused.
+	if err := <-waiting; err != errDraining {
+		t.Errorf("lock(waiting): %v, want %v", err, errDraining)
+	}
+	if err := agent.lock(ctx); err != errDraining {
+		t.Errorf("lock(draining): %v, want %v", err, errDraining)
+	}
+
+	// Without a running action, it returns right away.
+	agent = &ActionAgent{}
+	start := time.Now()
+	if err := agent.DrainLockActions(time.Minute); err != nil {
+		t.Errorf("DrainLockActions(idle): %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("DrainLockActions(idle) took %v", elapsed)
+	}
+}
+
+func TestActionMutexWaiters(t *testing.T) {
+	agent := &ActionAgent{}
+	ctx := context.Background()
+
+	if err := agent.lock(ctx); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	done := make(chan error)
+	for i := 0; i < 3; i++ {
+		go func() {
+			if err := agent.lock(ctx); err != nil {
+				done <- err
+				return
+			}
+			agent.unlock()
+			done <- nil
+		}()
+	}
+	for start := time.Now(); actionMutexWaiters.Get() != 3; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("actionMutexWaiters: %d, want 3", actionMutexWaiters.Get())
+		}
+	}
+	if got := actionMutexMaxWaiters.Get(); got < 3 {
+		t.Errorf("actionMutexMaxWaiters: %d, want at least 3", got)
+	}
+
+	agent.unlock()
+	for i := 0; i < 3; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("lock: %v", err)
+		}
+	}
+	if got := actionMutexWaiters.Get(); got != 0 {
+		t.Errorf("actionMutexWaiters: %d, want 0", got)
+	}
+}
+
+func TestActionQueueMaxDepth(t *testing.T) {
+	defer func(max int) { *actionQueueMaxDepth = max }(*actionQueueMaxDepth)
+	*actionQueueMaxDepth = 1
+	agent := &ActionAgent{}
+	ctx := context.Background()
+
+	if err := agent.lock(ctx); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		if err := agent.lock(ctx); err != nil {
+			done <- err
+			return
+		}
+		agent.unlock()
+		done <- nil
+	}()
+	for start := time.Now(); actionMutexWaiters.Get() != 1; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("actionMutexWaiters: %d, want 1", actionMutexWaiters.Get())
+		}
+	}
+
+	// The queue is full: the next action fails right away.
+	rejections := actionQueueRejections.Get()
+	if err := agent.lock(ctx); err != errActionQueueFull {
+		t.Errorf("lock(queue full): %v, want %v", err, errActionQueueFull)
+	}
+	if got := actionQueueRejections.Get() - rejections; got != 1 {
+		t.Errorf("actionQueueRejections: %d, want 1", got)
+	}
+	if got := actionMutexWaiters.Get(); got != 1 {
+		t.Errorf("actionMutexWaiters: %d, want 1", got)
+	}
+
+	agent.unlock()
+	if err := <-done; err != nil {
+		t.Errorf("lock: %v", err)
+	}
+	if err := agent.lock(ctx); err != nil {
+		t.Errorf("lock after the queue drained: %v", err)
+	}
+	agent.unlock()
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tabletmanager
+
+import (
+	"flag"
+
+	"github.com/youtube/vitess/go/stats"
+	"github.com/youtube/vitess/go/vt/topo/topoproto"
+)
+
+// This file contains the tagging of the tablet manager RPCs with the
+// keyspace and shard they target, to tell the tenants of a cluster
+// apart in the logs and the stats.
+
+var rpcTargetLabels = flag.Bool("tablet_manager_rpc_target_labels", false, "add the keyspace and shard targeted by a tablet manager RPC to its log lines, and count the RPCs by keyspace and shard in TabletManagerRPCsByTarget")
+
+// rpcsByTarget counts the RPCs by name, keyspace, shard and result, if
+// -tablet_manager_rpc_target_labels is set. The keyspace and shard are
+// empty if the target is not known.
+var rpcsByTarget = stats.NewMultiCounters("TabletManagerRPCsByTarget", []string{"RPC", "Keyspace", "Shard", "Result"})
+
+// keyspaceGetter and shardGetter are implemented by the RPC args that
+// name a keyspace and a shard, like the proto messages with these fields.
+type keyspaceGetter interface {
+	GetKeyspace() string
+}
+
+type shardGetter interface {
+	GetShard() string
+}
+
+// rpcTarget returns the keyspace and shard targeted by an RPC: the ones
+// of its args if they name a keyspace, and the ones of the tablet
+// otherwise. They're empty if neither is known, like for a tablet that
+// is not initialized yet.
+func (agent *ActionAgent) rpcTarget(args interface{}) (keyspace, shard string) {
+	if kg, ok := args.(keyspaceGetter); ok && kg.GetKeyspace() != "" {
+		if sg, ok := args.(shardGetter); ok {
+			shard = sg.GetShard()
+		}
+		return kg.GetKeyspace(), shard
+	}
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	if agent._tablet == nil {
+		return "", ""
+	}
+	return agent._tablet.Keyspace, agent._tablet.Shard
+}
+
+// rpcTargetSuffix returns the text added to the log lines of an RPC:
+// " for keyspace/shard", or "" if -tablet_manager_rpc_target_labels is
+// not set or the target is not known.
+func (agent *ActionAgent) rpcTargetSuffix(args interface{}) string {
+	if !*rpcTargetLabels {
+		return ""
+	}
+	keyspace, shard := agent.rpcTarget(args)
+	switch {
+	case keyspace == "":
+		return ""
+	case shard == "":
+		return " for " + keyspace
+	}
+	return " for " + topoproto.KeyspaceShardString(keyspace, shard)
+}
+
+// countRPCByTarget updates TabletManagerRPCsByTarget with the result
+// of an RPC, if -tablet_manager_rpc_target_labels is set.
+func (agent *ActionAgent) countRPCByTarget(name string, args interface{}, err error) {
+	if !*rpcTargetLabels {
+		return
+	}
+	keyspace, shard := agent.rpcTarget(args)
+	result := "OK"
+	if err != nil {
+		result = "Error"
+	}
+	rpcsByTarget.Add([]string{name, keyspace, shard, result}, 1)
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2017 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tabletmanager
+
+import (
+	"errors"
+	"testing"
+
+	topodatapb "github.com/youtube/vitess/go/vt/proto/topodata"
+)
+
+// targetArgs are the args of an RPC that names its target.
+type targetArgs struct {
+	keyspace, shard string
+}
+
+func (a *targetArgs) GetKeyspace() string { return a.keyspace }
+func (a *targetArgs) GetShard() string    { return a.shard }
+
+func TestRPCTarget(t *testing.T) {
+	defer func(labels bool) { *rpcTargetLabels = labels }(*rpcTargetLabels)
+	agent := &ActionAgent{}
+
+	*rpcTargetLabels = false
+	if got := agent.rpcTargetSuffix(&targetArgs{keyspace: "ks", shard: "0"}); got != "" {
+		t.Errorf("rpcTargetSuffix(disabled): %q, want none", got)
+	}
+
+	*rpcTargetLabels = true
+	testcases := []struct {
+		tablet *topodatapb.Tablet
+		args   interface{}
+		want   string
+	}{{
+		args: nil,
+		want: "",
+	}, {
+		args: &targetArgs{keyspace: "ks", shard: "-80"},
+		want: " for ks/-80",
+	}, {
+		args: &targetArgs{keyspace: "ks"},
+		want: " for ks",
+	}, {
+		tablet: &topodatapb.Tablet{Keyspace: "tablet_ks", Shard: "80-"},
+		args:   nil,
+		want:   " for tablet_ks/80-",
+	}, {
+		// Args without a keyspace target the tablet.
+		tablet: &topodatapb.Tablet{Keyspace: "tablet_ks", Shard: "80-"},
+		args:   &targetArgs{},
+		want:   " for tablet_ks/80-",
+	}}
+	for _, tcase := range testcases {
+		agent._tablet = tcase.tablet
+		if got := agent.rpcTargetSuffix(tcase.args); got != tcase.want {
+			t.Errorf("rpcTargetSuffix(%v, %v): %q, want %q", tcase.tablet, tcase.args, got, tcase.want)
+		}
+	}
+
+	agent._tablet = &topodatapb.Tablet{Keyspace: "ks", Shard: "0"}
+	agent.countRPCByTarget("TestRPCTarget", nil, nil)
+	agent.countRPCByTarget("TestRPCTarget", nil, errors.New("failed"))
+	counts := rpcsByTarget.Counts()
+	if got, want := counts["TestRPCTarget.ks.0.OK"], int64(1); got != want {
+		t.Errorf("TabletManagerRPCsByTarget OK: %d, want %d", got, want)
+	}
+	if got, want := counts["TestRPCTarget.ks.0.Error"], int64(1); got != want {
+		t.Errorf("TabletManagerRPCsByTarget Error: %d, want %d", got, want)
+	}
+}